@@ -0,0 +1,209 @@
+// Copyright 2012 Daniel Connelly.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rtreego
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Clone returns a copy of tree with the same options and contents.  The copy
+// shares the stored objects with tree, but its nodes are independent, so that
+// either tree can be modified without affecting the other.  Hooks registered
+// with OnInsert and OnDelete are kept, but grids attached with AttachGrid stay
+// with tree and are not updated by changes to the copy.  The copy gets an
+// empty query cache of its own if tree has one.  The nodes of a tree in BalanceLazy mode that
+// are still to be condensed are condensed in the copy later, and tree itself
+// is not modified, so Clone may be called concurrently with queries.
+func (tree *Rtree) Clone() *Rtree {
+	clone := *tree
+	clone.dirty = nil
+	if len(tree.dirty) > 0 {
+		clone.dirty = make(map[*node]bool, len(tree.dirty))
+	}
+	clone.root = tree.root.clone(nil, tree.dirty, clone.dirty)
+	clone.owned = nil
+	clone.deleted = nil
+	clone.insertHooks = append([]func(Spatial){}, tree.insertHooks...)
+	clone.deleteHooks = append([]func(Spatial){}, tree.deleteHooks...)
+	clone.grids = nil
+	if tree.maxSpeed != nil {
+		clone.maxSpeed = append([]float64{}, tree.maxSpeed...)
+	}
+	if c := tree.queryCache; c != nil {
+		clone.EnableQueryCache(c.capacity, c.quantum)
+	}
+	return &clone
+}
+
+// clone returns a deep copy of the subtree rooted at n with the specified
+// parent.  The copies of the nodes in dirty are added to cloneDirty.
+func (n *node) clone(parent *node, dirty, cloneDirty map[*node]bool) *node {
+	c := &node{
+		parent:  parent,
+		leaf:    n.leaf,
+		level:   n.level,
+		entries: make([]entry, len(n.entries), cap(n.entries)),
+	}
+	copy(c.entries, n.entries)
+	if dirty[n] {
+		cloneDirty[c] = true
+	}
+	if !n.leaf {
+		for i := range c.entries {
+			c.entries[i].child = n.entries[i].child.clone(c, dirty, cloneDirty)
+		}
+	}
+	return c
+}
+
+// own returns the child at index i of n, which must be owned by tree, after
+// replacing it by a copy owned by tree if it may be shared with other
+// versions of a SharedRtree.  The copy points to n as its parent, while the
+// children of the copy keep pointing to the node it was copied from, which
+// does no harm since every node that is modified is reached through own.
+func (tree *Rtree) own(n *node, i int) *node {
+	child := n.entries[i].child
+	if tree.owned == nil || tree.owned[child] {
+		return child
+	}
+	c := &node{
+		parent:  n,
+		leaf:    child.leaf,
+		level:   child.level,
+		entries: make([]entry, len(child.entries), cap(child.entries)),
+	}
+	copy(c.entries, child.entries)
+	tree.owned[c] = true
+	n.entries[i].child = c
+	return c
+}
+
+// ownPath owns the nodes from the root along the path of entry indices
+// returned by findPath and returns the last one, or nil if path is nil.
+func (tree *Rtree) ownPath(path []int) *node {
+	if path == nil {
+		return nil
+	}
+	n := tree.root
+	for _, i := range path {
+		n = tree.own(n, i)
+	}
+	return n
+}
+
+// ownAll copies all nodes of tree that may be shared with other versions of
+// a SharedRtree, for the operations that modify more than the path to a
+// single leaf.
+func (tree *Rtree) ownAll() {
+	if tree.owned == nil {
+		return
+	}
+	var dirty map[*node]bool
+	if len(tree.dirty) > 0 {
+		dirty = make(map[*node]bool, len(tree.dirty))
+	}
+	tree.root = tree.root.clone(nil, tree.dirty, dirty)
+	tree.dirty = dirty
+	tree.owned = nil
+}
+
+// findPath returns the indices of the entries leading from n to the leaf
+// holding obj, appended to path, or nil if obj is not stored below n.
+func (n *node) findPath(obj Spatial, bb Rect, cmp Comparator, path []int) []int {
+	if n.leaf {
+		for _, e := range n.entries {
+			if cmp(e.obj, obj) {
+				return path
+			}
+		}
+		return nil
+	}
+	for i, e := range n.entries {
+		if !e.bb.containsRect(bb) {
+			continue
+		}
+		if found := e.child.findPath(obj, bb, cmp, append(path, i)); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// SharedRtree is an Rtree that may be read concurrently without locking
+// while it is updated copy-on-write.  Readers obtain the current version of
+// the tree with Load, and UpdateCOW applies changes to a copy that replaces
+// the current version atomically once they are complete, so that readers
+// always see a consistent tree.
+//
+// The copy shares its nodes with the current version until they are
+// modified: Insert and Delete copy the nodes on the path from the root to
+// the leaf they change, and those of the nodes they split or condense, so
+// that an update costs about as much as the changes it makes.  Operations
+// changing the whole tree, such as Optimize, Compact, BulkUpdate or
+// DeleteFunc, copy all nodes first.  Since shared nodes keep pointing to the
+// parents they had when they were copied, Validate does not check the parent
+// pointers of versions of a SharedRtree.
+type SharedRtree struct {
+	mu      sync.Mutex   // serializes updates
+	current atomic.Value // *Rtree
+}
+
+// NewSharedRtree returns a SharedRtree whose initial version is tree.  tree
+// must not be modified afterwards.
+func NewSharedRtree(tree *Rtree) *SharedRtree {
+	// readers must not condense the initial version concurrently
+	tree.condenseDirty()
+	s := &SharedRtree{}
+	s.current.Store(tree)
+	return s
+}
+
+// Load returns the current version of the tree.  It is safe to call
+// concurrently with UpdateCOW.  The returned tree may be queried by any
+// number of goroutines, but must not be modified.
+func (s *SharedRtree) Load() *Rtree {
+	return s.current.Load().(*Rtree)
+}
+
+// UpdateCOW calls fn with a copy of the current version of the tree and then
+// makes the copy the current version.  Readers that loaded the previous
+// version keep seeing it unchanged.  Concurrent calls of UpdateCOW are
+// serialized.  As with Clone, the copy keeps the hooks of the tree but not
+// its grids.
+func (s *SharedRtree) UpdateCOW(fn func(*Rtree)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	next := s.Load().share()
+	fn(next)
+	// readers must not condense the new version concurrently
+	next.condenseDirty()
+	s.current.Store(next)
+}
+
+// share returns a version of tree for UpdateCOW that shares all nodes but the
+// root with tree.  tree must have been condensed.
+func (tree *Rtree) share() *Rtree {
+	next := *tree
+	next.root = &node{
+		leaf:    tree.root.leaf,
+		level:   tree.root.level,
+		entries: make([]entry, len(tree.root.entries), cap(tree.root.entries)),
+	}
+	copy(next.root.entries, tree.root.entries)
+	next.owned = map[*node]bool{next.root: true}
+	next.dirty = nil
+	next.deleted = nil
+	next.insertHooks = append([]func(Spatial){}, tree.insertHooks...)
+	next.deleteHooks = append([]func(Spatial){}, tree.deleteHooks...)
+	next.grids = nil
+	if tree.maxSpeed != nil {
+		next.maxSpeed = append([]float64{}, tree.maxSpeed...)
+	}
+	if c := tree.queryCache; c != nil {
+		next.EnableQueryCache(c.capacity, c.quantum)
+	}
+	return &next
+}
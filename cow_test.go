@@ -0,0 +1,174 @@
+package rtreego
+
+import (
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+func TestClone(t *testing.T) {
+	things := randomThings(300, 2)
+	for _, tc := range tests(2, 3, 6, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+			clone := rt.Clone()
+			verify(t, clone)
+			if clone.Size() != rt.Size() || clone.Depth() != rt.Depth() {
+				t.Fatalf("Clone has size %d and depth %d, expected %d and %d", clone.Size(), clone.Depth(), rt.Size(), rt.Depth())
+			}
+			ensureDisorderedSubset(t, clone.GetAll(), things)
+
+			for _, thing := range things[:100] {
+				clone.Delete(thing)
+			}
+			if rt.Size() != len(things) {
+				t.Errorf("deleting from the clone changed the size of the original to %d", rt.Size())
+			}
+			verify(t, rt)
+			if err := rt.Validate(); err != nil {
+				t.Error(err)
+			}
+			if q := rt.SearchIntersect(mustRect(Point{-10, -10}, []float64{200, 200})); len(q) != len(things) {
+				t.Errorf("original returned %d objects after deletes from the clone", len(q))
+			}
+		})
+	}
+}
+
+func TestSharedRtree(t *testing.T) {
+	things := randomThings(200, 2)
+	initial := NewTree(2, 3, 6, things[:100]...)
+	// the cache of every version is used by several readers at once
+	initial.EnableQueryCache(16, 10)
+	shared := NewSharedRtree(initial)
+	all := mustRect(Point{-10, -10}, []float64{200, 200})
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				rt := shared.Load()
+				// Every version holds the objects of its size, in order.
+				n := rt.Size()
+				if q := rt.SearchIntersect(all); len(q) != n {
+					t.Errorf("version of size %d returned %d objects", n, len(q))
+					return
+				}
+				p := Point{rand.Float64() * 100, rand.Float64() * 100}
+				if objs := rt.NearestNeighbors(3, p); len(objs) != 3 {
+					t.Errorf("NearestNeighbors returned %d objects", len(objs))
+					return
+				}
+			}
+		}()
+	}
+
+	for _, thing := range things[100:] {
+		thing := thing
+		shared.UpdateCOW(func(rt *Rtree) {
+			rt.Insert(thing)
+		})
+	}
+	close(done)
+	wg.Wait()
+
+	rt := shared.Load()
+	if rt.Size() != len(things) {
+		t.Fatalf("final version has size %d, expected %d", rt.Size(), len(things))
+	}
+	ensureDisorderedSubset(t, rt.SearchIntersect(all), things)
+}
+
+// nodeSet returns the nodes of rt.
+func nodeSet(rt *Rtree) map[*node]bool {
+	nodes := make(map[*node]bool)
+	rt.Walk(func(ref NodeRef, level int) bool {
+		nodes[ref.n] = true
+		return true
+	})
+	return nodes
+}
+
+func TestUpdateCOWCopiesPath(t *testing.T) {
+	things := randomThings(2000, 1)
+	for _, mode := range []BalanceMode{BalanceEager, BalanceLazy} {
+		rt := NewTree(2, 3, 6)
+		rt.SetBalanceMode(mode)
+		for _, thing := range things[:1000] {
+			rt.Insert(thing)
+		}
+		shared := NewSharedRtree(rt)
+
+		// keep every version with the objects it must hold
+		versions := []*Rtree{shared.Load()}
+		contents := [][]Spatial{append([]Spatial{}, things[:1000]...)}
+		stored := append([]Spatial{}, things[:1000]...)
+		totalCopied, totalNodes := 0, 0
+		for i, thing := range things[1000:1200] {
+			before := shared.Load()
+			shared.UpdateCOW(func(rt *Rtree) {
+				rt.Insert(thing)
+				if i%2 == 0 {
+					rt.Delete(stored[0])
+				}
+			})
+			stored = append(stored, thing)
+			if i%2 == 0 {
+				stored = stored[1:]
+			}
+			versions = append(versions, shared.Load())
+			contents = append(contents, append([]Spatial{}, stored...))
+
+			// only the changed paths are copied, and the nodes split or
+			// condensed along them
+			old, next := nodeSet(before), nodeSet(shared.Load())
+			copied := 0
+			for n := range next {
+				if !old[n] {
+					copied++
+				}
+			}
+			if copied > len(next)/2 {
+				t.Fatalf("update copied %d of %d nodes", copied, len(next))
+			}
+			totalCopied += copied
+			totalNodes += len(next)
+		}
+		// an update copies a few paths, i.e. a small fraction of the tree
+		if totalCopied*20 > totalNodes {
+			t.Errorf("updates copied %d of %d nodes, expected less than 5%%", totalCopied, totalNodes)
+		}
+
+		all := mustRect(Point{-10, -10}, []float64{200, 200})
+		for i, v := range versions {
+			if err := v.Validate(); err != nil {
+				t.Fatalf("version %d: %v", i, err)
+			}
+			q := v.SearchIntersect(all)
+			if len(q) != len(contents[i]) || v.Size() != len(contents[i]) {
+				t.Fatalf("version %d returned %d objects, expected %d", i, len(q), len(contents[i]))
+			}
+			ensureDisorderedSubset(t, q, contents[i])
+		}
+
+		// a clone of a version is an independent tree again
+		clone := versions[len(versions)-1].Clone()
+		verify(t, clone)
+		for _, thing := range stored[:500] {
+			if !clone.Delete(thing) {
+				t.Fatalf("Delete(%v) from the clone failed", thing)
+			}
+		}
+		if err := clone.Validate(); err != nil {
+			t.Error(err)
+		}
+	}
+}
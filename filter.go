@@ -30,3 +30,18 @@ func LimitFilter(limit int) Filter {
 		return false, false
 	}
 }
+
+// DistinctFilter refuses objects that it has already accepted, so that every
+// object is returned at most once even if it is stored in the tree several
+// times.  The objects must be comparable, e.g. pointers.  A new filter must be
+// created for every search.
+func DistinctFilter() Filter {
+	seen := make(map[Spatial]bool)
+	return func(results []Spatial, object Spatial) (refuse, abort bool) {
+		if seen[object] {
+			return true, false
+		}
+		seen[object] = true
+		return false, false
+	}
+}
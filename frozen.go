@@ -0,0 +1,211 @@
+// Copyright 2012 Daniel Connelly.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rtreego
+
+import "sort"
+
+// FrozenRtree is an immutable, read-optimized copy of an Rtree.  Its nodes
+// and entries are packed into contiguous slices and children are referenced
+// by index, which uses less memory and makes queries faster than on an Rtree.
+// A FrozenRtree supports the same queries as an Rtree but cannot be modified.
+//
+// Since a FrozenRtree is never rebalanced, its nodes need no parent pointers,
+// and a node takes the space of a few integers instead of a struct with
+// pointers.  It is the representation to use in memory-tight deployments.
+// Use a LeanRtree for a tree without parent pointers that can be modified.
+type FrozenRtree struct {
+	Dim    int
+	size   int
+	height int
+
+	// nodes holds the nodes in breadth-first order; nodes[0] is the root.
+	nodes []frozenNode
+
+	// The following slices are indexed by entry.  The entries of a node are
+	// stored contiguously.  bounds holds 2*Dim coordinates per entry: the
+	// most-negative corner followed by the most-positive corner.
+	bounds   []float64
+	children []int
+	objs     []Spatial
+}
+
+// frozenNode is a node of a FrozenRtree holding entries [first, first+count).
+type frozenNode struct {
+	first, count int
+	leaf         bool
+}
+
+// Freeze returns an immutable copy of tree stored in a packed layout.  The
+// copy shares the stored objects with tree but is not affected by later
+// changes to tree.
+func (tree *Rtree) Freeze() *FrozenRtree {
+	ft := &FrozenRtree{
+		Dim:    tree.Dim,
+		size:   tree.size,
+		height: tree.height,
+	}
+
+	queue := []*node{tree.root}
+	for i := 0; i < len(queue); i++ {
+		n := queue[i]
+		ft.nodes = append(ft.nodes, frozenNode{
+			first: len(ft.objs),
+			count: len(n.entries),
+			leaf:  n.leaf,
+		})
+		for _, e := range n.entries {
+			ft.bounds = append(ft.bounds, e.bb.p...)
+			ft.bounds = append(ft.bounds, e.bb.q...)
+			if n.leaf {
+				ft.children = append(ft.children, -1)
+				ft.objs = append(ft.objs, e.obj)
+				continue
+			}
+			ft.children = append(ft.children, len(queue))
+			ft.objs = append(ft.objs, nil)
+			queue = append(queue, e.child)
+		}
+	}
+	return ft
+}
+
+// Size returns the number of objects stored in tree.
+func (tree *FrozenRtree) Size() int {
+	return tree.size
+}
+
+// Depth returns the maximum depth of tree.
+func (tree *FrozenRtree) Depth() int {
+	return tree.height
+}
+
+// bb returns the bounding box of the entry at index i.  The returned Rect
+// refers to the packed coordinates and must not be modified.
+func (tree *FrozenRtree) bb(i int) Rect {
+	o := 2 * tree.Dim * i
+	return Rect{
+		p: tree.bounds[o : o+tree.Dim],
+		q: tree.bounds[o+tree.Dim : o+2*tree.Dim],
+	}
+}
+
+// intersects tests whether the entry at index i intersects bb, with the same
+// semantics as intersect.
+func (tree *FrozenRtree) intersects(i int, bb Rect) bool {
+	o := 2 * tree.Dim * i
+	min, max := tree.bounds[o:o+tree.Dim], tree.bounds[o+tree.Dim:o+2*tree.Dim]
+	for d := range min {
+		if bb.q[d] <= min[d] || max[d] <= bb.p[d] {
+			return false
+		}
+	}
+	return true
+}
+
+// SearchIntersect returns all objects that intersect the specified rectangle.
+func (tree *FrozenRtree) SearchIntersect(bb Rect, filters ...Filter) []Spatial {
+	if len(bb.p) != tree.Dim {
+		panic(DimError{tree.Dim, len(bb.p)})
+	}
+	results, _ := tree.searchIntersect([]Spatial{}, 0, bb, filters)
+	return results
+}
+
+func (tree *FrozenRtree) searchIntersect(results []Spatial, ni int, bb Rect, filters []Filter) ([]Spatial, bool) {
+	n := tree.nodes[ni]
+	for i := n.first; i < n.first+n.count; i++ {
+		if !tree.intersects(i, bb) {
+			continue
+		}
+
+		if !n.leaf {
+			var abort bool
+			results, abort = tree.searchIntersect(results, tree.children[i], bb, filters)
+			if abort {
+				return results, true
+			}
+			continue
+		}
+
+		refuse, abort := applyFilters(results, tree.objs[i], filters)
+		if !refuse {
+			results = append(results, tree.objs[i])
+		}
+
+		if abort {
+			return results, true
+		}
+	}
+	return results, false
+}
+
+// NearestNeighbor returns the closest object to the specified point.
+func (tree *FrozenRtree) NearestNeighbor(p Point) Spatial {
+	objs := tree.NearestNeighbors(1, p)
+	if len(objs) == 0 {
+		return nil
+	}
+	return objs[0]
+}
+
+// NearestNeighbors gets the closest Spatials to the Point.
+func (tree *FrozenRtree) NearestNeighbors(k int, p Point, filters ...Filter) []Spatial {
+	dists := make([]float64, 0, k)
+	objs := make([]Spatial, 0, k)
+	_, objs, _ = tree.nearestNeighbors(k, p, 0, dists, objs, filters)
+	return objs
+}
+
+func (tree *FrozenRtree) nearestNeighbors(k int, p Point, ni int, dists []float64, nearest []Spatial, filters []Filter) ([]float64, []Spatial, bool) {
+	var abort bool
+	n := tree.nodes[ni]
+	if n.leaf {
+		for i := n.first; i < n.first+n.count; i++ {
+			dist := p.minDist(tree.bb(i))
+			dists, nearest, abort = insertNearest(k, dists, nearest, dist, tree.objs[i], filters)
+			if abort {
+				break
+			}
+		}
+		return dists, nearest, abort
+	}
+
+	branches := make([]int, n.count)
+	branchDists := make([]float64, n.count)
+	for i := range branches {
+		branches[i] = n.first + i
+		branchDists[i] = p.minDist(tree.bb(n.first + i))
+	}
+	sort.Sort(branchSlice{branches, branchDists})
+
+	for i, b := range branches {
+		// only prune if buffer has k elements
+		if l := len(dists); l >= k && branchDists[i] > dists[l-1] {
+			break
+		}
+		dists, nearest, abort = tree.nearestNeighbors(k, p, tree.children[b], dists, nearest, filters)
+		if abort {
+			break
+		}
+	}
+	return dists, nearest, abort
+}
+
+// branchSlice sorts entry indices of a FrozenRtree by distance.
+type branchSlice struct {
+	entries []int
+	dists   []float64
+}
+
+func (s branchSlice) Len() int { return len(s.entries) }
+
+func (s branchSlice) Swap(i, j int) {
+	s.entries[i], s.entries[j] = s.entries[j], s.entries[i]
+	s.dists[i], s.dists[j] = s.dists[j], s.dists[i]
+}
+
+func (s branchSlice) Less(i, j int) bool {
+	return s.dists[i] < s.dists[j]
+}
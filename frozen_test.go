@@ -0,0 +1,125 @@
+package rtreego
+
+import (
+	"math/rand"
+	"runtime"
+	"testing"
+)
+
+func randomThings(n int, size float64) []Spatial {
+	things := make([]Spatial, n)
+	for i := range things {
+		r := mustRect(Point{rand.Float64() * 100, rand.Float64() * 100}, []float64{rand.Float64()*size + 0.01, rand.Float64()*size + 0.01})
+		things[i] = &r
+	}
+	return things
+}
+
+func TestFreeze(t *testing.T) {
+	things := randomThings(500, 2)
+
+	for _, tc := range tests(2, 3, 6, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+			ft := rt.Freeze()
+
+			if ft.Size() != rt.Size() || ft.Depth() != rt.Depth() {
+				t.Errorf("Freeze changed size or depth: %d/%d, expected %d/%d", ft.Size(), ft.Depth(), rt.Size(), rt.Depth())
+			}
+
+			for i := 0; i < 50; i++ {
+				bb := mustRect(Point{rand.Float64() * 90, rand.Float64() * 90}, []float64{10, 10})
+				expected := rt.SearchIntersect(bb)
+				q := ft.SearchIntersect(bb)
+				if len(q) != len(expected) {
+					t.Fatalf("FrozenRtree.SearchIntersect returned %d objects, expected %d", len(q), len(expected))
+				}
+				ensureDisorderedSubset(t, q, expected)
+
+				if q := ft.SearchIntersect(bb, LimitFilter(3)); len(expected) >= 3 && len(q) != 3 {
+					t.Errorf("FrozenRtree.SearchIntersect returned %d objects with limit 3", len(q))
+				}
+
+				p := Point{rand.Float64() * 100, rand.Float64() * 100}
+				if obj, exp := ft.NearestNeighbor(p), rt.NearestNeighbor(p); p.minDist(obj.Bounds()) != p.minDist(exp.Bounds()) {
+					t.Errorf("FrozenRtree.NearestNeighbor(%v) returned %v, expected %v", p, obj, exp)
+				}
+				objs, exp := ft.NearestNeighbors(5, p), rt.NearestNeighbors(5, p)
+				for j := range exp {
+					if p.minDist(objs[j].Bounds()) != p.minDist(exp[j].Bounds()) {
+						t.Errorf("FrozenRtree.NearestNeighbors(%v) failed at index %d: %v != %v", p, j, objs[j], exp[j])
+					}
+				}
+			}
+		})
+	}
+
+	if obj := NewTree(2, 3, 6).Freeze().NearestNeighbor(Point{0, 0}); obj != nil {
+		t.Errorf("NearestNeighbor on empty FrozenRtree returned %v", obj)
+	}
+}
+
+func benchmarkSearchIntersect(b *testing.B, search func(bb Rect) []Spatial) {
+	queries := make([]Rect, 100)
+	for i := range queries {
+		queries[i] = mustRect(Point{rand.Float64() * 95, rand.Float64() * 95}, []float64{5, 5})
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		search(queries[i%len(queries)])
+	}
+}
+
+func BenchmarkSearchIntersect(b *testing.B) {
+	rt := NewTree(2, 25, 50, randomThings(100000, 0.5)...)
+	benchmarkSearchIntersect(b, func(bb Rect) []Spatial { return rt.SearchIntersect(bb) })
+}
+
+func BenchmarkFrozenSearchIntersect(b *testing.B) {
+	ft := NewTree(2, 25, 50, randomThings(100000, 0.5)...).Freeze()
+	benchmarkSearchIntersect(b, func(bb Rect) []Spatial { return ft.SearchIntersect(bb) })
+}
+
+// benchmarkNodeMemory reports the heap memory retained by the tree built by
+// build per node of the tree, as returned by build.
+func benchmarkNodeMemory(b *testing.B, build func(things []Spatial) (tree interface{}, nodes int)) {
+	things := randomThings(100000, 0.5)
+
+	var retained uint64
+	var nodes int
+	var before, after runtime.MemStats
+	for i := 0; i < b.N; i++ {
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		tree, n := build(things)
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		retained += after.HeapAlloc - before.HeapAlloc
+		nodes += n
+		runtime.KeepAlive(tree)
+	}
+	b.ReportMetric(float64(retained)/float64(nodes), "B/node")
+}
+
+// countNodes returns the number of nodes of rt.
+func countNodes(rt *Rtree) int {
+	nodes := 0
+	for _, n := range rt.CountByLevel() {
+		nodes += n
+	}
+	return nodes
+}
+
+func BenchmarkNodeMemory(b *testing.B) {
+	benchmarkNodeMemory(b, func(things []Spatial) (interface{}, int) {
+		rt := NewTree(2, 25, 50, things...)
+		return rt, countNodes(rt)
+	})
+}
+
+func BenchmarkFrozenNodeMemory(b *testing.B) {
+	benchmarkNodeMemory(b, func(things []Spatial) (interface{}, int) {
+		rt := NewTree(2, 25, 50, things...)
+		return rt.Freeze(), countNodes(rt)
+	})
+}
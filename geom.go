@@ -5,8 +5,10 @@
 package rtreego
 
 import (
+	"encoding/json"
 	"fmt"
 	"math"
+	"sort"
 	"strings"
 )
 
@@ -28,6 +30,15 @@ func (err DistError) Error() string {
 	return "rtreego: improper distance"
 }
 
+// CoordError is an invalid coordinate.  It implements the error interface and
+// is generated when a coordinate is NaN or infinite, since such values break
+// the comparisons the tree relies on.
+type CoordError float64
+
+func (err CoordError) Error() string {
+	return fmt.Sprintf("rtreego: coordinate %v is not finite", float64(err))
+}
+
 // Point represents a point in n-dimensional Euclidean space.
 type Point []float64
 
@@ -37,6 +48,17 @@ func (p Point) Copy() Point {
 	return result
 }
 
+// checkFinite returns a CoordError for the first coordinate of p that is NaN
+// or infinite, or nil if all coordinates are finite.
+func (p Point) checkFinite() error {
+	for _, a := range p {
+		if math.IsNaN(a) || math.IsInf(a, 0) {
+			return CoordError(a)
+		}
+	}
+	return nil
+}
+
 // Dist computes the Euclidean distance between two points p and q.
 func (p Point) dist(q Point) float64 {
 	if len(p) != len(q) {
@@ -75,6 +97,67 @@ func (p Point) minDist(r Rect) float64 {
 	return sum
 }
 
+// nearestFace returns the axis of the face of r closest to p and the
+// distance to it.  If p lies outside r, the face is the one p is farthest
+// off, i.e. the one the closest point of r lies on, and the distance is the
+// Euclidean distance to r.  If p lies inside r, the face is the one closest
+// to p and the distance is the distance to that face.
+func (p Point) nearestFace(r Rect) (axis int, dist float64) {
+	if len(p) != len(r.p) {
+		panic(DimError{len(p), len(r.p)})
+	}
+
+	gap := 0.0
+	for i, pi := range p {
+		var d float64
+		if pi < r.p[i] {
+			d = r.p[i] - pi
+		} else if pi > r.q[i] {
+			d = pi - r.q[i]
+		}
+		if d > gap {
+			gap = d
+			axis = i
+		}
+	}
+	if gap > 0 {
+		return axis, math.Sqrt(p.minDist(r))
+	}
+
+	dist = math.Inf(1)
+	for i, pi := range p {
+		if d := math.Min(pi-r.p[i], r.q[i]-pi); d < dist {
+			dist = d
+			axis = i
+		}
+	}
+	return axis, dist
+}
+
+// minDistWeighted computes the square of the weighted distance from a point
+// to a rectangle, in which the squared distance along axis i is multiplied by
+// weights[i].  With all weights equal to 1 it is equal to minDist.
+func (p Point) minDistWeighted(r Rect, weights []float64) float64 {
+	if len(p) != len(r.p) {
+		panic(DimError{len(p), len(r.p)})
+	}
+	if len(p) != len(weights) {
+		panic(DimError{len(p), len(weights)})
+	}
+
+	sum := 0.0
+	for i, pi := range p {
+		if pi < r.p[i] {
+			d := pi - r.p[i]
+			sum += weights[i] * d * d
+		} else if pi > r.q[i] {
+			d := pi - r.q[i]
+			sum += weights[i] * d * d
+		}
+	}
+	return sum
+}
+
 // minMaxDist computes the minimum of the maximum distances from p to points
 // on r.  If r is the bounding box of some geometric objects, then there is
 // at least one object contained in r within minMaxDist(p, r) of p.
@@ -158,6 +241,62 @@ func (r Rect) Equal(other Rect) bool {
 	return true
 }
 
+// Intersects returns true if r and other share at least one point, including
+// rectangles that only touch at their boundaries.
+func (r Rect) Intersects(other Rect) bool {
+	return intersectClosed(r, other)
+}
+
+// IntersectsStrict returns true if the interiors of r and other overlap, i.e.
+// if their intersection has a positive volume.  Rectangles that only touch at
+// their boundaries do not intersect strictly.
+func (r Rect) IntersectsStrict(other Rect) bool {
+	if len(r.p) != len(other.p) {
+		panic(DimError{len(r.p), len(other.p)})
+	}
+	for i := range r.p {
+		if math.Max(r.p[i], other.p[i]) >= math.Min(r.q[i], other.q[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// SplitAlong clips r against the plane perpendicular to axis at value and
+// returns the parts of r below and above the plane.  If the plane does not
+// cross the interior of r, i.e. r lies on one side of it or only touches it,
+// ok is false and low and high are zero.  Clipping rectangles like this is
+// the building block of R+-trees, which split objects across nodes instead
+// of letting nodes overlap.  It panics with a DimError if axis is not one of
+// the axes of r.
+func (r Rect) SplitAlong(axis int, value float64) (low, high Rect, ok bool) {
+	if axis < 0 || axis >= len(r.p) {
+		panic(DimError{len(r.p), axis})
+	}
+	if value <= r.p[axis] || value >= r.q[axis] {
+		return Rect{}, Rect{}, false
+	}
+	low = Rect{append(Point{}, r.p...), append(Point{}, r.q...)}
+	high = Rect{append(Point{}, r.p...), append(Point{}, r.q...)}
+	low.q[axis] = value
+	high.p[axis] = value
+	return low, high, true
+}
+
+// equalWithin returns true if every coordinate of r differs from the
+// corresponding coordinate of other by at most eps.
+func (r Rect) equalWithin(other Rect, eps float64) bool {
+	if len(r.p) != len(other.p) {
+		panic(DimError{len(r.p), len(other.p)})
+	}
+	for i := range r.p {
+		if math.Abs(r.p[i]-other.p[i]) > eps || math.Abs(r.q[i]-other.q[i]) > eps {
+			return false
+		}
+	}
+	return true
+}
+
 func (r Rect) String() string {
 	s := make([]string, len(r.p))
 	for i, a := range r.p {
@@ -170,29 +309,42 @@ func (r Rect) String() string {
 // NewRect constructs and returns a pointer to a Rect given a corner point and
 // the lengths of each dimension.  The point p should be the most-negative point
 // on the rectangle (in every dimension) and every length should be positive.
+// A CoordError is returned if a coordinate of the rectangle is NaN or
+// infinite.
 func NewRect(p Point, lengths []float64) (r Rect, err error) {
 	r.p = p
 	if len(p) != len(lengths) {
 		err = &DimError{len(p), len(lengths)}
 		return
 	}
+	if err = p.checkFinite(); err != nil {
+		return
+	}
 	r.q = make([]float64, len(p))
 	for i := range p {
-		if lengths[i] <= 0 {
+		if !(lengths[i] > 0) {
 			err = DistError(lengths[i])
 			return
 		}
 		r.q[i] = p[i] + lengths[i]
 	}
+	err = r.q.checkFinite()
 	return
 }
 
 // NewRectFromPoints constructs and returns a pointer to a Rect given a corner points.
+// A CoordError is returned if a coordinate of either point is NaN or infinite.
 func NewRectFromPoints(minPoint, maxPoint Point) (r Rect, err error) {
 	if len(minPoint) != len(maxPoint) {
 		err = &DimError{len(minPoint), len(maxPoint)}
 		return
 	}
+	if err = minPoint.checkFinite(); err != nil {
+		return
+	}
+	if err = maxPoint.checkFinite(); err != nil {
+		return
+	}
 
 	// check that min and max point coordinates require swapping
 	copied := false
@@ -212,6 +364,46 @@ func NewRectFromPoints(minPoint, maxPoint Point) (r Rect, err error) {
 	return
 }
 
+// NewRect3D constructs a three-dimensional Rect from its most-negative corner
+// (x, y, z) and the lengths of its sides.  It is a shorthand for NewRect.
+func NewRect3D(x, y, z, dx, dy, dz float64) (Rect, error) {
+	return NewRect(Point{x, y, z}, []float64{dx, dy, dz})
+}
+
+// rectJSON is the JSON representation of a Rect.
+type rectJSON struct {
+	Min []float64 `json:"min"`
+	Max []float64 `json:"max"`
+}
+
+// MarshalJSON implements json.Marshaler.  A Rect is encoded as an object
+// holding its most-negative and most-positive corners, for example
+// {"min":[0,0],"max":[1,2]}.
+func (r Rect) MarshalJSON() ([]byte, error) {
+	return json.Marshal(rectJSON{Min: r.p, Max: r.q})
+}
+
+// UnmarshalJSON implements json.Unmarshaler for the encoding produced by
+// MarshalJSON.  A DimError is returned if the corners have different
+// dimensions and a DistError if a coordinate of min is larger than the
+// corresponding coordinate of max.
+func (r *Rect) UnmarshalJSON(data []byte) error {
+	var v rectJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	if len(v.Min) != len(v.Max) {
+		return &DimError{len(v.Min), len(v.Max)}
+	}
+	for i := range v.Min {
+		if v.Min[i] > v.Max[i] {
+			return DistError(v.Max[i] - v.Min[i])
+		}
+	}
+	r.p, r.q = v.Min, v.Max
+	return nil
+}
+
 // Size computes the measure of a rectangle (the product of its side lengths).
 func (r Rect) Size() float64 {
 	size := 1.0
@@ -257,6 +449,15 @@ func (r Rect) containsPoint(p Point) bool {
 	return true
 }
 
+// center returns the center point of r.
+func (r Rect) center() Point {
+	c := make(Point, len(r.p))
+	for i := range c {
+		c[i] = (r.p[i] + r.q[i]) / 2
+	}
+	return c
+}
+
 // containsRect tests whether r2 is is located inside r1.
 func (r Rect) containsRect(r2 Rect) bool {
 	if len(r.p) != len(r2.p) {
@@ -276,6 +477,22 @@ func (r Rect) containsRect(r2 Rect) bool {
 	return true
 }
 
+// containsRectInterior tests whether r2 is located inside r1 without
+// touching its boundary.
+func (r Rect) containsRectInterior(r2 Rect) bool {
+	if len(r.p) != len(r2.p) {
+		panic(DimError{len(r.p), len(r2.p)})
+	}
+
+	for i, a1 := range r.p {
+		if a1 >= r2.p[i] || r2.q[i] >= r.q[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
 // intersect computes the intersection of two rectangles.  If no intersection
 // exists, the intersection is nil.
 func intersect(r1, r2 Rect) bool {
@@ -322,6 +539,254 @@ func intersect(r1, r2 Rect) bool {
 	return true
 }
 
+// overlap returns the volume of the intersection of two rectangles, or 0 if
+// they do not intersect.
+func overlap(r1, r2 Rect) float64 {
+	if !intersect(r1, r2) {
+		return 0
+	}
+	v := 1.0
+	for i := range r1.p {
+		v *= math.Min(r1.q[i], r2.q[i]) - math.Max(r1.p[i], r2.p[i])
+	}
+	return v
+}
+
+// unionSize returns the size of the union of rects, counting the space
+// covered by several rectangles once.  It sweeps along the dimensions starting
+// at dim, computing the union of the cross sections of the rectangles between
+// consecutive boundaries.  Each of the 2n slabs along a dimension scans all
+// rectangles and recurses into the next dimension, so that it takes
+// O(n^(d+1)) time for n rectangles in d dimensions, e.g. O(n^3) in 2D.
+func unionSize(rects []Rect, dim int) float64 {
+	if len(rects) == 0 {
+		return 0
+	}
+	n := len(rects[0].p)
+
+	bounds := make([]float64, 0, 2*len(rects))
+	for _, r := range rects {
+		bounds = append(bounds, r.p[dim], r.q[dim])
+	}
+	sort.Float64s(bounds)
+
+	size := 0.0
+	active := make([]Rect, 0, len(rects))
+	for i := 1; i < len(bounds); i++ {
+		lo, hi := bounds[i-1], bounds[i]
+		if hi <= lo {
+			continue
+		}
+		active = active[:0]
+		for _, r := range rects {
+			if r.p[dim] <= lo && hi <= r.q[dim] {
+				active = append(active, r)
+			}
+		}
+		if len(active) == 0 {
+			continue
+		}
+		if dim == n-1 {
+			size += hi - lo
+		} else {
+			size += (hi - lo) * unionSize(active, dim+1)
+		}
+	}
+	return size
+}
+
+// mortonCode returns the position of the center of r along a Z-order curve
+// through bb.  Every coordinate is quantized to 64/dim bits relative to bb
+// (at most 32), and the bits of all coordinates are interleaved, so that the
+// curve runs along the first axis first.
+func mortonCode(r, bb Rect) uint64 {
+	dim := len(r.p)
+	bits := 64 / dim
+	if bits > 32 {
+		bits = 32
+	}
+	cells := float64(uint64(1)<<uint(bits) - 1)
+
+	coords := make([]uint64, dim)
+	for i := range coords {
+		c := 0.0
+		if d := bb.q[i] - bb.p[i]; d > 0 {
+			c = ((r.p[i]+r.q[i])/2 - bb.p[i]) / d
+		}
+		coords[i] = uint64(math.Max(0, math.Min(1, c)) * cells)
+	}
+
+	var code uint64
+	for b := bits - 1; b >= 0; b-- {
+		// the first axis gets the least significant bit
+		for i := dim - 1; i >= 0; i-- {
+			code = code<<1 | (coords[i]>>uint(b))&1
+		}
+	}
+	return code
+}
+
+// intersectClosed tests whether two rectangles intersect or touch, i.e.
+// whether they share at least one point including their boundaries.
+func intersectClosed(r1, r2 Rect) bool {
+	dim := len(r1.p)
+	if len(r2.p) != dim {
+		panic(DimError{dim, len(r2.p)})
+	}
+
+	for i := range r1.p {
+		if r2.q[i] < r1.p[i] || r1.q[i] < r2.p[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// intersectHalfOpen tests whether r intersects the half-open box
+// [a1, b1) x [a2, b2) x ... spanned by query, i.e. touching the lower
+// boundary of query counts as an intersection but touching the upper boundary
+// does not.
+func intersectHalfOpen(query, r Rect) bool {
+	dim := len(query.p)
+	if len(r.p) != dim {
+		panic(DimError{dim, len(r.p)})
+	}
+
+	for i := range query.p {
+		if r.q[i] < query.p[i] || query.q[i] <= r.p[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// minDistRect computes the square of the distance between the closest points
+// of r and r2.  If the rectangles intersect then the distance is zero.
+func (r Rect) minDistRect(r2 Rect) float64 {
+	if len(r.p) != len(r2.p) {
+		panic(DimError{len(r.p), len(r2.p)})
+	}
+
+	sum := 0.0
+	for i := range r.p {
+		if r2.q[i] < r.p[i] {
+			d := r.p[i] - r2.q[i]
+			sum += d * d
+		} else if r2.p[i] > r.q[i] {
+			d := r2.p[i] - r.q[i]
+			sum += d * d
+		}
+	}
+	return sum
+}
+
+// intersectRay tests whether the ray starting at origin and travelling along
+// dir hits r.  If it does, the ray parameter t at which it enters r is
+// returned, so that the entry point is origin + t*dir.  If origin lies inside
+// r, t is zero.
+//
+// Implemented using the slab method: the ray is clipped against the pair of
+// planes bounding r on every axis, and it hits r if and only if the clipped
+// parameter interval is non-empty.
+func (r Rect) intersectRay(origin, dir Point) (float64, bool) {
+	if len(origin) != len(r.p) {
+		panic(DimError{len(r.p), len(origin)})
+	}
+	if len(dir) != len(r.p) {
+		panic(DimError{len(r.p), len(dir)})
+	}
+
+	tmin, tmax := 0.0, math.Inf(1)
+	for i := range r.p {
+		if dir[i] == 0 {
+			// the ray is parallel to this slab, so it must start inside it
+			if origin[i] < r.p[i] || origin[i] > r.q[i] {
+				return 0, false
+			}
+			continue
+		}
+
+		t1 := (r.p[i] - origin[i]) / dir[i]
+		t2 := (r.q[i] - origin[i]) / dir[i]
+		if t1 > t2 {
+			t1, t2 = t2, t1
+		}
+		if t1 > tmin {
+			tmin = t1
+		}
+		if t2 < tmax {
+			tmax = t2
+		}
+		if tmin > tmax {
+			return 0, false
+		}
+	}
+	return tmin, true
+}
+
+// segmentDist returns the Euclidean distance between r and the line segment
+// from a to b, and the parameter t in [0, 1] of the first point a + t*(b-a)
+// of the segment at that distance.
+//
+// The parameters at which the segment enters and leaves the slab of r along
+// every axis divide [0, 1] into pieces, on each of which every coordinate of
+// the segment is either below, within or above the slab.  The squared
+// distance is then a quadratic function of t on every piece, whose minimum is
+// computed exactly.
+func (r Rect) segmentDist(a, b Point) (dist, t float64) {
+	dir := make(Point, len(a))
+	for i := range a {
+		dir[i] = b[i] - a[i]
+	}
+
+	cuts := []float64{0, 1}
+	for i, d := range dir {
+		if d == 0 {
+			continue
+		}
+		for _, x := range [2]float64{r.p[i], r.q[i]} {
+			if c := (x - a[i]) / d; c > 0 && c < 1 {
+				cuts = append(cuts, c)
+			}
+		}
+	}
+	sort.Float64s(cuts)
+
+	best, t := math.Inf(1), 0.0
+	for k := 0; k+1 < len(cuts); k++ {
+		lo, hi := cuts[k], cuts[k+1]
+		// coefficients of the squared distance A*t^2 + B*t + C on the
+		// piece, with the side of every slab taken at its midpoint
+		mid := (lo + hi) / 2
+		var A, B, C float64
+		for i := range a {
+			x := a[i] + mid*dir[i]
+			var off float64
+			switch {
+			case x < r.p[i]:
+				off = a[i] - r.p[i]
+			case x > r.q[i]:
+				off = a[i] - r.q[i]
+			default:
+				continue
+			}
+			A += dir[i] * dir[i]
+			B += 2 * off * dir[i]
+			C += off * off
+		}
+		min := lo
+		if A > 0 {
+			min = math.Max(lo, math.Min(hi, -B/(2*A)))
+		} else if B < 0 {
+			min = hi
+		}
+		if d := (A*min+B)*min + C; d < best {
+			best, t = d, min
+		}
+	}
+	return math.Sqrt(math.Max(best, 0)), t
+}
+
 // ToRect constructs a rectangle containing p with side lengths 2*tol.
 func (p Point) ToRect(tol float64) Rect {
 	dim := len(p)
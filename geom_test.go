@@ -5,7 +5,9 @@
 package rtreego
 
 import (
+	"encoding/json"
 	"math"
+	"math/rand"
 	"testing"
 )
 
@@ -371,3 +373,312 @@ func TestMinMaxdist(t *testing.T) {
 		t.Errorf("Expected %v.minMaxDist(%v) == %v, got %v", p, r, expected, d)
 	}
 }
+
+func TestIntersectRay(t *testing.T) {
+	r := mustRect(Point{1, 1}, []float64{2, 2})
+
+	if d, ok := r.intersectRay(Point{0, 2}, Point{1, 0}); !ok || math.Abs(d-1) > EPS {
+		t.Errorf("Expected ray to enter %v at t=1, got %v, %v", r, d, ok)
+	}
+	if d, ok := r.intersectRay(Point{2, 2}, Point{1, 1}); !ok || d != 0 {
+		t.Errorf("Expected ray starting inside %v to enter at t=0, got %v, %v", r, d, ok)
+	}
+	if _, ok := r.intersectRay(Point{0, 0}, Point{-1, 0}); ok {
+		t.Errorf("Expected ray pointing away from %v to miss", r)
+	}
+	if _, ok := r.intersectRay(Point{0, 4}, Point{1, 0}); ok {
+		t.Errorf("Expected parallel ray outside %v to miss", r)
+	}
+}
+
+func TestNewRectCoordError(t *testing.T) {
+	tests := []struct {
+		p       Point
+		lengths []float64
+	}{
+		{Point{math.NaN(), 0}, []float64{1, 1}},
+		{Point{0, math.Inf(1)}, []float64{1, 1}},
+		{Point{0, 0}, []float64{math.Inf(1), 1}},
+	}
+	for _, test := range tests {
+		_, err := NewRect(test.p, test.lengths)
+		if _, ok := err.(CoordError); !ok {
+			t.Errorf("Expected CoordError on NewRect(%v, %v), got %v", test.p, test.lengths, err)
+		}
+	}
+
+	p := Point{1.0, 2.0}
+	lengths := []float64{math.NaN(), 1}
+	if _, err := NewRect(p, lengths); err == nil {
+		t.Errorf("Expected error on NewRect(%v, %v)", p, lengths)
+	}
+
+	if _, err := NewRectFromPoints(Point{0, 0}, Point{math.Inf(1), 1}); err == nil {
+		t.Errorf("Expected error on NewRectFromPoints with infinite coordinate")
+	}
+}
+
+func TestMinDistRect(t *testing.T) {
+	r1 := mustRect(Point{0, 0}, []float64{1, 1})
+	r2 := mustRect(Point{4, 5}, []float64{1, 1})
+	r3 := mustRect(Point{0.5, 0.5}, []float64{2, 2})
+	if d := r1.minDistRect(r2); math.Abs(d-25) > EPS {
+		t.Errorf("Expected %v.minDistRect(%v) == 25, got %v", r1, r2, d)
+	}
+	if d := r2.minDistRect(r1); math.Abs(d-25) > EPS {
+		t.Errorf("Expected %v.minDistRect(%v) == 25, got %v", r2, r1, d)
+	}
+	if d := r1.minDistRect(r3); d != 0 {
+		t.Errorf("Expected %v.minDistRect(%v) == 0, got %v", r1, r3, d)
+	}
+}
+
+func TestRectJSON(t *testing.T) {
+	rect := mustRect(Point{1.0, -2.5, 3.0}, []float64{2.5, 8.0, 1.5})
+	data, err := json.Marshal(rect)
+	if err != nil {
+		t.Fatalf("Error on json.Marshal(%v): %v", rect, err)
+	}
+	if s := string(data); s != `{"min":[1,-2.5,3],"max":[3.5,5.5,4.5]}` {
+		t.Errorf("Unexpected JSON encoding of %v: %s", rect, s)
+	}
+
+	var decoded Rect
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Error on json.Unmarshal(%s): %v", data, err)
+	}
+	if !rect.Equal(decoded) {
+		t.Errorf("Expected %v after round trip, got %v", rect, decoded)
+	}
+}
+
+func TestRectJSONErrors(t *testing.T) {
+	var r Rect
+	if err := json.Unmarshal([]byte(`{"min":[0,0],"max":[1,1,1]}`), &r); err == nil {
+		t.Errorf("Expected DimError on mismatched array lengths")
+	} else if _, ok := err.(*DimError); !ok {
+		t.Errorf("Expected DimError on mismatched array lengths, got %v", err)
+	}
+	if _, ok := json.Unmarshal([]byte(`{"min":[0,2],"max":[1,1]}`), &r).(DistError); !ok {
+		t.Errorf("Expected DistError when min exceeds max")
+	}
+}
+
+func TestIntersectBoundaries(t *testing.T) {
+	query := mustRect(Point{0, 0}, []float64{1, 1})
+	below := mustRect(Point{-1, 0.5}, []float64{1, 0.1})
+	above := mustRect(Point{1, 0.5}, []float64{1, 0.1})
+	inside := mustRect(Point{0.2, 0.2}, []float64{0.5, 0.5})
+	outside := mustRect(Point{2, 2}, []float64{1, 1})
+
+	tests := []struct {
+		r                      Rect
+		open, closed, halfOpen bool
+	}{
+		{below, false, true, true},
+		{above, false, true, false},
+		{inside, true, true, true},
+		{outside, false, false, false},
+	}
+	for _, test := range tests {
+		if got := intersect(query, test.r); got != test.open {
+			t.Errorf("intersect(%v, %v) = %v", query, test.r, got)
+		}
+		if got := intersectClosed(query, test.r); got != test.closed {
+			t.Errorf("intersectClosed(%v, %v) = %v", query, test.r, got)
+		}
+		if got := intersectHalfOpen(query, test.r); got != test.halfOpen {
+			t.Errorf("intersectHalfOpen(%v, %v) = %v", query, test.r, got)
+		}
+	}
+}
+
+func TestContainsRectInterior(t *testing.T) {
+	r := mustRect(Point{0, 0}, []float64{2, 2})
+	inside := mustRect(Point{0.5, 0.5}, []float64{1, 1})
+	touching := mustRect(Point{0, 0.5}, []float64{1, 1})
+	if !r.containsRectInterior(inside) {
+		t.Errorf("Expected %v.containsRectInterior(%v) to return true", r, inside)
+	}
+	if r.containsRectInterior(touching) {
+		t.Errorf("Expected %v.containsRectInterior(%v) to return false", r, touching)
+	}
+}
+
+func TestIntersectsStrict(t *testing.T) {
+	r := mustRect(Point{0, 0}, []float64{2, 2})
+	cases := []struct {
+		other         Rect
+		loose, strict bool
+	}{
+		{mustRect(Point{1, 1}, []float64{2, 2}), true, true},     // overlapping
+		{mustRect(Point{0.5, 0.5}, []float64{1, 1}), true, true}, // inside
+		{mustRect(Point{2, 0}, []float64{1, 2}), true, false},    // sharing an edge
+		{mustRect(Point{2, 2}, []float64{1, 1}), true, false},    // sharing a corner
+		{mustRect(Point{3, 0}, []float64{1, 1}), false, false},   // disjoint
+		{Rect{Point{1, 1}, Point{1, 1}}, true, false},            // a point inside
+	}
+	for _, c := range cases {
+		if got := r.Intersects(c.other); got != c.loose {
+			t.Errorf("%v.Intersects(%v) = %v, expected %v", r, c.other, got, c.loose)
+		}
+		if got := c.other.Intersects(r); got != c.loose {
+			t.Errorf("%v.Intersects(%v) = %v, expected %v", c.other, r, got, c.loose)
+		}
+		if got := r.IntersectsStrict(c.other); got != c.strict {
+			t.Errorf("%v.IntersectsStrict(%v) = %v, expected %v", r, c.other, got, c.strict)
+		}
+		if got := c.other.IntersectsStrict(r); got != c.strict {
+			t.Errorf("%v.IntersectsStrict(%v) = %v, expected %v", c.other, r, got, c.strict)
+		}
+	}
+}
+
+func TestSplitAlong(t *testing.T) {
+	r := mustRect(Point{0, 1}, []float64{4, 2})
+
+	low, high, ok := r.SplitAlong(0, 1)
+	if !ok {
+		t.Fatalf("SplitAlong(0, 1) of %v did not split it", r)
+	}
+	if exp := mustRect(Point{0, 1}, []float64{1, 2}); !low.Equal(exp) {
+		t.Errorf("SplitAlong(0, 1) returned low part %v, expected %v", low, exp)
+	}
+	if exp := mustRect(Point{1, 1}, []float64{3, 2}); !high.Equal(exp) {
+		t.Errorf("SplitAlong(0, 1) returned high part %v, expected %v", high, exp)
+	}
+	if exp := mustRect(Point{0, 1}, []float64{4, 2}); !r.Equal(exp) {
+		t.Errorf("SplitAlong modified the rectangle to %v", r)
+	}
+
+	low, high, ok = r.SplitAlong(1, 2.5)
+	if !ok || !low.Equal(mustRect(Point{0, 1}, []float64{4, 1.5})) || !high.Equal(mustRect(Point{0, 2.5}, []float64{4, 0.5})) {
+		t.Errorf("SplitAlong(1, 2.5) = %v, %v, %v", low, high, ok)
+	}
+
+	for _, c := range []struct {
+		axis  int
+		value float64
+	}{
+		{0, -1}, // below
+		{1, 5},  // above
+		{0, 0},  // touching the low side
+		{1, 3},  // touching the high side
+	} {
+		if _, _, ok := r.SplitAlong(c.axis, c.value); ok {
+			t.Errorf("SplitAlong(%d, %v) of %v split it", c.axis, c.value, r)
+		}
+	}
+
+	for _, axis := range []int{-1, 2} {
+		func() {
+			defer func() {
+				if err := recover(); err != (DimError{2, axis}) {
+					t.Errorf("SplitAlong(%d, 1) panicked with %v, expected a DimError", axis, err)
+				}
+			}()
+			r.SplitAlong(axis, 1)
+		}()
+	}
+}
+
+func TestNewRect3D(t *testing.T) {
+	rect, err := NewRect3D(1, -2.5, 3, 2.5, 8, 1.5)
+	if err != nil {
+		t.Fatalf("Error on NewRect3D: %v", err)
+	}
+	exp := mustRect(Point{1, -2.5, 3}, []float64{2.5, 8, 1.5})
+	if !rect.Equal(exp) {
+		t.Errorf("Expected NewRect3D to return %v, got %v", exp, rect)
+	}
+	if _, err := NewRect3D(0, 0, 0, 1, -1, 1); err == nil {
+		t.Errorf("Expected error on NewRect3D with negative length")
+	}
+}
+
+func TestUnionSize(t *testing.T) {
+	cases := []struct {
+		rects []Rect
+		exp   float64
+	}{
+		{nil, 0},
+		{[]Rect{mustRect(Point{0, 0}, []float64{2, 3})}, 6},
+		{[]Rect{mustRect(Point{0, 0}, []float64{2, 2}), mustRect(Point{1, 1}, []float64{2, 2})}, 7},
+		{[]Rect{mustRect(Point{0, 0}, []float64{4, 4}), mustRect(Point{1, 1}, []float64{1, 1})}, 16},
+		{[]Rect{mustRect(Point{0, 0}, []float64{1, 1}), mustRect(Point{5, 5}, []float64{1, 2})}, 3},
+		{[]Rect{mustRect(Point{0, 0, 0}, []float64{2, 2, 2}), mustRect(Point{1, 1, 1}, []float64{2, 2, 2})}, 15},
+	}
+	for _, test := range cases {
+		if got := unionSize(test.rects, 0); math.Abs(got-test.exp) > EPS {
+			t.Errorf("unionSize(%v) = %v, expected %v", test.rects, got, test.exp)
+		}
+	}
+}
+
+func TestMortonCode(t *testing.T) {
+	bb := mustRect(Point{0, 0}, []float64{4, 4})
+	corner := func(x, y float64) Rect { return Rect{Point{x, y}, Point{x, y}} }
+
+	// the Z-order visits (0, 0), (4, 0), (0, 4) and (4, 4) in that order
+	codes := []uint64{
+		mortonCode(corner(0, 0), bb),
+		mortonCode(corner(4, 0), bb),
+		mortonCode(corner(0, 4), bb),
+		mortonCode(corner(4, 4), bb),
+	}
+	if codes[0] != 0 || codes[3] != math.MaxUint64 {
+		t.Errorf("mortonCode of extreme corners = %x, %x", codes[0], codes[3])
+	}
+	for i := 1; i < len(codes); i++ {
+		if codes[i-1] >= codes[i] {
+			t.Errorf("mortonCode does not follow Z-order: %x", codes)
+		}
+	}
+}
+
+func TestSegmentDist(t *testing.T) {
+	r := mustRect(Point{2, 2}, []float64{2, 2})
+	cases := []struct {
+		a, b    Point
+		dist, t float64
+	}{
+		{Point{0, 3}, Point{6, 3}, 0, 1.0 / 3},           // crosses r
+		{Point{0, 0}, Point{6, 0}, 2, 1.0 / 3},           // passes below r
+		{Point{0, 0}, Point{1, 1}, math.Sqrt(2), 1},      // ends before r
+		{Point{7, 8}, Point{7, 0}, 3, 4.0 / 8},           // parallel to the right side
+		{Point{3, 3}, Point{10, 3}, 0, 0},                // starts inside r
+		{Point{5, 5}, Point{5, 5}, math.Sqrt(2), 0},      // a single point
+		{Point{0, 10}, Point{10, 0}, math.Sqrt(2), 0.5},  // closest to a corner
+		{Point{6, 3}, Point{0, 9}, math.Sqrt(0.5), 0.25}, // closest to a corner inside the segment
+	}
+	for _, c := range cases {
+		dist, tt := r.segmentDist(c.a, c.b)
+		if math.Abs(dist-c.dist) > EPS || math.Abs(tt-c.t) > EPS {
+			t.Errorf("segmentDist(%v, %v) = %v, %v, expected %v, %v", c.a, c.b, dist, tt, c.dist, c.t)
+		}
+	}
+
+	// closest to an edge of a box
+	cube := mustRect(Point{0, 0, 0}, []float64{1, 1, 1})
+	a, b := Point{2, 2, -1}, Point{2, 2, 3}
+	if dist, tt := cube.segmentDist(a, b); math.Abs(dist-math.Sqrt(2)) > EPS || math.Abs(tt-0.25) > EPS {
+		t.Errorf("segmentDist(%v, %v) = %v, %v, expected %v, %v", a, b, dist, tt, math.Sqrt(2), 0.25)
+	}
+
+	// the distance is never larger than that of any point of the segment
+	for i := 0; i < 1000; i++ {
+		a := Point{rand.Float64() * 10, rand.Float64() * 10}
+		b := Point{rand.Float64() * 10, rand.Float64() * 10}
+		dist, tt := r.segmentDist(a, b)
+		at := Point{a[0] + tt*(b[0]-a[0]), a[1] + tt*(b[1]-a[1])}
+		if d := math.Sqrt(at.minDist(r)); math.Abs(d-dist) > EPS {
+			t.Fatalf("segmentDist(%v, %v) = %v at %v, whose distance is %v", a, b, dist, tt, d)
+		}
+		for s := 0.0; s <= 1; s += 0.01 {
+			p := Point{a[0] + s*(b[0]-a[0]), a[1] + s*(b[1]-a[1])}
+			if d := math.Sqrt(p.minDist(r)); d < dist-EPS {
+				t.Fatalf("segmentDist(%v, %v) = %v, but the point at %v has distance %v", a, b, dist, s, d)
+			}
+		}
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2012 Daniel Connelly.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rtreego
+
+import (
+	"fmt"
+	"math"
+)
+
+// Grid is an occupancy grid of an Rtree, counting the objects intersecting
+// each cell of a regular grid.  The counts are updated on every insert and
+// delete, so reading them is cheap.  Grids are created with AttachGrid.
+type Grid struct {
+	tree   *Rtree
+	cell   Rect
+	nx, ny int
+	counts []int
+
+	// bounds holds the bounds with which every object was counted, since
+	// the bounds of an object may have changed by the time it is deleted,
+	// e.g. in BulkUpdate.
+	bounds map[Spatial][]Rect
+}
+
+// AttachGrid returns a Grid of nx by ny cells covering the first two axes of
+// the tree, which is kept up to date by every insert and delete until it is
+// detached with Detach.  cell is the cell (0, 0); cell (i, j) is cell shifted
+// by i times its width along the first axis and j times its height along the
+// second.  On any further axes, all cells have the extent of cell.  The grid
+// counts the objects in the tree when it is attached, and objects must be
+// comparable with == so that they can be recognized when they are deleted.
+//
+// The grid belongs to tree alone: copies made by Clone or UpdateCOW do not
+// update it.  AttachGrid panics if nx or ny is not positive or if cell is
+// empty along the first two axes.
+func (tree *Rtree) AttachGrid(cell Rect, nx, ny int) *Grid {
+	if len(cell.p) != tree.Dim || tree.Dim < 2 {
+		panic(DimError{tree.Dim, len(cell.p)})
+	}
+	if nx <= 0 || ny <= 0 {
+		panic(fmt.Sprintf("rtreego: grid of %dx%d cells is empty", nx, ny))
+	}
+	if !(cell.q[0] > cell.p[0] && cell.q[1] > cell.p[1]) {
+		panic(fmt.Sprintf("rtreego: grid cell %v is empty", cell))
+	}
+	g := &Grid{
+		tree: tree,
+		cell: cell,
+		nx:   nx,
+		ny:   ny,
+	}
+	g.recount()
+	tree.grids = append(tree.grids, g)
+	return g
+}
+
+// Detach stops updating the grid, whose counts keep the state of the tree at
+// the time of the call.  Detaching a detached grid has no effect.
+func (g *Grid) Detach() {
+	if g.tree == nil {
+		return
+	}
+	grids := g.tree.grids
+	for i, other := range grids {
+		if other == g {
+			g.tree.grids = append(grids[:i], grids[i+1:]...)
+			break
+		}
+	}
+	g.tree = nil
+}
+
+// recount counts the objects in the tree anew, after their stored bounds
+// changed.
+func (g *Grid) recount() {
+	g.counts = make([]int, g.nx*g.ny)
+	g.bounds = make(map[Spatial][]Rect, g.tree.size)
+	for _, e := range g.tree.root.appendObjects(nil) {
+		g.add(e.obj, e.bb)
+	}
+}
+
+// Count returns the number of objects intersecting cell (i, j).  It panics if
+// the cell is outside the grid.
+func (g *Grid) Count(i, j int) int {
+	g.check(i, j)
+	return g.counts[j*g.nx+i]
+}
+
+// Cell returns the rectangle of cell (i, j).  It panics if the cell is
+// outside the grid.
+func (g *Grid) Cell(i, j int) Rect {
+	g.check(i, j)
+	r := Rect{append(Point{}, g.cell.p...), append(Point{}, g.cell.q...)}
+	w, h := g.cell.q[0]-g.cell.p[0], g.cell.q[1]-g.cell.p[1]
+	r.p[0], r.q[0] = g.cell.p[0]+float64(i)*w, g.cell.p[0]+float64(i+1)*w
+	r.p[1], r.q[1] = g.cell.p[1]+float64(j)*h, g.cell.p[1]+float64(j+1)*h
+	return r
+}
+
+func (g *Grid) check(i, j int) {
+	if i < 0 || i >= g.nx || j < 0 || j >= g.ny {
+		panic(fmt.Sprintf("rtreego: cell (%d, %d) is outside the %dx%d grid", i, j, g.nx, g.ny))
+	}
+}
+
+func (g *Grid) add(obj Spatial, bb Rect) {
+	g.bounds[obj] = append(g.bounds[obj], bb)
+	g.update(bb, 1)
+}
+
+func (g *Grid) remove(obj Spatial) {
+	bbs := g.bounds[obj]
+	if len(bbs) == 0 {
+		return
+	}
+	bb := bbs[len(bbs)-1]
+	if len(bbs) == 1 {
+		delete(g.bounds, obj)
+	} else {
+		g.bounds[obj] = bbs[:len(bbs)-1]
+	}
+	g.update(bb, -1)
+}
+
+// update adds delta to the counts of the cells intersecting bb.
+func (g *Grid) update(bb Rect, delta int) {
+	// the range of cells is widened by one on each side to be safe from
+	// rounding errors; intersect decides about the cells at its boundary
+	imin, imax := g.cellRange(bb, 0, g.nx)
+	jmin, jmax := g.cellRange(bb, 1, g.ny)
+	for j := jmin; j <= jmax; j++ {
+		for i := imin; i <= imax; i++ {
+			if intersect(g.Cell(i, j), bb) {
+				g.counts[j*g.nx+i] += delta
+			}
+		}
+	}
+}
+
+// cellRange returns the range of indices of cells along axis that may
+// intersect bb, clamped to the n cells of the grid.
+func (g *Grid) cellRange(bb Rect, axis, n int) (min, max int) {
+	w := g.cell.q[axis] - g.cell.p[axis]
+	lo := math.Floor((bb.p[axis]-g.cell.p[axis])/w) - 1
+	hi := math.Ceil((bb.q[axis]-g.cell.p[axis])/w) + 1
+	return int(math.Max(lo, 0)), int(math.Min(hi, float64(n-1)))
+}
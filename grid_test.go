@@ -0,0 +1,147 @@
+package rtreego
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestGrid(t *testing.T) {
+	things := randomThings(300, 5)
+	for _, tc := range tests(2, 3, 6, things[:200]...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+			g := rt.AttachGrid(mustRect(Point{0, 0}, []float64{10, 10}), 10, 10)
+			check := func(when string) {
+				for j := 0; j < 10; j++ {
+					for i := 0; i < 10; i++ {
+						if exp := len(rt.SearchIntersect(g.Cell(i, j))); g.Count(i, j) != exp {
+							t.Fatalf("%s: cell (%d, %d) counts %d objects, expected %d", when, i, j, g.Count(i, j), exp)
+						}
+					}
+				}
+			}
+			check("after attaching")
+
+			for _, thing := range things[200:] {
+				rt.Insert(thing)
+			}
+			check("after inserts")
+
+			for _, thing := range things[:150] {
+				rt.Delete(thing)
+			}
+			check("after deletes")
+
+			// the grid forgets the previous bounds of moved objects
+			moved := things[250:]
+			for _, obj := range moved {
+				r := obj.(*Rect)
+				*r = mustRect(Point{r.p[0] / 2, r.p[1] / 2}, []float64{1, 1})
+			}
+			if err := rt.BulkUpdate(moved); err != nil {
+				t.Fatal(err)
+			}
+			check("after BulkUpdate")
+
+			rt.DeleteFunc(func(Spatial) bool { return true })
+			check("after deleting everything")
+		})
+	}
+
+	rt := NewTree(2, 3, 6)
+	g := rt.AttachGrid(mustRect(Point{0, 0}, []float64{1, 1}), 2, 2)
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("Count of a cell outside the grid did not panic")
+			}
+		}()
+		g.Count(2, 0)
+	}()
+
+	for _, c := range []struct {
+		cell   Rect
+		nx, ny int
+	}{
+		{mustRect(Point{0, 0}, []float64{1, 1}), 0, 2},
+		{mustRect(Point{0, 0}, []float64{1, 1}), 2, -1},
+		{Rect{Point{0, 0}, Point{0, 1}}, 2, 2},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("AttachGrid(%v, %d, %d) did not panic", c.cell, c.nx, c.ny)
+				}
+			}()
+			rt.AttachGrid(c.cell, c.nx, c.ny)
+		}()
+	}
+}
+
+func TestGridDetach(t *testing.T) {
+	things := randomThings(100, 5)
+	rt := NewTree(2, 3, 6, things[:50]...)
+	cell := mustRect(Point{0, 0}, []float64{10, 10})
+	g := rt.AttachGrid(cell, 10, 10)
+	other := rt.AttachGrid(cell, 10, 10)
+	total := func(g *Grid) int {
+		n := 0
+		for _, c := range g.counts {
+			n += c
+		}
+		return n
+	}
+	before := total(g)
+
+	// changes to copies of the tree do not reach its grids
+	clone := rt.Clone()
+	for _, thing := range things[50:] {
+		clone.Insert(thing)
+	}
+	clone.Delete(things[0])
+	shared := NewSharedRtree(rt.Clone())
+	shared.UpdateCOW(func(next *Rtree) {
+		next.Insert(things[99])
+	})
+	if total(g) != before {
+		t.Errorf("grid counts %d objects after changing copies of the tree, expected %d", total(g), before)
+	}
+
+	g.Detach()
+	g.Detach()
+	rt.Insert(things[50])
+	if total(g) != before {
+		t.Errorf("detached grid counts %d objects after an insert, expected %d", total(g), before)
+	}
+	if total(other) == before || len(rt.grids) != 1 {
+		t.Errorf("detaching a grid stopped updating the other grid of the tree")
+	}
+}
+
+func TestGridTimeHorizon(t *testing.T) {
+	var things []Spatial
+	for i := 0; i < 100; i++ {
+		bb := mustRect(Point{rand.Float64() * 80, rand.Float64() * 80}, []float64{1, 1})
+		things = append(things, &mover{bb, []float64{rand.Float64() * 2, rand.Float64() * 2}})
+	}
+	rt := NewTree(2, 3, 6, things...)
+	g := rt.AttachGrid(mustRect(Point{0, 0}, []float64{10, 10}), 10, 10)
+
+	// rebuilding the tree with swept bounds is reflected by the grid
+	rt.SetTimeHorizon(10)
+	for j := 0; j < 10; j++ {
+		for i := 0; i < 10; i++ {
+			if exp := len(rt.SearchIntersect(g.Cell(i, j))); g.Count(i, j) != exp {
+				t.Fatalf("cell (%d, %d) counts %d objects, expected %d", i, j, g.Count(i, j), exp)
+			}
+		}
+	}
+	for _, thing := range things {
+		rt.Delete(thing)
+	}
+	for _, c := range g.counts {
+		if c != 0 {
+			t.Fatalf("grid counts %v after deleting everything", g.counts)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+// Copyright 2012 Daniel Connelly.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rtreego
+
+// LeanRtree is an R-tree whose nodes do not point to their parents and do not
+// record their level, which saves two words per node compared to an Rtree.
+// Instead of following parent pointers, inserts and deletes remember the path
+// they descended on an explicit stack and adjust and condense the tree along
+// it.  Unlike a FrozenRtree, a LeanRtree can still be modified.
+//
+// The parentless nodes are a separate type rather than an option of Rtree,
+// since NodeRef, InsertNearLeaf, the versions of a SharedRtree and the
+// incremental updates of the stored bounds on insert all follow parent
+// pointers, and an option would have to disable them all.  LeanRtree makes
+// the same choices as an Rtree with the default options: subtrees are chosen
+// by LeastEnlargement by area with DefaultEnlargementEpsilon, and nodes are
+// split with the quadratic algorithm of Rtree, so inserting the same objects
+// into both builds the same tree.  LeanRtree only supports insertion,
+// deletion and intersection queries.
+type LeanRtree struct {
+	Dim         int
+	MinChildren int
+	MaxChildren int
+	root        *leanNode
+	size        int
+	height      int
+}
+
+type leanNode struct {
+	leaf    bool
+	entries []leanEntry
+}
+
+type leanEntry struct {
+	bb    Rect
+	child *leanNode
+	obj   Spatial
+}
+
+// NewLeanTree returns an empty LeanRtree of the specified dimension whose
+// nodes hold between min and max entries.
+func NewLeanTree(dim, min, max int) *LeanRtree {
+	return &LeanRtree{
+		Dim:         dim,
+		MinChildren: min,
+		MaxChildren: max,
+		root:        &leanNode{leaf: true},
+		height:      1,
+	}
+}
+
+// Size returns the number of objects stored in tree.
+func (tree *LeanRtree) Size() int {
+	return tree.size
+}
+
+// Depth returns the maximum depth of tree.
+func (tree *LeanRtree) Depth() int {
+	return tree.height
+}
+
+// leanStep is a node on the path descended by an insert or delete, with the
+// index of the entry followed to the next node.
+type leanStep struct {
+	n     *leanNode
+	entry int
+}
+
+// Insert inserts a spatial object into the tree.  A DimError is returned if
+// the bounds of obj do not have the dimension of the tree.
+func (tree *LeanRtree) Insert(obj Spatial) error {
+	bb := obj.Bounds()
+	if len(bb.p) != tree.Dim {
+		return &DimError{tree.Dim, len(bb.p)}
+	}
+	tree.insert(obj, bb)
+	return nil
+}
+
+func (tree *LeanRtree) insert(obj Spatial, bb Rect) {
+	// descend to the leaf needing the least enlargement, remembering the
+	// path since nodes do not point to their parents
+	var path []leanStep
+	n := tree.root
+	for !n.leaf {
+		chosen := n.chooseEntry(bb)
+		path = append(path, leanStep{n, chosen})
+		n = n.entries[chosen].child
+	}
+	n.entries = append(n.entries, leanEntry{bb: bb, obj: obj})
+	tree.size++
+
+	// adjust the bounding boxes bottom-up, splitting overflowing nodes
+	var split *leanNode
+	if len(n.entries) > tree.MaxChildren {
+		n, split = tree.split(n)
+	}
+	for len(path) > 0 {
+		parent := path[len(path)-1]
+		path = path[:len(path)-1]
+		parent.n.entries[parent.entry].bb = n.computeBoundingBox()
+		if split != nil {
+			parent.n.entries = append(parent.n.entries, leanEntry{bb: split.computeBoundingBox(), child: split})
+			split = nil
+			if len(parent.n.entries) > tree.MaxChildren {
+				n, split = tree.split(parent.n)
+				continue
+			}
+		}
+		n = parent.n
+	}
+	if split != nil {
+		tree.root = &leanNode{entries: []leanEntry{
+			{bb: n.computeBoundingBox(), child: n},
+			{bb: split.computeBoundingBox(), child: split},
+		}}
+		tree.height++
+	}
+}
+
+// chooseEntry returns the index of the entry of n whose bounds need the least
+// enlargement to include bb, as chosen by Rtree with the default options.
+func (n *leanNode) chooseEntry(bb Rect) int {
+	return leastEnlargement(len(n.entries), func(i int) Rect {
+		return n.entries[i].bb
+	}, bb, CostArea.measure(), DefaultEnlargementEpsilon)
+}
+
+// computeBoundingBox finds the MBR of the children of n.
+func (n *leanNode) computeBoundingBox() Rect {
+	bb := n.entries[0].bb
+	for _, e := range n.entries[1:] {
+		bb = boundingBox(bb, e.bb)
+	}
+	return bb
+}
+
+// leanRef stands in for a child of an internal leanNode while it is split.
+type leanRef struct {
+	bb    Rect
+	child *leanNode
+}
+
+func (r *leanRef) Bounds() Rect {
+	return r.bb
+}
+
+// split splits an overflowing node with the algorithm used by Rtree, by
+// converting its entries to leaf entries of a temporary node.  n is reused as
+// the left node.
+func (tree *LeanRtree) split(n *leanNode) (left, right *leanNode) {
+	tmp := &node{leaf: true, entries: make([]entry, len(n.entries))}
+	for i, e := range n.entries {
+		obj := e.obj
+		if !n.leaf {
+			obj = &leanRef{e.bb, e.child}
+		}
+		tmp.entries[i] = entry{bb: e.bb, obj: obj}
+	}
+
+	l, r := tmp.split(tree.MinChildren, CostArea.measure())
+	convert := func(group *node, ln *leanNode) *leanNode {
+		ln.entries = make([]leanEntry, len(group.entries), tree.MaxChildren+1)
+		for i, e := range group.entries {
+			if n.leaf {
+				ln.entries[i] = leanEntry{bb: e.bb, obj: e.obj}
+			} else {
+				ln.entries[i] = leanEntry{bb: e.bb, child: e.obj.(*leanRef).child}
+			}
+		}
+		return ln
+	}
+	return convert(l, n), convert(r, &leanNode{leaf: n.leaf})
+}
+
+// Delete removes an object from the tree and reports whether it was found.
+// Objects are compared as in Rtree.Delete.  Underflowing nodes on the path to
+// the object are removed and their objects reinserted.
+func (tree *LeanRtree) Delete(obj Spatial) bool {
+	bb := obj.Bounds()
+	if len(bb.p) != tree.Dim {
+		return false
+	}
+	path := tree.root.findLeaf(nil, obj, bb)
+	if path == nil {
+		return false
+	}
+
+	leaf := path[len(path)-1]
+	leaf.n.entries = append(leaf.n.entries[:leaf.entry], leaf.n.entries[leaf.entry+1:]...)
+	tree.size--
+
+	// condense the tree bottom-up along the path, collecting the objects
+	// of underflowing nodes
+	var orphans []Spatial
+	for i := len(path) - 1; i > 0; i-- {
+		n, parent := path[i].n, path[i-1]
+		if len(n.entries) < tree.MinChildren {
+			orphans = n.appendObjects(orphans)
+			l := len(parent.n.entries)
+			parent.n.entries[parent.entry] = parent.n.entries[l-1]
+			parent.n.entries = parent.n.entries[:l-1]
+			continue
+		}
+		en := &parent.n.entries[parent.entry]
+		prevBox := en.bb
+		en.bb = n.computeBoundingBox()
+		if en.bb.Equal(prevBox) {
+			break
+		}
+	}
+
+	for !tree.root.leaf && len(tree.root.entries) == 1 {
+		tree.root = tree.root.entries[0].child
+		tree.height--
+	}
+	if !tree.root.leaf && len(tree.root.entries) == 0 {
+		tree.root = &leanNode{leaf: true}
+		tree.height = 1
+	}
+
+	for _, obj := range orphans {
+		tree.size--
+		tree.insert(obj, obj.Bounds())
+	}
+	return true
+}
+
+// findLeaf returns the path from n to the leaf entry holding obj, appended to
+// path, or nil if obj is not stored below n.
+func (n *leanNode) findLeaf(path []leanStep, obj Spatial, bb Rect) []leanStep {
+	for i, e := range n.entries {
+		if n.leaf {
+			if defaultComparator(e.obj, obj) {
+				return append(path, leanStep{n, i})
+			}
+			continue
+		}
+		if !e.bb.containsRect(bb) {
+			continue
+		}
+		if found := e.child.findLeaf(append(path, leanStep{n, i}), obj, bb); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// appendObjects appends the objects stored below n to objs.
+func (n *leanNode) appendObjects(objs []Spatial) []Spatial {
+	for _, e := range n.entries {
+		if n.leaf {
+			objs = append(objs, e.obj)
+		} else {
+			objs = e.child.appendObjects(objs)
+		}
+	}
+	return objs
+}
+
+// SearchIntersect returns all objects that intersect the specified rectangle.
+func (tree *LeanRtree) SearchIntersect(bb Rect, filters ...Filter) []Spatial {
+	if len(bb.p) != tree.Dim {
+		panic(DimError{tree.Dim, len(bb.p)})
+	}
+	results, _ := tree.root.searchIntersect([]Spatial{}, bb, filters)
+	return results
+}
+
+func (n *leanNode) searchIntersect(results []Spatial, bb Rect, filters []Filter) ([]Spatial, bool) {
+	for _, e := range n.entries {
+		if !intersect(bb, e.bb) {
+			continue
+		}
+
+		if !n.leaf {
+			var abort bool
+			results, abort = e.child.searchIntersect(results, bb, filters)
+			if abort {
+				return results, true
+			}
+			continue
+		}
+
+		refuse, abort := applyFilters(results, e.obj, filters)
+		if !refuse {
+			results = append(results, e.obj)
+		}
+		if abort {
+			return results, true
+		}
+	}
+	return results, false
+}
@@ -0,0 +1,224 @@
+package rtreego
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// checkLean verifies that the bounding boxes of the entries of n are tight,
+// that the nodes below the root hold between MinChildren and MaxChildren
+// entries and that all leaves are at the depth of tree.  It returns the
+// number of objects stored below n.
+func checkLean(t *testing.T, tree *LeanRtree, n *leanNode, depth int) int {
+	t.Helper()
+	if n != tree.root && (len(n.entries) < tree.MinChildren || len(n.entries) > tree.MaxChildren) {
+		t.Errorf("node at depth %d has %d entries, expected %d to %d", depth, len(n.entries), tree.MinChildren, tree.MaxChildren)
+	}
+	if n.leaf {
+		if depth != tree.Depth() {
+			t.Errorf("leaf at depth %d, expected %d", depth, tree.Depth())
+		}
+		return len(n.entries)
+	}
+	objs := 0
+	for _, e := range n.entries {
+		if bb := e.child.computeBoundingBox(); !e.bb.Equal(bb) {
+			t.Errorf("entry at depth %d has bounds %v, expected %v", depth, e.bb, bb)
+		}
+		objs += checkLean(t, tree, e.child, depth+1)
+	}
+	return objs
+}
+
+func TestLeanRtree(t *testing.T) {
+	things := randomThings(1000, 2)
+	lt := NewLeanTree(2, 3, 6)
+	for _, thing := range things {
+		if err := lt.Insert(thing); err != nil {
+			t.Fatalf("Insert(%v) returned %v", thing, err)
+		}
+	}
+	if lt.Size() != len(things) || lt.Depth() < 4 {
+		t.Fatalf("Size() = %d, Depth() = %d after inserting %d objects", lt.Size(), lt.Depth(), len(things))
+	}
+	if objs := checkLean(t, lt, lt.root, 1); objs != len(things) {
+		t.Errorf("tree stores %d objects, expected %d", objs, len(things))
+	}
+
+	// deleting objects must condense the tree along the remembered path
+	for _, thing := range things[:700] {
+		if !lt.Delete(thing) {
+			t.Fatalf("Delete(%v) failed", thing)
+		}
+	}
+	if lt.Delete(things[0]) {
+		t.Errorf("Delete of a deleted object succeeded")
+	}
+	if lt.Size() != 300 {
+		t.Errorf("Size() = %d after deletes, expected 300", lt.Size())
+	}
+	if objs := checkLean(t, lt, lt.root, 1); objs != 300 {
+		t.Errorf("tree stores %d objects after deletes, expected 300", objs)
+	}
+
+	rt := NewTree(2, 3, 6, things[700:]...)
+	for i := 0; i < 50; i++ {
+		bb := mustRect(Point{rand.Float64() * 90, rand.Float64() * 90}, []float64{10, 10})
+		expected := rt.SearchIntersect(bb)
+		q := lt.SearchIntersect(bb)
+		if len(q) != len(expected) {
+			t.Fatalf("SearchIntersect(%v) returned %d objects, expected %d", bb, len(q), len(expected))
+		}
+		ensureDisorderedSubset(t, q, expected)
+		if q := lt.SearchIntersect(bb, LimitFilter(2)); len(expected) >= 2 && len(q) != 2 {
+			t.Errorf("SearchIntersect returned %d objects with limit 2", len(q))
+		}
+	}
+
+	for _, thing := range things[700:] {
+		lt.Delete(thing)
+	}
+	if lt.Size() != 0 || lt.Depth() != 1 || len(lt.root.entries) != 0 {
+		t.Errorf("Size() = %d, Depth() = %d after deleting everything, expected an empty leaf", lt.Size(), lt.Depth())
+	}
+
+	if err := lt.Insert(&Rect{Point{0, 0, 0}, Point{1, 1, 1}}); err == nil {
+		t.Errorf("Insert of a three-dimensional object succeeded")
+	}
+}
+
+// sameLeanStructure reports whether the leanNode ln has the same entries as n,
+// in the same order, down to the objects.
+func sameLeanStructure(n *node, ln *leanNode) bool {
+	if n.leaf != ln.leaf || len(n.entries) != len(ln.entries) {
+		return false
+	}
+	for i, e := range n.entries {
+		le := ln.entries[i]
+		if !e.bb.Equal(le.bb) {
+			return false
+		}
+		if n.leaf {
+			if e.obj != le.obj {
+				return false
+			}
+		} else if !sameLeanStructure(e.child, le.child) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestLeanRtreeMatchesRtree(t *testing.T) {
+	// inserting the same objects builds the same tree as an Rtree with the
+	// default options, whose choices LeanRtree shares
+	things := randomThings(2000, 3)
+	rt := NewTree(2, 3, 6)
+	lt := NewLeanTree(2, 3, 6)
+	for _, thing := range things {
+		rt.Insert(thing)
+		if err := lt.Insert(thing); err != nil {
+			t.Fatalf("Insert(%v) returned %v", thing, err)
+		}
+	}
+	if lt.Depth() != rt.Depth() || !sameLeanStructure(rt.root, lt.root) {
+		t.Fatalf("LeanRtree of depth %d differs from the Rtree of depth %d built from the same objects", lt.Depth(), rt.Depth())
+	}
+
+	// interleaved deletes and inserts keep the tree balanced and tight and
+	// answer queries like an Rtree
+	stored := append([]Spatial{}, things...)
+	for round := 0; round < 10; round++ {
+		rand.Shuffle(len(stored), func(i, j int) { stored[i], stored[j] = stored[j], stored[i] })
+		for _, thing := range stored[:300] {
+			if !lt.Delete(thing) || !rt.Delete(thing) {
+				t.Fatalf("Delete(%v) failed", thing)
+			}
+		}
+		fresh := randomThings(200, 3)
+		for _, thing := range fresh {
+			lt.Insert(thing)
+			rt.Insert(thing)
+		}
+		stored = append(stored[300:], fresh...)
+
+		if lt.Size() != len(stored) {
+			t.Fatalf("Size() = %d, expected %d", lt.Size(), len(stored))
+		}
+		if objs := checkLean(t, lt, lt.root, 1); objs != len(stored) {
+			t.Fatalf("tree stores %d objects, expected %d", objs, len(stored))
+		}
+		for i := 0; i < 20; i++ {
+			bb := mustRect(Point{rand.Float64() * 90, rand.Float64() * 90}, []float64{10, 10})
+			expected := rt.SearchIntersect(bb)
+			q := lt.SearchIntersect(bb)
+			if len(q) != len(expected) {
+				t.Fatalf("SearchIntersect(%v) returned %d objects, expected %d", bb, len(q), len(expected))
+			}
+			ensureDisorderedSubset(t, q, expected)
+		}
+	}
+}
+
+func TestLeanRtreeDeleteEqualer(t *testing.T) {
+	var things []Spatial
+	lt := NewLeanTree(2, 3, 6)
+	for i, thing := range randomThings(200, 2) {
+		obj := &labeled{thing.Bounds(), fmt.Sprint(i)}
+		things = append(things, obj)
+		lt.Insert(obj)
+	}
+	for _, thing := range things[:100] {
+		stored := thing.(*labeled)
+		if !lt.Delete(&labeled{stored.bb, stored.label}) {
+			t.Fatalf("Delete of an equal copy of %v failed", stored)
+		}
+	}
+	if other := (&labeled{things[150].(*labeled).bb, "other"}); lt.Delete(other) {
+		t.Errorf("Delete(%v) of an object with different content succeeded", other)
+	}
+	if lt.Size() != 100 {
+		t.Errorf("Size() = %d, expected 100", lt.Size())
+	}
+	checkLean(t, lt, lt.root, 1)
+	ensureDisorderedSubset(t, lt.SearchIntersect(mustRect(Point{-10, -10}, []float64{200, 200})), things[100:])
+}
+
+func TestLeanRtreeDimensions(t *testing.T) {
+	lt := NewLeanTree(2, 3, 6)
+	for _, thing := range randomThings(20, 1) {
+		lt.Insert(thing)
+	}
+	if lt.Delete(&Rect{Point{0, 0, 0}, Point{1, 1, 1}}) {
+		t.Errorf("Delete of a three-dimensional object succeeded")
+	}
+	defer func() {
+		r := recover()
+		if err, ok := r.(DimError); !ok || err.Expected != 2 || err.Actual != 3 {
+			t.Errorf("SearchIntersect with a three-dimensional box panicked with %v, expected a DimError", r)
+		}
+	}()
+	lt.SearchIntersect(mustRect(Point{0, 0, 0}, []float64{1, 1, 1}))
+}
+
+// leanCopy copies the nodes below n to leanNodes of the same capacity, so
+// that the memory of both layouts can be compared on the same tree.
+func leanCopy(n *node) *leanNode {
+	ln := &leanNode{leaf: n.leaf, entries: make([]leanEntry, len(n.entries), cap(n.entries))}
+	for i, e := range n.entries {
+		ln.entries[i] = leanEntry{bb: e.bb, obj: e.obj}
+		if !n.leaf {
+			ln.entries[i].child = leanCopy(e.child)
+		}
+	}
+	return ln
+}
+
+func BenchmarkLeanNodeMemory(b *testing.B) {
+	benchmarkNodeMemory(b, func(things []Spatial) (interface{}, int) {
+		rt := NewTree(2, 25, 50, things...)
+		lt := &LeanRtree{Dim: 2, MinChildren: 25, MaxChildren: 50, root: leanCopy(rt.root), size: rt.size, height: rt.height}
+		return lt, countNodes(rt)
+	})
+}
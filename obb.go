@@ -0,0 +1,54 @@
+// Copyright 2012 Daniel Connelly.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rtreego
+
+import "math"
+
+// SearchOBB returns all objects intersecting the oriented rectangle centered
+// at center with the specified half extents along its axes, rotated by angle
+// radians counterclockwise around its center, e.g. the selection of a
+// rotated selection tool.  The tree must be two-dimensional.
+//
+// The tree is searched with the axis-aligned bounding box of the oriented
+// rectangle, and the objects found are then tested against the oriented
+// rectangle itself with the separating axis theorem, so that objects in the
+// corners of the bounding box outside the rectangle are not returned.
+func (tree *Rtree) SearchOBB(center Point, halfExtents []float64, angle float64) []Spatial {
+	if tree.Dim != 2 {
+		panic(DimError{2, tree.Dim})
+	}
+	if len(center) != 2 {
+		panic(DimError{2, len(center)})
+	}
+	if len(halfExtents) != 2 {
+		panic(DimError{2, len(halfExtents)})
+	}
+
+	sin, cos := math.Sincos(angle)
+	axes := [2][2]float64{{cos, sin}, {-sin, cos}}
+	ex := math.Abs(cos)*halfExtents[0] + math.Abs(sin)*halfExtents[1]
+	ey := math.Abs(sin)*halfExtents[0] + math.Abs(cos)*halfExtents[1]
+	bb := Rect{Point{center[0] - ex, center[1] - ey}, Point{center[0] + ex, center[1] + ey}}
+
+	// the coordinate axes cannot separate the objects found from the
+	// oriented rectangle, since they intersect its bounding box, so only the
+	// axes of the rectangle need to be tested
+	obb := func(results []Spatial, obj Spatial) (refuse, abort bool) {
+		r := tree.bounds(obj)
+		c := r.center()
+		wx, wy := (r.q[0]-r.p[0])/2, (r.q[1]-r.p[1])/2
+		for i, u := range axes {
+			d := math.Abs(u[0]*(c[0]-center[0]) + u[1]*(c[1]-center[1]))
+			if d >= math.Abs(u[0])*wx+math.Abs(u[1])*wy+halfExtents[i] {
+				return true, false
+			}
+		}
+		return false, false
+	}
+	q := tree.startQuery()
+	results := tree.searchIntersect([]Spatial{}, tree.root, bb, []Filter{obb}, q)
+	tree.finishQuery(q)
+	return results
+}
@@ -0,0 +1,62 @@
+package rtreego
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSearchOBB(t *testing.T) {
+	// a square rotated by 45 degrees is a diamond with vertices at a distance
+	// of 10*sqrt(2) from its center
+	center := Point{50, 50}
+	half := []float64{10, 10}
+	in := []Spatial{
+		&Rect{Point{49.5, 49.5}, Point{50.5, 50.5}}, // center
+		&Rect{Point{50, 36}, Point{51, 37}},         // near the bottom vertex
+		&Rect{Point{63, 49}, Point{64, 50}},         // near the right vertex
+		&Rect{Point{40, 40}, Point{44, 44}},         // straddling an edge
+	}
+	out := []Spatial{
+		&Rect{Point{36, 36}, Point{37, 37}}, // corners of the bounding box
+		&Rect{Point{63, 63}, Point{64, 64}},
+		&Rect{Point{36, 63}, Point{37, 64}},
+		&Rect{Point{63, 36}, Point{64, 37}},
+		&Rect{Point{80, 80}, Point{81, 81}}, // outside the bounding box
+	}
+	things := append(append([]Spatial{}, in...), out...)
+	for _, tc := range tests(2, 2, 4, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+			q := rt.SearchOBB(center, half, math.Pi/4)
+			if len(q) != len(in) {
+				t.Fatalf("SearchOBB returned %d objects, expected %d", len(q), len(in))
+			}
+			ensureDisorderedSubset(t, q, in)
+
+			// the same square unrotated contains the corners of its
+			// bounding box
+			bb := mustRect(Point{36, 36}, []float64{28, 28})
+			q = rt.SearchOBB(Point{50, 50}, []float64{14, 14}, 0)
+			if expected := rt.SearchIntersect(bb); len(q) != len(expected) {
+				t.Errorf("unrotated SearchOBB returned %d objects, expected %d", len(q), len(expected))
+			}
+		})
+	}
+
+	things = randomThings(500, 2)
+	rt := NewTree(2, 3, 6, things...)
+	for _, angle := range []float64{0, math.Pi / 2, math.Pi} {
+		q := rt.SearchOBB(Point{40, 60}, []float64{15, 5}, angle)
+		var bb Rect
+		if angle == math.Pi/2 {
+			bb = mustRect(Point{35, 45}, []float64{10, 30})
+		} else {
+			bb = mustRect(Point{25, 55}, []float64{30, 10})
+		}
+		expected := rt.SearchIntersect(bb)
+		if len(q) != len(expected) {
+			t.Errorf("SearchOBB rotated by %v returned %d objects, expected %d", angle, len(q), len(expected))
+		}
+		ensureDisorderedSubset(t, q, expected)
+	}
+}
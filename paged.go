@@ -0,0 +1,497 @@
+// Copyright 2012 Daniel Connelly.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rtreego
+
+import (
+	"container/list"
+	"fmt"
+)
+
+// PageNode is the stored form of a node of a PagedRtree.  The entries of a
+// leaf hold objects, the entries of an internal node refer to their children
+// by id.  The header page with id 0 holds no entries but the Header of the
+// tree.
+type PageNode struct {
+	Leaf    bool
+	Entries []PageEntry
+	Header  *PageHeader
+}
+
+// PageHeader describes a PagedRtree, so that the tree can be reopened from its
+// store with OpenPagedTree.
+type PageHeader struct {
+	Dim         int
+	MinChildren int
+	MaxChildren int
+	Root        int64 // id of the root node
+	NextID      int64 // id of the next node allocated
+	Size        int
+	Height      int
+}
+
+// headerID is the id of the header page of a PagedRtree.
+const headerID = 0
+
+// PageEntry is an entry of a PageNode.  Its Bounds contain the bounds of the
+// object, or of all entries of the child node.
+type PageEntry struct {
+	Bounds Rect
+	Child  int64   // id of the child node of an internal node
+	Obj    Spatial // object stored in a leaf
+}
+
+// NodeStore stores the nodes of a PagedRtree by id.  A store may keep nodes
+// anywhere, e.g. on disk, in which case it is responsible for encoding the
+// objects stored in the leaves.  Rects can be encoded as JSON.
+//
+// A PagedRtree calls Store after every change to a node, so a store may
+// return the same *PageNode from Load that it was given by Store, or a copy.
+type NodeStore interface {
+	Load(id int64) (*PageNode, error)
+	Store(id int64, n *PageNode) error
+}
+
+// PagedRtree is an R-tree whose nodes are kept in a NodeStore instead of
+// memory, for indexes that are too large to fit in RAM.  Every node is loaded
+// from the store when a query or insert visits it.  Wrap the store with
+// NewLRUStore to keep the most recently used nodes in memory.
+//
+// PagedRtree makes the same choices as an Rtree with the default options:
+// subtrees are chosen by LeastEnlargement by area with
+// DefaultEnlargementEpsilon, and nodes are split with the quadratic algorithm
+// of Rtree.  PagedRtree only supports insertion, deletion and intersection
+// queries.  The size, height and id of the root are kept in the header page
+// of the store, which is rewritten after every insert and delete.
+type PagedRtree struct {
+	Dim         int
+	MinChildren int
+	MaxChildren int
+	store       NodeStore
+	root        int64
+	nextID      int64
+	size        int
+	height      int
+}
+
+// NewPagedTree returns an empty PagedRtree storing its nodes in store.  The
+// tree allocates node ids starting from 0 for its header page, overwriting any
+// nodes with these ids in store.  An error is returned if the header or the
+// empty root cannot be stored.
+func NewPagedTree(store NodeStore, dim, min, max int) (*PagedRtree, error) {
+	tree := &PagedRtree{
+		Dim:         dim,
+		MinChildren: min,
+		MaxChildren: max,
+		store:       store,
+		nextID:      headerID + 1,
+		height:      1,
+	}
+	tree.root = tree.newID()
+	if err := store.Store(tree.root, &PageNode{Leaf: true}); err != nil {
+		return nil, err
+	}
+	if err := tree.storeHeader(); err != nil {
+		return nil, err
+	}
+	return tree, nil
+}
+
+// OpenPagedTree returns the PagedRtree stored in store by NewPagedTree,
+// Insert and Delete, as described by its header page.  Errors of the store
+// are passed on, and an error is returned if the store holds no header page.
+func OpenPagedTree(store NodeStore) (*PagedRtree, error) {
+	n, err := store.Load(headerID)
+	if err != nil {
+		return nil, err
+	}
+	h := n.Header
+	if h == nil {
+		return nil, fmt.Errorf("rtreego: node %d of the store is not the header of a PagedRtree", headerID)
+	}
+	return &PagedRtree{
+		Dim:         h.Dim,
+		MinChildren: h.MinChildren,
+		MaxChildren: h.MaxChildren,
+		store:       store,
+		root:        h.Root,
+		nextID:      h.NextID,
+		size:        h.Size,
+		height:      h.Height,
+	}, nil
+}
+
+// storeHeader stores the header page describing tree.
+func (tree *PagedRtree) storeHeader() error {
+	return tree.store.Store(headerID, &PageNode{Header: &PageHeader{
+		Dim:         tree.Dim,
+		MinChildren: tree.MinChildren,
+		MaxChildren: tree.MaxChildren,
+		Root:        tree.root,
+		NextID:      tree.nextID,
+		Size:        tree.size,
+		Height:      tree.height,
+	}})
+}
+
+func (tree *PagedRtree) newID() int64 {
+	id := tree.nextID
+	tree.nextID++
+	return id
+}
+
+// Size returns the number of objects stored in tree.
+func (tree *PagedRtree) Size() int {
+	return tree.size
+}
+
+// Depth returns the maximum depth of tree.
+func (tree *PagedRtree) Depth() int {
+	return tree.height
+}
+
+// pathStep is a node visited by an insert or delete, with the index of the
+// entry followed to the next node.
+type pathStep struct {
+	id    int64
+	n     *PageNode
+	entry int
+}
+
+// Insert inserts a spatial object into the tree.  A DimError is returned if
+// the bounds of obj do not have the dimension of the tree, and errors of the
+// store are passed on, in which case the tree may be left inconsistent.
+func (tree *PagedRtree) Insert(obj Spatial) error {
+	bb := obj.Bounds()
+	if len(bb.p) != tree.Dim {
+		return &DimError{tree.Dim, len(bb.p)}
+	}
+	if err := tree.insert(obj, bb); err != nil {
+		return err
+	}
+	return tree.storeHeader()
+}
+
+func (tree *PagedRtree) insert(obj Spatial, bb Rect) error {
+	// descend to the leaf needing the least enlargement, remembering the
+	// path since nodes do not point to their parents
+	var path []pathStep
+	id := tree.root
+	n, err := tree.store.Load(id)
+	if err != nil {
+		return err
+	}
+	for !n.Leaf {
+		chosen := chooseEntry(n, bb)
+		path = append(path, pathStep{id, n, chosen})
+		id = n.Entries[chosen].Child
+		if n, err = tree.store.Load(id); err != nil {
+			return err
+		}
+	}
+	n.Entries = append(n.Entries, PageEntry{Bounds: bb, Obj: obj})
+	tree.size++
+
+	// store the changed nodes bottom-up, splitting overflowing ones
+	for {
+		var split *PageNode
+		var splitID int64
+		if len(n.Entries) > tree.MaxChildren {
+			n, split = tree.split(n)
+			splitID = tree.newID()
+			if err := tree.store.Store(splitID, split); err != nil {
+				return err
+			}
+		}
+		if err := tree.store.Store(id, n); err != nil {
+			return err
+		}
+
+		if len(path) == 0 {
+			if split == nil {
+				return nil
+			}
+			root := &PageNode{Entries: []PageEntry{
+				{Bounds: pageBounds(n), Child: id},
+				{Bounds: pageBounds(split), Child: splitID},
+			}}
+			tree.root = tree.newID()
+			tree.height++
+			return tree.store.Store(tree.root, root)
+		}
+
+		parent := path[len(path)-1]
+		path = path[:len(path)-1]
+		parent.n.Entries[parent.entry].Bounds = pageBounds(n)
+		if split != nil {
+			parent.n.Entries = append(parent.n.Entries, PageEntry{Bounds: pageBounds(split), Child: splitID})
+		}
+		id, n = parent.id, parent.n
+	}
+}
+
+// chooseEntry returns the index of the entry of n whose bounds need the least
+// enlargement to include bb, as chosen by Rtree with the default options.
+func chooseEntry(n *PageNode, bb Rect) int {
+	return leastEnlargement(len(n.Entries), func(i int) Rect {
+		return n.Entries[i].Bounds
+	}, bb, CostArea.measure(), DefaultEnlargementEpsilon)
+}
+
+// pageBounds returns the bounding box of the entries of n.
+func pageBounds(n *PageNode) Rect {
+	bb := n.Entries[0].Bounds
+	for _, e := range n.Entries[1:] {
+		bb = boundingBox(bb, e.Bounds)
+	}
+	return bb
+}
+
+// pageRef stands in for a child of an internal PageNode while it is split.
+type pageRef struct {
+	bb    Rect
+	child int64
+}
+
+func (r *pageRef) Bounds() Rect {
+	return r.bb
+}
+
+// split splits an overflowing node with the algorithm used by Rtree, by
+// converting its entries to leaf entries of a temporary node.
+func (tree *PagedRtree) split(n *PageNode) (left, right *PageNode) {
+	tmp := &node{leaf: true, entries: make([]entry, len(n.Entries))}
+	for i, e := range n.Entries {
+		obj := e.Obj
+		if !n.Leaf {
+			obj = &pageRef{e.Bounds, e.Child}
+		}
+		tmp.entries[i] = entry{bb: e.Bounds, obj: obj}
+	}
+
+	l, r := tmp.split(tree.MinChildren, CostArea.measure())
+	convert := func(group *node) *PageNode {
+		page := &PageNode{Leaf: n.Leaf, Entries: make([]PageEntry, len(group.entries))}
+		for i, e := range group.entries {
+			if n.Leaf {
+				page.Entries[i] = PageEntry{Bounds: e.bb, Obj: e.obj}
+			} else {
+				page.Entries[i] = PageEntry{Bounds: e.bb, Child: e.obj.(*pageRef).child}
+			}
+		}
+		return page
+	}
+	return convert(l), convert(r)
+}
+
+// Delete removes an object from the tree and reports whether it was found.
+// Objects are compared as in Rtree.Delete.  Underflowing nodes on the path to
+// the object are removed and their objects reinserted; the ids of removed
+// nodes are not reused.  Errors of the store are passed on, in which case the
+// tree may be left inconsistent.
+func (tree *PagedRtree) Delete(obj Spatial) (bool, error) {
+	bb := obj.Bounds()
+	if len(bb.p) != tree.Dim {
+		return false, nil
+	}
+	path, err := tree.findLeaf(nil, tree.root, obj, bb)
+	if path == nil || err != nil {
+		return false, err
+	}
+
+	leaf := path[len(path)-1]
+	leaf.n.Entries = append(leaf.n.Entries[:leaf.entry], leaf.n.Entries[leaf.entry+1:]...)
+	tree.size--
+
+	// condense the tree bottom-up along the path, collecting the objects
+	// of underflowing nodes and storing the remaining ones
+	var orphans []Spatial
+	for i := len(path) - 1; i > 0; i-- {
+		step, parent := path[i], path[i-1]
+		if len(step.n.Entries) < tree.MinChildren {
+			if orphans, err = tree.appendObjects(orphans, step.n); err != nil {
+				return true, err
+			}
+			l := len(parent.n.Entries)
+			parent.n.Entries[parent.entry] = parent.n.Entries[l-1]
+			parent.n.Entries = parent.n.Entries[:l-1]
+			continue
+		}
+		if err := tree.store.Store(step.id, step.n); err != nil {
+			return true, err
+		}
+		parent.n.Entries[parent.entry].Bounds = pageBounds(step.n)
+	}
+
+	root := path[0].n
+	for !root.Leaf && len(root.Entries) == 1 {
+		tree.root = root.Entries[0].Child
+		tree.height--
+		if root, err = tree.store.Load(tree.root); err != nil {
+			return true, err
+		}
+	}
+	if !root.Leaf && len(root.Entries) == 0 {
+		root = &PageNode{Leaf: true}
+		tree.height = 1
+	}
+	if err := tree.store.Store(tree.root, root); err != nil {
+		return true, err
+	}
+
+	for _, obj := range orphans {
+		tree.size--
+		if err := tree.insert(obj, obj.Bounds()); err != nil {
+			return true, err
+		}
+	}
+	return true, tree.storeHeader()
+}
+
+// findLeaf returns the path from the node id to the leaf entry holding obj,
+// appended to path, or nil if obj is not stored below the node.
+func (tree *PagedRtree) findLeaf(path []pathStep, id int64, obj Spatial, bb Rect) ([]pathStep, error) {
+	n, err := tree.store.Load(id)
+	if err != nil {
+		return nil, err
+	}
+	for i, e := range n.Entries {
+		if n.Leaf {
+			if defaultComparator(e.Obj, obj) {
+				return append(path, pathStep{id, n, i}), nil
+			}
+			continue
+		}
+		if !e.Bounds.containsRect(bb) {
+			continue
+		}
+		found, err := tree.findLeaf(append(path, pathStep{id, n, i}), e.Child, obj, bb)
+		if found != nil || err != nil {
+			return found, err
+		}
+	}
+	return nil, nil
+}
+
+// appendObjects appends the objects stored below n to objs, loading the
+// nodes below n from the store.
+func (tree *PagedRtree) appendObjects(objs []Spatial, n *PageNode) ([]Spatial, error) {
+	for _, e := range n.Entries {
+		if n.Leaf {
+			objs = append(objs, e.Obj)
+			continue
+		}
+		child, err := tree.store.Load(e.Child)
+		if err != nil {
+			return objs, err
+		}
+		if objs, err = tree.appendObjects(objs, child); err != nil {
+			return objs, err
+		}
+	}
+	return objs, nil
+}
+
+// SearchIntersect returns all objects that intersect the specified rectangle,
+// loading the visited nodes from the store.  Errors of the store are passed
+// on.
+func (tree *PagedRtree) SearchIntersect(bb Rect, filters ...Filter) ([]Spatial, error) {
+	if len(bb.p) != tree.Dim {
+		panic(DimError{tree.Dim, len(bb.p)})
+	}
+	results, _, err := tree.searchIntersect([]Spatial{}, tree.root, bb, filters)
+	return results, err
+}
+
+func (tree *PagedRtree) searchIntersect(results []Spatial, id int64, bb Rect, filters []Filter) ([]Spatial, bool, error) {
+	n, err := tree.store.Load(id)
+	if err != nil {
+		return results, true, err
+	}
+	for _, e := range n.Entries {
+		if !intersect(bb, e.Bounds) {
+			continue
+		}
+
+		if !n.Leaf {
+			var abort bool
+			results, abort, err = tree.searchIntersect(results, e.Child, bb, filters)
+			if abort {
+				return results, true, err
+			}
+			continue
+		}
+
+		refuse, abort := applyFilters(results, e.Obj, filters)
+		if !refuse {
+			results = append(results, e.Obj)
+		}
+		if abort {
+			return results, true, nil
+		}
+	}
+	return results, false, nil
+}
+
+// lruStore is a NodeStore caching recently used nodes of another store.
+type lruStore struct {
+	backing  NodeStore
+	capacity int
+	order    *list.List // of *lruEntry, most recently used first
+	entries  map[int64]*list.Element
+}
+
+type lruEntry struct {
+	id int64
+	n  *PageNode
+}
+
+// NewLRUStore returns a NodeStore keeping up to capacity of the most recently
+// used nodes of backing in memory.  Nodes are written through to backing when
+// they are stored, so evicting a node from the cache only drops it from
+// memory.
+func NewLRUStore(backing NodeStore, capacity int) NodeStore {
+	return &lruStore{
+		backing:  backing,
+		capacity: capacity,
+		order:    list.New(),
+		entries:  make(map[int64]*list.Element),
+	}
+}
+
+func (s *lruStore) Load(id int64) (*PageNode, error) {
+	if el, ok := s.entries[id]; ok {
+		s.order.MoveToFront(el)
+		return el.Value.(*lruEntry).n, nil
+	}
+	n, err := s.backing.Load(id)
+	if err != nil {
+		return nil, err
+	}
+	s.add(id, n)
+	return n, nil
+}
+
+func (s *lruStore) Store(id int64, n *PageNode) error {
+	if err := s.backing.Store(id, n); err != nil {
+		return err
+	}
+	if el, ok := s.entries[id]; ok {
+		el.Value.(*lruEntry).n = n
+		s.order.MoveToFront(el)
+		return nil
+	}
+	s.add(id, n)
+	return nil
+}
+
+// add caches n and evicts the least recently used node if the cache is full.
+func (s *lruStore) add(id int64, n *PageNode) {
+	s.entries[id] = s.order.PushFront(&lruEntry{id, n})
+	if s.order.Len() > s.capacity {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.entries, oldest.Value.(*lruEntry).id)
+	}
+}
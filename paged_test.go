@@ -0,0 +1,316 @@
+package rtreego
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// mapStore is a NodeStore keeping copies of the nodes in a map, as a store
+// encoding them to disk would, and counting the loads.
+type mapStore struct {
+	nodes map[int64]PageNode
+	loads int
+	fail  bool
+}
+
+func newMapStore() *mapStore {
+	return &mapStore{nodes: make(map[int64]PageNode)}
+}
+
+func (s *mapStore) Load(id int64) (*PageNode, error) {
+	if s.fail {
+		return nil, errors.New("load failed")
+	}
+	n, ok := s.nodes[id]
+	if !ok {
+		return nil, errors.New("no such node")
+	}
+	s.loads++
+	n.Entries = append([]PageEntry{}, n.Entries...)
+	return &n, nil
+}
+
+func (s *mapStore) Store(id int64, n *PageNode) error {
+	c := *n
+	c.Entries = append([]PageEntry{}, n.Entries...)
+	s.nodes[id] = c
+	return nil
+}
+
+func TestPagedRtree(t *testing.T) {
+	things := randomThings(1000, 2)
+	backing := newMapStore()
+	store := NewLRUStore(backing, 8)
+	pt, err := NewPagedTree(store, 2, 3, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, thing := range things {
+		if err := pt.Insert(thing); err != nil {
+			t.Fatalf("Insert(%v) returned %v", thing, err)
+		}
+	}
+	if pt.Size() != len(things) {
+		t.Errorf("Size() = %d, expected %d", pt.Size(), len(things))
+	}
+	if len(backing.nodes) <= 8 {
+		t.Fatalf("tree has %d nodes, expected more than fit into the cache", len(backing.nodes))
+	}
+	if lru := store.(*lruStore); lru.order.Len() > 8 || len(lru.entries) > 8 {
+		t.Errorf("LRU store holds %d nodes, expected at most 8", lru.order.Len())
+	}
+
+	rt := NewTree(2, 3, 6, things...)
+	loads := backing.loads
+	for i := 0; i < 100; i++ {
+		bb := mustRect(Point{rand.Float64() * 90, rand.Float64() * 90}, []float64{10, 10})
+		q, err := pt.SearchIntersect(bb)
+		if err != nil {
+			t.Fatalf("SearchIntersect(%v) returned %v", bb, err)
+		}
+		expected := rt.SearchIntersect(bb)
+		if len(q) != len(expected) {
+			t.Fatalf("SearchIntersect(%v) returned %d objects, expected %d", bb, len(q), len(expected))
+		}
+		ensureDisorderedSubset(t, q, expected)
+	}
+	if backing.loads == loads {
+		t.Errorf("queries did not load any evicted nodes")
+	}
+
+	all, _ := pt.SearchIntersect(mustRect(Point{-10, -10}, []float64{200, 200}), LimitFilter(5))
+	if len(all) != 5 {
+		t.Errorf("SearchIntersect with limit 5 returned %d objects", len(all))
+	}
+
+	if err := pt.Insert(&Rect{Point{0, 0, 0}, Point{1, 1, 1}}); err == nil {
+		t.Errorf("Insert of a three-dimensional object succeeded")
+	}
+
+	// the tree can be reopened from the backing store after dropping it and
+	// its cache, and grows from where it left off
+	reopened, err := OpenPagedTree(NewLRUStore(backing, 8))
+	if err != nil {
+		t.Fatalf("OpenPagedTree returned %v", err)
+	}
+	if reopened.Size() != pt.Size() || reopened.Depth() != pt.Depth() || reopened.Dim != 2 || reopened.MinChildren != 3 || reopened.MaxChildren != 6 {
+		t.Errorf("reopened tree has size %d, depth %d and dimensions %d, %d to %d, expected %d, %d and 2, 3 to 6",
+			reopened.Size(), reopened.Depth(), reopened.Dim, reopened.MinChildren, reopened.MaxChildren, pt.Size(), pt.Depth())
+	}
+	more := randomThings(100, 2)
+	for _, thing := range more {
+		if err := reopened.Insert(thing); err != nil {
+			t.Fatalf("Insert(%v) into the reopened tree returned %v", thing, err)
+		}
+	}
+	reopened, err = OpenPagedTree(backing)
+	if err != nil {
+		t.Fatalf("OpenPagedTree returned %v", err)
+	}
+	all, _ = reopened.SearchIntersect(mustRect(Point{-10, -10}, []float64{200, 200}))
+	expected := append(append([]Spatial{}, things...), more...)
+	if reopened.Size() != len(expected) || len(all) != len(expected) {
+		t.Fatalf("reopened tree has size %d and holds %d objects, expected %d", reopened.Size(), len(all), len(expected))
+	}
+	ensureDisorderedSubset(t, all, expected)
+
+	if _, err := OpenPagedTree(newMapStore()); err == nil {
+		t.Errorf("OpenPagedTree of an empty store succeeded")
+	}
+	empty := newMapStore()
+	empty.Store(0, &PageNode{Leaf: true})
+	if _, err := OpenPagedTree(empty); err == nil {
+		t.Errorf("OpenPagedTree of a store without a header succeeded")
+	}
+
+	// errors of the store are passed on once the cache misses
+	backing.fail = true
+	store = NewLRUStore(backing, 8)
+	pt.store = store
+	if _, err := pt.SearchIntersect(mustRect(Point{0, 0}, []float64{10, 10})); err == nil {
+		t.Errorf("SearchIntersect with a failing store succeeded")
+	}
+}
+
+// checkPaged verifies that the bounds of the entries of the node id are tight,
+// that the nodes below the root hold between MinChildren and MaxChildren
+// entries and that all leaves are at the depth of tree.  It returns the
+// number of objects stored below the node.
+func checkPaged(t *testing.T, tree *PagedRtree, id int64, depth int) int {
+	t.Helper()
+	n, err := tree.store.Load(id)
+	if err != nil {
+		t.Fatalf("Load(%d) returned %v", id, err)
+	}
+	if id != tree.root && (len(n.Entries) < tree.MinChildren || len(n.Entries) > tree.MaxChildren) {
+		t.Errorf("node at depth %d has %d entries, expected %d to %d", depth, len(n.Entries), tree.MinChildren, tree.MaxChildren)
+	}
+	if n.Leaf {
+		if depth != tree.Depth() {
+			t.Errorf("leaf at depth %d, expected %d", depth, tree.Depth())
+		}
+		return len(n.Entries)
+	}
+	objs := 0
+	for _, e := range n.Entries {
+		child, err := tree.store.Load(e.Child)
+		if err != nil {
+			t.Fatalf("Load(%d) returned %v", e.Child, err)
+		}
+		if bb := pageBounds(child); !e.Bounds.Equal(bb) {
+			t.Errorf("entry at depth %d has bounds %v, expected %v", depth, e.Bounds, bb)
+		}
+		objs += checkPaged(t, tree, e.Child, depth+1)
+	}
+	return objs
+}
+
+// samePagedStructure reports whether the node id of tree has the same entries
+// as n, in the same order, down to the objects.
+func samePagedStructure(t *testing.T, n *node, tree *PagedRtree, id int64) bool {
+	page, err := tree.store.Load(id)
+	if err != nil {
+		t.Fatalf("Load(%d) returned %v", id, err)
+	}
+	if n.leaf != page.Leaf || len(n.entries) != len(page.Entries) {
+		return false
+	}
+	for i, e := range n.entries {
+		pe := page.Entries[i]
+		if !e.bb.Equal(pe.Bounds) {
+			return false
+		}
+		if n.leaf {
+			if e.obj != pe.Obj {
+				return false
+			}
+		} else if !samePagedStructure(t, e.child, tree, pe.Child) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestPagedRtreeMatchesRtree(t *testing.T) {
+	// inserting the same objects builds the same tree as an Rtree with the
+	// default options, whose choices PagedRtree shares
+	things := randomThings(1000, 3)
+	rt := NewTree(2, 3, 6)
+	pt, err := NewPagedTree(newMapStore(), 2, 3, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, thing := range things {
+		rt.Insert(thing)
+		if err := pt.Insert(thing); err != nil {
+			t.Fatalf("Insert(%v) returned %v", thing, err)
+		}
+	}
+	if pt.Depth() != rt.Depth() || !samePagedStructure(t, rt.root, pt, pt.root) {
+		t.Errorf("PagedRtree of depth %d differs from the Rtree of depth %d built from the same objects", pt.Depth(), rt.Depth())
+	}
+}
+
+func TestPagedRtreeDelete(t *testing.T) {
+	things := randomThings(1000, 2)
+	backing := newMapStore()
+	pt, err := NewPagedTree(NewLRUStore(backing, 8), 2, 3, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, thing := range things {
+		pt.Insert(thing)
+	}
+
+	// deleting objects must condense the tree along the remembered path
+	for _, thing := range things[:700] {
+		if ok, err := pt.Delete(thing); !ok || err != nil {
+			t.Fatalf("Delete(%v) = %v, %v", thing, ok, err)
+		}
+	}
+	if ok, err := pt.Delete(things[0]); ok || err != nil {
+		t.Errorf("Delete of a deleted object = %v, %v", ok, err)
+	}
+	if ok, _ := pt.Delete(&Rect{Point{0, 0, 0}, Point{1, 1, 1}}); ok {
+		t.Errorf("Delete of a three-dimensional object succeeded")
+	}
+	if pt.Size() != 300 {
+		t.Errorf("Size() = %d after deletes, expected 300", pt.Size())
+	}
+	if objs := checkPaged(t, pt, pt.root, 1); objs != 300 {
+		t.Errorf("tree stores %d objects after deletes, expected 300", objs)
+	}
+
+	rt := NewTree(2, 3, 6, things[700:]...)
+	for i := 0; i < 50; i++ {
+		bb := mustRect(Point{rand.Float64() * 90, rand.Float64() * 90}, []float64{10, 10})
+		q, err := pt.SearchIntersect(bb)
+		if err != nil {
+			t.Fatalf("SearchIntersect(%v) returned %v", bb, err)
+		}
+		expected := rt.SearchIntersect(bb)
+		if len(q) != len(expected) {
+			t.Fatalf("SearchIntersect(%v) returned %d objects, expected %d", bb, len(q), len(expected))
+		}
+		ensureDisorderedSubset(t, q, expected)
+	}
+
+	// the deletes are recorded in the header
+	reopened, err := OpenPagedTree(backing)
+	if err != nil {
+		t.Fatalf("OpenPagedTree returned %v", err)
+	}
+	if reopened.Size() != 300 || reopened.Depth() != pt.Depth() {
+		t.Errorf("reopened tree has size %d and depth %d, expected 300 and %d", reopened.Size(), reopened.Depth(), pt.Depth())
+	}
+
+	for _, thing := range things[700:] {
+		pt.Delete(thing)
+	}
+	if all, _ := pt.SearchIntersect(mustRect(Point{-10, -10}, []float64{200, 200})); pt.Size() != 0 || pt.Depth() != 1 || len(all) != 0 {
+		t.Errorf("Size() = %d, Depth() = %d after deleting everything, expected an empty leaf", pt.Size(), pt.Depth())
+	}
+
+	// the emptied tree can be filled again
+	for _, thing := range things[:100] {
+		pt.Insert(thing)
+	}
+	if objs := checkPaged(t, pt, pt.root, 1); objs != 100 {
+		t.Errorf("refilled tree stores %d objects, expected 100", objs)
+	}
+
+	backing.fail = true
+	pt.store = backing
+	if _, err := pt.Delete(things[0]); err == nil {
+		t.Errorf("Delete with a failing store succeeded")
+	}
+}
+
+func TestPagedRtreeDeleteEqualer(t *testing.T) {
+	var things []Spatial
+	pt, err := NewPagedTree(newMapStore(), 2, 3, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, thing := range randomThings(200, 2) {
+		obj := &labeled{thing.Bounds(), fmt.Sprint(i)}
+		things = append(things, obj)
+		pt.Insert(obj)
+	}
+	for _, thing := range things[:100] {
+		stored := thing.(*labeled)
+		if ok, err := pt.Delete(&labeled{stored.bb, stored.label}); !ok || err != nil {
+			t.Fatalf("Delete of an equal copy of %v = %v, %v", stored, ok, err)
+		}
+	}
+	if ok, _ := pt.Delete(&labeled{things[150].(*labeled).bb, "other"}); ok {
+		t.Errorf("Delete of an object with different content succeeded")
+	}
+	if objs := checkPaged(t, pt, pt.root, 1); objs != 100 || pt.Size() != 100 {
+		t.Errorf("tree stores %d objects and has size %d, expected 100", objs, pt.Size())
+	}
+	all, _ := pt.SearchIntersect(mustRect(Point{-10, -10}, []float64{200, 200}))
+	ensureDisorderedSubset(t, all, things[100:])
+}
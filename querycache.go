@@ -0,0 +1,146 @@
+// Copyright 2012 Daniel Connelly.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rtreego
+
+import (
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sync"
+)
+
+// queryCache is an LRU cache of the candidates for queries of SearchIntersect
+// by query box rounded outwards to multiples of quantum, see
+// EnableQueryCache.
+type queryCache struct {
+	capacity int
+	quantum  float64
+
+	mu      sync.Mutex // guards the fields below, for concurrent queries
+	order   *list.List // of *queryCacheEntry, most recently used first
+	entries map[string]*list.Element
+
+	// counted for tests
+	hits, misses int
+}
+
+type queryCacheEntry struct {
+	key        string
+	candidates []entry
+}
+
+// EnableQueryCache makes SearchIntersect keep the results of the last size
+// distinct queries, for applications issuing almost the same queries over
+// and over, such as the viewports of a map.  The cache is keyed by the query
+// rectangle rounded outwards to multiples of quantum: a query looks up the
+// objects intersecting the rounded rectangle in the cache, or in the tree if
+// they are not cached, and returns those intersecting the query rectangle
+// itself.  Thus cached queries return the same objects as uncached ones.
+// The cache is cleared whenever the tree is modified.  A size of 0 disables
+// the cache.  EnableQueryCache panics if quantum is not positive.
+//
+// Querying a tree with a cache modifies the cache, which is locked so that
+// the tree may still be queried concurrently, e.g. the versions of a
+// SharedRtree.
+func (tree *Rtree) EnableQueryCache(size int, quantum float64) {
+	if size <= 0 {
+		tree.queryCache = nil
+		return
+	}
+	if !(quantum > 0) {
+		panic(fmt.Sprintf("rtreego: query cache quantum %v is not positive", quantum))
+	}
+	tree.queryCache = &queryCache{
+		capacity: size,
+		quantum:  quantum,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// invalidateQueryCache clears the query cache after the tree was modified.
+func (tree *Rtree) invalidateQueryCache() {
+	if c := tree.queryCache; c != nil {
+		c.mu.Lock()
+		if c.order.Len() > 0 {
+			c.order.Init()
+			c.entries = make(map[string]*list.Element)
+		}
+		c.mu.Unlock()
+	}
+}
+
+// searchIntersectCached is SearchIntersect for trees with a query cache.  The
+// nodes visited on a cache miss are counted in q.
+func (tree *Rtree) searchIntersectCached(bb Rect, filters []Filter, q *slowQuery) []Spatial {
+	c := tree.queryCache
+	rounded, key := c.round(bb)
+	var candidates []entry
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		c.hits++
+		c.order.MoveToFront(el)
+		candidates = el.Value.(*queryCacheEntry).candidates
+	} else {
+		c.misses++
+		candidates = tree.root.appendIntersecting(nil, rounded, q)
+		c.entries[key] = c.order.PushFront(&queryCacheEntry{key, candidates})
+		if c.order.Len() > c.capacity {
+			oldest := c.order.Back()
+			c.order.Remove(oldest)
+			delete(c.entries, oldest.Value.(*queryCacheEntry).key)
+		}
+	}
+	c.mu.Unlock()
+
+	results := []Spatial{}
+	for _, e := range candidates {
+		if !intersect(bb, e.bb) {
+			continue
+		}
+		refuse, abort := applyFilters(results, e.obj, filters)
+		if !refuse {
+			results = append(results, e.obj)
+		}
+		if abort {
+			break
+		}
+	}
+	return results
+}
+
+// round returns bb rounded outwards to multiples of the quantum and the key
+// of the rounded rectangle in the cache, which holds the bits of its
+// coordinates, so that distinct rounded rectangles have distinct keys.
+func (c *queryCache) round(bb Rect) (Rect, string) {
+	rounded := Rect{make(Point, len(bb.p)), make(Point, len(bb.q))}
+	buf := make([]byte, 2*8*len(bb.p))
+	for i := range bb.p {
+		// guard against rounding errors of the multiplication
+		rounded.p[i] = math.Min(math.Floor(bb.p[i]/c.quantum)*c.quantum, bb.p[i])
+		rounded.q[i] = math.Max(math.Ceil(bb.q[i]/c.quantum)*c.quantum, bb.q[i])
+		binary.LittleEndian.PutUint64(buf[16*i:], math.Float64bits(rounded.p[i]))
+		binary.LittleEndian.PutUint64(buf[16*i+8:], math.Float64bits(rounded.q[i]))
+	}
+	return rounded, string(buf)
+}
+
+// appendIntersecting appends the leaf entries below n intersecting bb to
+// entries, counting the nodes visited in q.
+func (n *node) appendIntersecting(entries []entry, bb Rect, q *slowQuery) []entry {
+	q.visit()
+	for _, e := range n.entries {
+		if !intersect(bb, e.bb) {
+			continue
+		}
+		if n.leaf {
+			entries = append(entries, e)
+		} else {
+			entries = e.child.appendIntersecting(entries, bb, q)
+		}
+	}
+	return entries
+}
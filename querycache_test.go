@@ -0,0 +1,96 @@
+package rtreego
+
+import "testing"
+
+func TestQueryCache(t *testing.T) {
+	things := randomThings(500, 2)
+	for _, tc := range tests(2, 3, 6, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+			fresh := tc.build()
+			rt.EnableQueryCache(4, 10)
+			c := rt.queryCache
+
+			// nearly identical viewports share the rounded box [10, 40]x[20, 50]
+			for _, bb := range []Rect{
+				mustRect(Point{12, 21}, []float64{25, 25}),
+				mustRect(Point{12.5, 21}, []float64{25, 25}),
+				mustRect(Point{11, 22}, []float64{26, 27}),
+			} {
+				q := rt.SearchIntersect(bb)
+				expected := fresh.SearchIntersect(bb)
+				if len(q) != len(expected) {
+					t.Fatalf("SearchIntersect(%v) returned %d objects, expected %d", bb, len(q), len(expected))
+				}
+				ensureDisorderedSubset(t, q, expected)
+			}
+			if c.misses != 1 || c.hits != 2 {
+				t.Errorf("cache had %d hits and %d misses, expected 2 and 1", c.hits, c.misses)
+			}
+			bb := mustRect(Point{12, 21}, []float64{25, 25})
+			if q := rt.SearchIntersect(bb, LimitFilter(3)); len(q) != 3 {
+				t.Errorf("cached SearchIntersect with limit 3 returned %d objects", len(q))
+			}
+
+			// only the most recent rounded boxes are kept
+			for i := 0; i < 4; i++ {
+				rt.SearchIntersect(mustRect(Point{float64(20 * i), 70}, []float64{5, 5}))
+			}
+			if c.order.Len() != 4 || len(c.entries) != 4 {
+				t.Errorf("cache holds %d queries, expected 4", c.order.Len())
+			}
+			hits := c.hits
+			rt.SearchIntersect(bb)
+			if c.hits != hits {
+				t.Errorf("evicted query was answered from the cache")
+			}
+
+			// inserting invalidates the cache
+			added := &Rect{Point{20, 30}, Point{21, 31}}
+			if err := rt.TryInsert(added); err != nil {
+				t.Fatal(err)
+			}
+			hits = c.hits
+			q := rt.SearchIntersect(bb)
+			if c.hits != hits {
+				t.Errorf("query after Insert was answered from the cache")
+			}
+			if !contains(added, q) {
+				t.Errorf("SearchIntersect did not return the object inserted after caching")
+			}
+			if len(q) != len(fresh.SearchIntersect(bb))+1 {
+				t.Errorf("SearchIntersect returned %d objects after Insert", len(q))
+			}
+
+			rt.Delete(added)
+			if q := rt.SearchIntersect(bb); contains(added, q) {
+				t.Errorf("SearchIntersect returned the object deleted after caching")
+			}
+		})
+	}
+}
+
+func TestQueryCacheLargeCoordinates(t *testing.T) {
+	// the rounded coordinates overflow an int64 when divided by the quantum
+	a := &Rect{Point{1e10, 1e10}, Point{1e10 + 1, 1e10 + 1}}
+	b := &Rect{Point{2e10, 2e10}, Point{2e10 + 1, 2e10 + 1}}
+	rt := NewTree(2, 3, 6, a, b)
+	rt.EnableQueryCache(4, 1e-9)
+	for _, obj := range []*Rect{a, b} {
+		bb := mustRect(Point{obj.p[0] - 0.5, obj.p[1] - 0.5}, []float64{1, 1})
+		if q := rt.SearchIntersect(bb); len(q) != 1 || q[0] != obj {
+			t.Errorf("SearchIntersect(%v) = %v, expected %v", bb, q, obj)
+		}
+	}
+
+	for _, quantum := range []float64{0, -1} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("EnableQueryCache with quantum %v failed to panic", quantum)
+				}
+			}()
+			rt.EnableQueryCache(4, quantum)
+		}()
+	}
+}
@@ -6,32 +6,275 @@
 package rtreego
 
 import (
+	"container/heap"
+	"errors"
 	"fmt"
+	"io"
 	"math"
+	"math/rand"
+	"reflect"
 	"sort"
+	"time"
 )
 
+// ErrDuplicate is returned by TryInsert in RejectDuplicates mode when the object
+// is already stored in the tree.
+var ErrDuplicate = errors.New("rtreego: object is already in the tree")
+
+// ErrOutlier is returned by TryInsert when the object is rejected by the handler
+// registered with SetOutlierHandler.
+var ErrOutlier = errors.New("rtreego: object rejected as outlier")
+
 // Comparator compares two spatials and returns whether they are equal.
 type Comparator func(obj1, obj2 Spatial) (equal bool)
 
+// Equaler is implemented by objects that are compared by content rather than
+// by identity.  Equal reports whether the object is equal to other.
+type Equaler interface {
+	Equal(other Spatial) bool
+}
+
+// defaultComparator compares the stored object obj1 with obj2 using the Equal
+// method of obj1 if it implements Equaler, and by identity otherwise.
 func defaultComparator(obj1, obj2 Spatial) bool {
+	if eq, ok := obj1.(Equaler); ok {
+		return eq.Equal(obj2)
+	}
 	return obj1 == obj2
 }
 
 // Rtree represents an R-tree, a balanced search tree for storing and querying
 // spatial objects.  Dim specifies the number of spatial dimensions and
 // MinChildren/MaxChildren specify the minimum/maximum branching factors.
+//
+// If StrictInsert is set, Insert and TryInsert validate the bounds of every
+// object before adding it and reject objects with NaN or infinite
+// coordinates, which would otherwise silently corrupt the tree.
+//
+// If RejectDuplicates is set, Insert and TryInsert do not store an object that
+// is already in the tree, for which TryInsert returns ErrDuplicate.  Storing
+// the same object twice leaves two references to it, only one of which is
+// removed by Delete.
+//
+// If SoftMaxChildren is larger than MaxChildren, leaves may hold up to
+// SoftMaxChildren entries before they are split.  This reduces the number of
+// splits during bursts of inserts; Compact splits the oversized leaves later.
+//
+// If BalancedSplit is set, overflowing nodes are split into two groups of
+// (nearly) equal size instead of stopping only when one group would drop
+// below MinChildren, as long as the overlap of the two groups is nearly the
+// same as with the classic split: it may exceed the overlap of the classic
+// split by at most 1% of the volume of the node.  This avoids lopsided
+// splits on clustered data without adding significant overlap.
+//
+// Cost selects the measure of bounding boxes that insertion and splitting
+// try to minimize, see CostMetric.
+//
+// EnlargementEpsilon is the difference in cost up to which Insert considers
+// the enlargements of two subtrees tied when choosing where to add an object,
+// in which case the smaller subtree is chosen.  It is relative to the larger
+// of the costs of the two enlarged subtrees, so that it does not depend on
+// the scale of the coordinates.  Without it, rounding errors make exact ties
+// rare and the choice between nearly equal subtrees arbitrary.  NewTree sets
+// it to DefaultEnlargementEpsilon.
+//
+// If NormalizeAxes is set, the insertion and split heuristics compute costs
+// after scaling every axis by the extent of the tree along it, so that an axis
+// with a larger coordinate range (e.g. longitude versus latitude) does not
+// dominate.  The extent is computed once and only updated when an object
+// beyond it is inserted, so it is not shrunk by deletions.  Since scaling the
+// axes scales all areas by the same factor, normalizing cannot change any
+// decision made under CostArea, so NormalizeAxes requires Cost to be
+// CostMargin: inserting into a tree with NormalizeAxes set under CostArea
+// panics rather than silently ignoring the setting.
 type Rtree struct {
-	Dim         int
-	MinChildren int
-	MaxChildren int
-	root        *node
-	size        int
-	height      int
+	Dim              int
+	MinChildren      int
+	MaxChildren      int
+	SoftMaxChildren  int
+	StrictInsert     bool
+	RejectDuplicates bool
+	BalancedSplit    bool
+	Cost             CostMetric
+	NormalizeAxes    bool
+
+	EnlargementEpsilon float64
+
+	root   *node
+	size   int
+	height int
 
 	// deleted is a temporary buffer to avoid memory allocations in Delete.
 	// It is just an optimization and not part of the data structure.
 	deleted []*node
+
+	// hooks registered with OnInsert and OnDelete
+	insertHooks []func(Spatial)
+	deleteHooks []func(Spatial)
+
+	// grids are the grids attached with AttachGrid, which are not copied
+	// to clones
+	grids []*Grid
+
+	// outlierHandler is called for inserts enlarging the root, see
+	// SetOutlierHandler
+	outlierHandler func(obj Spatial, enlargement float64) bool
+
+	// slowQueryLog is called for searches taking longer than
+	// slowQueryThreshold, see SetSlowQueryLog
+	slowQueryThreshold time.Duration
+	slowQueryLog       func(nodesVisited int, d time.Duration)
+
+	// debug enables validation after every mutation, see SetDebug
+	debug bool
+
+	// autoOptimize is the number of mutations after which the tree is
+	// optimized, see SetAutoOptimize; mutations counts the mutations since
+	// the last optimization.
+	autoOptimize int
+	mutations    int
+
+	// sorted is set if the entries of every node are sorted by the minimum
+	// coordinate of their bounding boxes on sortAxis, see Optimize.
+	sorted bool
+
+	// sortLeaves is set if the entries of every leaf are kept sorted by the
+	// minimum coordinate of their bounding boxes on leafSortAxis, see
+	// SetLeafSortAxis.
+	sortLeaves   bool
+	leafSortAxis int
+
+	// balanceMode is set with SetBalanceMode; in BalanceLazy mode, dirty
+	// holds the nodes below which objects have been deleted since the tree
+	// was last condensed.
+	balanceMode BalanceMode
+	dirty       map[*node]bool
+
+	// queryCache caches the results of SearchIntersect, see
+	// EnableQueryCache
+	queryCache *queryCache
+
+	// preferEpsilon is the distance within which NearestNeighborPreferring
+	// considers objects equally near, see SetPreferEpsilon
+	preferEpsilon float64
+
+	// timeHorizon is the end of the time window over which Moving objects
+	// are stored, see SetTimeHorizon; maxSpeed is the largest speed of any
+	// object inserted along every axis, or nil if none was Moving.
+	timeHorizon float64
+	maxSpeed    []float64
+
+	// rng is the source of randomness of Sample, see SetSeed, or nil to use
+	// the default source of math/rand
+	rng *rand.Rand
+
+	// chooseSubtree is the insertion policy set with SetChooseSubtree, or
+	// nil for LeastEnlargement
+	chooseSubtree ChooseSubtree
+
+	// coerce is set if objects of lower dimension are extended to the
+	// dimension of the tree with coerceValue, see SetCoerceDimensions
+	coerce      bool
+	coerceValue float64
+
+	// normCost is the cost function of NormalizeAxes for the metric
+	// normMetric and the extent normExtent of the objects in the tree, or
+	// nil if it has not been computed since the tree was rebuilt, see cost
+	normCost   func(Rect) float64
+	normMetric CostMetric
+	normExtent Rect
+
+	// owned is nil unless tree is a version of a SharedRtree, in which case
+	// the nodes not in owned may be shared with other versions and are
+	// copied before they are modified, see own
+	owned map[*node]bool
+}
+
+// DefaultEnlargementEpsilon is the EnlargementEpsilon of trees returned by
+// NewTree.
+const DefaultEnlargementEpsilon = 1e-9
+
+// CostMetric is a measure of bounding boxes used by the insertion and split
+// heuristics of an Rtree.
+type CostMetric int
+
+const (
+	// CostArea minimizes the area (volume) of bounding boxes.  This is the
+	// default and works best for roughly square objects.  Since the area
+	// does not depend on the relative scale of the axes, it cannot be
+	// combined with NormalizeAxes.
+	CostArea CostMetric = iota
+
+	// CostMargin minimizes the margin (perimeter) of bounding boxes, which
+	// favors square nodes and works better for long, skinny objects.
+	CostMargin
+)
+
+// BalanceMode determines when an Rtree is condensed after deletions, see
+// SetBalanceMode.
+type BalanceMode int
+
+const (
+	// BalanceEager condenses the tree on every Delete.  This is the default.
+	BalanceEager BalanceMode = iota
+
+	// BalanceLazy defers condensing the tree until the next insert or
+	// query, or a call of Compact.
+	BalanceLazy
+)
+
+// measure returns the function computing the cost of a bounding box.
+func (c CostMetric) measure() func(Rect) float64 {
+	if c == CostMargin {
+		return Rect.margin
+	}
+	return Rect.Size
+}
+
+// normalized returns the function computing the cost of a bounding box after
+// scaling every axis by the inverse of the extent of bb along it.  Axes along
+// which bb is degenerate are not scaled.
+func (c CostMetric) normalized(bb Rect) func(Rect) float64 {
+	scale := make([]float64, len(bb.p))
+	for i := range scale {
+		scale[i] = 1
+		if d := bb.q[i] - bb.p[i]; d > 0 {
+			scale[i] = 1 / d
+		}
+	}
+	if c == CostMargin {
+		return func(r Rect) float64 {
+			sum := 0.0
+			for i, a := range r.p {
+				sum += (r.q[i] - a) * scale[i]
+			}
+			return math.Pow(2, float64(len(r.p)-1)) * sum
+		}
+	}
+	return func(r Rect) float64 {
+		size := 1.0
+		for i, a := range r.p {
+			size *= (r.q[i] - a) * scale[i]
+		}
+		return size
+	}
+}
+
+// cost returns the function computing the cost of a bounding box for the
+// insertion and split heuristics.
+func (tree *Rtree) cost() func(Rect) float64 {
+	if tree.NormalizeAxes && tree.Cost != CostMargin {
+		panic("rtreego: NormalizeAxes has no effect unless Cost is CostMargin")
+	}
+	if !tree.NormalizeAxes || len(tree.root.entries) == 0 {
+		return tree.Cost.measure()
+	}
+	if tree.normCost == nil || tree.normMetric != tree.Cost {
+		tree.normExtent = tree.root.computeBoundingBox()
+		tree.normMetric = tree.Cost
+		tree.normCost = tree.Cost.normalized(tree.normExtent)
+	}
+	return tree.normCost
 }
 
 // NewTree returns an Rtree. If the number of objects given on initialization
@@ -39,12 +282,13 @@ type Rtree struct {
 // Minimizing Top-down bulk-loading algorithm.
 func NewTree(dim, min, max int, objs ...Spatial) *Rtree {
 	rt := &Rtree{
-		Dim:         dim,
-		MinChildren: min,
-		MaxChildren: max,
-		height:      1,
+		Dim:                dim,
+		MinChildren:        min,
+		MaxChildren:        max,
+		EnlargementEpsilon: DefaultEnlargementEpsilon,
+		height:             1,
 		root: &node{
-			entries: []entry{},
+			entries: make([]entry, 0, max+1),
 			leaf:    true,
 			level:   1,
 		},
@@ -61,6 +305,26 @@ func NewTree(dim, min, max int, objs ...Spatial) *Rtree {
 	return rt
 }
 
+// NewTreeInferred returns an Rtree storing first, whose dimension is the
+// dimension of the bounds of first.  Later inserts of objects with another
+// dimension return a DimError, as for a tree created with NewTree.
+func NewTreeInferred(min, max int, first Spatial) *Rtree {
+	return NewTree(len(first.Bounds().p), min, max, first)
+}
+
+// NewTreeFromRects returns an Rtree bulk-loaded with one object per
+// rectangle, for callers that store their data elsewhere and only need an
+// index of its bounds.  The returned handles are *Item values whose Data is
+// the index of the rectangle in rects; handles[i] is the object stored for
+// rects[i] and can be passed to Delete.
+func NewTreeFromRects(dim, min, max int, rects []Rect) (*Rtree, []Spatial) {
+	handles := make([]Spatial, len(rects))
+	for i, r := range rects {
+		handles[i] = NewItem(r, i)
+	}
+	return NewTree(dim, min, max, handles...), handles
+}
+
 // Size returns the number of objects currently stored in tree.
 func (tree *Rtree) Size() int {
 	return tree.size
@@ -75,6 +339,311 @@ func (tree *Rtree) Depth() int {
 	return tree.height
 }
 
+// SetDebug enables or disables debug mode.  In debug mode, the tree is
+// validated after every Insert and Delete and a violated invariant causes a
+// panic with the error returned by Validate.  Debug mode is off by default.
+func (tree *Rtree) SetDebug(on bool) {
+	tree.debug = on
+}
+
+// mutated is called after every successful Insert and Delete.  It optimizes
+// the tree if enough mutations have been made and validates the tree if debug
+// mode is enabled.
+func (tree *Rtree) mutated() {
+	tree.invalidateQueryCache()
+	if tree.autoOptimize > 0 {
+		tree.mutations++
+		if tree.mutations >= tree.autoOptimize {
+			tree.Optimize()
+		}
+	}
+	if tree.debug {
+		if err := tree.Validate(); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// Optimize rebuilds tree from scratch using the same bulk-loading algorithm
+// as NewTree.  The rebuilt tree stores the same objects but usually has much
+// less overlap between nodes than a tree built by many inserts and deletes,
+// which makes queries faster.
+//
+// The entries of every node are also sorted along the first axis, or along
+// the axis set with SetLeafSortAxis, which lets SearchIntersect skip the
+// remaining entries of a node once they start past the query rectangle.  The
+// order is kept until the tree is modified.
+func (tree *Rtree) Optimize() {
+	tree.dirty = nil
+	tree.bulkLoadEntries(tree.root.appendObjects(nil))
+	tree.root.sortByAxis(tree.sortAxis(), false)
+	tree.sorted = true
+	tree.mutations = 0
+}
+
+// OptimizeRegion rebuilds the part of the tree holding the objects in bb with
+// the bulk-loading algorithm, for maintaining a large tree in which only one
+// region has been churned by inserts and deletes, without the disruption of
+// rebuilding everything with Optimize.  Starting at the root, the tree is
+// descended as long as a single child intersects bb.  The children of the
+// node reached that intersect bb are then replaced by subtrees bulk-loaded
+// from their objects, at the same level, and the rest of the tree is left
+// as it is.
+func (tree *Rtree) OptimizeRegion(bb Rect) {
+	if len(bb.p) != tree.Dim {
+		panic(DimError{tree.Dim, len(bb.p)})
+	}
+	tree.condenseDirty()
+	tree.ownAll()
+
+	n := tree.root
+	var region, rest []entry
+	for !n.leaf {
+		region, rest = nil, nil
+		for _, e := range n.entries {
+			if intersect(bb, e.bb) {
+				region = append(region, e)
+			} else {
+				rest = append(rest, e)
+			}
+		}
+		if len(region) != 1 || region[0].child.leaf {
+			break
+		}
+		n = region[0].child
+	}
+	if n.leaf || len(region) == 0 {
+		return
+	}
+
+	var objs []entry
+	for _, e := range region {
+		objs = e.child.appendObjects(objs)
+	}
+	rebuilt := tree.omtRoot(n.level, objs)
+	n.entries = append(rest, rebuilt.entries...)
+	for _, e := range rebuilt.entries {
+		e.child.parent = n
+		if tree.sortLeaves {
+			e.child.sortByAxis(tree.leafSortAxis, true)
+		}
+	}
+	tree.sorted = false
+	tree.invalidateQueryCache()
+
+	// Every child holds at most MaxChildren^(n.level-1) objects, so there
+	// are no more rebuilt children than replaced ones, unless leaves were
+	// allowed to grow beyond MaxChildren by SoftMaxChildren.
+	if err := tree.rebalance(n, tree.MaxChildren); err != nil {
+		panic(err)
+	}
+}
+
+// AutoTune chooses the value of MaxChildren for which the sample queries are
+// cheapest and rebuilds tree with it using the bulk-loading algorithm.  The
+// candidates are the current value and the powers of two from 4 to 256, and
+// MinChildren is scaled in proportion.  The cost of a query is the number of
+// entries SearchIntersect examines, i.e. the sum of the sizes of the nodes it
+// visits, which unlike timings does not depend on the machine.  If no
+// rebuilt tree is cheaper than tree as it is, tree is left unchanged.  The
+// chosen value of MaxChildren is returned.
+func (tree *Rtree) AutoTune(samples []Rect) int {
+	for _, bb := range samples {
+		if len(bb.p) != tree.Dim {
+			panic(DimError{tree.Dim, len(bb.p)})
+		}
+	}
+	tree.condenseDirty()
+	tree.ownAll()
+
+	root, height, sorted := tree.root, tree.height, tree.sorted
+	min, max := tree.MinChildren, tree.MaxChildren
+	best, bestCost := max, tree.queryCost(samples)
+	entries := root.appendObjects(nil)
+
+	candidates := []int{max}
+	for m := 4; m <= 256; m *= 2 {
+		if m != max {
+			candidates = append(candidates, m)
+		}
+	}
+	for _, m := range candidates {
+		tree.MaxChildren = m
+		tree.MinChildren = min * m / max
+		if tree.MinChildren < 1 {
+			tree.MinChildren = 1
+		}
+		tree.bulkLoadEntries(append([]entry{}, entries...))
+		if cost := tree.queryCost(samples); cost < bestCost {
+			best, bestCost = m, cost
+			root, height, sorted = tree.root, tree.height, tree.sorted
+		}
+	}
+
+	tree.MaxChildren = best
+	tree.MinChildren = min * best / max
+	if tree.MinChildren < 1 {
+		tree.MinChildren = 1
+	}
+	tree.root, tree.height, tree.sorted = root, height, sorted
+	return best
+}
+
+// queryCost returns the number of entries examined by SearchIntersect for
+// all of the specified rectangles.
+func (tree *Rtree) queryCost(samples []Rect) int {
+	cost := 0
+	for _, bb := range samples {
+		cost += tree.root.queryCost(bb)
+	}
+	return cost
+}
+
+func (n *node) queryCost(bb Rect) int {
+	cost := len(n.entries)
+	if n.leaf {
+		return cost
+	}
+	for _, e := range n.entries {
+		if intersect(bb, e.bb) {
+			cost += e.child.queryCost(bb)
+		}
+	}
+	return cost
+}
+
+// sortAxis returns the axis along which Optimize sorts the entries of nodes.
+func (tree *Rtree) sortAxis() int {
+	if tree.sortLeaves {
+		return tree.leafSortAxis
+	}
+	return 0
+}
+
+// sortByAxis sorts the entries of n and its descendants by the minimum
+// coordinate of their bounding boxes on the specified axis.  If leavesOnly is
+// set, the entries of internal nodes are left in place.
+func (n *node) sortByAxis(axis int, leavesOnly bool) {
+	if n.leaf || !leavesOnly {
+		sort.SliceStable(n.entries, func(i, j int) bool {
+			return n.entries[i].bb.p[axis] < n.entries[j].bb.p[axis]
+		})
+	}
+	if n.leaf {
+		return
+	}
+	for _, e := range n.entries {
+		e.child.sortByAxis(axis, leavesOnly)
+	}
+}
+
+// SetLeafSortAxis keeps the objects within every leaf of tree sorted by the
+// minimum coordinate of their bounding boxes on the specified axis.  Inserts
+// and splits then maintain the order, and SearchAxisRange uses it to
+// binary-search the leaves instead of scanning all of their objects.  A
+// negative axis disables sorting, which is the default.  It panics with a
+// DimError if axis is not smaller than the dimension of tree.
+func (tree *Rtree) SetLeafSortAxis(axis int) {
+	if axis >= tree.Dim {
+		panic(DimError{tree.Dim, axis})
+	}
+	tree.sortLeaves = axis >= 0
+	tree.leafSortAxis = axis
+	tree.sorted = false
+	if tree.sortLeaves {
+		tree.ownAll()
+		tree.root.sortByAxis(axis, true)
+	}
+}
+
+// insertSorted inserts e into the leaf n after the entries whose bounding
+// boxes start at or before e on the specified axis.
+func (n *node) insertSorted(e entry, axis int) {
+	i := sort.Search(len(n.entries), func(i int) bool {
+		return n.entries[i].bb.p[axis] > e.bb.p[axis]
+	})
+	n.entries = append(n.entries, entry{})
+	copy(n.entries[i+1:], n.entries[i:])
+	n.entries[i] = e
+}
+
+// SetAutoOptimize makes tree call Optimize automatically once everyMutations
+// objects have been inserted or deleted since the last optimization.  Setting
+// everyMutations to 0 disables automatic optimization, which is the default.
+func (tree *Rtree) SetAutoOptimize(everyMutations int) {
+	tree.autoOptimize = everyMutations
+	tree.mutations = 0
+}
+
+// SetSeed makes the random choices of tree, i.e. those of Sample, use a
+// source seeded with seed, so that they are reproducible.  Building the tree
+// never uses randomness: Insert, Delete and the bulk-loading algorithm
+// produce the same tree from the same sequence of operations.  A seeded tree
+// must not be sampled concurrently, and a Clone shares the source of tree.
+func (tree *Rtree) SetSeed(seed int64) {
+	tree.rng = rand.New(rand.NewSource(seed))
+}
+
+// Validate checks the structural invariants of tree and returns an error
+// describing the first violation found, or nil if the tree is consistent.
+// It verifies that all leaves are at the same depth, that no node has more
+// than MaxChildren entries, that parent pointers are correct unless tree is a
+// version of a SharedRtree, that every entry's bounding box contains its
+// child and that Size matches the number of stored objects.
+func (tree *Rtree) Validate() error {
+	if tree.root.level != tree.height {
+		return fmt.Errorf("rtreego: root level %d differs from height %d", tree.root.level, tree.height)
+	}
+	count, err := tree.validate(tree.root)
+	if err != nil {
+		return err
+	}
+	if count != tree.size {
+		return fmt.Errorf("rtreego: tree contains %d objects but size is %d", count, tree.size)
+	}
+	return nil
+}
+
+// validate checks the subtree rooted at n and returns its number of objects.
+func (tree *Rtree) validate(n *node) (int, error) {
+	if max := tree.capacity(n); len(n.entries) > max {
+		return 0, fmt.Errorf("rtreego: node at level %d has %d entries (max: %d)", n.level, len(n.entries), max)
+	}
+	if n.leaf {
+		if n.level != 1 {
+			return 0, fmt.Errorf("rtreego: leaf node at level %d", n.level)
+		}
+		for _, e := range n.entries {
+			if e.obj == nil || e.child != nil {
+				return 0, fmt.Errorf("rtreego: leaf entry %v does not hold an object", e)
+			}
+		}
+		return len(n.entries), nil
+	}
+
+	count := 0
+	for _, e := range n.entries {
+		if e.child == nil {
+			return 0, fmt.Errorf("rtreego: non-leaf entry at level %d has no child", n.level)
+		}
+		if e.child.level != n.level-1 {
+			return 0, fmt.Errorf("rtreego: child of node at level %d is at level %d", n.level, e.child.level)
+		}
+		if e.child.parent != n && tree.owned == nil {
+			return 0, fmt.Errorf("rtreego: wrong parent pointer at level %d", e.child.level)
+		}
+		if len(e.child.entries) > 0 && !e.bb.containsRect(e.child.computeBoundingBox()) {
+			return 0, fmt.Errorf("rtreego: entry bounding box %v does not contain its child at level %d", e.bb, e.child.level)
+		}
+		c, err := tree.validate(e.child)
+		if err != nil {
+			return 0, err
+		}
+		count += c
+	}
+	return count, nil
+}
+
 type dimSorter struct {
 	dim  int
 	objs []entry
@@ -110,15 +679,38 @@ func sortByDim(dim int, objs []entry) {
 // bulkLoad bulk loads the Rtree using OMT algorithm. bulkLoad contains special
 // handling for the root node.
 func (tree *Rtree) bulkLoad(objs []Spatial) {
-	n := len(objs)
-
 	// create entries for all the objects
-	entries := make([]entry, n)
+	entries := make([]entry, len(objs))
 	for i := range objs {
 		entries[i] = entry{
-			bb:  objs[i].Bounds(),
+			bb:  tree.bounds(objs[i]),
 			obj: objs[i],
 		}
+		tree.trackVelocity(objs[i])
+	}
+	tree.bulkLoadEntries(entries)
+}
+
+// bulkLoadEntries replaces the contents of the tree with the given leaf
+// entries using the OMT algorithm.  The order of entries is modified.
+func (tree *Rtree) bulkLoadEntries(entries []entry) {
+	tree.sorted = false
+	tree.owned = nil
+	tree.normCost = nil
+	tree.invalidateQueryCache()
+	n := len(entries)
+	if n <= tree.MaxChildren {
+		tree.height = 1
+		tree.size = n
+		tree.root = &node{
+			entries: append([]entry{}, entries...),
+			leaf:    true,
+			level:   1,
+		}
+		if tree.sortLeaves {
+			tree.root.sortByAxis(tree.leafSortAxis, true)
+		}
+		return
 	}
 
 	// following equations are defined in the paper describing OMT
@@ -131,8 +723,24 @@ func (tree *Rtree) bulkLoad(objs []Spatial) {
 	// eg, math.Log(9) / math.Log(3) > 2
 	h := math.Ceil(math.Log2(N) / math.Log2(M))
 
+	tree.height = int(h)
+	tree.size = n
+	tree.root = tree.omtRoot(int(h), entries)
+	if tree.sortLeaves {
+		tree.root.sortByAxis(tree.leafSortAxis, true)
+	}
+}
+
+// omtRoot bulk-loads entries into a subtree whose root is at the specified
+// level, which must be high enough for the subtree to hold all entries.
+func (tree *Rtree) omtRoot(level int, entries []entry) *node {
+	var (
+		N = float64(len(entries))
+		M = float64(tree.MaxChildren)
+	)
+
 	// Eq2: size of subtrees at the root
-	nsub := math.Pow(M, h-1)
+	nsub := math.Pow(M, float64(level-1))
 
 	// Inner Eq3: number of subtrees at the root
 	s := math.Ceil(N / nsub)
@@ -143,9 +751,7 @@ func (tree *Rtree) bulkLoad(objs []Spatial) {
 	// sort all entries by first dimension
 	sortByDim(0, entries)
 
-	tree.height = int(h)
-	tree.size = n
-	tree.root = tree.omt(int(h), int(S), entries, int(s))
+	return tree.omt(level, int(S), entries, int(s))
 }
 
 // omt is the recursive part of the Overlap Minimizing Top-loading bulk-
@@ -241,109 +847,718 @@ type Spatial interface {
 	Bounds() Rect
 }
 
+// Item pairs an arbitrary value with a rectangle so that it can be stored in
+// an Rtree without implementing Spatial.  Queries return the *Item that was
+// inserted.
+type Item struct {
+	Rect Rect
+	Data interface{}
+}
+
+// NewItem returns an Item storing data with the bounds r.
+func NewItem(r Rect, data interface{}) *Item {
+	return &Item{Rect: r, Data: data}
+}
+
+// Bounds returns the rectangle of item.
+func (item *Item) Bounds() Rect {
+	return item.Rect
+}
+
 // Insertion
 
 // Insert inserts a spatial object into the tree.  If insertion
 // causes a leaf node to overflow, the tree is rebalanced automatically.
 //
+// Insert panics with a DimError if the bounds of obj do not have the
+// dimension of the tree and cannot be extended to it as set with
+// SetCoerceDimensions, and with a CoordError if the tree is in StrictInsert
+// mode and the bounds are not finite.  Objects that are rejected as
+// duplicates in RejectDuplicates mode or by the handler registered with
+// SetOutlierHandler are not inserted.  Use TryInsert to have all of these
+// reported as errors.
+//
 // Implemented per Section 3.2 of "R-trees: A Dynamic Index Structure for
 // Spatial Searching" by A. Guttman, Proceedings of ACM SIGMOD, p. 47-57, 1984.
 func (tree *Rtree) Insert(obj Spatial) {
-	e := entry{obj.Bounds(), nil, obj}
-	tree.insert(e, 1)
-	tree.size++
+	switch err := tree.TryInsert(obj).(type) {
+	case nil:
+	case *DimError:
+		panic(*err)
+	case CoordError:
+		panic(err)
+	}
 }
 
-// insert adds the specified entry to the tree at the specified level.
-func (tree *Rtree) insert(e entry, level int) {
-	leaf := tree.chooseNode(tree.root, e, level)
-	leaf.entries = append(leaf.entries, e)
+// TryInsert inserts a spatial object into the tree like Insert, but returns an
+// error instead of panicking or silently rejecting obj.  The tree is left
+// unchanged if an error is returned.
+//
+// A DimError is returned if the bounds of obj do not have the dimension of the
+// tree and cannot be extended to it as set with SetCoerceDimensions.  If the
+// tree is in StrictInsert mode, a CoordError is returned as well when the
+// bounds of obj are not finite.  If the tree is in RejectDuplicates mode,
+// ErrDuplicate is returned when obj is already in the tree.  ErrOutlier is
+// returned when obj is rejected by the handler registered with
+// SetOutlierHandler.
+func (tree *Rtree) TryInsert(obj Spatial) error {
+	tree.condenseDirty()
+	_, err := tree.insertObject(obj, tree.root)
+	return err
+}
 
-	// update parent pointer if necessary
-	if e.child != nil {
-		e.child.parent = leaf
+// InsertHint inserts a spatial object into the tree like TryInsert, but starts
+// looking for the leaf to add it to from the leaf containing hint, an object
+// stored in the tree that is expected to lie close to obj.  If the leaf of
+// hint does not contain the bounds of obj, its ancestors are tried in turn.
+// This is useful for moving objects: insert the object at its new position
+// with its previous position as the hint, then delete the previous position.
+// If hint is nil or not in the tree, InsertHint behaves like TryInsert.
+//
+// The leaf of hint is found by a search from the root as in Delete, so
+// InsertHint only saves choosing the subtree at every level on the way down.
+// InsertNearLeaf skips the descent altogether.
+func (tree *Rtree) InsertHint(obj, hint Spatial) error {
+	tree.condenseDirty()
+	var leaf NodeRef
+	if hint != nil {
+		if bb := tree.bounds(hint); len(bb.p) == tree.Dim {
+			if n := tree.root.findLeaf(hint, bb, defaultComparator); n != nil && n.holds(hint) {
+				leaf = NodeRef{n}
+			}
+		}
 	}
+	_, err := tree.InsertNearLeaf(obj, leaf)
+	return err
+}
 
-	// split leaf if overflows
-	var split *node
-	if len(leaf.entries) > tree.MaxChildren {
-		leaf, split = leaf.split(tree.MinChildren)
+// InsertNearLeaf is like InsertHint, but starts looking for the leaf to add
+// obj to from the leaf hint and returns the leaf holding obj afterwards, so
+// that the descent from the root is skipped for objects that stay close to
+// it.  For moving objects, keep the leaf returned for every object and pass it
+// as the hint for the next position of the object.
+//
+// Unlike other uses of a NodeRef, hint may be a leaf returned before the tree
+// was modified: a hint that is not a leaf of the tree anymore, the zero
+// NodeRef or any hint for a version of a SharedRtree is ignored, and obj is
+// inserted from the root like TryInsert.
+func (tree *Rtree) InsertNearLeaf(obj Spatial, hint NodeRef) (NodeRef, error) {
+	tree.condenseDirty()
+	start := tree.root
+	bb := tree.bounds(obj)
+	if tree.owned == nil && len(bb.p) == tree.Dim && tree.holdsLeaf(hint.n) {
+		start = hint.n
+		for start.parent != nil && !start.getEntry().bb.containsRect(bb) {
+			start = start.parent
+		}
 	}
-	root, splitRoot := tree.adjustTree(leaf, split)
-	if splitRoot != nil {
-		oldRoot := root
-		tree.height++
-		tree.root = &node{
-			parent: nil,
-			level:  tree.height,
-			entries: []entry{
-				{bb: oldRoot.computeBoundingBox(), child: oldRoot},
-				{bb: splitRoot.computeBoundingBox(), child: splitRoot},
-			},
+	leaf, err := tree.insertObject(obj, start)
+	if err != nil {
+		return NodeRef{}, err
+	}
+
+	// a split may have moved obj to a new sibling of the leaf, and a forced
+	// reinsertion anywhere
+	for n := leaf; n != nil; n = n.parent {
+		if l := n.findLeaf(obj, bb, defaultComparator); l != nil && l.holds(obj) {
+			return NodeRef{l}, nil
 		}
-		oldRoot.parent = tree.root
-		splitRoot.parent = tree.root
 	}
+	return NodeRef{}, nil
 }
 
-// chooseNode finds the node at the specified level to which e should be added.
-func (tree *Rtree) chooseNode(n *node, e entry, level int) *node {
-	if n.leaf || n.level == level {
-		return n
+// holdsLeaf reports whether n is a leaf of tree, by following its parents to
+// the root.
+func (tree *Rtree) holdsLeaf(n *node) bool {
+	if n == nil || !n.leaf {
+		return false
 	}
-
-	// find the entry whose bb needs least enlargement to include obj
-	diff := math.MaxFloat64
-	var chosen entry
-	for _, en := range n.entries {
-		bb := boundingBox(en.bb, e.bb)
-		d := bb.Size() - en.bb.Size()
-		if d < diff || (d == diff && en.bb.Size() < chosen.bb.Size()) {
-			diff = d
-			chosen = en
+	for ; n.parent != nil; n = n.parent {
+		if n.getEntry() == nil {
+			return false
 		}
 	}
-
-	return tree.chooseNode(chosen.child, e, level)
+	return n == tree.root
 }
 
-// adjustTree splits overflowing nodes and propagates the changes upwards.
-func (tree *Rtree) adjustTree(n, nn *node) (*node, *node) {
-	// Let the caller handle root adjustments.
-	if n == tree.root {
-		return n, nn
+// holds reports whether the leaf n holds obj.
+func (n *node) holds(obj Spatial) bool {
+	for _, e := range n.entries {
+		if defaultComparator(e.obj, obj) {
+			return true
+		}
 	}
+	return false
+}
 
-	// Re-size the bounding box of n to account for lower-level changes.
-	en := n.getEntry()
-	prevBox := en.bb
-	en.bb = n.computeBoundingBox()
-
-	// If nn is nil, then we're just propagating changes upwards.
-	if nn == nil {
-		// Optimize for the case where nothing is changed
-		// to avoid computeBoundingBox which is expensive.
-		if en.bb.Equal(prevBox) {
-			return tree.root, nil
+// insertObject checks obj and inserts it below the node start, whose bounding
+// box must contain the bounds of obj unless start is the root, and returns
+// the node it was added to.
+func (tree *Rtree) insertObject(obj Spatial, start *node) (*node, error) {
+	e := entry{tree.bounds(obj), nil, obj}
+	if len(e.bb.p) != tree.Dim {
+		return nil, &DimError{tree.Dim, len(e.bb.p)}
+	}
+	if tree.StrictInsert {
+		if err := tree.checkBounds(e.bb); err != nil {
+			return nil, err
 		}
-		return tree.adjustTree(n.parent, nil)
 	}
-
-	// Otherwise, these are two nodes resulting from a split.
-	// n was reused as the "left" node, but we need to add nn to n.parent.
-	enn := entry{nn.computeBoundingBox(), nn, nil}
-	n.parent.entries = append(n.parent.entries, enn)
-
-	// If the new entry overflows the parent, split the parent and propagate.
-	if len(n.parent.entries) > tree.MaxChildren {
-		return tree.adjustTree(n.parent.split(tree.MinChildren))
+	if tree.RejectDuplicates && tree.Contains(obj) {
+		return nil, ErrDuplicate
+	}
+	if tree.outlierHandler != nil && tree.size > 0 {
+		bb := tree.root.computeBoundingBox()
+		if !bb.containsRect(e.bb) {
+			enlargement := math.Inf(1)
+			if size := bb.Size(); size > 0 {
+				enlargement = boundingBox(bb, e.bb).Size() / size
+			}
+			if !tree.outlierHandler(obj, enlargement) {
+				return nil, ErrOutlier
+			}
+		}
+	}
+	leaf, err := tree.insertBelow(start, e, 1)
+	if err != nil {
+		return nil, err
 	}
+	tree.size++
+	tree.trackVelocity(obj)
 
-	// Otherwise keep propagating changes upwards.
-	return tree.adjustTree(n.parent, nil)
+	tree.notifyInsert(obj)
+	tree.mutated()
+	return leaf, nil
 }
 
-// getEntry returns a pointer to the entry for the node n from n's parent.
+// InsertBatchAuto inserts objs into the tree, either by inserting every
+// object or by rebuilding the tree from scratch with the bulk-loading
+// algorithm, whichever is estimated to be cheaper.
+//
+// An insert descends the tree, choosing among up to MaxChildren entries per
+// level, and splits the leaf it reaches if it is full, which takes time
+// quadratic in MaxChildren.  Inserting k objects is estimated to cost
+// k * MaxChildren * (Depth() + f * MaxChildren), where f is the fraction of
+// full leaves.  Bulk loading sorts all n objects of the tree, which is
+// estimated to cost n * log2(n).  The tree is rebuilt when the latter is
+// smaller, i.e. when the batch is large compared to the tree, or the tree is
+// tightly packed.
+//
+// Since rebuilding bypasses the checks made by Insert, the objects are always
+// inserted one by one if the tree is in StrictInsert or RejectDuplicates mode
+// or has an outlier handler.  The first error returned by TryInsert is returned;
+// if the bounds of an object do not have the dimension of the tree, a
+// DimError is returned and no object is inserted.
+func (tree *Rtree) InsertBatchAuto(objs []Spatial) error {
+	for _, obj := range objs {
+		if d := len(tree.bounds(obj).p); d != tree.Dim {
+			return &DimError{tree.Dim, d}
+		}
+	}
+
+	checked := tree.StrictInsert || tree.RejectDuplicates || tree.outlierHandler != nil
+	if checked || !tree.rebuildIsCheaper(len(objs)) {
+		var err error
+		for _, obj := range objs {
+			if insertErr := tree.TryInsert(obj); insertErr != nil && err == nil {
+				err = insertErr
+			}
+		}
+		return err
+	}
+
+	tree.rebuildWith(objs)
+	for _, obj := range objs {
+		tree.notifyInsert(obj)
+	}
+	tree.mutated()
+	return nil
+}
+
+// rebuildIsCheaper reports whether bulk loading the tree with k additional
+// objects is estimated to be cheaper than inserting them one by one, as
+// described by InsertBatchAuto.
+func (tree *Rtree) rebuildIsCheaper(k int) bool {
+	n := float64(tree.size + k)
+	leaves, full := tree.root.countFullLeaves(tree.MaxChildren)
+	m := float64(tree.MaxChildren)
+	insertCost := float64(k) * m * (float64(tree.height) + float64(full)/float64(leaves)*m)
+	return n > 1 && n*math.Log2(n) < insertCost
+}
+
+// rebuildWith bulk loads the tree with its objects and objs, whose bounds
+// must have the dimension of the tree.  No hooks are called.
+func (tree *Rtree) rebuildWith(objs []Spatial) {
+	entries := tree.root.appendObjects(make([]entry, 0, tree.size+len(objs)))
+	for _, obj := range objs {
+		entries = append(entries, entry{bb: tree.bounds(obj), obj: obj})
+		tree.trackVelocity(obj)
+	}
+	tree.bulkLoadEntries(entries)
+}
+
+// countFullLeaves returns the number of leaves in the subtree of n and the
+// number of those holding at least max entries.
+func (n *node) countFullLeaves(max int) (leaves, full int) {
+	if n.leaf {
+		if len(n.entries) >= max {
+			return 1, 1
+		}
+		return 1, 0
+	}
+	for _, e := range n.entries {
+		l, f := e.child.countFullLeaves(max)
+		leaves += l
+		full += f
+	}
+	return leaves, full
+}
+
+// InsertStream inserts the objects received from ch until it is closed and
+// returns the number of objects inserted.  Objects with invalid bounds are
+// validated as in StrictInsert mode and skipped; the channel is still drained
+// and the first error encountered is returned.
+func (tree *Rtree) InsertStream(ch <-chan Spatial) (count int, err error) {
+	for obj := range ch {
+		insertErr := tree.checkBounds(tree.bounds(obj))
+		if insertErr == nil {
+			insertErr = tree.TryInsert(obj)
+		}
+		if insertErr != nil {
+			if err == nil {
+				err = insertErr
+			}
+			continue
+		}
+		count++
+	}
+	return count, err
+}
+
+// Compact splits all leaves holding more than MaxChildren entries, which can
+// be left behind by inserts when SoftMaxChildren is set, and condenses the
+// tree after deletions in BalanceLazy mode.
+func (tree *Rtree) Compact() {
+	tree.condenseDirty()
+	tree.ownAll()
+	for {
+		leaf := tree.root.oversizedLeaf(tree.MaxChildren)
+		if leaf == nil {
+			return
+		}
+		tree.sorted = false
+		if err := tree.rebalance(leaf, tree.MaxChildren); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// oversizedLeaf returns a leaf in the subtree of n with more than max
+// entries, or nil if there is none.
+func (n *node) oversizedLeaf(max int) *node {
+	if n.leaf {
+		if len(n.entries) > max {
+			return n
+		}
+		return nil
+	}
+	for _, e := range n.entries {
+		if leaf := e.child.oversizedLeaf(max); leaf != nil {
+			return leaf
+		}
+	}
+	return nil
+}
+
+// SetOutlierHandler registers fn to be called before Insert adds an object
+// that extends beyond the bounding box of all objects in the tree.  The
+// enlargement is the ratio of the area (volume) of the bounding box after the
+// insert to the one before, which is infinite if the tree is degenerate along
+// some axis.  If fn returns false, the object is not inserted and TryInsert
+// returns ErrOutlier.  This guards against objects with accidentally huge bounds,
+// which would make the tree much less efficient.  A nil fn removes the
+// handler.
+func (tree *Rtree) SetOutlierHandler(fn func(obj Spatial, enlargement float64) bool) {
+	tree.outlierHandler = fn
+}
+
+// SetSlowQueryLog registers fn to be called after every search that takes
+// longer than threshold, with the number of nodes visited and the time taken,
+// to find queries made slow by overlap between nodes.  The searches logged are
+// SearchIntersect and the searches built on it, SearchIntersectWithBoundary,
+// SearchOBB, SearchIntersectAt, NearestNeighbor, NearestNeighbors,
+// NearestNeighborsWithDist and NearestNeighborsTieBreak.  The nodes are counted
+// during the search itself, so a search stopped early by a filter only counts
+// the nodes visited until then, and a SearchIntersect answered from the query
+// cache counts none.  A nil fn disables logging.
+func (tree *Rtree) SetSlowQueryLog(threshold time.Duration, fn func(nodesVisited int, d time.Duration)) {
+	tree.slowQueryThreshold = threshold
+	tree.slowQueryLog = fn
+}
+
+// slowQuery measures a search for the slow query log.
+type slowQuery struct {
+	start   time.Time
+	visited int
+}
+
+// startQuery starts measuring a search, or returns nil if slow queries are
+// not logged.
+func (tree *Rtree) startQuery() *slowQuery {
+	if tree.slowQueryLog == nil {
+		return nil
+	}
+	return &slowQuery{start: time.Now()}
+}
+
+// visit counts a node visited by the search measured by q, if any.
+func (q *slowQuery) visit() {
+	if q != nil {
+		q.visited++
+	}
+}
+
+// finishQuery logs the search measured by q if it was slow.
+func (tree *Rtree) finishQuery(q *slowQuery) {
+	if q == nil {
+		return
+	}
+	if d := time.Since(q.start); d > tree.slowQueryThreshold {
+		tree.slowQueryLog(q.visited, d)
+	}
+}
+
+// SetBalanceMode sets when the tree is condensed after deletions.  In
+// BalanceEager mode, the default, every Delete eliminates underflowing nodes
+// at once and reinserts their objects.  In BalanceLazy mode, Delete only
+// removes the object from its leaf, drops the nodes left empty and shrinks the
+// bounding boxes of the ancestors, and the underflowing nodes are condensed
+// together once an object is inserted or PopNearest is called, or Compact
+// is called.  This makes long runs of deletions much cheaper, since the nodes
+// eliminated by them are dissolved and their objects reinserted only once.
+//
+// Until then, nodes may hold fewer than MinChildren entries, but the tree is
+// otherwise consistent.  Queries never condense the tree, so a lazily
+// balanced tree may be queried concurrently like any other.  Switching to
+// BalanceEager condenses the tree.
+func (tree *Rtree) SetBalanceMode(mode BalanceMode) {
+	tree.balanceMode = mode
+	if mode == BalanceEager {
+		tree.condenseDirty()
+	}
+}
+
+// OnInsert registers fn to be called with every object added by Insert, after
+// the tree has been rebalanced.  Hooks are called in registration order.
+func (tree *Rtree) OnInsert(fn func(Spatial)) {
+	tree.insertHooks = append(tree.insertHooks, fn)
+}
+
+// OnDelete registers fn to be called with every object removed from the tree,
+// after the tree has been rebalanced.  Hooks are called in registration order
+// and are not called if nothing was deleted.
+func (tree *Rtree) OnDelete(fn func(Spatial)) {
+	tree.deleteHooks = append(tree.deleteHooks, fn)
+}
+
+// notifyInsert calls the insert hooks and updates the grids of tree for an
+// object added to it.
+func (tree *Rtree) notifyInsert(obj Spatial) {
+	for _, fn := range tree.insertHooks {
+		fn(obj)
+	}
+	for _, g := range tree.grids {
+		g.add(obj, tree.bounds(obj))
+	}
+}
+
+// notifyDelete calls the delete hooks and updates the grids of tree for an
+// object removed from it.
+func (tree *Rtree) notifyDelete(obj Spatial) {
+	for _, fn := range tree.deleteHooks {
+		fn(obj)
+	}
+	for _, g := range tree.grids {
+		g.remove(obj)
+	}
+}
+
+// bounds returns the bounds of obj as stored in the tree, i.e. the bounds
+// returned by objectBounds swept over the time horizon of the tree if obj is
+// Moving.
+func (tree *Rtree) bounds(obj Spatial) Rect {
+	return tree.sweep(obj, tree.objectBounds(obj))
+}
+
+// SetCoerceDimensions makes tree accept objects whose bounds have fewer
+// dimensions than the tree instead of rejecting them with a DimError.  Their
+// bounds are extended to the dimension of the tree with the zero extent
+// [value, value] on every missing axis, so that e.g. a 2D object in a 3D tree
+// is stored in the plane z = value and found by queries intersecting that
+// plane.  Since this changes the meaning of such objects, it is disabled by
+// default.
+//
+// Coerced objects are found again by Delete and Contains by extending their
+// bounds the same way, so the setting can only be changed while the tree is
+// empty.  SetCoerceDimensions panics if tree holds any objects.
+func (tree *Rtree) SetCoerceDimensions(on bool, value float64) {
+	if tree.size > 0 {
+		panic(fmt.Sprintf("rtreego: SetCoerceDimensions on a tree holding %d objects", tree.size))
+	}
+	tree.coerce = on
+	tree.coerceValue = value
+}
+
+// objectBounds returns the bounds of obj, extended to the dimension of the
+// tree if set with SetCoerceDimensions.
+func (tree *Rtree) objectBounds(obj Spatial) Rect {
+	bb := obj.Bounds()
+	if !tree.coerce || len(bb.p) >= tree.Dim {
+		return bb
+	}
+	c := Rect{make(Point, tree.Dim), make(Point, tree.Dim)}
+	copy(c.p, bb.p)
+	copy(c.q, bb.q)
+	for i := len(bb.p); i < tree.Dim; i++ {
+		c.p[i], c.q[i] = tree.coerceValue, tree.coerceValue
+	}
+	return c
+}
+
+// checkBounds validates that bb can be stored in tree.
+func (tree *Rtree) checkBounds(bb Rect) error {
+	if len(bb.p) != tree.Dim {
+		return &DimError{tree.Dim, len(bb.p)}
+	}
+	if err := bb.p.checkFinite(); err != nil {
+		return err
+	}
+	return bb.q.checkFinite()
+}
+
+// insert adds the specified entry to the tree at the specified level.  It is
+// used to reinsert entries that were already stored in the tree, so an error
+// means that the tree has been corrupted and insert panics with it.
+func (tree *Rtree) insert(e entry, level int) {
+	if _, err := tree.insertBelow(tree.root, e, level); err != nil {
+		panic(err)
+	}
+}
+
+// insertBelow inserts e at the specified level below the node start and
+// returns the node it was added to, before that node was split.
+func (tree *Rtree) insertBelow(start *node, e entry, level int) (*node, error) {
+	if len(e.bb.p) == tree.Dim && tree.normCost != nil && !tree.normExtent.containsRect(e.bb) {
+		tree.normExtent = boundingBox(tree.normExtent, e.bb)
+		tree.normCost = tree.normMetric.normalized(tree.normExtent)
+	}
+	leaf, err := tree.chooseNode(start, e, level)
+	if err != nil {
+		return nil, err
+	}
+	tree.sorted = false
+	if leaf.leaf && tree.sortLeaves {
+		leaf.insertSorted(e, tree.leafSortAxis)
+	} else {
+		leaf.entries = append(leaf.entries, e)
+	}
+
+	// update parent pointer if necessary
+	if e.child != nil {
+		e.child.parent = leaf
+	}
+
+	// split leaf if overflows, otherwise just enlarge the bounding boxes of
+	// its ancestors to include e instead of recomputing them
+	if len(leaf.entries) > tree.capacity(leaf) {
+		return leaf, tree.rebalance(leaf, tree.capacity(leaf))
+	}
+	tree.enlargeAncestors(leaf, e.bb)
+	return leaf, nil
+}
+
+// enlargeAncestors enlarges the bounding boxes stored for n and its ancestors
+// in their parents to include bb, after an entry with bounds bb has been
+// added to n.  Since the stored bounding boxes of the ancestors of n are the
+// tightest boxes of their entries before the addition, enlarging them gives
+// the tightest boxes after it, so they do not have to be recomputed from all
+// entries.
+func (tree *Rtree) enlargeAncestors(n *node, bb Rect) {
+	for n != tree.root {
+		en := n.getEntry()
+		if en.bb.containsRect(bb) {
+			return
+		}
+		en.bb = boundingBox(en.bb, bb)
+		n = n.parent
+	}
+}
+
+// capacity returns the number of entries n may hold before it is split.
+func (tree *Rtree) capacity(n *node) int {
+	if n.leaf && tree.SoftMaxChildren > tree.MaxChildren {
+		return tree.SoftMaxChildren
+	}
+	return tree.MaxChildren
+}
+
+// rebalance splits n if it holds more than max entries and propagates the
+// changes upwards.  Errors of split are passed on.
+func (tree *Rtree) rebalance(n *node, max int) error {
+	var split *node
+	if len(n.entries) > max {
+		var err error
+		if n, split, err = tree.split(n); err != nil {
+			return err
+		}
+	}
+	root, splitRoot, err := tree.adjustTree(n, split)
+	if err != nil {
+		return err
+	}
+	if splitRoot != nil {
+		oldRoot := root
+		tree.height++
+		tree.root = &node{
+			parent:  nil,
+			level:   tree.height,
+			entries: make([]entry, 0, tree.MaxChildren+1),
+		}
+		tree.root.entries = append(tree.root.entries,
+			entry{bb: oldRoot.computeBoundingBox(), child: oldRoot},
+			entry{bb: splitRoot.computeBoundingBox(), child: splitRoot},
+		)
+		oldRoot.parent = tree.root
+		splitRoot.parent = tree.root
+	}
+	return nil
+}
+
+// chooseNode finds the node at the specified level to which e should be added.
+// A DimError is returned if the bounds of e do not have the dimension of the
+// tree, since they could not be compared with those of the subtrees.
+func (tree *Rtree) chooseNode(n *node, e entry, level int) (*node, error) {
+	if len(e.bb.p) != tree.Dim {
+		return nil, &DimError{tree.Dim, len(e.bb.p)}
+	}
+	if n.leaf || n.level == level {
+		return n, nil
+	}
+
+	var chosen int
+	if tree.chooseSubtree != nil && e.obj != nil {
+		candidates := make([]Rect, len(n.entries))
+		for i, en := range n.entries {
+			candidates[i] = en.bb
+		}
+		chosen = tree.chooseSubtree(candidates, e.obj)
+		if chosen < 0 || chosen >= len(candidates) {
+			panic(fmt.Sprintf("rtreego: ChooseSubtree policy returned index %d for %d candidates", chosen, len(candidates)))
+		}
+	} else {
+		chosen = tree.leastEnlargement(n.entries, e.bb)
+	}
+
+	return tree.chooseNode(tree.own(n, chosen), e, level)
+}
+
+// ChooseSubtree is a policy choosing the subtree to which Insert adds obj, by
+// returning the index of one of the bounding boxes of the subtrees of a node
+// in candidates.  It is called for every internal node on the path from the
+// root to the leaf that obj is added to, see SetChooseSubtree.
+type ChooseSubtree func(candidates []Rect, obj Spatial) int
+
+// SetChooseSubtree replaces the policy by which Insert chooses the subtree to
+// add an object to, e.g. to minimize overlap or prefer fuller nodes.  A nil
+// fn restores the default policy, LeastEnlargement.  Subtrees moved when the
+// tree is condensed after a deletion are always placed with the default
+// policy.  Insert panics before modifying the tree if fn returns an index
+// that is not one of candidates.
+func (tree *Rtree) SetChooseSubtree(fn ChooseSubtree) {
+	tree.chooseSubtree = fn
+}
+
+// LeastEnlargement is the default ChooseSubtree policy of tree.  It chooses
+// the candidate whose cost, see CostMetric, is enlarged least by including the
+// bounds of obj, treating enlargements within EnlargementEpsilon as ties
+// which are resolved in favor of the candidate with the smaller cost.  Custom
+// policies can fall back to it.
+func (tree *Rtree) LeastEnlargement(candidates []Rect, obj Spatial) int {
+	entries := make([]entry, len(candidates))
+	for i, bb := range candidates {
+		entries[i].bb = bb
+	}
+	return tree.leastEnlargement(entries, tree.bounds(obj))
+}
+
+// leastEnlargement returns the index of the entry whose bb needs least
+// enlargement to include bb, as described for LeastEnlargement.
+func (tree *Rtree) leastEnlargement(entries []entry, bb Rect) int {
+	return leastEnlargement(len(entries), func(i int) Rect {
+		return entries[i].bb
+	}, bb, tree.cost(), tree.EnlargementEpsilon)
+}
+
+// leastEnlargement returns the index of the one of the n bounding boxes
+// returned by box whose cost needs least enlargement to include bb, treating
+// enlargements within epsilon as ties as described for LeastEnlargement.
+func leastEnlargement(n int, box func(i int) Rect, bb Rect, cost func(Rect) float64, epsilon float64) int {
+	diff := math.MaxFloat64
+	chosen, chosenCost := 0, 0.0
+	for i := 0; i < n; i++ {
+		enlarged := cost(boundingBox(box(i), bb))
+		d := enlarged - cost(box(i))
+		eps := epsilon * math.Max(enlarged, chosenCost)
+		if d < diff-eps || (d <= diff+eps && cost(box(i)) < cost(box(chosen))) {
+			diff = d
+			chosen, chosenCost = i, enlarged
+		}
+	}
+	return chosen
+}
+
+// adjustTree splits overflowing nodes and propagates the changes upwards.
+// Errors of split are passed on.
+func (tree *Rtree) adjustTree(n, nn *node) (*node, *node, error) {
+	// Let the caller handle root adjustments.
+	if n == tree.root {
+		return n, nn, nil
+	}
+
+	// Re-size the bounding box of n to account for lower-level changes.
+	en := n.getEntry()
+	prevBox := en.bb
+	en.bb = n.computeBoundingBox()
+
+	// If nn is nil, then we're just propagating changes upwards.
+	if nn == nil {
+		// Optimize for the case where nothing is changed
+		// to avoid computeBoundingBox which is expensive.
+		if en.bb.Equal(prevBox) {
+			return tree.root, nil, nil
+		}
+		return tree.adjustTree(n.parent, nil)
+	}
+
+	// Otherwise, these are two nodes resulting from a split.
+	// n was reused as the "left" node, but we need to add nn to n.parent.
+	enn := entry{nn.computeBoundingBox(), nn, nil}
+	n.parent.entries = append(n.parent.entries, enn)
+
+	// If the new entry overflows the parent, split the parent and propagate.
+	if len(n.parent.entries) > tree.MaxChildren {
+		left, right, err := tree.split(n.parent)
+		if err != nil {
+			return nil, nil, err
+		}
+		return tree.adjustTree(left, right)
+	}
+
+	// Otherwise keep propagating changes upwards.
+	return tree.adjustTree(n.parent, nil)
+}
+
+// getEntry returns a pointer to the entry for the node n from n's parent.
 func (n *node) getEntry() *entry {
 	var e *entry
 	for i := range n.parent.entries {
@@ -355,8 +1570,12 @@ func (n *node) getEntry() *entry {
 	return e
 }
 
-// computeBoundingBox finds the MBR of the children of n.
+// computeBoundingBox finds the MBR of the children of n.  The root of an
+// empty tree has no children, for which the zero Rect is returned.
 func (n *node) computeBoundingBox() (bb Rect) {
+	if len(n.entries) == 0 {
+		return
+	}
 	if len(n.entries) == 1 {
 		bb = n.entries[0].bb
 		return
@@ -369,9 +1588,68 @@ func (n *node) computeBoundingBox() (bb Rect) {
 	return
 }
 
+// split splits the overflowing node n according to the split options of tree.
+// A DimError is returned and n is left unchanged if the bounds of any entry of
+// n do not have the dimension of the tree.
+func (tree *Rtree) split(n *node) (left, right *node, err error) {
+	for _, e := range n.entries {
+		if len(e.bb.p) != tree.Dim {
+			return nil, nil, &DimError{tree.Dim, len(e.bb.p)}
+		}
+	}
+	// the split sets the parent pointers of the children of n
+	if tree.owned != nil && !n.leaf {
+		for i := range n.entries {
+			tree.own(n, i)
+		}
+	}
+	cost := tree.cost()
+	minGroupSize := tree.MinChildren
+	if balanced := len(n.entries) / 2; tree.BalancedSplit && balanced > minGroupSize {
+		tolerance := balancedSplitTolerance * n.computeBoundingBox().Size()
+		if n.splitOverlap(balanced, cost) <= n.splitOverlap(minGroupSize, cost)+tolerance {
+			minGroupSize = balanced
+		}
+	}
+	left, right = n.split(minGroupSize, cost)
+	if tree.owned != nil {
+		tree.owned[right] = true
+	}
+	if left.leaf && tree.sortLeaves {
+		left.sortByAxis(tree.leafSortAxis, true)
+		right.sortByAxis(tree.leafSortAxis, true)
+	}
+	return left, right, nil
+}
+
+// balancedSplitTolerance is the fraction of the volume of a node by which the
+// overlap of a balanced split may exceed that of the classic split, see
+// BalancedSplit.
+const balancedSplitTolerance = 0.01
+
+// splitOverlap returns the overlap of the groups into which n would be split
+// with the specified minimum group size, without changing n.
+func (n *node) splitOverlap(minGroupSize int, cost func(Rect) float64) float64 {
+	c := &node{
+		parent:  n.parent,
+		leaf:    n.leaf,
+		level:   n.level,
+		entries: append([]entry{}, n.entries...),
+	}
+	left, right := c.split(minGroupSize, cost)
+	// the split pointed the children of n to the groups
+	if !n.leaf {
+		for _, e := range n.entries {
+			e.child.parent = n
+		}
+	}
+	return overlap(left.computeBoundingBox(), right.computeBoundingBox())
+}
+
 // split splits a node into two groups while attempting to minimize the
-// bounding-box area of the resulting groups.
-func (n *node) split(minGroupSize int) (left, right *node) {
+// cost of the bounding boxes of the resulting groups.  The seeds of the split
+// are always chosen by wasted area.
+func (n *node) split(minGroupSize int, cost func(Rect) float64) (left, right *node) {
 	// find the initial split
 	l, r := n.pickSeeds()
 	leftSeed, rightSeed := n.entries[l], n.entries[r]
@@ -380,15 +1658,19 @@ func (n *node) split(minGroupSize int) (left, right *node) {
 	remaining := append(n.entries[:l], n.entries[l+1:r]...)
 	remaining = append(remaining, n.entries[r+1:]...)
 
-	// setup the new split nodes, but re-use n as the left node
+	// setup the new split nodes, but re-use n as the left node.  Both are
+	// allocated with room for as many entries as n, so that they can be
+	// filled up to overflowing again without reallocation.
 	left = n
-	left.entries = []entry{leftSeed}
+	left.entries = make([]entry, 1, len(n.entries))
+	left.entries[0] = leftSeed
 	right = &node{
 		parent:  n.parent,
 		leaf:    n.leaf,
 		level:   n.level,
-		entries: []entry{rightSeed},
+		entries: make([]entry, 1, len(n.entries)),
 	}
+	right.entries[0] = rightSeed
 
 	// TODO
 	if rightSeed.child != nil {
@@ -400,7 +1682,7 @@ func (n *node) split(minGroupSize int) (left, right *node) {
 
 	// distribute all of n's old entries into left and right.
 	for len(remaining) > 0 {
-		next := pickNext(left, right, remaining)
+		next := pickNext(left, right, remaining, cost)
 		e := remaining[next]
 
 		if len(remaining)+len(left.entries) <= minGroupSize {
@@ -408,7 +1690,7 @@ func (n *node) split(minGroupSize int) (left, right *node) {
 		} else if len(remaining)+len(right.entries) <= minGroupSize {
 			assign(e, right)
 		} else {
-			assignGroup(e, left, right)
+			assignGroup(e, left, right, cost)
 		}
 
 		remaining = append(remaining[:next], remaining[next+1:]...)
@@ -417,6 +1699,58 @@ func (n *node) split(minGroupSize int) (left, right *node) {
 	return
 }
 
+// chooseSplitAxis returns the axis along which entries should be split, as
+// chosen by the R*-tree split: along every axis, the entries are sorted by
+// the lower and by the upper coordinates of their bounding boxes, and the
+// margins of the two groups of every distribution of the sorted entries with
+// at least minFill entries per group are summed up.  The axis with the least
+// sum is chosen, which favors splitting into square groups.  entries is not
+// modified.
+//
+// From "The R*-tree: An Efficient and Robust Access Method for Points and
+// Rectangles" by N. Beckmann et al, Proceedings of ACM SIGMOD, p. 322-331,
+// 1990.
+func chooseSplitAxis(entries []entry, minFill int) (axis int) {
+	if minFill < 1 {
+		minFill = 1
+	}
+	sorted := append([]entry{}, entries...)
+	n := len(sorted)
+	if n < 2*minFill {
+		return 0
+	}
+
+	// low[i] and high[i] are the bounding boxes of the first and last i+1
+	// sorted entries
+	low := make([]Rect, n)
+	high := make([]Rect, n)
+	best := math.Inf(1)
+	for dim := range sorted[0].bb.p {
+		sum := 0.0
+		for _, upper := range []bool{false, true} {
+			sort.SliceStable(sorted, func(i, j int) bool {
+				if upper {
+					return sorted[i].bb.q[dim] < sorted[j].bb.q[dim]
+				}
+				return sorted[i].bb.p[dim] < sorted[j].bb.p[dim]
+			})
+			low[0], high[0] = sorted[0].bb, sorted[n-1].bb
+			for i := 1; i < n; i++ {
+				low[i] = boundingBox(low[i-1], sorted[i].bb)
+				high[i] = boundingBox(high[i-1], sorted[n-1-i].bb)
+			}
+			for k := minFill; k <= n-minFill; k++ {
+				sum += low[k-1].margin() + high[n-k-1].margin()
+			}
+		}
+		if sum < best {
+			best = sum
+			axis = dim
+		}
+	}
+	return axis
+}
+
 // getAllBoundingBoxes traverses tree populating slice of bounding boxes of non-leaf nodes.
 func (n *node) getAllBoundingBoxes() []Rect {
 	var rects []Rect
@@ -441,15 +1775,15 @@ func assign(e entry, group *node) {
 }
 
 // assignGroup chooses one of two groups to which a node should be added.
-func assignGroup(e entry, left, right *node) {
+func assignGroup(e entry, left, right *node, cost func(Rect) float64) {
 	leftBB := left.computeBoundingBox()
 	rightBB := right.computeBoundingBox()
 	leftEnlarged := boundingBox(leftBB, e.bb)
 	rightEnlarged := boundingBox(rightBB, e.bb)
 
 	// first, choose the group that needs the least enlargement
-	leftDiff := leftEnlarged.Size() - leftBB.Size()
-	rightDiff := rightEnlarged.Size() - rightBB.Size()
+	leftDiff := cost(leftEnlarged) - cost(leftBB)
+	rightDiff := cost(rightEnlarged) - cost(rightBB)
 	if diff := leftDiff - rightDiff; diff < 0 {
 		assign(e, left)
 		return
@@ -458,8 +1792,8 @@ func assignGroup(e entry, left, right *node) {
 		return
 	}
 
-	// next, choose the group that has smaller area
-	if diff := leftBB.Size() - rightBB.Size(); diff < 0 {
+	// next, choose the group that has smaller cost
+	if diff := cost(leftBB) - cost(rightBB); diff < 0 {
 		assign(e, left)
 		return
 	} else if diff > 0 {
@@ -492,13 +1826,13 @@ func (n *node) pickSeeds() (int, int) {
 }
 
 // pickNext chooses an entry to be added to an entry group.
-func pickNext(left, right *node, entries []entry) (next int) {
+func pickNext(left, right *node, entries []entry, cost func(Rect) float64) (next int) {
 	maxDiff := -1.0
 	leftBB := left.computeBoundingBox()
 	rightBB := right.computeBoundingBox()
 	for i, e := range entries {
-		d1 := boundingBox(leftBB, e.bb).Size() - leftBB.Size()
-		d2 := boundingBox(rightBB, e.bb).Size() - rightBB.Size()
+		d1 := cost(boundingBox(leftBB, e.bb)) - cost(leftBB)
+		d2 := cost(boundingBox(rightBB, e.bb)) - cost(rightBB)
 		d := math.Abs(d1 - d2)
 		if d > maxDiff {
 			maxDiff = d
@@ -512,7 +1846,10 @@ func pickNext(left, right *node, entries []entry) (next int) {
 
 // Delete removes an object from the tree.  If the object is not found, returns
 // false, otherwise returns true. Uses the default comparator when checking
-// equality.
+// equality, which compares objects by identity, unless the stored object
+// implements Equaler, in which case its Equal method decides.  This lets
+// objects be deleted by content, e.g. by passing a new instance equal to the
+// stored one.
 //
 // Implemented per Section 3.3 of "R-trees: A Dynamic Index Structure for
 // Spatial Searching" by A. Guttman, Proceedings of ACM SIGMOD, p. 47-57, 1984.
@@ -524,8 +1861,21 @@ func (tree *Rtree) Delete(obj Spatial) bool {
 // comparator for evaluating equalness. This is useful when you want to remove
 // an object from a tree but don't have a pointer to the original object
 // anymore.
+//
+// Like the queries, it panics with a DimError if the bounds of obj do not have
+// the dimension of the tree, e.g. because they changed dimension after obj
+// was inserted.
 func (tree *Rtree) DeleteWithComparator(obj Spatial, cmp Comparator) bool {
-	n := tree.findLeaf(tree.root, obj, cmp)
+	bb := tree.bounds(obj)
+	if len(bb.p) != tree.Dim {
+		panic(DimError{tree.Dim, len(bb.p)})
+	}
+	var n *node
+	if tree.owned != nil {
+		n = tree.ownPath(tree.root.findPath(obj, bb, cmp, []int{}))
+	} else {
+		n = tree.root.findLeaf(obj, bb, cmp)
+	}
 	if n == nil {
 		return false
 	}
@@ -539,37 +1889,111 @@ func (tree *Rtree) DeleteWithComparator(obj Spatial, cmp Comparator) bool {
 	if ind < 0 {
 		return false
 	}
+	tree.removeEntry(n, ind)
+	return true
+}
 
+// removeEntry removes the entry at index ind from the leaf n, condenses the
+// tree as set with SetBalanceMode and returns the removed object.
+func (tree *Rtree) removeEntry(n *node, ind int) Spatial {
+	deleted := n.entries[ind].obj
 	n.entries = append(n.entries[:ind], n.entries[ind+1:]...)
-
-	tree.condenseTree(n)
 	tree.size--
 
-	if !tree.root.leaf && len(tree.root.entries) == 1 {
-		tree.root = tree.root.entries[0].child
+	if tree.balanceMode == BalanceLazy {
+		tree.markDirty(n)
+		tree.shrinkAncestors(n)
+	} else {
+		tree.condenseTree(n)
+		if !tree.root.leaf && len(tree.root.entries) == 1 {
+			tree.root = tree.own(tree.root, 0)
+		}
+		tree.height = tree.root.level
 	}
 
-	tree.height = tree.root.level
+	tree.notifyDelete(deleted)
+	tree.mutated()
+	return deleted
+}
 
-	return true
+// PopNearest removes the closest object to the specified point from the tree
+// and returns it, or nil if the tree is empty.  This is cheaper than
+// NearestNeighbor followed by Delete, since the leaf holding the object is
+// found by the nearest neighbor search instead of a second descent.  Hooks
+// registered with OnDelete are called as for Delete.
+func (tree *Rtree) PopNearest(p Point) Spatial {
+	if len(p) != tree.Dim {
+		panic(DimError{tree.Dim, len(p)})
+	}
+	tree.condenseDirty()
+	tree.ownAll()
+	leaf, ind, _ := tree.root.nearestEntry(p, nil, -1, math.Inf(1))
+	if leaf == nil {
+		return nil
+	}
+	return tree.removeEntry(leaf, ind)
 }
 
-// findLeaf finds the leaf node containing obj.
-func (tree *Rtree) findLeaf(n *node, obj Spatial, cmp Comparator) *node {
+// nearestEntry returns the leaf below n holding the entry closest to p and
+// its index, if it is closer than the squared distance d of the entry at
+// index ind of leaf.  Otherwise leaf, ind and d are returned unchanged.
+func (n *node) nearestEntry(p Point, leaf *node, ind int, d float64) (*node, int, float64) {
 	if n.leaf {
-		return n
-	}
-	// if not leaf, search all candidate subtrees
-	for _, e := range n.entries {
-		if e.bb.containsRect(obj.Bounds()) {
-			leaf := tree.findLeaf(e.child, obj, cmp)
-			if leaf == nil {
-				continue
+		for i, e := range n.entries {
+			if dist := p.minDist(e.bb); dist < d {
+				leaf, ind, d = n, i, dist
 			}
-			// check if the leaf actually contains the object
-			for _, leafEntry := range leaf.entries {
-				if cmp(leafEntry.obj, obj) {
-					return leaf
+		}
+		return leaf, ind, d
+	}
+
+	// visit the children closest first, so that farther ones can be pruned
+	branches := make([]entry, len(n.entries))
+	dists := make([]float64, len(n.entries))
+	for i, e := range n.entries {
+		branches[i] = e
+		dists[i] = p.minDist(e.bb)
+	}
+	sort.Sort(entrySlice{branches, dists})
+	for i, e := range branches {
+		if dists[i] >= d {
+			break
+		}
+		leaf, ind, d = e.child.nearestEntry(p, leaf, ind, d)
+	}
+	return leaf, ind, d
+}
+
+// Contains reports whether obj is stored in the tree.  Objects are compared as
+// in Delete, and like Delete, Contains panics with a DimError if the bounds of
+// obj do not have the dimension of the tree.
+func (tree *Rtree) Contains(obj Spatial) bool {
+	bb := tree.bounds(obj)
+	if len(bb.p) != tree.Dim {
+		panic(DimError{tree.Dim, len(bb.p)})
+	}
+	n := tree.root.findLeaf(obj, bb, defaultComparator)
+	return n != nil && n.holds(obj)
+}
+
+// findLeaf finds the leaf node below n containing obj, whose bounds are bb.
+// The bounds are computed once by the caller, so that they cannot change
+// during the descent.
+func (n *node) findLeaf(obj Spatial, bb Rect, cmp Comparator) *node {
+	if n.leaf {
+		return n
+	}
+	// if not leaf, search all candidate subtrees
+	for _, e := range n.entries {
+		if e.bb.containsRect(bb) {
+			leaf := e.child.findLeaf(obj, bb, cmp)
+			if leaf == nil {
+				continue
+			}
+			// check if the leaf actually contains the object
+			for _, leafEntry := range leaf.entries {
+				if cmp(leafEntry.obj, obj) {
+					return leaf
 				}
 			}
 		}
@@ -579,6 +2003,8 @@ func (tree *Rtree) findLeaf(n *node, obj Spatial, cmp Comparator) *node {
 
 // condenseTree deletes underflowing nodes and propagates the changes upwards.
 func (tree *Rtree) condenseTree(n *node) {
+	tree.sorted = false
+
 	// reset the deleted buffer
 	tree.deleted = tree.deleted[:0]
 
@@ -609,75 +2035,1950 @@ func (tree *Rtree) condenseTree(n *node) {
 			prevBox := en.bb
 			en.bb = n.computeBoundingBox()
 
-			if en.bb.Equal(prevBox) {
-				// Optimize for the case where nothing is changed
-				// to avoid computeBoundingBox which is expensive.
-				break
-			}
+			if en.bb.Equal(prevBox) {
+				// Optimize for the case where nothing is changed
+				// to avoid computeBoundingBox which is expensive.
+				break
+			}
+		}
+		n = n.parent
+	}
+
+	// Trees that were bulk-loaded may contain underfull nodes, in which case
+	// the root can lose all of its entries.  Start over from an empty leaf.
+	if !tree.root.leaf && len(tree.root.entries) == 0 {
+		tree.root = &node{entries: []entry{}, leaf: true, level: 1}
+		tree.height = 1
+	}
+
+	for i := len(tree.deleted) - 1; i >= 0; i-- {
+		n := tree.deleted[i]
+		if n.level >= tree.root.level {
+			// the tree is too shallow to hold n, reinsert its objects instead
+			for _, e := range n.appendObjects(nil) {
+				tree.insert(e, 1)
+			}
+			continue
+		}
+		// reinsert entry so that it will remain at the same level as before
+		e := entry{n.computeBoundingBox(), n, nil}
+		tree.insert(e, n.level+1)
+	}
+}
+
+// markDirty records that an object has been deleted from the leaf n without
+// condensing the tree, see SetBalanceMode.
+func (tree *Rtree) markDirty(n *node) {
+	if tree.dirty == nil {
+		tree.dirty = make(map[*node]bool)
+	}
+	for ; n != nil && !tree.dirty[n]; n = n.parent {
+		tree.dirty[n] = true
+	}
+}
+
+// shrinkAncestors drops n and its ancestors from the tree if they are left
+// empty by a lazy deletion from the leaf n, and shrinks the bounding boxes of
+// the remaining ones, so that queries see a consistent tree without
+// condensing it.  Both change the order of the entries along the sorted axis.
+func (tree *Rtree) shrinkAncestors(n *node) {
+	tree.sorted = false
+	for n != tree.root {
+		parent := n.parent
+		if len(n.entries) == 0 {
+			delete(tree.dirty, n)
+			for i, e := range parent.entries {
+				if e.child == n {
+					l := len(parent.entries)
+					parent.entries[i] = parent.entries[l-1]
+					parent.entries[l-1] = entry{}
+					parent.entries = parent.entries[:l-1]
+					break
+				}
+			}
+		} else {
+			en := n.getEntry()
+			prevBox := en.bb
+			en.bb = n.computeBoundingBox()
+			if en.bb.Equal(prevBox) {
+				return
+			}
+		}
+		n = parent
+	}
+	if !tree.root.leaf && len(tree.root.entries) == 0 {
+		tree.root = &node{entries: []entry{}, leaf: true, level: 1}
+		tree.height = 1
+		tree.dirty = nil
+	}
+}
+
+// condenseDirty condenses the nodes recorded by markDirty: underflowing
+// nodes are eliminated and their objects reinserted, and the bounding boxes
+// of the remaining ones shrunk.
+func (tree *Rtree) condenseDirty() {
+	if len(tree.dirty) == 0 {
+		return
+	}
+	dirty := tree.dirty
+	tree.dirty = nil
+	var orphans []entry
+	tree.root.condenseDirty(tree.MinChildren, dirty, &orphans)
+	tree.condensed(orphans)
+}
+
+func (n *node) condenseDirty(minChildren int, dirty map[*node]bool, orphans *[]entry) {
+	if n.leaf {
+		return
+	}
+	kept := n.entries[:0]
+	for _, e := range n.entries {
+		if !dirty[e.child] {
+			kept = append(kept, e)
+			continue
+		}
+		e.child.condenseDirty(minChildren, dirty, orphans)
+		if len(e.child.entries) < minChildren {
+			*orphans = e.child.appendObjects(*orphans)
+			continue
+		}
+		e.bb = e.child.computeBoundingBox()
+		kept = append(kept, e)
+	}
+
+	// clear the dropped entries so they can be garbage collected
+	for i := len(kept); i < len(n.entries); i++ {
+		n.entries[i] = entry{}
+	}
+	n.entries = kept
+}
+
+// BulkUpdate re-indexes objects whose bounds have changed since they were
+// inserted.  The objects are removed from the tree in a single traversal, the
+// tree is condensed once, and the objects are re-inserted with their current
+// bounds, either one by one or by rebuilding the tree as in InsertBatchAuto,
+// whichever is estimated to be cheaper.  This is cheaper than deleting and
+// re-inserting every object individually when many objects move, but since
+// the previous bounds of the objects are only known to the tree, the
+// traversal visits every entry even if few objects are listed.  Objects that
+// are not in the tree are ignored.
+//
+// The stored objects are compared with objs like in Delete: by their Equal
+// method if they implement Equaler, which takes time proportional to
+// len(objs) for every such object, and by identity otherwise.  Objects that
+// neither implement Equaler nor are comparable with ==, such as structs
+// holding slices, cannot be located; if objs holds any, an error is returned
+// and the tree is left unchanged.
+//
+// The new bounds must be returned as a new Rect rather than by modifying the
+// coordinates of the previous one in place, since the tree keeps a reference
+// to the previous bounds.  Hooks registered with OnDelete and OnInsert are
+// called for every moved object.
+//
+// The new bounds of all objects are validated as by TryInsert before any
+// object is removed, and if any of them are invalid, the first error is
+// returned and the tree is left unchanged.  Since the objects were accepted
+// when they were first inserted, they are not checked for duplicates or
+// passed to the handler registered with SetOutlierHandler again, so no object
+// is ever lost.
+func (tree *Rtree) BulkUpdate(objs []Spatial) error {
+	moved := make(map[Spatial]bool, len(objs))
+	for _, obj := range objs {
+		bb := tree.bounds(obj)
+		if len(bb.p) != tree.Dim {
+			return &DimError{tree.Dim, len(bb.p)}
+		}
+		if tree.StrictInsert {
+			if err := tree.checkBounds(bb); err != nil {
+				return err
+			}
+		}
+		if reflect.TypeOf(obj).Comparable() {
+			moved[obj] = true
+		} else if _, ok := obj.(Equaler); !ok {
+			return fmt.Errorf("rtreego: BulkUpdate cannot locate objects of the non-comparable type %T", obj)
+		}
+	}
+
+	removed := tree.deleteMatching(func(stored Spatial) bool {
+		if eq, ok := stored.(Equaler); ok {
+			for _, obj := range objs {
+				if eq.Equal(obj) {
+					return true
+				}
+			}
+			return false
+		}
+		if !reflect.TypeOf(stored).Comparable() {
+			return false
+		}
+		return moved[stored]
+	})
+	if len(removed) == 0 {
+		return nil
+	}
+
+	if tree.rebuildIsCheaper(len(removed)) {
+		tree.rebuildWith(removed)
+	} else {
+		for _, obj := range removed {
+			tree.insert(entry{bb: tree.bounds(obj), obj: obj}, 1)
+			tree.size++
+			tree.trackVelocity(obj)
+		}
+	}
+	for _, obj := range removed {
+		tree.notifyDelete(obj)
+		tree.notifyInsert(obj)
+	}
+	tree.mutated()
+	return nil
+}
+
+// DeleteFunc removes every object for which pred returns true and returns
+// the number of objects removed.  Like BulkUpdate, the objects are removed in
+// a single traversal and the tree is condensed once.
+func (tree *Rtree) DeleteFunc(pred func(Spatial) bool) int {
+	removed := tree.deleteMatching(pred)
+	if len(removed) == 0 {
+		return 0
+	}
+	for _, obj := range removed {
+		tree.notifyDelete(obj)
+	}
+	tree.mutated()
+	return len(removed)
+}
+
+// deleteMatching removes all objects for which pred returns true in a single
+// traversal and condenses the tree once.  The removed objects are returned.
+func (tree *Rtree) deleteMatching(pred func(Spatial) bool) []Spatial {
+	tree.condenseDirty()
+	tree.ownAll()
+	var removed []Spatial
+	var orphans []entry
+	tree.root.deleteMatching(tree.MinChildren, pred, &removed, &orphans)
+	tree.size -= len(removed)
+	tree.condensed(orphans)
+	return removed
+}
+
+// condensed shortens the tree after nodes have been eliminated from it and
+// reinserts the objects of the eliminated nodes.
+func (tree *Rtree) condensed(orphans []entry) {
+	tree.sorted = false
+	tree.invalidateQueryCache()
+	for !tree.root.leaf && len(tree.root.entries) == 1 {
+		tree.root = tree.own(tree.root, 0)
+		tree.root.parent = nil
+	}
+	if !tree.root.leaf && len(tree.root.entries) == 0 {
+		tree.root = &node{
+			entries: []entry{},
+			leaf:    true,
+			level:   1,
+		}
+	}
+	tree.height = tree.root.level
+
+	// reinsert the objects of eliminated nodes
+	for _, e := range orphans {
+		tree.insert(e, 1)
+	}
+}
+
+// deleteMatching removes the objects below n for which pred returns true.
+// Underflowing descendants of n are eliminated and their remaining objects
+// appended to orphans.  It returns whether n was changed.
+func (n *node) deleteMatching(minChildren int, pred func(Spatial) bool, removed *[]Spatial, orphans *[]entry) bool {
+	kept := n.entries[:0]
+	changed := false
+	for _, e := range n.entries {
+		if n.leaf {
+			if pred(e.obj) {
+				*removed = append(*removed, e.obj)
+				changed = true
+				continue
+			}
+			kept = append(kept, e)
+			continue
+		}
+
+		if !e.child.deleteMatching(minChildren, pred, removed, orphans) {
+			kept = append(kept, e)
+			continue
+		}
+		changed = true
+		if len(e.child.entries) < minChildren {
+			*orphans = e.child.appendObjects(*orphans)
+			continue
+		}
+		e.bb = e.child.computeBoundingBox()
+		kept = append(kept, e)
+	}
+
+	// clear the dropped entries so they can be garbage collected
+	for i := len(kept); i < len(n.entries); i++ {
+		n.entries[i] = entry{}
+	}
+	n.entries = kept
+	return changed
+}
+
+// appendObjects appends the leaf entries of all objects below n to entries.
+func (n *node) appendObjects(entries []entry) []entry {
+	if n.leaf {
+		return append(entries, n.entries...)
+	}
+	for _, e := range n.entries {
+		entries = e.child.appendObjects(entries)
+	}
+	return entries
+}
+
+// TrimCapacity reallocates the entries of every node in the tree to exactly
+// their length, releasing the excess capacity left behind by deletions.  This
+// is useful for long-lived trees after a large number of objects has been
+// deleted.
+func (tree *Rtree) TrimCapacity() {
+	tree.ownAll()
+	tree.root.trimCapacity()
+	tree.deleted = nil
+}
+
+func (n *node) trimCapacity() {
+	if len(n.entries) != cap(n.entries) {
+		entries := make([]entry, len(n.entries))
+		copy(entries, n.entries)
+		n.entries = entries
+	}
+	if n.leaf {
+		return
+	}
+	for _, e := range n.entries {
+		e.child.trimCapacity()
+	}
+}
+
+// Searching
+
+// SearchIntersect returns all objects that intersect the specified rectangle.
+// Implemented per Section 3.1 of "R-trees: A Dynamic Index Structure for
+// Spatial Searching" by A. Guttman, Proceedings of ACM SIGMOD, p. 47-57, 1984.
+func (tree *Rtree) SearchIntersect(bb Rect, filters ...Filter) []Spatial {
+	q := tree.startQuery()
+	var results []Spatial
+	if tree.queryCache != nil {
+		results = tree.searchIntersectCached(bb, filters, q)
+	} else {
+		results = tree.searchIntersect([]Spatial{}, tree.root, bb, filters, q)
+	}
+	tree.finishQuery(q)
+	return results
+}
+
+// AnyIntersect reports whether any object in the tree intersects the
+// specified rectangle.  The traversal stops at the first match, which is much
+// cheaper than SearchIntersect for dense regions.
+func (tree *Rtree) AnyIntersect(bb Rect) bool {
+	return tree.root.anyIntersect(bb)
+}
+
+func (n *node) anyIntersect(bb Rect) bool {
+	for _, e := range n.entries {
+		if !intersect(bb, e.bb) {
+			continue
+		}
+		if n.leaf || e.child.anyIntersect(bb) {
+			return true
+		}
+	}
+	return false
+}
+
+// CountIntersectMulti returns the number of objects intersecting each of the
+// specified rectangles, e.g. the bins of a histogram, in a single traversal of
+// the tree.  Every node is tested only against the rectangles that intersect
+// its parent, so nodes in the common part of overlapping rectangles are
+// visited once instead of once per rectangle.
+func (tree *Rtree) CountIntersectMulti(boxes []Rect) []int {
+	active := make([]int, len(boxes))
+	for i, bb := range boxes {
+		if len(bb.p) != tree.Dim {
+			panic(DimError{tree.Dim, len(bb.p)})
+		}
+		active[i] = i
+	}
+	counts := make([]int, len(boxes))
+	tree.root.countIntersectMulti(boxes, active, counts)
+	return counts
+}
+
+// countIntersectMulti adds the objects in the subtree of n to the counts of
+// the intersecting boxes, considering only the boxes with indices in active.
+func (n *node) countIntersectMulti(boxes []Rect, active []int, counts []int) {
+	relevant := make([]int, 0, len(active))
+	for _, e := range n.entries {
+		relevant = relevant[:0]
+		for _, i := range active {
+			if intersect(boxes[i], e.bb) {
+				relevant = append(relevant, i)
+			}
+		}
+		if len(relevant) == 0 {
+			continue
+		}
+		if n.leaf {
+			for _, i := range relevant {
+				counts[i]++
+			}
+		} else {
+			e.child.countIntersectMulti(boxes, relevant, counts)
+		}
+	}
+}
+
+// ReduceIntersect folds fn over the objects that intersect bb, starting with
+// init, and returns the final accumulator.  This computes aggregates such as
+// counts and sums without collecting the objects in a slice.
+func (tree *Rtree) ReduceIntersect(bb Rect, init interface{}, fn func(acc interface{}, obj Spatial) interface{}) interface{} {
+	if len(bb.p) != tree.Dim {
+		panic(DimError{tree.Dim, len(bb.p)})
+	}
+	return tree.root.reduceIntersect(bb, init, fn)
+}
+
+func (n *node) reduceIntersect(bb Rect, acc interface{}, fn func(acc interface{}, obj Spatial) interface{}) interface{} {
+	for _, e := range n.entries {
+		if !intersect(bb, e.bb) {
+			continue
+		}
+		if n.leaf {
+			acc = fn(acc, e.obj)
+		} else {
+			acc = e.child.reduceIntersect(bb, acc, fn)
+		}
+	}
+	return acc
+}
+
+// ClassifyIntersect returns the objects that intersect the specified
+// rectangle, split into those lying entirely inside it and those only
+// partially overlapping it, in a single traversal.  Subtrees lying in the
+// interior of bb are reported as inside without testing their objects.
+func (tree *Rtree) ClassifyIntersect(bb Rect) (inside, partial []Spatial) {
+	if len(bb.p) != tree.Dim {
+		panic(DimError{tree.Dim, len(bb.p)})
+	}
+	inside, partial = []Spatial{}, []Spatial{}
+	tree.root.classifyIntersect(bb, &inside, &partial)
+	return inside, partial
+}
+
+func (n *node) classifyIntersect(bb Rect, inside, partial *[]Spatial) {
+	for _, e := range n.entries {
+		if !intersect(bb, e.bb) {
+			continue
+		}
+		if n.leaf {
+			if bb.containsRect(e.bb) {
+				*inside = append(*inside, e.obj)
+			} else {
+				*partial = append(*partial, e.obj)
+			}
+			continue
+		}
+		if bb.containsRectInterior(e.bb) {
+			for _, oe := range e.child.appendObjects(nil) {
+				*inside = append(*inside, oe.obj)
+			}
+			continue
+		}
+		e.child.classifyIntersect(bb, inside, partial)
+	}
+}
+
+// OverlapResult is an object returned by SearchIntersectWithOverlap together
+// with the volume of the intersection of its bounding box with the query
+// rectangle.
+type OverlapResult struct {
+	Obj     Spatial
+	Overlap float64
+}
+
+// SearchIntersectWithOverlap returns all objects that intersect the specified
+// rectangle, like SearchIntersect, together with the volume of the overlap of
+// each object's bounding box with bb.  This allows ranking results by how
+// much of them lies in the query rectangle.
+func (tree *Rtree) SearchIntersectWithOverlap(bb Rect) []OverlapResult {
+	if len(bb.p) != tree.Dim {
+		panic(DimError{tree.Dim, len(bb.p)})
+	}
+	return tree.root.searchIntersectWithOverlap([]OverlapResult{}, bb)
+}
+
+func (n *node) searchIntersectWithOverlap(results []OverlapResult, bb Rect) []OverlapResult {
+	for _, e := range n.entries {
+		if !intersect(bb, e.bb) {
+			continue
+		}
+		if n.leaf {
+			results = append(results, OverlapResult{e.obj, overlap(bb, e.bb)})
+		} else {
+			results = e.child.searchIntersectWithOverlap(results, bb)
+		}
+	}
+	return results
+}
+
+// BestOverlap returns the object whose bounding box has the largest overlap
+// with bb, i.e. the largest volume of intersection, together with that
+// volume.  Subtrees are visited in the order of the overlap of their
+// bounding boxes with bb, which bounds the overlap of any object in them, and
+// skipped once that bound is no larger than the best overlap found.  Among
+// objects with the same overlap the first one found is returned.  If no
+// object overlaps bb with a positive volume, nil and 0 are returned.
+func (tree *Rtree) BestOverlap(bb Rect) (Spatial, float64) {
+	if len(bb.p) != tree.Dim {
+		panic(DimError{tree.Dim, len(bb.p)})
+	}
+	var best Spatial
+	bestOverlap := 0.0
+	tree.root.bestOverlap(bb, &best, &bestOverlap)
+	return best, bestOverlap
+}
+
+func (n *node) bestOverlap(bb Rect, best *Spatial, bestOverlap *float64) {
+	if n.leaf {
+		for _, e := range n.entries {
+			if v := overlap(bb, e.bb); v > *bestOverlap {
+				*best, *bestOverlap = e.obj, v
+			}
+		}
+		return
+	}
+
+	branches := make([]entry, 0, len(n.entries))
+	bounds := make([]float64, 0, len(n.entries))
+	for _, e := range n.entries {
+		if v := overlap(bb, e.bb); v > *bestOverlap {
+			branches = append(branches, e)
+			bounds = append(bounds, -v) // sorted by decreasing overlap
+		}
+	}
+	sort.Sort(entrySlice{branches, bounds})
+	for i, e := range branches {
+		if -bounds[i] <= *bestOverlap {
+			break
+		}
+		e.child.bestOverlap(bb, best, bestOverlap)
+	}
+}
+
+// TracedResult is an object returned by SearchIntersectTraced together with
+// the path along which it was reached.
+type TracedResult struct {
+	Obj Spatial
+
+	// Path holds the bounding boxes of the nodes from the root to the leaf
+	// holding Obj, both included.
+	Path []Rect
+}
+
+// SearchIntersectTraced returns all objects that intersect the specified
+// rectangle like SearchIntersect, each with the bounding boxes of the nodes
+// visited on the way to it.  This shows why an object was reached, and
+// comparing the paths of nearby results exposes detours caused by
+// overlapping nodes.
+func (tree *Rtree) SearchIntersectTraced(bb Rect) []TracedResult {
+	if len(bb.p) != tree.Dim {
+		panic(DimError{tree.Dim, len(bb.p)})
+	}
+	results := []TracedResult{}
+	if len(tree.root.entries) == 0 {
+		return results
+	}
+	return tree.root.searchIntersectTraced(results, []Rect{tree.root.computeBoundingBox()}, bb)
+}
+
+func (n *node) searchIntersectTraced(results []TracedResult, path []Rect, bb Rect) []TracedResult {
+	for _, e := range n.entries {
+		if !intersect(bb, e.bb) {
+			continue
+		}
+		if n.leaf {
+			results = append(results, TracedResult{e.obj, append([]Rect{}, path...)})
+		} else {
+			results = e.child.searchIntersectTraced(results, append(path, e.bb), bb)
+		}
+	}
+	return results
+}
+
+// IntersectingLeaves returns the bounding boxes of all leaves of the tree
+// that intersect the specified rectangle.  Every object intersecting bb is
+// stored in one of these leaves, so results can be cached per leaf rather
+// than per object.
+func (tree *Rtree) IntersectingLeaves(bb Rect) []Rect {
+	if len(bb.p) != tree.Dim {
+		panic(DimError{tree.Dim, len(bb.p)})
+	}
+	if tree.root.leaf {
+		if len(tree.root.entries) > 0 {
+			if leafBB := tree.root.computeBoundingBox(); intersect(bb, leafBB) {
+				return []Rect{leafBB}
+			}
+		}
+		return []Rect{}
+	}
+	return tree.root.intersectingLeaves([]Rect{}, bb)
+}
+
+func (n *node) intersectingLeaves(leaves []Rect, bb Rect) []Rect {
+	for _, e := range n.entries {
+		if !intersect(bb, e.bb) {
+			continue
+		}
+		if e.child.leaf {
+			leaves = append(leaves, e.bb)
+		} else {
+			leaves = e.child.intersectingLeaves(leaves, bb)
+		}
+	}
+	return leaves
+}
+
+// SearchExact returns all objects whose bounds equal bb up to eps, i.e.
+// whose coordinates each differ from the corresponding coordinate of bb by
+// at most eps.  With eps = 0 this matches the objects for which Rect.Equal
+// reports equal bounds.  Only subtrees that may contain such an object, i.e.
+// that contain bb shrunk by eps on every side, are visited.
+func (tree *Rtree) SearchExact(bb Rect, eps float64) []Spatial {
+	if len(bb.p) != tree.Dim {
+		panic(DimError{tree.Dim, len(bb.p)})
+	}
+	return tree.root.searchExact([]Spatial{}, bb, eps)
+}
+
+func (n *node) searchExact(results []Spatial, bb Rect, eps float64) []Spatial {
+	for _, e := range n.entries {
+		if n.leaf {
+			if e.bb.equalWithin(bb, eps) {
+				results = append(results, e.obj)
+			}
+			continue
+		}
+		covers := true
+		for i := range bb.p {
+			if e.bb.p[i] > bb.p[i]+eps || e.bb.q[i] < bb.q[i]-eps {
+				covers = false
+				break
+			}
+		}
+		if covers {
+			results = e.child.searchExact(results, bb, eps)
+		}
+	}
+	return results
+}
+
+// SearchIntersectMulti returns, for each of the specified rectangles, the
+// objects that intersect it.  The tree is traversed once for all rectangles,
+// and each subtree is only tested against the rectangles that intersect it,
+// which is cheaper than separate searches for overlapping query regions.
+func (tree *Rtree) SearchIntersectMulti(boxes []Rect) [][]Spatial {
+	results := make([][]Spatial, len(boxes))
+	active := make([]int, len(boxes))
+	for i, bb := range boxes {
+		if len(bb.p) != tree.Dim {
+			panic(DimError{tree.Dim, len(bb.p)})
+		}
+		results[i] = []Spatial{}
+		active[i] = i
+	}
+	tree.root.searchIntersectMulti(results, boxes, active)
+	return results
+}
+
+func (n *node) searchIntersectMulti(results [][]Spatial, boxes []Rect, active []int) {
+	matching := make([]int, 0, len(active))
+	for _, e := range n.entries {
+		matching = matching[:0]
+		for _, i := range active {
+			if intersect(boxes[i], e.bb) {
+				matching = append(matching, i)
+			}
+		}
+		if len(matching) == 0 {
+			continue
+		}
+
+		if !n.leaf {
+			e.child.searchIntersectMulti(results, boxes, matching)
+			continue
+		}
+		for _, i := range matching {
+			results[i] = append(results[i], e.obj)
+		}
+	}
+}
+
+// SearchQuadrants splits the specified rectangle of a two-dimensional tree
+// into four equal quadrants and returns the objects intersecting each of them,
+// using a single traversal.  Quadrant i contains the upper half of bb along
+// the x axis if bit 0 of i is set and along the y axis if bit 1 of i is set,
+// so the quadrants are ordered lower-left, lower-right, upper-left and
+// upper-right.  Objects spanning the boundaries between quadrants appear in
+// every quadrant they intersect.  It panics with a DimError if tree or bb is
+// not two-dimensional.
+func (tree *Rtree) SearchQuadrants(bb Rect) [4][]Spatial {
+	if tree.Dim != 2 {
+		panic(DimError{tree.Dim, 2})
+	}
+	if len(bb.p) != tree.Dim {
+		panic(DimError{tree.Dim, len(bb.p)})
+	}
+	center := Point{(bb.p[0] + bb.q[0]) / 2, (bb.p[1] + bb.q[1]) / 2}
+	var boxes []Rect
+	for i := 0; i < 4; i++ {
+		q := Rect{bb.p.Copy(), center.Copy()}
+		for d := 0; d < 2; d++ {
+			if i&(1<<uint(d)) != 0 {
+				q.p[d], q.q[d] = center[d], bb.q[d]
+			}
+		}
+		boxes = append(boxes, q)
+	}
+
+	var quadrants [4][]Spatial
+	copy(quadrants[:], tree.SearchIntersectMulti(boxes))
+	return quadrants
+}
+
+// SearchBox3D returns all objects that intersect the box with the specified
+// corners.  It is a shorthand for SearchIntersect on three-dimensional trees
+// and panics with a DimError if tree is not three-dimensional.
+func (tree *Rtree) SearchBox3D(minx, miny, minz, maxx, maxy, maxz float64) []Spatial {
+	if tree.Dim != 3 {
+		panic(DimError{tree.Dim, 3})
+	}
+	bb, err := NewRectFromPoints(Point{minx, miny, minz}, Point{maxx, maxy, maxz})
+	if err != nil {
+		panic(err)
+	}
+	return tree.SearchIntersect(bb)
+}
+
+// SearchIntersect2D returns all objects whose footprint in the first two
+// dimensions intersects the rectangle with the specified corners, regardless
+// of their extent along the other dimensions.  This allows e.g. a 3D tree to
+// be queried in the XY plane.  It panics with a DimError if tree has fewer
+// than two dimensions.
+func (tree *Rtree) SearchIntersect2D(xmin, ymin, xmax, ymax float64) []Spatial {
+	if tree.Dim < 2 {
+		panic(DimError{tree.Dim, 2})
+	}
+	bb := Rect{make(Point, tree.Dim), make(Point, tree.Dim)}
+	bb.p[0], bb.q[0] = math.Min(xmin, xmax), math.Max(xmin, xmax)
+	bb.p[1], bb.q[1] = math.Min(ymin, ymax), math.Max(ymin, ymax)
+	for i := 2; i < tree.Dim; i++ {
+		bb.p[i], bb.q[i] = math.Inf(-1), math.Inf(1)
+	}
+	return tree.SearchIntersect(bb)
+}
+
+// QueryPlan describes the work done by a search, see ExplainIntersect.
+type QueryPlan struct {
+	// NodesPerLevel holds the number of nodes visited at each level of the
+	// tree; index 0 holds the number of leaves.
+	NodesPerLevel []int
+
+	// Nodes holds the bounding boxes of the visited nodes in the order in
+	// which they were visited.
+	Nodes []Rect
+
+	// Results is the number of objects found.
+	Results int
+}
+
+// ExplainIntersect runs SearchIntersect for bb and reports the nodes visited.
+// Visiting many more nodes than necessary for the number of results points to
+// overlap between nodes, which Optimize may reduce.
+func (tree *Rtree) ExplainIntersect(bb Rect) QueryPlan {
+	if len(bb.p) != tree.Dim {
+		panic(DimError{tree.Dim, len(bb.p)})
+	}
+	plan := QueryPlan{NodesPerLevel: make([]int, tree.height)}
+	tree.root.explainIntersect(bb, tree.root.computeBoundingBox(), &plan)
+	return plan
+}
+
+func (n *node) explainIntersect(bb, nodeBB Rect, plan *QueryPlan) {
+	plan.NodesPerLevel[n.level-1]++
+	plan.Nodes = append(plan.Nodes, nodeBB)
+	for _, e := range n.entries {
+		if !intersect(bb, e.bb) {
+			continue
+		}
+		if n.leaf {
+			plan.Results++
+			continue
+		}
+		e.child.explainIntersect(bb, e.bb, plan)
+	}
+}
+
+// SearchIntersectOrdered is similar to SearchIntersect, but sorts the results
+// using less before returning them.  Unlike the traversal order returned by
+// SearchIntersect, the order does not depend on the internal structure of the
+// tree, which makes it reproducible across differently built trees.
+func (tree *Rtree) SearchIntersectOrdered(bb Rect, less func(a, b Spatial) bool) []Spatial {
+	results := tree.SearchIntersect(bb)
+	sort.Slice(results, func(i, j int) bool {
+		return less(results[i], results[j])
+	})
+	return results
+}
+
+// TopKIntersect returns the k objects with the highest score among the
+// objects that intersect bb, in order of decreasing score.  Only the k best
+// objects seen so far are kept during the search.
+func (tree *Rtree) TopKIntersect(bb Rect, k int, score func(Spatial) float64) []Spatial {
+	if len(bb.p) != tree.Dim {
+		panic(DimError{tree.Dim, len(bb.p)})
+	}
+	if k <= 0 {
+		return []Spatial{}
+	}
+
+	top := &scoredHeap{}
+	tree.root.topKIntersect(bb, k, score, top)
+	results := make([]Spatial, top.Len())
+	for i := len(results) - 1; i >= 0; i-- {
+		results[i] = heap.Pop(top).(scored).obj
+	}
+	return results
+}
+
+func (n *node) topKIntersect(bb Rect, k int, score func(Spatial) float64, top *scoredHeap) {
+	for _, e := range n.entries {
+		if !intersect(bb, e.bb) {
+			continue
+		}
+		if !n.leaf {
+			e.child.topKIntersect(bb, k, score, top)
+			continue
+		}
+		s := score(e.obj)
+		if top.Len() < k {
+			heap.Push(top, scored{e.obj, s})
+		} else if s > top.objs[0].score {
+			top.objs[0] = scored{e.obj, s}
+			heap.Fix(top, 0)
+		}
+	}
+}
+
+// scored is an object with its score.
+type scored struct {
+	obj   Spatial
+	score float64
+}
+
+// scoredHeap is a min-heap of scored objects.
+type scoredHeap struct {
+	objs []scored
+}
+
+func (h *scoredHeap) Len() int { return len(h.objs) }
+
+func (h *scoredHeap) Less(i, j int) bool { return h.objs[i].score < h.objs[j].score }
+
+func (h *scoredHeap) Swap(i, j int) { h.objs[i], h.objs[j] = h.objs[j], h.objs[i] }
+
+func (h *scoredHeap) Push(x interface{}) { h.objs = append(h.objs, x.(scored)) }
+
+func (h *scoredHeap) Pop() interface{} {
+	x := h.objs[len(h.objs)-1]
+	h.objs = h.objs[:len(h.objs)-1]
+	return x
+}
+
+// SearchIntersectWithLimit is similar to SearchIntersect, but returns
+// immediately when the first k results are found. A negative k behaves exactly
+// like SearchIntersect and returns all the results.
+//
+// Kept for backwards compatibility, please use SearchIntersect with a
+// LimitFilter.
+func (tree *Rtree) SearchIntersectWithLimit(k int, bb Rect) []Spatial {
+	// backwards compatibility, previous implementation didn't limit results if
+	// k was negative.
+	if k < 0 {
+		return tree.SearchIntersect(bb)
+	}
+	return tree.SearchIntersect(bb, LimitFilter(k))
+}
+
+// Sample returns k objects chosen uniformly at random from tree, or all
+// objects if the tree stores fewer than k, in the order in which they are
+// stored.  The choice is made with the source set with SetSeed, if any.
+func (tree *Rtree) Sample(k int) []Spatial {
+	intn := rand.Intn
+	if tree.rng != nil {
+		intn = tree.rng.Intn
+	}
+	// reservoir sampling, keeping the objects in a sorted subset of the
+	// stored order
+	var sample []Spatial
+	for i, e := range tree.root.appendObjects(nil) {
+		if i < k {
+			sample = append(sample, e.obj)
+		} else if j := intn(i + 1); j < k {
+			copy(sample[j:], sample[j+1:])
+			sample[k-1] = e.obj
+		}
+	}
+	return sample
+}
+
+// GetAll returns all objects stored in tree.
+func (tree *Rtree) GetAll() []Spatial {
+	objs := make([]Spatial, 0, tree.size)
+	for _, e := range tree.root.appendObjects(nil) {
+		objs = append(objs, e.obj)
+	}
+	return objs
+}
+
+// SearchNotIntersecting returns all objects that do not intersect the
+// specified rectangle, i.e. the complement of SearchIntersect(bb).  Subtrees
+// lying in the interior of bb are skipped and subtrees not intersecting bb
+// are returned without checking their objects individually.  It panics with
+// a DimError if bb does not have the dimension of the tree.
+func (tree *Rtree) SearchNotIntersecting(bb Rect) []Spatial {
+	if len(bb.p) != tree.Dim {
+		panic(DimError{tree.Dim, len(bb.p)})
+	}
+	return tree.root.searchNotIntersecting([]Spatial{}, bb)
+}
+
+func (n *node) searchNotIntersecting(results []Spatial, bb Rect) []Spatial {
+	for _, e := range n.entries {
+		if n.leaf {
+			if !intersect(e.bb, bb) {
+				results = append(results, e.obj)
+			}
+			continue
+		}
+
+		if bb.containsRectInterior(e.bb) {
+			continue
+		}
+		if !intersect(e.bb, bb) {
+			for _, oe := range e.child.appendObjects(nil) {
+				results = append(results, oe.obj)
+			}
+			continue
+		}
+		results = e.child.searchNotIntersecting(results, bb)
+	}
+	return results
+}
+
+// Boundary specifies whether objects touching the boundary of a query
+// rectangle intersect it.
+type Boundary int
+
+const (
+	// BoundaryOpen only matches objects that overlap the query rectangle with
+	// non-zero volume, so touching objects do not intersect.  This is the
+	// behavior of SearchIntersect.
+	BoundaryOpen Boundary = iota
+
+	// BoundaryClosed matches all objects sharing at least one point with the
+	// query rectangle, including objects that only touch its boundary.
+	BoundaryClosed
+
+	// BoundaryHalfOpen treats the query rectangle as half-open: objects
+	// touching its most-negative boundary intersect it, objects touching its
+	// most-positive boundary do not.  Queries with adjacent tiles then never
+	// return an object lying exactly on the shared boundary twice.
+	BoundaryHalfOpen
+)
+
+// intersects returns the intersection test for a query rectangle.
+func (b Boundary) intersects() func(query, r Rect) bool {
+	switch b {
+	case BoundaryClosed:
+		return intersectClosed
+	case BoundaryHalfOpen:
+		return intersectHalfOpen
+	}
+	return intersect
+}
+
+// SearchAxisRange returns all objects whose extent on the axis set with
+// SetLeafSortAxis overlaps the open interval (min, max), regardless of their
+// other coordinates.  The leaves are binary-searched for the objects starting
+// before max.  If leaf sorting is disabled, the first axis is used and every
+// object of the leaves is tested.
+func (tree *Rtree) SearchAxisRange(min, max float64) []Spatial {
+	return tree.root.searchAxisRange([]Spatial{}, tree.sortAxis(), min, max, tree.sortLeaves)
+}
+
+func (n *node) searchAxisRange(results []Spatial, axis int, min, max float64, sorted bool) []Spatial {
+	entries := n.entries
+	if n.leaf && sorted {
+		entries = entries[:sort.Search(len(entries), func(i int) bool {
+			return entries[i].bb.p[axis] >= max
+		})]
+	}
+	for _, e := range entries {
+		if e.bb.p[axis] >= max || e.bb.q[axis] <= min {
+			continue
+		}
+		if n.leaf {
+			results = append(results, e.obj)
+		} else {
+			results = e.child.searchAxisRange(results, axis, min, max, sorted)
+		}
+	}
+	return results
+}
+
+// SearchIntersectWithBoundary is similar to SearchIntersect, but boundary
+// controls whether objects touching the boundary of bb are returned.
+func (tree *Rtree) SearchIntersectWithBoundary(bb Rect, boundary Boundary, filters ...Filter) []Spatial {
+	q := tree.startQuery()
+	results, _ := tree.searchIntersectWith([]Spatial{}, tree.root, bb, boundary.intersects(), filters, q)
+	tree.finishQuery(q)
+	return results
+}
+
+// searchIntersect appends the objects below n intersecting bb and accepted by
+// the filters to results, counting the nodes visited in q.
+func (tree *Rtree) searchIntersect(results []Spatial, n *node, bb Rect, filters []Filter, q *slowQuery) []Spatial {
+	if tree.sorted {
+		results, _ = tree.searchIntersectSorted(results, n, bb, tree.sortAxis(), filters, q)
+	} else {
+		results, _ = tree.searchIntersectWith(results, n, bb, intersect, filters, q)
+	}
+	return results
+}
+
+// searchIntersectSorted is like searchIntersectWith for trees whose entries
+// are sorted by sortByAxis.  The entries of a node after the first one
+// starting at or past the end of bb on the sorted axis cannot intersect it.
+func (tree *Rtree) searchIntersectSorted(results []Spatial, n *node, bb Rect, axis int, filters []Filter, q *slowQuery) ([]Spatial, bool) {
+	q.visit()
+	for _, e := range n.entries {
+		if e.bb.p[axis] >= bb.q[axis] {
+			break
+		}
+		if !intersect(bb, e.bb) {
+			continue
+		}
+
+		if !n.leaf {
+			var abort bool
+			results, abort = tree.searchIntersectSorted(results, e.child, bb, axis, filters, q)
+			if abort {
+				return results, true
+			}
+			continue
+		}
+
+		refuse, abort := applyFilters(results, e.obj, filters)
+		if !refuse {
+			results = append(results, e.obj)
+		}
+
+		if abort {
+			return results, true
+		}
+	}
+	return results, false
+}
+
+// searchIntersectWith appends the objects below n for which intersects
+// reports true and that are accepted by the filters to results, and reports
+// whether a filter aborted the search.
+func (tree *Rtree) searchIntersectWith(results []Spatial, n *node, bb Rect, intersects func(query, r Rect) bool, filters []Filter, q *slowQuery) ([]Spatial, bool) {
+	q.visit()
+	for _, e := range n.entries {
+		if !intersects(bb, e.bb) {
+			continue
+		}
+
+		if !n.leaf {
+			var abort bool
+			results, abort = tree.searchIntersectWith(results, e.child, bb, intersects, filters, q)
+			if abort {
+				return results, true
+			}
+			continue
+		}
+
+		refuse, abort := applyFilters(results, e.obj, filters)
+		if !refuse {
+			results = append(results, e.obj)
+		}
+
+		if abort {
+			return results, true
+		}
+	}
+	return results, false
+}
+
+// RayIntersect returns all objects whose bounding boxes are hit by the ray
+// starting at origin and travelling along dir.  Subtrees whose bounding boxes
+// are missed by the ray are not visited.  If sorted is true, the results are
+// ordered by the distance along the ray at which it enters each bounding box,
+// otherwise they are returned in traversal order.
+func (tree *Rtree) RayIntersect(origin, dir Point, sorted bool) []Spatial {
+	hits, dists := tree.rayIntersect([]entry{}, []float64{}, tree.root, origin, dir)
+	if sorted {
+		sort.Sort(entrySlice{hits, dists})
+	}
+
+	results := make([]Spatial, len(hits))
+	for i := range hits {
+		results[i] = hits[i].obj
+	}
+	return results
+}
+
+func (tree *Rtree) rayIntersect(hits []entry, dists []float64, n *node, origin, dir Point) ([]entry, []float64) {
+	for _, e := range n.entries {
+		t, ok := e.bb.intersectRay(origin, dir)
+		if !ok {
+			continue
+		}
+
+		if !n.leaf {
+			hits, dists = tree.rayIntersect(hits, dists, e.child, origin, dir)
+			continue
+		}
+
+		hits = append(hits, e)
+		dists = append(dists, t)
+	}
+	return hits, dists
+}
+
+// SearchAlongPath returns all objects whose bounding boxes lie within width
+// of the polyline through the points of path, ordered by the position along
+// the path of their closest point on it.  This fetches data in the order in
+// which a route passes it.  The subtrees visited are those intersecting the
+// bounding box of a segment of the path enlarged by width on every side.
+func (tree *Rtree) SearchAlongPath(path []Point, width float64) []Spatial {
+	if len(path) == 0 {
+		return []Spatial{}
+	}
+	if len(path) == 1 {
+		path = []Point{path[0], path[0]}
+	}
+
+	// corridors[i] covers segment i and offsets[i] is the length of the path
+	// before it.
+	corridors := make([]Rect, len(path)-1)
+	offsets := make([]float64, len(path)-1)
+	for i := range corridors {
+		a, b := path[i], path[i+1]
+		if len(a) != tree.Dim {
+			panic(DimError{tree.Dim, len(a)})
+		}
+		if len(b) != tree.Dim {
+			panic(DimError{tree.Dim, len(b)})
+		}
+		c := Rect{make(Point, tree.Dim), make(Point, tree.Dim)}
+		for d := range a {
+			c.p[d] = math.Min(a[d], b[d]) - width
+			c.q[d] = math.Max(a[d], b[d]) + width
+		}
+		corridors[i] = c
+		if i > 0 {
+			offsets[i] = offsets[i-1] + path[i-1].dist(path[i])
+		}
+	}
+
+	hits, positions := tree.root.searchAlongPath([]entry{}, []float64{}, path, corridors, offsets, width)
+	sort.Stable(entrySlice{hits, positions})
+	results := make([]Spatial, len(hits))
+	for i := range hits {
+		results[i] = hits[i].obj
+	}
+	return results
+}
+
+func (n *node) searchAlongPath(hits []entry, positions []float64, path []Point, corridors []Rect, offsets []float64, width float64) ([]entry, []float64) {
+	for _, e := range n.entries {
+		near := false
+		for _, c := range corridors {
+			if intersectClosed(c, e.bb) {
+				near = true
+				break
+			}
+		}
+		if !near {
+			continue
+		}
+		if !n.leaf {
+			hits, positions = e.child.searchAlongPath(hits, positions, path, corridors, offsets, width)
+			continue
+		}
+
+		best, pos := math.Inf(1), 0.0
+		for i := range corridors {
+			dist, t := e.bb.segmentDist(path[i], path[i+1])
+			if dist < best {
+				best = dist
+				pos = offsets[i] + t*path[i].dist(path[i+1])
+			}
+		}
+		if best <= width {
+			hits = append(hits, e)
+			positions = append(positions, pos)
+		}
+	}
+	return hits, positions
+}
+
+// NearestNeighbor returns the closest object to the specified point.
+// Implemented per "Nearest Neighbor Queries" by Roussopoulos et al
+func (tree *Rtree) NearestNeighbor(p Point) Spatial {
+	q := tree.startQuery()
+	obj, _ := tree.nearestNeighbor(p, tree.root, math.MaxFloat64, nil, q)
+	tree.finishQuery(q)
+	return obj
+}
+
+// NearestFace returns the closest object to the specified point, the axis
+// of the face of its bounding box closest to the point and the distance to
+// that face.  If the point lies outside the bounding box, the face is the one
+// the point lies farthest off and the distance is the distance to the box.
+// If the point lies inside it, the face is the closest one and the distance
+// is the distance the point would have to move to leave the box through it.
+// For an empty tree, NearestFace returns nil, -1 and +Inf.
+func (tree *Rtree) NearestFace(p Point) (Spatial, int, float64) {
+	obj := tree.NearestNeighbor(p)
+	if obj == nil {
+		return nil, -1, math.Inf(1)
+	}
+	axis, dist := p.nearestFace(tree.bounds(obj))
+	return obj, axis, dist
+}
+
+// NearestNeighborRing returns the closest object to the specified point, like
+// NearestNeighbor.  It first searches boxes of doubling size around p until
+// one of them contains an object, and then only has to consider the subtrees
+// that are closer to p than that object.  This is faster than NearestNeighbor
+// when the objects are clustered near p.
+func (tree *Rtree) NearestNeighborRing(p Point) Spatial {
+	if len(p) != tree.Dim {
+		panic(DimError{tree.Dim, len(p)})
+	}
+	if tree.size == 0 {
+		return nil
+	}
+
+	// start with a box of about the average spacing between objects
+	bb := tree.root.computeBoundingBox()
+	extent := 0.0
+	for i := range bb.p {
+		extent = math.Max(extent, bb.q[i]-bb.p[i])
+	}
+	r := extent / math.Pow(float64(tree.size), 1/float64(tree.Dim))
+	if !(r > 0) {
+		r = 1
+	}
+
+	box := Rect{make(Point, len(p)), make(Point, len(p))}
+	for {
+		for i := range p {
+			box.p[i], box.q[i] = p[i]-r, p[i]+r
+		}
+		candidates := tree.SearchIntersectWithBoundary(box, BoundaryClosed)
+		if len(candidates) == 0 {
+			r *= 2
+			continue
+		}
+
+		var nearest Spatial
+		d := math.Inf(1)
+		for _, obj := range candidates {
+			if dist := p.minDist(tree.bounds(obj)); dist < d {
+				nearest, d = obj, dist
+			}
+		}
+		nearest, _ = tree.nearestNeighbor(p, tree.root, d, nearest, nil)
+		return nearest
+	}
+}
+
+// ClosestPair returns the two distinct objects in the tree whose bounding
+// boxes are closest to each other, along with the distance between them.  If
+// the tree contains fewer than two objects, nil objects and a NaN distance are
+// returned.
+//
+// Pairs of subtrees are visited in order of increasing distance between their
+// bounding boxes, and pairs that cannot contain a closer pair than the best
+// one found so far are pruned.
+func (tree *Rtree) ClosestPair() (a, b Spatial, dist float64) {
+	if tree.size < 2 {
+		return nil, nil, math.NaN()
+	}
+
+	cp := &closestPair{dist: math.Inf(1)}
+	cp.visit(tree.root, tree.root)
+	return cp.a, cp.b, math.Sqrt(cp.dist)
+}
+
+// closestPair holds the state of a ClosestPair search.  dist is a squared
+// distance.
+type closestPair struct {
+	a, b Spatial
+	dist float64
+}
+
+type nodePair struct {
+	n1, n2 *node
+	dist   float64
+}
+
+// visit searches all pairs of objects with one object below n1 and the other
+// one below n2.  n1 and n2 are always at the same level of the tree.
+func (cp *closestPair) visit(n1, n2 *node) {
+	if n1.leaf {
+		for i, e1 := range n1.entries {
+			others := n2.entries
+			if n1 == n2 {
+				others = n2.entries[i+1:]
+			}
+			for _, e2 := range others {
+				if d := e1.bb.minDistRect(e2.bb); d < cp.dist {
+					cp.a, cp.b, cp.dist = e1.obj, e2.obj, d
+				}
+			}
+		}
+		return
+	}
+
+	pairs := []nodePair{}
+	for i, e1 := range n1.entries {
+		others := n2.entries
+		if n1 == n2 {
+			others = n2.entries[i:]
+		}
+		for _, e2 := range others {
+			pairs = append(pairs, nodePair{e1.child, e2.child, e1.bb.minDistRect(e2.bb)})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].dist < pairs[j].dist })
+
+	for _, pair := range pairs {
+		if pair.dist >= cp.dist {
+			break
+		}
+		cp.visit(pair.n1, pair.n2)
+	}
+}
+
+// Partition is a group of spatially close objects stored below one node of an
+// Rtree.  Bounds returns the bounding box of that node.
+type Partition struct {
+	Objects []Spatial
+	bb      Rect
+}
+
+// Bounds returns the bounding box of the objects in p.
+func (p Partition) Bounds() Rect {
+	return p.bb
+}
+
+// PartitionAtLevel groups the objects of tree by the nodes at the specified
+// level, where level 1 is the leaf level and tree.Depth() is the root.  Every
+// object is contained in exactly one partition.  If level is out of range or
+// the tree is empty, nil is returned.
+func (tree *Rtree) PartitionAtLevel(level int) []Partition {
+	if level < 1 || level > tree.height || tree.size == 0 {
+		return nil
+	}
+	if level == tree.height {
+		return []Partition{tree.root.partition(tree.root.computeBoundingBox())}
+	}
+	return tree.root.partitionAtLevel(level, nil)
+}
+
+func (n *node) partitionAtLevel(level int, parts []Partition) []Partition {
+	for _, e := range n.entries {
+		if e.child.level == level {
+			parts = append(parts, e.child.partition(e.bb))
+			continue
+		}
+		parts = e.child.partitionAtLevel(level, parts)
+	}
+	return parts
+}
+
+// partition returns a Partition of the objects below n with bounding box bb.
+func (n *node) partition(bb Rect) Partition {
+	var objs []Spatial
+	for _, e := range n.appendObjects(nil) {
+		objs = append(objs, e.obj)
+	}
+	return Partition{Objects: objs, bb: bb}
+}
+
+// Extreme returns the object extending farthest along the specified axis: if
+// max is true, the object whose bounding box has the largest maximum
+// coordinate on axis, otherwise the object whose bounding box has the
+// smallest minimum coordinate on axis.  Subtrees which cannot contain a more
+// extreme object than the best one found so far are pruned.  If the tree is
+// empty, nil is returned.  It panics with a DimError if axis is not one of
+// the axes of tree.
+func (tree *Rtree) Extreme(axis int, max bool) Spatial {
+	if axis < 0 || axis >= tree.Dim {
+		panic(DimError{tree.Dim, axis})
+	}
+	// the search always maximizes, so minimum coordinates are negated
+	value := func(bb Rect) float64 {
+		if max {
+			return bb.q[axis]
+		}
+		return -bb.p[axis]
+	}
+	obj, _ := tree.root.extreme(value, nil, math.Inf(-1))
+	return obj
+}
+
+func (n *node) extreme(value func(Rect) float64, best Spatial, bestValue float64) (Spatial, float64) {
+	if n.leaf {
+		for _, e := range n.entries {
+			if v := value(e.bb); best == nil || v > bestValue {
+				best, bestValue = e.obj, v
+			}
+		}
+		return best, bestValue
+	}
+
+	branches := make([]entry, len(n.entries))
+	values := make([]float64, len(n.entries))
+	for i, e := range n.entries {
+		branches[i] = e
+		values[i] = -value(e.bb)
+	}
+	sort.Sort(entrySlice{branches, values})
+
+	for i, e := range branches {
+		if best != nil && -values[i] <= bestValue {
+			break
+		}
+		best, bestValue = e.child.extreme(value, best, bestValue)
+	}
+	return best, bestValue
+}
+
+// SmallestContaining returns the object with the smallest bounding box that
+// contains the specified point, or nil if no object contains it.  This finds
+// the innermost object of nested data such as hierarchical polygons.
+func (tree *Rtree) SmallestContaining(p Point) Spatial {
+	obj, _ := tree.root.smallestContaining(p, nil, math.Inf(1))
+	return obj
+}
+
+func (n *node) smallestContaining(p Point, best Spatial, bestSize float64) (Spatial, float64) {
+	for _, e := range n.entries {
+		if !e.bb.containsPoint(p) {
+			continue
+		}
+		if !n.leaf {
+			best, bestSize = e.child.smallestContaining(p, best, bestSize)
+			continue
+		}
+		if size := e.bb.Size(); best == nil || size < bestSize {
+			best, bestSize = e.obj, size
+		}
+	}
+	return best, bestSize
+}
+
+// CoverageArea returns the area (volume) of the union of the bounding boxes
+// of all leaves, as an estimate of how much of the space is occupied by the
+// data.  Space covered by several leaves is counted once.  Since leaves may
+// contain gaps between their objects, this is an upper bound on the space
+// covered by the objects themselves.  Computing the union takes time
+// polynomial in the number of leaves, O(n^3) for n leaves in 2D, so it is
+// meant for diagnostics rather than for large trees.
+func (tree *Rtree) CoverageArea() float64 {
+	return unionSize(tree.root.leafBoundingBoxes(nil), 0)
+}
+
+// Selectivity returns an estimate of the fraction of the objects in the tree
+// intersecting bb, for deciding whether a query is worth answering from the
+// index.  The estimate assumes the objects of every leaf to be spread
+// uniformly over its bounding box: a leaf contributes its number of objects
+// times the fraction of its bounding box covered by bb.  Only the inner nodes
+// intersecting bb are visited, not the objects in the leaves, so this is
+// cheaper than SearchIntersect.  An empty tree returns 0.
+func (tree *Rtree) Selectivity(bb Rect) float64 {
+	if len(bb.p) != tree.Dim {
+		panic(DimError{tree.Dim, len(bb.p)})
+	}
+	if tree.size == 0 {
+		return 0
+	}
+	if tree.root.leaf {
+		return coverage(tree.root.computeBoundingBox(), bb) * float64(len(tree.root.entries)) / float64(tree.size)
+	}
+	return tree.root.estimateIntersect(bb) / float64(tree.size)
+}
+
+// estimateIntersect returns the estimated number of objects below the inner
+// node n intersecting bb, see Selectivity.
+func (n *node) estimateIntersect(bb Rect) float64 {
+	count := 0.0
+	for _, e := range n.entries {
+		if !intersect(bb, e.bb) {
+			continue
+		}
+		if e.child.leaf {
+			count += coverage(e.bb, bb) * float64(len(e.child.entries))
+		} else {
+			count += e.child.estimateIntersect(bb)
+		}
+	}
+	return count
+}
+
+// coverage returns the fraction of the rectangle nbb covered by bb.  Along
+// axes on which nbb is degenerate, it counts as covered if bb intersects it.
+func coverage(nbb, bb Rect) float64 {
+	if !intersectClosed(nbb, bb) {
+		return 0
+	}
+	f := 1.0
+	for i := range nbb.p {
+		if d := nbb.q[i] - nbb.p[i]; d > 0 {
+			f *= (math.Min(nbb.q[i], bb.q[i]) - math.Max(nbb.p[i], bb.p[i])) / d
+		}
+	}
+	return f
+}
+
+func (n *node) leafBoundingBoxes(bbs []Rect) []Rect {
+	if !n.leaf {
+		for _, e := range n.entries {
+			bbs = e.child.leafBoundingBoxes(bbs)
+		}
+		return bbs
+	}
+	if len(n.entries) == 0 {
+		return bbs
+	}
+	return append(bbs, n.computeBoundingBox())
+}
+
+// DumpRects writes the bounds of every object in tree to w, one object per
+// line as its most-negative and most-positive corners.  The lines are sorted
+// by the Morton code of the centers of the objects and then by text, so the
+// output only depends on the objects stored and not on the structure of the
+// tree, which makes it suitable for golden files.
+func (tree *Rtree) DumpRects(w io.Writer) error {
+	entries := tree.root.appendObjects(nil)
+	if len(entries) == 0 {
+		return nil
+	}
+	bb := tree.root.computeBoundingBox()
+
+	type line struct {
+		code uint64
+		text string
+	}
+	lines := make([]line, len(entries))
+	for i, e := range entries {
+		lines[i] = line{mortonCode(e.bb, bb), fmt.Sprintf("%v %v\n", []float64(e.bb.p), []float64(e.bb.q))}
+	}
+	sort.Slice(lines, func(i, j int) bool {
+		if lines[i].code != lines[j].code {
+			return lines[i].code < lines[j].code
+		}
+		return lines[i].text < lines[j].text
+	})
+
+	for _, l := range lines {
+		if _, err := io.WriteString(w, l.text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DensestLeaf returns the bounding box and the number of objects of the leaf
+// holding the most objects, as a cheap estimate of where the data is densest.
+// Among leaves with equal counts the one with the smallest bounding box is
+// chosen.  An empty tree returns a zero Rect and 0.
+func (tree *Rtree) DensestLeaf() (Rect, int) {
+	if tree.size == 0 {
+		return Rect{}, 0
+	}
+	leaf, _ := tree.root.densestLeaf(nil, 0)
+	return leaf.computeBoundingBox(), len(leaf.entries)
+}
+
+func (n *node) densestLeaf(best *node, bestSize float64) (*node, float64) {
+	if !n.leaf {
+		for _, e := range n.entries {
+			best, bestSize = e.child.densestLeaf(best, bestSize)
+		}
+		return best, bestSize
+	}
+	if len(n.entries) == 0 {
+		return best, bestSize
+	}
+	if best == nil || len(n.entries) > len(best.entries) {
+		return n, n.computeBoundingBox().Size()
+	}
+	if len(n.entries) == len(best.entries) {
+		if size := n.computeBoundingBox().Size(); size < bestSize {
+			return n, size
+		}
+	}
+	return best, bestSize
+}
+
+// LeafAssignments returns the objects stored in each leaf of tree, in the
+// order in which they are stored.  Leaves are listed in depth-first order.
+// This is useful for comparing the shapes of trees built from the same data.
+func (tree *Rtree) LeafAssignments() [][]Spatial {
+	return tree.root.leafAssignments(nil)
+}
+
+func (n *node) leafAssignments(leaves [][]Spatial) [][]Spatial {
+	if !n.leaf {
+		for _, e := range n.entries {
+			leaves = e.child.leafAssignments(leaves)
+		}
+		return leaves
+	}
+	objs := make([]Spatial, len(n.entries))
+	for i, e := range n.entries {
+		objs[i] = e.obj
+	}
+	return append(leaves, objs)
+}
+
+// SplitByBounds partitions the objects of tree into new trees, one for each
+// of the specified rectangles plus a residual tree, for distributing the
+// index across shards.  An object is put into the tree of the first rectangle
+// containing the center of its bounding box, or into the residual tree, which
+// is the last of the len(boxes)+1 returned trees, if no rectangle contains it.
+// The new trees have the dimension and branching factors of tree and are
+// bulk-loaded; tree itself is not modified.
+func (tree *Rtree) SplitByBounds(boxes []Rect) []*Rtree {
+	for _, bb := range boxes {
+		if len(bb.p) != tree.Dim {
+			panic(DimError{tree.Dim, len(bb.p)})
+		}
+	}
+
+	parts := make([][]Spatial, len(boxes)+1)
+	for _, obj := range tree.GetAll() {
+		c := tree.bounds(obj).center()
+		i := 0
+		for i < len(boxes) && !boxes[i].containsPoint(c) {
+			i++
+		}
+		parts[i] = append(parts[i], obj)
+	}
+
+	trees := make([]*Rtree, len(parts))
+	for i, objs := range parts {
+		trees[i] = NewTree(tree.Dim, tree.MinChildren, tree.MaxChildren, objs...)
+	}
+	return trees
+}
+
+// BFS calls fn for every object in tree in coarse-to-fine order, for
+// progressive loading of the data.  Every node is represented by the first
+// object in its subtree, and the nodes are visited in breadth-first order.
+// The object representing the root is reported first with level 0, followed
+// by the objects representing each further child of the root with level 1,
+// and so on; every object is reported once, with the depth of the shallowest
+// node it represents.  The order only depends on the structure of the tree,
+// so it is reproducible for a tree that is not modified.
+func (tree *Rtree) BFS(fn func(level int, obj Spatial)) {
+	if len(tree.root.entries) == 0 {
+		return
+	}
+	fn(0, tree.root.first())
+
+	queue := []*node{tree.root}
+	for depth := 1; len(queue) > 0; depth++ {
+		var next []*node
+		for _, n := range queue {
+			for i, e := range n.entries {
+				if n.leaf {
+					if i > 0 {
+						fn(depth, e.obj)
+					}
+					continue
+				}
+				// the first child is represented by the object of n
+				if i > 0 {
+					fn(depth, e.child.first())
+				}
+				next = append(next, e.child)
+			}
+		}
+		queue = next
+	}
+}
+
+// first returns the first object in the subtree of n.
+func (n *node) first() Spatial {
+	for !n.leaf {
+		n = n.entries[0].child
+	}
+	return n.entries[0].obj
+}
+
+// LODNodes calls fn for the shallowest nodes of tree whose bounding boxes
+// have an area (volume) of at most maxArea, with the number of objects below
+// them, for level-of-detail rendering: every such node can be drawn as a
+// single blob instead of its objects.  Objects whose bounds are larger than
+// maxArea are passed to fn individually with a count of 1, so that the
+// counts always add up to Size().
+func (tree *Rtree) LODNodes(maxArea float64, fn func(bb Rect, count int)) {
+	if len(tree.root.entries) == 0 {
+		return
+	}
+	if bb := tree.root.computeBoundingBox(); bb.Size() <= maxArea {
+		fn(bb, tree.root.countObjects())
+		return
+	}
+	tree.root.lodNodes(maxArea, fn)
+}
+
+func (n *node) lodNodes(maxArea float64, fn func(Rect, int)) {
+	for _, e := range n.entries {
+		switch {
+		case n.leaf:
+			fn(e.bb, 1)
+		case e.bb.Size() <= maxArea:
+			fn(e.bb, e.child.countObjects())
+		default:
+			e.child.lodNodes(maxArea, fn)
+		}
+	}
+}
+
+// countObjects returns the number of objects below n.
+func (n *node) countObjects() int {
+	if n.leaf {
+		return len(n.entries)
+	}
+	count := 0
+	for _, e := range n.entries {
+		count += e.child.countObjects()
+	}
+	return count
+}
+
+// NodeRef is an opaque handle of a node of an Rtree, passed to the function
+// given to Walk or returned by InsertNearLeaf.  It is only valid until the
+// tree is modified, except as a hint for InsertNearLeaf.
+type NodeRef struct {
+	n *node
+}
+
+// Walk calls fn for the nodes of tree in depth-first order, starting with
+// the root, with the level of every node, which is 1 for the leaves.  The
+// children of a node are only visited if fn returns true for it.
+func (tree *Rtree) Walk(fn func(ref NodeRef, level int) bool) {
+	tree.root.walk(fn)
+}
+
+func (n *node) walk(fn func(NodeRef, int) bool) {
+	if !fn(NodeRef{n}, n.level) || n.leaf {
+		return
+	}
+	for _, e := range n.entries {
+		e.child.walk(fn)
+	}
+}
+
+// NodeBounds returns the bounding box of the node ref.  The bounding boxes of
+// all nodes but the root are stored in their parents and kept up to date as
+// entries are added and removed, so this does not visit the entries of the
+// node.  The bounding box of the root is computed from its entries.
+func (tree *Rtree) NodeBounds(ref NodeRef) Rect {
+	if ref.n.parent == nil {
+		return ref.n.computeBoundingBox()
+	}
+	return ref.n.getEntry().bb
+}
+
+// FindDuplicates returns the objects that are stored more than once in tree,
+// such as an object inserted twice when the tree is not in RejectDuplicates
+// mode.  Each duplicate is reported once, in the order in which GetAll would
+// first return it.  Objects are compared with ==, so they must be comparable.
+func (tree *Rtree) FindDuplicates() []Spatial {
+	var dups []Spatial
+	seen := make(map[Spatial]int, tree.size)
+	for _, obj := range tree.GetAll() {
+		seen[obj]++
+		if seen[obj] == 2 {
+			dups = append(dups, obj)
 		}
-		n = n.parent
 	}
+	return dups
+}
 
-	for i := len(tree.deleted) - 1; i >= 0; i-- {
-		n := tree.deleted[i]
-		// reinsert entry so that it will remain at the same level as before
-		e := entry{n.computeBoundingBox(), n, nil}
-		tree.insert(e, n.level+1)
+// DistinctBounds groups the objects in the tree by their bounds and returns
+// the number of objects in each group, keyed by the bounds of the group as
+// formatted by DumpRects without the newline.  Objects whose bounds are equal
+// within eps, as in SearchExact, belong to the same group: every object joins
+// the group of an earlier object within eps of it, or starts a new one, so
+// that with a positive eps the groups depend on the order of the objects.
+// This shows how much of the data shares the same geometry.
+//
+// Like the other queries, DistinctBounds does not condense a tree in
+// BalanceLazy mode, whose nodes still to be condensed hold their objects
+// until then, so it may be called concurrently with other queries.
+func (tree *Rtree) DistinctBounds(eps float64) map[string]int {
+	counts := make(map[string]int)
+	groups := NewTree(tree.Dim, tree.MinChildren, tree.MaxChildren)
+	for _, e := range tree.root.appendObjects(nil) {
+		var group *Item
+		if found := groups.SearchExact(e.bb, eps); len(found) > 0 {
+			group = found[0].(*Item)
+		} else {
+			group = NewItem(e.bb, fmt.Sprintf("%v %v", []float64(e.bb.p), []float64(e.bb.q)))
+			groups.Insert(group)
+		}
+		counts[group.Data.(string)]++
 	}
+	return counts
 }
 
-// Searching
+// EqualContents reports whether tree and other store the same objects, each
+// the same number of times, regardless of the structure of the trees.  This
+// is meant for tests comparing trees built in different ways.  Objects are
+// compared with ==, as in FindDuplicates, and the bounds they were indexed
+// with must be equal as well.
+func (tree *Rtree) EqualContents(other *Rtree) bool {
+	if tree.size != other.size || tree.Dim != other.Dim {
+		return false
+	}
+	a := tree.root.appendObjects(nil)
+	b := other.root.appendObjects(nil)
+	if len(a) != len(b) {
+		return false
+	}
+	bounds := make(map[Spatial][]Rect, len(a))
+	for _, e := range a {
+		bounds[e.obj] = append(bounds[e.obj], e.bb)
+	}
+	for _, e := range b {
+		bbs := bounds[e.obj]
+		i := 0
+		for i < len(bbs) && !bbs[i].Equal(e.bb) {
+			i++
+		}
+		if i == len(bbs) {
+			return false
+		}
+		bounds[e.obj] = append(bbs[:i], bbs[i+1:]...)
+	}
+	return true
+}
 
-// SearchIntersect returns all objects that intersect the specified rectangle.
-// Implemented per Section 3.1 of "R-trees: A Dynamic Index Structure for
-// Spatial Searching" by A. Guttman, Proceedings of ACM SIGMOD, p. 47-57, 1984.
-func (tree *Rtree) SearchIntersect(bb Rect, filters ...Filter) []Spatial {
-	return tree.searchIntersect([]Spatial{}, tree.root, bb, filters)
+// FillHistogram returns the number of nodes of tree holding each number of
+// entries, i.e. it maps a number of entries to the number of nodes with that
+// many entries.  Many nodes with few entries indicate that splits leave them
+// half-empty and that MinChildren or MaxChildren should be tuned.
+func (tree *Rtree) FillHistogram() map[int]int {
+	hist := make(map[int]int)
+	tree.root.fillHistogram(hist)
+	return hist
 }
 
-// SearchIntersectWithLimit is similar to SearchIntersect, but returns
-// immediately when the first k results are found. A negative k behaves exactly
-// like SearchIntersect and returns all the results.
-//
-// Kept for backwards compatibility, please use SearchIntersect with a
-// LimitFilter.
-func (tree *Rtree) SearchIntersectWithLimit(k int, bb Rect) []Spatial {
-	// backwards compatibility, previous implementation didn't limit results if
-	// k was negative.
-	if k < 0 {
-		return tree.SearchIntersect(bb)
+func (n *node) fillHistogram(hist map[int]int) {
+	hist[len(n.entries)]++
+	if n.leaf {
+		return
+	}
+	for _, e := range n.entries {
+		e.child.fillHistogram(hist)
 	}
-	return tree.SearchIntersect(bb, LimitFilter(k))
 }
 
-func (tree *Rtree) searchIntersect(results []Spatial, n *node, bb Rect, filters []Filter) []Spatial {
-	for _, e := range n.entries {
-		if !intersect(e.bb, bb) {
-			continue
-		}
+// CountByLevel returns the number of nodes at each level of tree.  Index 0
+// holds the number of leaves and the last index holds the root, so the length
+// of the result is tree.Depth().
+func (tree *Rtree) CountByLevel() []int {
+	counts := make([]int, tree.height)
+	tree.root.countByLevel(counts)
+	return counts
+}
 
-		if !n.leaf {
-			results = tree.searchIntersect(results, e.child, bb, filters)
-			continue
-		}
+func (n *node) countByLevel(counts []int) {
+	counts[n.level-1]++
+	if n.leaf {
+		return
+	}
+	for _, e := range n.entries {
+		e.child.countByLevel(counts)
+	}
+}
 
-		refuse, abort := applyFilters(results, e.obj, filters)
-		if !refuse {
-			results = append(results, e.obj)
-		}
+// OverlapStats returns the total overlap volume of all pairs of sibling
+// entries in the internal nodes of the tree, and its average over all such
+// pairs.  Less overlap generally means that fewer subtrees have to be visited
+// by queries, which makes it useful for comparing tree-building strategies.
+func (tree *Rtree) OverlapStats() (total float64, avg float64) {
+	total, pairs := tree.root.overlapStats()
+	if pairs == 0 {
+		return 0, 0
+	}
+	return total, total / float64(pairs)
+}
 
-		if abort {
-			break
+func (n *node) overlapStats() (total float64, pairs int) {
+	if n.leaf {
+		return 0, 0
+	}
+	for i, e1 := range n.entries {
+		for _, e2 := range n.entries[i+1:] {
+			total += overlap(e1.bb, e2.bb)
+			pairs++
 		}
+		t, p := e1.child.overlapStats()
+		total += t
+		pairs += p
 	}
-	return results
+	return total, pairs
 }
 
-// NearestNeighbor returns the closest object to the specified point.
-// Implemented per "Nearest Neighbor Queries" by Roussopoulos et al
-func (tree *Rtree) NearestNeighbor(p Point) Spatial {
-	obj, _ := tree.nearestNeighbor(p, tree.root, math.MaxFloat64, nil)
-	return obj
+// TotalMargin returns the sum of the margins (perimeters) of the bounding
+// boxes of all entries in the internal nodes of the tree.  Like the overlap
+// returned by OverlapStats, it predicts query performance: a lower total
+// margin means squarer nodes, which are visited by fewer queries.
+func (tree *Rtree) TotalMargin() float64 {
+	return tree.root.totalMargin()
+}
+
+func (n *node) totalMargin() float64 {
+	if n.leaf {
+		return 0
+	}
+	total := 0.0
+	for _, e := range n.entries {
+		total += e.bb.margin() + e.child.totalMargin()
+	}
+	return total
 }
 
 // GetAllBoundingBoxes returning slice of bounding boxes by traversing tree. Slice
@@ -755,10 +4056,16 @@ func pruneEntriesMinDist(d float64, entries []entry, minDists []float64) []entry
 	return entries[:i]
 }
 
-func (tree *Rtree) nearestNeighbor(p Point, n *node, d float64, nearest Spatial) (Spatial, float64) {
+// nearestNeighbor returns the object in the subtree of n closest to p if it is
+// closer than nearest, which is at the squared distance d from p, and its
+// squared distance.  Like minDist and minMaxDist, all distances are squared,
+// which preserves their order without taking square roots.  The nodes visited
+// are counted in q.
+func (tree *Rtree) nearestNeighbor(p Point, n *node, d float64, nearest Spatial, q *slowQuery) (Spatial, float64) {
+	q.visit()
 	if n.leaf {
 		for _, e := range n.entries {
-			dist := math.Sqrt(p.minDist(e.bb))
+			dist := p.minDist(e.bb)
 			if dist < d {
 				d = dist
 				nearest = e.obj
@@ -783,11 +4090,11 @@ func (tree *Rtree) nearestNeighbor(p Point, n *node, d float64, nearest Spatial)
 
 		for _, e := range n.entries {
 			minDist := p.minDist(e.bb)
-			if minDist > minMinMaxDist {
+			if minDist > minMinMaxDist || minDist >= d {
 				continue
 			}
 
-			subNearest, dist := tree.nearestNeighbor(p, e.child, d, nearest)
+			subNearest, dist := tree.nearestNeighbor(p, e.child, d, nearest, q)
 			if dist < d {
 				d = dist
 				nearest = subNearest
@@ -798,7 +4105,51 @@ func (tree *Rtree) nearestNeighbor(p Point, n *node, d float64, nearest Spatial)
 	return nearest, d
 }
 
+// NearestNeighborWeighted returns the closest object to the specified point
+// using a weighted Euclidean distance, in which the squared distance along
+// axis i is multiplied by weights[i].  This is useful when the axes have
+// different units.  With all weights equal to 1 it returns the same object as
+// NearestNeighbor.  Weights must not be negative.
+func (tree *Rtree) NearestNeighborWeighted(p Point, weights []float64) Spatial {
+	obj, _ := tree.nearestNeighborWeighted(p, weights, tree.root, math.MaxFloat64, nil)
+	return obj
+}
+
+func (tree *Rtree) nearestNeighborWeighted(p Point, weights []float64, n *node, d float64, nearest Spatial) (Spatial, float64) {
+	if n.leaf {
+		for _, e := range n.entries {
+			if dist := p.minDistWeighted(e.bb, weights); dist < d {
+				d = dist
+				nearest = e.obj
+			}
+		}
+		return nearest, d
+	}
+
+	// visit the closest branches first and prune the ones that are farther
+	// away than the nearest object found so far
+	branches := make([]entry, len(n.entries))
+	dists := make([]float64, len(n.entries))
+	for i, e := range n.entries {
+		branches[i] = e
+		dists[i] = p.minDistWeighted(e.bb, weights)
+	}
+	sort.Sort(entrySlice{branches, dists})
+
+	for i, e := range branches {
+		if dists[i] >= d {
+			break
+		}
+		nearest, d = tree.nearestNeighborWeighted(p, weights, e.child, d, nearest)
+	}
+	return nearest, d
+}
+
 // NearestNeighbors gets the closest Spatials to the Point.
+//
+// The search orders and prunes candidates by the squared distance from the
+// point, which preserves the order of distances without taking a square root
+// per comparison.  Use NearestNeighborsWithDist to obtain the distances.
 func (tree *Rtree) NearestNeighbors(k int, p Point, filters ...Filter) []Spatial {
 	// preallocate the buffers for sortings the branches. At each level of the
 	// tree, we slide the buffer by the number of entries in the node.
@@ -810,14 +4161,433 @@ func (tree *Rtree) NearestNeighbors(k int, p Point, filters ...Filter) []Spatial
 	dists := make([]float64, 0, k)
 	objs := make([]Spatial, 0, k)
 
-	objs, _, _ = tree.nearestNeighbors(k, p, tree.root, dists, objs, filters, branches, branchDists)
+	q := tree.startQuery()
+	objs, _, _ = tree.nearestNeighbors(k, p, tree.root, dists, objs, filters, nil, branches, branchDists, q)
+	tree.finishQuery(q)
+	return objs
+}
+
+// NearestNeighborsWithDist is like NearestNeighbors, but also returns the
+// Euclidean distance from p to the bounding box of each object.  The
+// distances are true distances, not squared ones; the square roots are taken
+// once for the results after the search.
+func (tree *Rtree) NearestNeighborsWithDist(k int, p Point, filters ...Filter) ([]Spatial, []float64) {
+	maxBufSize := tree.MaxChildren * tree.Depth()
+	branches := make([]entry, maxBufSize)
+	branchDists := make([]float64, maxBufSize)
+
+	dists := make([]float64, 0, k)
+	objs := make([]Spatial, 0, k)
+
+	q := tree.startQuery()
+	objs, dists, _ = tree.nearestNeighbors(k, p, tree.root, dists, objs, filters, nil, branches, branchDists, q)
+	tree.finishQuery(q)
+	for i, d := range dists {
+		dists[i] = math.Sqrt(d)
+	}
+	return objs, dists
+}
+
+// NearestNeighborsForCluster returns the union of the k nearest neighbors of
+// each of the specified points, which is cheaper than separate searches when
+// the points are close to each other.  The tree is traversed once in order of
+// increasing distance of the nodes from the closest point, and the traversal
+// stops when the next node is farther from every point than the k-th nearest
+// neighbor found so far for the point that has the farthest one.  The
+// neighbors of the first point are returned first, by increasing distance,
+// followed by the new neighbors of each following point.  The neighbors of
+// different points are told apart by the entries of the tree holding them, so
+// the objects need not be comparable, and an object stored twice is returned
+// once for every stored copy that is a neighbor.
+func (tree *Rtree) NearestNeighborsForCluster(points []Point, k int) []Spatial {
+	for _, p := range points {
+		if len(p) != tree.Dim {
+			panic(DimError{tree.Dim, len(p)})
+		}
+	}
+	if k <= 0 || len(points) == 0 {
+		return []Spatial{}
+	}
+
+	dists := make([][]float64, len(points))
+	nearest := make([][]Spatial, len(points))
+	for i := range points {
+		dists[i] = make([]float64, 0, k)
+		nearest[i] = make([]Spatial, 0, k)
+	}
+	// bound returns the largest k-th nearest distance over all points.
+	bound := func() float64 {
+		max := 0.0
+		for _, d := range dists {
+			if len(d) < k {
+				return math.Inf(1)
+			}
+			max = math.Max(max, d[k-1])
+		}
+		return max
+	}
+	// minDist returns the distance of bb from the closest point.
+	minDist := func(bb Rect) float64 {
+		min := math.Inf(1)
+		for _, p := range points {
+			min = math.Min(min, p.minDist(bb))
+		}
+		return min
+	}
+
+	queue := &nodeHeap{}
+	heap.Push(queue, nodeDist{tree.root, 0})
+	for queue.Len() > 0 {
+		next := heap.Pop(queue).(nodeDist)
+		if next.dist > bound() {
+			break
+		}
+		for j, e := range next.n.entries {
+			if !next.n.leaf {
+				heap.Push(queue, nodeDist{e.child, minDist(e.bb)})
+				continue
+			}
+			ref := storedEntry{&next.n.entries[j]}
+			for i, p := range points {
+				dists[i], nearest[i], _ = insertNearest(k, dists[i], nearest[i], p.minDist(e.bb), ref, nil)
+			}
+		}
+	}
+
+	// an entry is a neighbor of several points if they are close, so the
+	// union is formed by the identity of the entries, which unlike the
+	// objects are always comparable
+	results := []Spatial{}
+	seen := make(map[*entry]bool)
+	for _, refs := range nearest {
+		for _, ref := range refs {
+			if e := ref.(storedEntry).e; !seen[e] {
+				seen[e] = true
+				results = append(results, e.obj)
+			}
+		}
+	}
+	return results
+}
+
+// storedEntry is a leaf entry found by a search, which is distinct from every
+// other entry of the tree even if they hold equal objects.
+type storedEntry struct {
+	e *entry
+}
+
+func (s storedEntry) Bounds() Rect {
+	return s.e.bb
+}
+
+// nodeDist is a node with its distance from a query.
+type nodeDist struct {
+	n    *node
+	dist float64
+}
+
+// nodeHeap is a min-heap of nodes by distance.
+type nodeHeap []nodeDist
+
+func (h nodeHeap) Len() int { return len(h) }
+
+func (h nodeHeap) Less(i, j int) bool { return h[i].dist < h[j].dist }
+
+func (h nodeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *nodeHeap) Push(x interface{}) { *h = append(*h, x.(nodeDist)) }
+
+func (h *nodeHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// SetPreferEpsilon sets the difference of distances up to which
+// NearestNeighborPreferring considers two objects equally near.  It is 0 by
+// default, i.e. only objects at exactly the same distance are compared.
+func (tree *Rtree) SetPreferEpsilon(eps float64) {
+	tree.preferEpsilon = eps
+}
+
+// NearestNeighborPreferring returns the closest object to the specified
+// point like NearestNeighbor, but among the objects whose distance is within
+// the epsilon set with SetPreferEpsilon of the closest distance it returns
+// the one preferred by better, which reports whether a is preferred over b.
+// Of candidates neither of which is preferred, the closer one is returned.
+// An empty tree returns nil.
+func (tree *Rtree) NearestNeighborPreferring(p Point, better func(a, b Spatial) bool) Spatial {
+	if len(p) != tree.Dim {
+		panic(DimError{tree.Dim, len(p)})
+	}
+	var candidates []scored
+	nearest := math.Inf(1)
+	tree.root.nearestCandidates(p, tree.preferEpsilon, &nearest, &candidates)
+
+	var chosen Spatial
+	chosenDist := 0.0
+	for _, c := range candidates {
+		if c.score > nearest+tree.preferEpsilon {
+			continue
+		}
+		if chosen == nil || better(c.obj, chosen) || (!better(chosen, c.obj) && c.score < chosenDist) {
+			chosen, chosenDist = c.obj, c.score
+		}
+	}
+	return chosen
+}
+
+// nearestCandidates appends the objects below n within eps of the distance
+// nearest of the closest object found so far to candidates, scored by their
+// distances from p, and updates nearest.  Candidates found
+// before a closer object may be too far away.
+func (n *node) nearestCandidates(p Point, eps float64, nearest *float64, candidates *[]scored) {
+	if n.leaf {
+		for _, e := range n.entries {
+			d := math.Sqrt(p.minDist(e.bb))
+			if d > *nearest+eps {
+				continue
+			}
+			if d < *nearest {
+				*nearest = d
+			}
+			*candidates = append(*candidates, scored{e.obj, d})
+		}
+		return
+	}
+
+	// visit the children closest first, so that farther ones can be pruned
+	branches := make([]entry, len(n.entries))
+	dists := make([]float64, len(n.entries))
+	for i, e := range n.entries {
+		branches[i] = e
+		dists[i] = math.Sqrt(p.minDist(e.bb))
+	}
+	sort.Sort(entrySlice{branches, dists})
+	for i, e := range branches {
+		if dists[i] > *nearest+eps {
+			break
+		}
+		e.child.nearestCandidates(p, eps, nearest, candidates)
+	}
+}
+
+// ReverseNearestNeighbors returns the objects that have p as their nearest
+// neighbor, i.e. the objects for which no other object in the tree is closer
+// than p.  Objects are represented by the centers of their bounding boxes, so
+// the distance between two objects is the distance between their centers.
+//
+// The query works in two phases.  In the filter phase, the tree is traversed
+// closest first from p, and every subtree lying entirely on the side of the
+// perpendicular bisector of p and a candidate found so far that is closer to
+// the candidate is pruned, since the candidate is closer than p to all of its
+// objects.  The remaining objects are candidates.  In the refinement phase,
+// every candidate is checked with a range query for another object closer
+// to it than p.
+//
+// Implemented per "Reverse kNN Search in Arbitrary Dimensionality" by Y. Tao,
+// D. Papadias and X. Lian, Proceedings of VLDB, p. 744-755, 2004, for k = 1.
+func (tree *Rtree) ReverseNearestNeighbors(p Point) []Spatial {
+	if len(p) != tree.Dim {
+		panic(DimError{tree.Dim, len(p)})
+	}
+
+	// filter
+	var candidates []entry
+	var centers []Point
+	pruned := func(bb Rect) bool {
+		for _, c := range centers {
+			if closerToCenter(bb, c, p) {
+				return true
+			}
+		}
+		return false
+	}
+	queue := &nodeHeap{}
+	heap.Push(queue, nodeDist{tree.root, 0})
+	for queue.Len() > 0 {
+		n := heap.Pop(queue).(nodeDist).n
+		if !n.leaf {
+			for _, e := range n.entries {
+				if !pruned(e.bb) {
+					heap.Push(queue, nodeDist{e.child, p.minDist(e.bb)})
+				}
+			}
+			continue
+		}
+		entries := append([]entry{}, n.entries...)
+		dists := make([]float64, len(entries))
+		for i, e := range entries {
+			dists[i] = p.dist(e.bb.center())
+		}
+		sort.Sort(entrySlice{entries, dists})
+		for _, e := range entries {
+			if c := e.bb.center(); !pruned(Rect{c, c}) {
+				candidates = append(candidates, e)
+				centers = append(centers, c)
+			}
+		}
+	}
+
+	// refinement
+	results := []Spatial{}
+	for i, e := range candidates {
+		c := centers[i]
+		r := p.dist(c)
+		closer := false
+		for _, other := range tree.SearchIntersect(c.ToRect(r)) {
+			if other != e.obj && c.dist(tree.bounds(other).center()) < r {
+				closer = true
+				break
+			}
+		}
+		if !closer {
+			results = append(results, e.obj)
+		}
+	}
+	return results
+}
+
+// closerToCenter reports whether every point of bb is closer to c than to p.
+func closerToCenter(bb Rect, c, p Point) bool {
+	// x is closer to c iff 2 x.(p-c) < |p|^2 - |c|^2, so compare the
+	// largest value of the left-hand side over bb
+	lhs, rhs := 0.0, 0.0
+	for i := range p {
+		d := p[i] - c[i]
+		x := bb.p[i]
+		if d > 0 {
+			x = bb.q[i]
+		}
+		lhs += 2 * x * d
+		rhs += p[i]*p[i] - c[i]*c[i]
+	}
+	return lhs < rhs
+}
+
+// LeafInfo describes a leaf of the tree returned by NearestLeaves.
+type LeafInfo struct {
+	Bounds Rect // bounding box of the objects in the leaf
+	Count  int  // number of objects in the leaf
+}
+
+// NearestLeaves returns the k leaves of the tree closest to the specified
+// point, ordered by the distance of their bounding boxes from it, for a quick
+// answer to which clusters of objects are nearby without visiting the
+// objects themselves.  Empty leaves are skipped, and fewer than k leaves are
+// returned if the tree has fewer.
+func (tree *Rtree) NearestLeaves(k int, p Point) []LeafInfo {
+	if len(p) != tree.Dim {
+		panic(DimError{tree.Dim, len(p)})
+	}
+	leaves := []LeafInfo{}
+	queue := &nodeHeap{}
+	heap.Push(queue, nodeDist{tree.root, 0})
+	for queue.Len() > 0 && len(leaves) < k {
+		n := heap.Pop(queue).(nodeDist).n
+		if n.leaf {
+			if len(n.entries) > 0 {
+				leaves = append(leaves, LeafInfo{n.computeBoundingBox(), len(n.entries)})
+			}
+			continue
+		}
+		for _, e := range n.entries {
+			heap.Push(queue, nodeDist{e.child, p.minDist(e.bb)})
+		}
+	}
+	return leaves
+}
+
+// NearestNeighborsTieBreak is like NearestNeighbors, but breaks ties between
+// objects at the same distance from p with less, which reports whether a
+// should be returned before b.  Among equidistant objects, those ordered first
+// by less are returned first and are preferred when not all of them fit into
+// the k results, which makes the result deterministic.
+func (tree *Rtree) NearestNeighborsTieBreak(k int, p Point, less func(a, b Spatial) bool, filters ...Filter) []Spatial {
+	maxBufSize := tree.MaxChildren * tree.Depth()
+	branches := make([]entry, maxBufSize)
+	branchDists := make([]float64, maxBufSize)
+
+	dists := make([]float64, 0, k)
+	objs := make([]Spatial, 0, k)
+
+	q := tree.startQuery()
+	objs, _, _ = tree.nearestNeighbors(k, p, tree.root, dists, objs, filters, less, branches, branchDists, q)
+	tree.finishQuery(q)
 	return objs
 }
 
+// NearestNeighborsCapped returns the k closest objects to the specified point
+// like NearestNeighbors, but holds at most maxQueueLen nodes in memory while
+// searching, for use under tight memory constraints.  Nodes are visited
+// closest first from a queue, and when the queue grows beyond maxQueueLen,
+// the farthest nodes are dropped.  The returned bool reports whether that
+// happened, in which case the results may be approximate: objects in dropped
+// nodes are missed, so farther objects may be returned in their place.
+func (tree *Rtree) NearestNeighborsCapped(k, maxQueueLen int, p Point) ([]Spatial, bool) {
+	if len(p) != tree.Dim {
+		panic(DimError{tree.Dim, len(p)})
+	}
+	if maxQueueLen < 1 {
+		maxQueueLen = 1
+	}
+	dists := make([]float64, 0, k)
+	objs := make([]Spatial, 0, k)
+	if k <= 0 {
+		return objs, false
+	}
+
+	capped := false
+	queue := &nodeHeap{}
+	heap.Push(queue, nodeDist{tree.root, 0})
+	for queue.Len() > 0 {
+		next := heap.Pop(queue).(nodeDist)
+		if len(dists) == k && next.dist > dists[k-1] {
+			break
+		}
+		n := next.n
+		if n.leaf {
+			for _, e := range n.entries {
+				dists, objs, _ = insertNearest(k, dists, objs, p.minDist(e.bb), e.obj, nil)
+			}
+			continue
+		}
+		for _, e := range n.entries {
+			d := p.minDist(e.bb)
+			if len(dists) == k && d > dists[k-1] {
+				continue
+			}
+			heap.Push(queue, nodeDist{e.child, d})
+			if queue.Len() > maxQueueLen {
+				// drop the farthest node
+				farthest := 0
+				for i, nd := range *queue {
+					if nd.dist > (*queue)[farthest].dist {
+						farthest = i
+					}
+				}
+				heap.Remove(queue, farthest)
+				capped = true
+			}
+		}
+	}
+	return objs, capped
+}
+
 // insert obj into nearest and return the first k elements in increasing order.
 func insertNearest(k int, dists []float64, nearest []Spatial, dist float64, obj Spatial, filters []Filter) ([]float64, []Spatial, bool) {
+	return insertNearestWith(k, dists, nearest, dist, obj, filters, nil)
+}
+
+// insertNearestWith is like insertNearest, but places obj before the objects
+// at the same distance that it is ordered before by less, if less is not nil.
+func insertNearestWith(k int, dists []float64, nearest []Spatial, dist float64, obj Spatial, filters []Filter, less func(a, b Spatial) bool) ([]float64, []Spatial, bool) {
 	i := sort.SearchFloat64s(dists, dist)
 	for i < len(nearest) && dist >= dists[i] {
+		if dist == dists[i] && less != nil && less(obj, nearest[i]) {
+			break
+		}
 		i++
 	}
 	if i >= k {
@@ -847,12 +4617,13 @@ func insertNearest(k int, dists []float64, nearest []Spatial, dist float64, obj
 	return dists, nearest, false
 }
 
-func (tree *Rtree) nearestNeighbors(k int, p Point, n *node, dists []float64, nearest []Spatial, filters []Filter, b []entry, bd []float64) ([]Spatial, []float64, bool) {
+func (tree *Rtree) nearestNeighbors(k int, p Point, n *node, dists []float64, nearest []Spatial, filters []Filter, less func(a, b Spatial) bool, b []entry, bd []float64, q *slowQuery) ([]Spatial, []float64, bool) {
+	q.visit()
 	var abort bool
 	if n.leaf {
 		for _, e := range n.entries {
 			dist := p.minDist(e.bb)
-			dists, nearest, abort = insertNearest(k, dists, nearest, dist, e.obj, filters)
+			dists, nearest, abort = insertNearestWith(k, dists, nearest, dist, e.obj, filters, less)
 			if abort {
 				break
 			}
@@ -864,7 +4635,7 @@ func (tree *Rtree) nearestNeighbors(k int, p Point, n *node, dists []float64, ne
 			branches = pruneEntriesMinDist(dists[l-1], branches, branchDists)
 		}
 		for _, e := range branches {
-			nearest, dists, abort = tree.nearestNeighbors(k, p, e.child, dists, nearest, filters, b[len(n.entries):], bd[len(n.entries):])
+			nearest, dists, abort = tree.nearestNeighbors(k, p, e.child, dists, nearest, filters, less, b[len(n.entries):], bd[len(n.entries):], q)
 			if abort {
 				break
 			}
@@ -0,0 +1,350 @@
+// Copyright 2012 Daniel Connelly.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rtreego
+
+import "math"
+
+// Rect2D is a two-dimensional rectangle whose corners are stored in arrays
+// instead of slices.  It is the rectangle type of Rtree2D.
+type Rect2D struct {
+	Min, Max [2]float64
+}
+
+// NewRect2D constructs a Rect2D from its most-negative corner (x, y) and the
+// lengths of its sides, with the same validation as NewRect.
+func NewRect2D(x, y, dx, dy float64) (Rect2D, error) {
+	r, err := NewRect(Point{x, y}, []float64{dx, dy})
+	if err != nil {
+		return Rect2D{}, err
+	}
+	return toRect2D(r), nil
+}
+
+// toRect2D converts a two-dimensional Rect to a Rect2D.
+func toRect2D(r Rect) Rect2D {
+	return Rect2D{
+		Min: [2]float64{r.p[0], r.p[1]},
+		Max: [2]float64{r.q[0], r.q[1]},
+	}
+}
+
+// Rect converts r to a Rect.
+func (r Rect2D) Rect() Rect {
+	return Rect{
+		p: Point{r.Min[0], r.Min[1]},
+		q: Point{r.Max[0], r.Max[1]},
+	}
+}
+
+// size computes the area of r.
+func (r Rect2D) size() float64 {
+	return (r.Max[0] - r.Min[0]) * (r.Max[1] - r.Min[1])
+}
+
+// union returns the bounding box of r and r2.
+func (r Rect2D) union(r2 Rect2D) Rect2D {
+	return Rect2D{
+		Min: [2]float64{math.Min(r.Min[0], r2.Min[0]), math.Min(r.Min[1], r2.Min[1])},
+		Max: [2]float64{math.Max(r.Max[0], r2.Max[0]), math.Max(r.Max[1], r2.Max[1])},
+	}
+}
+
+// intersects tests whether r and r2 intersect, with the same semantics as
+// intersect.
+func (r Rect2D) intersects(r2 Rect2D) bool {
+	return r2.Min[0] < r.Max[0] && r.Min[0] < r2.Max[0] &&
+		r2.Min[1] < r.Max[1] && r.Min[1] < r2.Max[1]
+}
+
+// Rtree2D is an R-tree specialized to two dimensions.  It stores the bounding
+// boxes of its entries as Rect2D values, so that choosing a leaf and splitting
+// nodes work on arrays without the bounds checks and allocations of the
+// slices in a Rect.  Nodes are split with the quadratic algorithm by area, as
+// in an Rtree with the default options.
+//
+// Rtree2D only supports insertion and intersection queries.  Use Rtree for
+// the other operations and for options such as BalancedSplit.
+type Rtree2D struct {
+	MinChildren int
+	MaxChildren int
+	root        *node2D
+	size        int
+	height      int
+}
+
+type node2D struct {
+	parent  *node2D
+	leaf    bool
+	entries []entry2D
+}
+
+type entry2D struct {
+	bb    Rect2D
+	child *node2D
+	obj   Spatial
+}
+
+// NewTree2D returns an empty two-dimensional R-tree whose nodes hold between
+// min and max entries.
+func NewTree2D(min, max int) *Rtree2D {
+	return &Rtree2D{
+		MinChildren: min,
+		MaxChildren: max,
+		height:      1,
+		root: &node2D{
+			leaf:    true,
+			entries: make([]entry2D, 0, max+1),
+		},
+	}
+}
+
+// Size returns the number of objects stored in tree.
+func (tree *Rtree2D) Size() int {
+	return tree.size
+}
+
+// Depth returns the maximum depth of tree.
+func (tree *Rtree2D) Depth() int {
+	return tree.height
+}
+
+// Insert inserts a spatial object into the tree.  A DimError is returned if
+// the object is not two-dimensional.
+func (tree *Rtree2D) Insert(obj Spatial) error {
+	bb := obj.Bounds()
+	if len(bb.p) != 2 {
+		return &DimError{2, len(bb.p)}
+	}
+	e := entry2D{bb: toRect2D(bb), obj: obj}
+
+	leaf := tree.chooseLeaf(tree.root, e.bb)
+	leaf.entries = append(leaf.entries, e)
+	tree.size++
+
+	var split *node2D
+	if len(leaf.entries) > tree.MaxChildren {
+		leaf, split = leaf.split(tree.MinChildren)
+	}
+	root, splitRoot := tree.adjustTree(leaf, split)
+	if splitRoot != nil {
+		tree.height++
+		tree.root = &node2D{
+			entries: make([]entry2D, 0, tree.MaxChildren+1),
+		}
+		tree.root.entries = append(tree.root.entries,
+			entry2D{bb: root.computeBoundingBox(), child: root},
+			entry2D{bb: splitRoot.computeBoundingBox(), child: splitRoot},
+		)
+		root.parent = tree.root
+		splitRoot.parent = tree.root
+	}
+	return nil
+}
+
+// chooseLeaf finds the leaf to which an entry with bounding box bb should be
+// added.
+func (tree *Rtree2D) chooseLeaf(n *node2D, bb Rect2D) *node2D {
+	for !n.leaf {
+		diff := math.MaxFloat64
+		var chosen *entry2D
+		for i := range n.entries {
+			en := &n.entries[i]
+			size := en.bb.size()
+			d := en.bb.union(bb).size() - size
+			if d < diff || (d == diff && size < chosen.bb.size()) {
+				diff = d
+				chosen = en
+			}
+		}
+		n = chosen.child
+	}
+	return n
+}
+
+// adjustTree splits overflowing nodes and propagates the changes upwards.
+func (tree *Rtree2D) adjustTree(n, nn *node2D) (*node2D, *node2D) {
+	for n != tree.root {
+		en := n.getEntry()
+		prevBox := en.bb
+		en.bb = n.computeBoundingBox()
+
+		if nn == nil {
+			if en.bb == prevBox {
+				return tree.root, nil
+			}
+			n = n.parent
+			continue
+		}
+
+		n.parent.entries = append(n.parent.entries, entry2D{bb: nn.computeBoundingBox(), child: nn})
+		if len(n.parent.entries) > tree.MaxChildren {
+			n, nn = n.parent.split(tree.MinChildren)
+		} else {
+			n, nn = n.parent, nil
+		}
+	}
+	return n, nn
+}
+
+// getEntry returns a pointer to the entry for the node n from n's parent.
+func (n *node2D) getEntry() *entry2D {
+	for i := range n.parent.entries {
+		if n.parent.entries[i].child == n {
+			return &n.parent.entries[i]
+		}
+	}
+	return nil
+}
+
+// computeBoundingBox finds the MBR of the children of n.
+func (n *node2D) computeBoundingBox() Rect2D {
+	bb := n.entries[0].bb
+	for _, e := range n.entries[1:] {
+		bb = bb.union(e.bb)
+	}
+	return bb
+}
+
+// split splits a node into two groups with the quadratic algorithm, so that
+// each group holds at least minGroupSize entries.  n is reused as the left
+// node.
+func (n *node2D) split(minGroupSize int) (left, right *node2D) {
+	l, r := n.pickSeeds()
+	leftSeed, rightSeed := n.entries[l], n.entries[r]
+
+	remaining := append(n.entries[:l], n.entries[l+1:r]...)
+	remaining = append(remaining, n.entries[r+1:]...)
+
+	left = n
+	left.entries = make([]entry2D, 1, len(n.entries))
+	left.entries[0] = leftSeed
+	right = &node2D{
+		parent:  n.parent,
+		leaf:    n.leaf,
+		entries: make([]entry2D, 1, len(n.entries)),
+	}
+	right.entries[0] = rightSeed
+	if leftSeed.child != nil {
+		leftSeed.child.parent = left
+	}
+	if rightSeed.child != nil {
+		rightSeed.child.parent = right
+	}
+
+	// The bounding boxes of both groups are maintained as entries are
+	// added instead of being recomputed for every entry.
+	leftBB, rightBB := leftSeed.bb, rightSeed.bb
+	for len(remaining) > 0 {
+		next := pickNext2D(leftBB, rightBB, remaining)
+		e := remaining[next]
+
+		var toLeft bool
+		if len(remaining)+len(left.entries) <= minGroupSize {
+			toLeft = true
+		} else if len(remaining)+len(right.entries) <= minGroupSize {
+			toLeft = false
+		} else {
+			toLeft = chooseGroup2D(e.bb, leftBB, rightBB, len(left.entries), len(right.entries))
+		}
+		if toLeft {
+			left.assign(e)
+			leftBB = leftBB.union(e.bb)
+		} else {
+			right.assign(e)
+			rightBB = rightBB.union(e.bb)
+		}
+
+		remaining = append(remaining[:next], remaining[next+1:]...)
+	}
+	return
+}
+
+func (n *node2D) assign(e entry2D) {
+	if e.child != nil {
+		e.child.parent = n
+	}
+	n.entries = append(n.entries, e)
+}
+
+// chooseGroup2D reports whether an entry with bounding box bb should be added
+// to the left group rather than to the right one, with the same rules as
+// assignGroup.
+func chooseGroup2D(bb, leftBB, rightBB Rect2D, nLeft, nRight int) bool {
+	leftSize, rightSize := leftBB.size(), rightBB.size()
+	leftDiff := leftBB.union(bb).size() - leftSize
+	rightDiff := rightBB.union(bb).size() - rightSize
+	if leftDiff != rightDiff {
+		return leftDiff < rightDiff
+	}
+	if leftSize != rightSize {
+		return leftSize < rightSize
+	}
+	return nLeft <= nRight
+}
+
+// pickSeeds chooses two child entries of n to start a split.
+func (n *node2D) pickSeeds() (int, int) {
+	left, right := 0, 1
+	maxWastedSpace := -1.0
+	for i, e1 := range n.entries {
+		for j, e2 := range n.entries[i+1:] {
+			d := e1.bb.union(e2.bb).size() - e1.bb.size() - e2.bb.size()
+			if d > maxWastedSpace {
+				maxWastedSpace = d
+				left, right = i, j+i+1
+			}
+		}
+	}
+	return left, right
+}
+
+// pickNext2D chooses an entry to be added to one of the groups with the
+// specified bounding boxes.
+func pickNext2D(leftBB, rightBB Rect2D, entries []entry2D) (next int) {
+	maxDiff := -1.0
+	leftSize, rightSize := leftBB.size(), rightBB.size()
+	for i, e := range entries {
+		d1 := leftBB.union(e.bb).size() - leftSize
+		d2 := rightBB.union(e.bb).size() - rightSize
+		if d := math.Abs(d1 - d2); d > maxDiff {
+			maxDiff = d
+			next = i
+		}
+	}
+	return
+}
+
+// SearchIntersect returns all objects that intersect the specified rectangle.
+func (tree *Rtree2D) SearchIntersect(bb Rect2D, filters ...Filter) []Spatial {
+	results, _ := tree.root.searchIntersect([]Spatial{}, bb, filters)
+	return results
+}
+
+func (n *node2D) searchIntersect(results []Spatial, bb Rect2D, filters []Filter) ([]Spatial, bool) {
+	for i := range n.entries {
+		e := &n.entries[i]
+		if !bb.intersects(e.bb) {
+			continue
+		}
+
+		if !n.leaf {
+			var abort bool
+			results, abort = e.child.searchIntersect(results, bb, filters)
+			if abort {
+				return results, true
+			}
+			continue
+		}
+
+		refuse, abort := applyFilters(results, e.obj, filters)
+		if !refuse {
+			results = append(results, e.obj)
+		}
+		if abort {
+			return results, true
+		}
+	}
+	return results, false
+}
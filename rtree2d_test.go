@@ -0,0 +1,101 @@
+package rtreego
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestRtree2D(t *testing.T) {
+	things := randomThings(1000, 2)
+	rt := NewTree(2, 3, 6, things...)
+	rt2 := NewTree2D(3, 6)
+	for _, thing := range things {
+		if err := rt2.Insert(thing); err != nil {
+			t.Fatalf("Insert(%v) returned %v", thing, err)
+		}
+	}
+	if rt2.Size() != len(things) {
+		t.Errorf("Size() = %d, expected %d", rt2.Size(), len(things))
+	}
+	if rt2.Depth() < 2 {
+		t.Errorf("Depth() = %d, expected the root to have been split", rt2.Depth())
+	}
+
+	for i := 0; i < 100; i++ {
+		bb := mustRect(Point{rand.Float64() * 90, rand.Float64() * 90}, []float64{10, 10})
+		expected := rt.SearchIntersect(bb)
+		q := rt2.SearchIntersect(toRect2D(bb))
+		if len(q) != len(expected) {
+			t.Fatalf("SearchIntersect(%v) returned %d objects, expected %d", bb, len(q), len(expected))
+		}
+		ensureDisorderedSubset(t, q, expected)
+	}
+
+	bb, err := NewRect2D(0, 0, 100, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q := rt2.SearchIntersect(bb, LimitFilter(5)); len(q) != 5 {
+		t.Errorf("SearchIntersect with limit 5 returned %d objects", len(q))
+	}
+
+	if err := rt2.Insert(&Rect{Point{0, 0, 0}, Point{1, 1, 1}}); err == nil {
+		t.Errorf("Insert of a three-dimensional object succeeded")
+	}
+	if rt2.Size() != len(things) {
+		t.Errorf("Size() = %d after failed Insert, expected %d", rt2.Size(), len(things))
+	}
+}
+
+func TestNewRect2D(t *testing.T) {
+	r, err := NewRect2D(1, 2, 3, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := mustRect(Point{1, 2}, []float64{3, 4}); !r.Rect().Equal(exp) {
+		t.Errorf("NewRect2D(1, 2, 3, 4).Rect() = %v, expected %v", r.Rect(), exp)
+	}
+	if _, err := NewRect2D(1, 2, 0, 4); err == nil {
+		t.Errorf("NewRect2D with zero length succeeded")
+	}
+}
+
+func BenchmarkInsertGeneric2D(b *testing.B) {
+	things := randomThings(10000, 0.5)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rt := NewTree(2, 25, 50)
+		for _, thing := range things {
+			rt.Insert(thing)
+		}
+	}
+}
+
+func BenchmarkInsertRtree2D(b *testing.B) {
+	things := randomThings(10000, 0.5)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rt := NewTree2D(25, 50)
+		for _, thing := range things {
+			rt.Insert(thing)
+		}
+	}
+}
+
+func BenchmarkSearchIntersectGeneric2D(b *testing.B) {
+	rt := NewTree(2, 25, 50)
+	for _, thing := range randomThings(100000, 0.5) {
+		rt.Insert(thing)
+	}
+	benchmarkSearchIntersect(b, func(bb Rect) []Spatial { return rt.SearchIntersect(bb) })
+}
+
+func BenchmarkSearchIntersectRtree2D(b *testing.B) {
+	rt := NewTree2D(25, 50)
+	for _, thing := range randomThings(100000, 0.5) {
+		rt.Insert(thing)
+	}
+	benchmarkSearchIntersect(b, func(bb Rect) []Spatial { return rt.SearchIntersect(toRect2D(bb)) })
+}
@@ -3,11 +3,13 @@ package rtreego
 import (
 	"fmt"
 	"log"
+	"math"
 	"math/rand"
 	"sort"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 type testCase struct {
@@ -203,18 +205,66 @@ var chooseLeafNodeTests = []struct {
 	},
 }
 
+func TestChooseLeafNodeEpsilon(t *testing.T) {
+	// Including obj enlarges the area of bb0 by 1 and that of bb1 by
+	// 1+1e-12.  Within the default epsilon, this is a tie won by the
+	// smaller bb1.
+	obj := mustRect(Point{0, 0}, []float64{1, 1})
+	bb0 := mustRect(Point{0, 1}, []float64{1, 100})
+	bb1 := mustRect(Point{1, 0}, []float64{1, 1 + 1e-12})
+
+	for _, c := range []struct {
+		eps float64
+		exp int
+	}{
+		{0, 0},
+		{DefaultEnlargementEpsilon, 1},
+	} {
+		rt := NewTree(2, 3, 6)
+		rt.EnlargementEpsilon = c.eps
+		rt.root = &node{level: 2}
+		for _, bb := range []Rect{bb0, bb1} {
+			leaf := &node{rt.root, true, []entry{}, 1}
+			rt.root.entries = append(rt.root.entries, entry{bb, leaf, nil})
+		}
+
+		expected := rt.root.entries[c.exp].child
+		if leaf, _ := rt.chooseNode(rt.root, entry{obj, nil, &obj}, 1); leaf != expected {
+			t.Errorf("with EnlargementEpsilon %v, expected leaf %d to be chosen", c.eps, c.exp)
+		}
+	}
+
+	// Including obj enlarges the area of bb0 by s^2 and that of bb1 by
+	// 1.5s^2, which is no tie at any scale s.
+	for _, s := range []float64{1, 1e-5, 1e5} {
+		obj := mustRect(Point{0, 0}, []float64{s, s})
+		rt := NewTree(2, 3, 6)
+		rt.root = &node{level: 2}
+		for _, bb := range []Rect{
+			mustRect(Point{0, s}, []float64{s, 100 * s}),
+			mustRect(Point{s, 0}, []float64{s, 1.5 * s}),
+		} {
+			leaf := &node{rt.root, true, []entry{}, 1}
+			rt.root.entries = append(rt.root.entries, entry{bb, leaf, nil})
+		}
+		if leaf, _ := rt.chooseNode(rt.root, entry{obj, nil, &obj}, 1); leaf != rt.root.entries[0].child {
+			t.Errorf("at scale %v, expected the leaf needing least enlargement to be chosen", s)
+		}
+	}
+}
+
 func TestChooseLeafNodeEmpty(t *testing.T) {
 	rt := NewTree(3, 5, 10)
 	obj := Point{0, 0, 0}.ToRect(0.5)
 	e := entry{obj, nil, obj}
-	if leaf := rt.chooseNode(rt.root, e, 1); leaf != rt.root {
+	if leaf, _ := rt.chooseNode(rt.root, e, 1); leaf != rt.root {
 		t.Errorf("expected chooseLeaf of empty tree to return root")
 	}
 }
 
 func TestChooseLeafNode(t *testing.T) {
 	for _, test := range chooseLeafNodeTests {
-		rt := Rtree{}
+		rt := Rtree{Dim: 3}
 		rt.root = &node{}
 
 		leaf0 := &node{rt.root, true, []entry{}, 1}
@@ -232,7 +282,7 @@ func TestChooseLeafNode(t *testing.T) {
 		e := entry{obj, nil, obj}
 
 		expected := rt.root.entries[test.exp].child
-		if leaf := rt.chooseNode(rt.root, e, 1); leaf != expected {
+		if leaf, _ := rt.chooseNode(rt.root, e, 1); leaf != expected {
 			t.Errorf("%s: expected %d", test.desc, test.exp)
 		}
 	}
@@ -261,7 +311,7 @@ func TestPickNext(t *testing.T) {
 	entry3 := entry{bb: mustRect(Point{1, 2}, []float64{1, 1})}
 	entries := []entry{entry1, entry2, entry3}
 
-	chosen := pickNext(left, right, entries)
+	chosen := pickNext(left, right, entries, Rect.Size)
 	if !entryEq(entries[chosen], entry2) {
 		t.Errorf("expected entry %d", 3)
 	}
@@ -276,7 +326,7 @@ func TestSplit(t *testing.T) {
 	entries := []entry{entry1, entry2, entry3, entry4, entry5}
 	n := &node{entries: entries}
 
-	l, r := n.split(0) // left=entry2, right=entry4
+	l, r := n.split(0, Rect.Size) // left=entry2, right=entry4
 	expLeft := mustRect(Point{1, -1}, []float64{2, 4})
 	expRight := mustRect(Point{-3, -3}, []float64{3, 4})
 
@@ -290,6 +340,41 @@ func TestSplit(t *testing.T) {
 	}
 }
 
+func TestChooseSplitAxis(t *testing.T) {
+	var wide, tall, strips, deep []entry
+	for i := 0; i < 10; i++ {
+		x := float64(i * 10)
+		jitter := float64(i%3) * 0.1
+		wide = append(wide, entry{bb: mustRect(Point{x, jitter}, []float64{1, 1})})
+		tall = append(tall, entry{bb: mustRect(Point{jitter, x}, []float64{1, 1})})
+		// long horizontal strips stacked on top of each other
+		strips = append(strips, entry{bb: mustRect(Point{jitter, float64(i)}, []float64{100, 1})})
+		deep = append(deep, entry{bb: mustRect(Point{jitter, 1, x}, []float64{1, 1, 1})})
+	}
+
+	cases := []struct {
+		name    string
+		entries []entry
+		exp     int
+	}{
+		{"spread along x", wide, 0},
+		{"spread along y", tall, 1},
+		{"horizontal strips", strips, 1},
+		{"spread along z", deep, 2},
+	}
+	for _, c := range cases {
+		before := append([]entry{}, c.entries...)
+		if axis := chooseSplitAxis(c.entries, 3); axis != c.exp {
+			t.Errorf("%s: chooseSplitAxis returned axis %d, expected %d", c.name, axis, c.exp)
+		}
+		for i := range before {
+			if !c.entries[i].bb.Equal(before[i].bb) {
+				t.Fatalf("%s: chooseSplitAxis reordered the entries", c.name)
+			}
+		}
+	}
+}
+
 func TestSplitUnderflow(t *testing.T) {
 	entry1 := entry{bb: mustRect(Point{0, 0}, []float64{1, 1})}
 	entry2 := entry{bb: mustRect(Point{0, 1}, []float64{1, 1})}
@@ -299,7 +384,7 @@ func TestSplitUnderflow(t *testing.T) {
 	entries := []entry{entry1, entry2, entry3, entry4, entry5}
 	n := &node{entries: entries}
 
-	l, r := n.split(2)
+	l, r := n.split(2, Rect.Size)
 
 	if len(l.entries) != 3 || len(r.entries) != 2 {
 		t.Errorf("expected underflow assignment for right group")
@@ -316,7 +401,7 @@ func TestAssignGroupLeastEnlargement(t *testing.T) {
 	group1 := &node{entries: []entry{r00, r01}}
 	group2 := &node{entries: []entry{r10, r11}}
 
-	assignGroup(r02, group1, group2)
+	assignGroup(r02, group1, group2, Rect.Size)
 	if len(group1.entries) != 3 || len(group2.entries) != 2 {
 		t.Errorf("expected r02 added to group 1")
 	}
@@ -331,7 +416,7 @@ func TestAssignGroupSmallerArea(t *testing.T) {
 	group1 := &node{entries: []entry{r00, r01}}
 	group2 := &node{entries: []entry{r12}}
 
-	assignGroup(r02, group1, group2)
+	assignGroup(r02, group1, group2, Rect.Size)
 	if len(group2.entries) != 2 || len(group1.entries) != 2 {
 		t.Errorf("expected r02 added to group 2")
 	}
@@ -346,7 +431,7 @@ func TestAssignGroupFewerEntries(t *testing.T) {
 	group1 := &node{entries: []entry{r0001}}
 	group2 := &node{entries: []entry{r12, r22}}
 
-	assignGroup(r02, group1, group2)
+	assignGroup(r02, group1, group2, Rect.Size)
 	if len(group2.entries) != 2 || len(group1.entries) != 2 {
 		t.Errorf("expected r02 added to group 2")
 	}
@@ -384,7 +469,7 @@ func TestAdjustTreeNoSplit(t *testing.T) {
 	right := node{rt.root, false, []entry{r10, r11}, 1}
 
 	rt.root.entries = []entry{leftEntry}
-	retl, retr := rt.adjustTree(&left, &right)
+	retl, retr, _ := rt.adjustTree(&left, &right)
 
 	if retl != rt.root || retr != nil {
 		t.Errorf("Expected adjustTree didn't split the root")
@@ -417,7 +502,7 @@ func TestAdjustTreeSplitParent(t *testing.T) {
 	right := node{rt.root, false, []entry{r10, r11}, 1}
 
 	rt.root.entries = []entry{leftEntry}
-	retl, retr := rt.adjustTree(&left, &right)
+	retl, retr, _ := rt.adjustTree(&left, &right)
 
 	if len(retl.entries) != 1 || len(retr.entries) != 1 {
 		t.Errorf("Expected adjustTree distributed the entries")
@@ -622,7 +707,7 @@ func TestFindLeaf(t *testing.T) {
 	}
 	verify(t, rt)
 	for _, thing := range things {
-		leaf := rt.findLeaf(rt.root, thing, defaultComparator)
+		leaf := rt.root.findLeaf(thing, thing.Bounds(), defaultComparator)
 		if leaf == nil {
 			printNode(rt.root, 0)
 			t.Fatalf("Unable to find leaf containing an entry after insertion!")
@@ -661,7 +746,7 @@ func TestFindLeafDoesNotExist(t *testing.T) {
 	}
 
 	obj := mustRect(Point{99, 99}, []float64{99, 99})
-	leaf := rt.findLeaf(rt.root, obj, defaultComparator)
+	leaf := rt.root.findLeaf(obj, obj.Bounds(), defaultComparator)
 	if leaf != nil {
 		t.Errorf("findLeaf failed to return nil for non-existent object")
 	}
@@ -722,7 +807,7 @@ func TestChooseNodeNonLeaf(t *testing.T) {
 
 	obj := mustRect(Point{0, 10}, []float64{1, 2})
 	e := entry{obj, nil, obj}
-	n := rt.chooseNode(rt.root, e, 2)
+	n, _ := rt.chooseNode(rt.root, e, 2)
 	if n.level != 2 {
 		t.Errorf("chooseNode failed to stop at desired level")
 	}
@@ -1365,6 +1450,196 @@ func TestNearestNeighborsHalf(t *testing.T) {
 	}
 }
 
+func TestNearestNeighborsTieBreak(t *testing.T) {
+	// Eight objects at the same distance from the origin, plus one closer.
+	rects := []Rect{
+		mustRect(Point{2, -1}, []float64{1, 2}),
+		mustRect(Point{-3, -1}, []float64{1, 2}),
+		mustRect(Point{-1, 2}, []float64{2, 1}),
+		mustRect(Point{-1, -3}, []float64{2, 1}),
+		mustRect(Point{2, 4}, []float64{1, 1}),
+		mustRect(Point{-5, 4}, []float64{3, 1}),
+		mustRect(Point{2, -5}, []float64{1, 1}),
+		mustRect(Point{-4, -5}, []float64{2, 1}),
+		mustRect(Point{0.5, 0.5}, []float64{0.5, 0.5}),
+	}
+	things := []Spatial{}
+	for i := range rects {
+		things = append(things, &rects[i])
+	}
+
+	// Order equidistant objects by their lower corner, x first.
+	less := func(a, b Spatial) bool {
+		pa, pb := a.Bounds().p, b.Bounds().p
+		if pa[0] != pb[0] {
+			return pa[0] < pb[0]
+		}
+		return pa[1] < pb[1]
+	}
+
+	p := Point{0, 0}
+	expected := append([]Spatial{}, things...)
+	sort.SliceStable(expected, func(i, j int) bool {
+		di, dj := p.minDist(expected[i].Bounds()), p.minDist(expected[j].Bounds())
+		if di != dj {
+			return di < dj
+		}
+		return less(expected[i], expected[j])
+	})
+
+	for _, tc := range tests(2, 2, 3, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+
+			for k := 1; k <= len(things); k++ {
+				objs := rt.NearestNeighborsTieBreak(k, p, less)
+				if len(objs) != k {
+					t.Fatalf("NearestNeighborsTieBreak(%d) returned %d objects", k, len(objs))
+				}
+				for i := range objs {
+					if objs[i] != expected[i] {
+						t.Errorf("NearestNeighborsTieBreak(%d) failed at index %d: %v != %v", k, i, objs[i], expected[i])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestNearestNeighborsWithDist(t *testing.T) {
+	things := randomThings(300, 2)
+	p := Point{25, 50}
+	for _, tc := range tests(2, 3, 6, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+			objs, dists := rt.NearestNeighborsWithDist(10, p)
+			if len(dists) != len(objs) {
+				t.Fatalf("NearestNeighborsWithDist returned %d distances for %d objects", len(dists), len(objs))
+			}
+			ensureOrderedSubset(t, objs, rt.NearestNeighbors(10, p))
+			for i, obj := range objs {
+				exp := math.Sqrt(p.minDist(obj.Bounds()))
+				if math.Abs(dists[i]-exp) > EPS {
+					t.Errorf("distance %d = %v, expected %v", i, dists[i], exp)
+				}
+			}
+		})
+	}
+
+	objs, dists := NewTree(2, 3, 6).NearestNeighborsWithDist(3, p)
+	if len(objs) != 0 || len(dists) != 0 {
+		t.Errorf("NearestNeighborsWithDist on empty tree returned %v, %v", objs, dists)
+	}
+}
+
+// nearestNeighborSqrt is the search of NearestNeighbor comparing true
+// instead of squared distances, to measure the cost of the square roots.
+func nearestNeighborSqrt(p Point, n *node, d float64, nearest Spatial) (Spatial, float64) {
+	if n.leaf {
+		for _, e := range n.entries {
+			if dist := math.Sqrt(p.minDist(e.bb)); dist < d {
+				d, nearest = dist, e.obj
+			}
+		}
+		return nearest, d
+	}
+	minMinMaxDist := math.MaxFloat64
+	for _, e := range n.entries {
+		minMinMaxDist = math.Min(minMinMaxDist, math.Sqrt(p.minMaxDist(e.bb)))
+	}
+	for _, e := range n.entries {
+		if minDist := math.Sqrt(p.minDist(e.bb)); minDist > minMinMaxDist || minDist >= d {
+			continue
+		}
+		if sub, dist := nearestNeighborSqrt(p, e.child, d, nearest); dist < d {
+			d, nearest = dist, sub
+		}
+	}
+	return nearest, d
+}
+
+func benchmarkNearestNeighbor(b *testing.B, nn func(rt *Rtree, p Point) Spatial) {
+	rt := NewTree(2, 25, 50, randomThings(100000, 0.5)...)
+	points := make([]Point, 100)
+	for i := range points {
+		points[i] = Point{rand.Float64() * 100, rand.Float64() * 100}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		nn(rt, points[i%len(points)])
+	}
+}
+
+func BenchmarkNearestNeighborSquared(b *testing.B) {
+	benchmarkNearestNeighbor(b, func(rt *Rtree, p Point) Spatial { return rt.NearestNeighbor(p) })
+}
+
+func BenchmarkNearestNeighborSqrt(b *testing.B) {
+	benchmarkNearestNeighbor(b, func(rt *Rtree, p Point) Spatial {
+		obj, _ := nearestNeighborSqrt(p, rt.root, math.MaxFloat64, nil)
+		return obj
+	})
+}
+
+func TestNearestNeighborsForCluster(t *testing.T) {
+	things := randomThings(500, 1)
+	for _, tc := range tests(2, 3, 6, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+			for i := 0; i < 20; i++ {
+				center := Point{rand.Float64() * 100, rand.Float64() * 100}
+				var points []Point
+				for j := 0; j < 5; j++ {
+					points = append(points, Point{center[0] + rand.Float64()*4, center[1] + rand.Float64()*4})
+				}
+
+				var expected []Spatial
+				seen := make(map[Spatial]bool)
+				for _, p := range points {
+					for _, obj := range rt.NearestNeighbors(3, p) {
+						if !seen[obj] {
+							seen[obj] = true
+							expected = append(expected, obj)
+						}
+					}
+				}
+
+				objs := rt.NearestNeighborsForCluster(points, 3)
+				if len(objs) != len(expected) {
+					t.Fatalf("NearestNeighborsForCluster returned %d objects, expected %d", len(objs), len(expected))
+				}
+				for j := range objs {
+					if objs[j] != expected[j] {
+						t.Errorf("NearestNeighborsForCluster failed at index %d: %v != %v", j, objs[j], expected[j])
+					}
+				}
+			}
+		})
+	}
+
+	if objs := NewTree(2, 3, 6).NearestNeighborsForCluster([]Point{{0, 0}}, 3); len(objs) != 0 {
+		t.Errorf("NearestNeighborsForCluster on empty tree returned %v", objs)
+	}
+
+	// objects that are not comparable, such as Rect values, are told apart
+	// by their entries
+	var values []Spatial
+	for i := 0; i < 50; i++ {
+		values = append(values, mustRect(Point{float64(i), 0}, []float64{0.5, 0.5}))
+	}
+	rt := NewTree(2, 3, 6, values...)
+	objs := rt.NearestNeighborsForCluster([]Point{{10, 0}, {10.5, 0}, {30, 0}}, 2)
+	expected := []Spatial{values[10], values[9], values[11], values[30], values[29]}
+	if len(objs) != len(expected) {
+		t.Fatalf("NearestNeighborsForCluster of Rect values returned %v, expected %v", objs, expected)
+	}
+	for i := range objs {
+		if !objs[i].Bounds().Equal(expected[i].Bounds()) {
+			t.Errorf("NearestNeighborsForCluster of Rect values failed at index %d: %v != %v", i, objs[i], expected[i])
+		}
+	}
+}
+
 func ensureOrderedSubset(t *testing.T, actual []Spatial, expected []Spatial) {
 	for i := range actual {
 		if len(expected)-1 < i || actual[i] != expected[i] {
@@ -1390,3 +1665,4179 @@ func contains(obj Spatial, slice []Spatial) bool {
 
 	return false
 }
+
+func TestRayIntersect(t *testing.T) {
+	rects := []Rect{
+		mustRect(Point{5, -1, -1}, []float64{1, 2, 2}),
+		mustRect(Point{2, -1, -1}, []float64{1, 2, 2}),
+		mustRect(Point{8, 0, 0}, []float64{1, 1, 1}),
+		mustRect(Point{2, 5, 0}, []float64{1, 1, 1}),
+		mustRect(Point{-4, -1, -1}, []float64{1, 2, 2}),
+		mustRect(Point{6, 3, 3}, []float64{1, 1, 1}),
+	}
+	things := []Spatial{}
+	for i := range rects {
+		things = append(things, &rects[i])
+	}
+
+	for _, tc := range tests(3, 2, 3, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+
+			origin, dir := Point{0, 0.5, 0.5}, Point{1, 0, 0}
+			expected := []Spatial{things[1], things[0], things[2]}
+
+			q := rt.RayIntersect(origin, dir, false)
+			if len(q) != len(expected) {
+				t.Fatalf("RayIntersect returned %d objects, expected %d", len(q), len(expected))
+			}
+			ensureDisorderedSubset(t, q, expected)
+
+			q = rt.RayIntersect(origin, dir, true)
+			for i := range expected {
+				if q[i] != expected[i] {
+					t.Errorf("RayIntersect failed to sort by entry distance at index %d: %v != %v", i, q[i], expected[i])
+				}
+			}
+		})
+	}
+}
+
+func TestInsertStrict(t *testing.T) {
+	rt := NewTree(2, 3, 3)
+	rt.StrictInsert = true
+
+	if err := rt.TryInsert(mustRect(Point{0, 0}, []float64{1, 1})); err != nil {
+		t.Errorf("TryInsert failed on valid object: %v", err)
+	}
+
+	nan := Point{math.NaN(), 0}.ToRect(1)
+	if err := rt.TryInsert(nan); err == nil {
+		t.Errorf("TryInsert failed to reject NaN coordinates")
+	}
+	inf := Rect{Point{0, 0}, Point{math.Inf(1), 1}}
+	if err := rt.TryInsert(inf); err == nil {
+		t.Errorf("TryInsert failed to reject infinite coordinates")
+	}
+	if _, ok := rt.TryInsert(Point{0, 0, 0}.ToRect(1)).(*DimError); !ok {
+		t.Errorf("TryInsert failed to reject object with wrong dimension")
+	}
+
+	if rt.Size() != 1 {
+		t.Errorf("Rejected inserts changed the tree size to %d", rt.Size())
+	}
+
+	// Insert panics with the errors for invalid objects
+	func() {
+		defer func() {
+			if _, ok := recover().(CoordError); !ok {
+				t.Errorf("Insert of NaN coordinates did not panic with a CoordError")
+			}
+		}()
+		rt.Insert(nan)
+	}()
+	func() {
+		defer func() {
+			if err := recover(); err != (DimError{2, 3}) {
+				t.Errorf("Insert of a three-dimensional object panicked with %v, expected a DimError", err)
+			}
+		}()
+		rt.Insert(Point{0, 0, 0}.ToRect(1))
+	}()
+
+	// and silently skips rejected ones
+	rt.RejectDuplicates = true
+	dup := &Rect{Point{5, 5}, Point{6, 6}}
+	rt.Insert(dup)
+	rt.Insert(dup)
+	if rt.Size() != 2 {
+		t.Errorf("Insert of a duplicate changed the tree size to %d", rt.Size())
+	}
+}
+
+func TestTrimCapacity(t *testing.T) {
+	rects := make([]Rect, 100)
+	things := []Spatial{}
+	for i := range rects {
+		rects[i] = mustRect(Point{float64(i % 10), float64(i / 10)}, []float64{0.5, 0.5})
+		things = append(things, &rects[i])
+	}
+
+	for _, tc := range tests(2, 3, 6, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+			for _, thing := range things[:90] {
+				rt.Delete(thing)
+			}
+			rt.TrimCapacity()
+			verify(t, rt)
+
+			var check func(n *node)
+			check = func(n *node) {
+				if len(n.entries) != cap(n.entries) {
+					t.Errorf("TrimCapacity left node with len %d and cap %d", len(n.entries), cap(n.entries))
+				}
+				if n.leaf {
+					return
+				}
+				for _, e := range n.entries {
+					check(e.child)
+				}
+			}
+			check(rt.root)
+
+			if rt.Size() != 10 {
+				t.Errorf("TrimCapacity changed the tree size to %d", rt.Size())
+			}
+			for _, thing := range things[90:] {
+				if !rt.Delete(thing) {
+					t.Errorf("Thing %v was not found in tree after TrimCapacity", thing)
+				}
+			}
+		})
+	}
+}
+
+func TestMutationHooks(t *testing.T) {
+	rects := []Rect{
+		mustRect(Point{0, 0}, []float64{2, 1}),
+		mustRect(Point{3, 1}, []float64{1, 2}),
+		mustRect(Point{1, 2}, []float64{2, 2}),
+		mustRect(Point{8, 6}, []float64{1, 1}),
+		mustRect(Point{10, 3}, []float64{1, 2}),
+	}
+	things := []Spatial{}
+	for i := range rects {
+		things = append(things, &rects[i])
+	}
+
+	rt := NewTree(2, 2, 3)
+	var order []string
+	inserted := map[Spatial]int{}
+	deleted := map[Spatial]int{}
+	rt.OnInsert(func(obj Spatial) {
+		inserted[obj]++
+		order = append(order, "first")
+	})
+	rt.OnInsert(func(obj Spatial) {
+		order = append(order, "second")
+	})
+	rt.OnDelete(func(obj Spatial) {
+		if contains(obj, rt.SearchIntersect(obj.Bounds())) {
+			t.Errorf("OnDelete called before %v was removed", obj)
+		}
+		deleted[obj]++
+	})
+
+	for _, thing := range things {
+		rt.Insert(thing)
+	}
+	for _, thing := range things {
+		if inserted[thing] != 1 {
+			t.Errorf("OnInsert called %d times for %v", inserted[thing], thing)
+		}
+	}
+	for i := 0; i < len(order); i += 2 {
+		if order[i] != "first" || order[i+1] != "second" {
+			t.Fatalf("hooks not called in registration order: %v", order)
+		}
+	}
+
+	rt.Delete(things[0])
+	rt.Delete(things[0])
+	rt.Delete(&Rect{Point{99, 99}, Point{100, 100}})
+	if len(deleted) != 1 || deleted[things[0]] != 1 {
+		t.Errorf("OnDelete called for %v, expected only one call for %v", deleted, things[0])
+	}
+}
+
+func TestClosestPair(t *testing.T) {
+	things := []Spatial{}
+	for i := 0; i < 200; i++ {
+		p := Point{rand.Float64() * 100, rand.Float64() * 100}
+		r := mustRect(p, []float64{rand.Float64(), rand.Float64()})
+		things = append(things, &r)
+	}
+
+	best := math.Inf(1)
+	for i := range things {
+		for j := range things[i+1:] {
+			d := math.Sqrt(things[i].Bounds().minDistRect(things[i+1+j].Bounds()))
+			if d < best {
+				best = d
+			}
+		}
+	}
+
+	for _, tc := range tests(2, 3, 6, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+
+			a, b, dist := rt.ClosestPair()
+			if a == nil || b == nil || a == b {
+				t.Fatalf("ClosestPair returned invalid pair %v, %v", a, b)
+			}
+			if math.Abs(dist-best) > EPS {
+				t.Errorf("ClosestPair returned distance %v, expected %v", dist, best)
+			}
+			if d := math.Sqrt(a.Bounds().minDistRect(b.Bounds())); math.Abs(d-dist) > EPS {
+				t.Errorf("ClosestPair returned distance %v for objects at distance %v", dist, d)
+			}
+		})
+	}
+
+	rt := NewTree(2, 3, 6, things[0])
+	if a, b, dist := rt.ClosestPair(); a != nil || b != nil || !math.IsNaN(dist) {
+		t.Errorf("ClosestPair on a single object returned %v, %v, %v", a, b, dist)
+	}
+}
+
+func TestNearestNeighborWeighted(t *testing.T) {
+	things := []Spatial{}
+	for i := 0; i < 100; i++ {
+		r := mustRect(Point{rand.Float64() * 100, rand.Float64() * 100}, []float64{1, 1})
+		things = append(things, &r)
+	}
+	near := mustRect(Point{50, 80}, []float64{1, 1})
+	far := mustRect(Point{90, 50}, []float64{1, 1})
+
+	for _, tc := range tests(2, 3, 6, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+
+			for i := 0; i < 50; i++ {
+				p := Point{rand.Float64() * 100, rand.Float64() * 100}
+				exp := rt.NearestNeighbor(p)
+				obj := rt.NearestNeighborWeighted(p, []float64{1, 1})
+				if p.minDist(obj.Bounds()) != p.minDist(exp.Bounds()) {
+					t.Errorf("NearestNeighborWeighted(%v) with unit weights returned %v, expected %v", p, obj, exp)
+				}
+			}
+		})
+	}
+
+	rt := NewTree(2, 3, 6, &near, &far)
+	p := Point{50, 50}
+	if obj := rt.NearestNeighborWeighted(p, []float64{1, 1}); obj != &near {
+		t.Errorf("NearestNeighborWeighted(%v) returned %v, expected %v", p, obj, near)
+	}
+	if obj := rt.NearestNeighborWeighted(p, []float64{0.01, 1}); obj != &far {
+		t.Errorf("NearestNeighborWeighted(%v) with down-weighted x axis returned %v, expected %v", p, obj, far)
+	}
+}
+
+func TestBulkUpdate(t *testing.T) {
+	rects := make([]Rect, 100)
+	things := []Spatial{}
+	for i := range rects {
+		rects[i] = mustRect(Point{rand.Float64() * 100, rand.Float64() * 100}, []float64{1, 1})
+		things = append(things, &rects[i])
+	}
+
+	for _, tc := range tests(2, 3, 6, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+
+			for tick := 0; tick < 5; tick++ {
+				var moved []Spatial
+				for i := tick % 2; i < len(rects); i += 2 {
+					p := Point{rand.Float64() * 100, rand.Float64() * 100}
+					rects[i] = mustRect(p, []float64{1, 1})
+					moved = append(moved, &rects[i])
+				}
+				rt.BulkUpdate(moved)
+
+				verify(t, rt)
+				if rt.Size() != len(things) {
+					t.Fatalf("BulkUpdate changed the tree size to %d", rt.Size())
+				}
+
+				bb := mustRect(Point{rand.Float64() * 50, rand.Float64() * 50}, []float64{50, 50})
+				var expected []Spatial
+				for _, thing := range things {
+					if intersect(bb, thing.Bounds()) {
+						expected = append(expected, thing)
+					}
+				}
+				q := rt.SearchIntersect(bb)
+				if len(q) != len(expected) {
+					t.Fatalf("SearchIntersect after BulkUpdate returned %d objects, expected %d", len(q), len(expected))
+				}
+				ensureDisorderedSubset(t, q, expected)
+			}
+		})
+	}
+}
+
+func TestBulkUpdateEqualer(t *testing.T) {
+	var things []Spatial
+	for i, thing := range randomThings(100, 2) {
+		things = append(things, &labeled{thing.Bounds(), fmt.Sprint(i)})
+	}
+
+	for _, tc := range tests(2, 3, 6, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+			var copies []Spatial
+			for _, thing := range things[:50] {
+				stored := thing.(*labeled)
+				stored.bb = mustRect(Point{rand.Float64() * 100, rand.Float64() * 100}, []float64{1, 1})
+				copies = append(copies, &labeled{stored.bb, stored.label})
+			}
+			if err := rt.BulkUpdate(copies); err != nil {
+				t.Fatalf("BulkUpdate of equal copies returned %v", err)
+			}
+			verify(t, rt)
+			if rt.Size() != len(things) {
+				t.Fatalf("BulkUpdate changed the tree size to %d", rt.Size())
+			}
+			for _, thing := range things[:50] {
+				if q := rt.SearchIntersect(thing.Bounds()); !contains(thing, q) {
+					t.Fatalf("%v not found at its new bounds after BulkUpdate", thing)
+				}
+			}
+		})
+	}
+}
+
+func TestBulkUpdateNonComparable(t *testing.T) {
+	things := randomThings(20, 2)
+	rt := NewTree(2, 3, 6, things...)
+	obj := mustRect(Point{1, 1}, []float64{1, 1})
+	if err := rt.BulkUpdate([]Spatial{things[0], obj}); err == nil {
+		t.Errorf("BulkUpdate of a non-comparable object returned no error")
+	}
+	if rt.Size() != len(things) {
+		t.Errorf("failed BulkUpdate changed the tree size to %d", rt.Size())
+	}
+	verify(t, rt)
+}
+
+func TestBulkUpdateOutlier(t *testing.T) {
+	rects := make([]Rect, 50)
+	things := []Spatial{}
+	for i := range rects {
+		rects[i] = mustRect(Point{rand.Float64() * 10, rand.Float64() * 10}, []float64{1, 1})
+		things = append(things, &rects[i])
+	}
+	rt := NewTree(2, 3, 6, things...)
+	rt.SetOutlierHandler(func(obj Spatial, enlargement float64) bool {
+		return false
+	})
+
+	var moved []Spatial
+	for i := 0; i < 10; i++ {
+		rects[i] = mustRect(Point{1000 + float64(i), 1000}, []float64{1, 1})
+		moved = append(moved, &rects[i])
+	}
+	if err := rt.BulkUpdate(moved); err != nil {
+		t.Fatalf("BulkUpdate returned %v", err)
+	}
+	if rt.Size() != len(things) {
+		t.Fatalf("BulkUpdate lost objects rejected by the outlier handler, size %d", rt.Size())
+	}
+	verify(t, rt)
+	q := rt.SearchIntersect(mustRect(Point{999, 999}, []float64{20, 3}))
+	if len(q) != len(moved) {
+		t.Fatalf("SearchIntersect at the new bounds returned %d objects, expected %d", len(q), len(moved))
+	}
+	ensureDisorderedSubset(t, q, moved)
+}
+
+func TestBalancedSplit(t *testing.T) {
+	newNode := func() *node {
+		entries := []entry{}
+		for i := 0; i < 7; i++ {
+			entries = append(entries, entry{bb: mustRect(Point{0, 0}, []float64{1, 1})})
+		}
+		entries = append(entries, entry{bb: mustRect(Point{10, 10}, []float64{1, 1})})
+		return &node{leaf: true, entries: entries}
+	}
+
+	rt := NewTree(2, 1, 7)
+	l, r, _ := rt.split(newNode())
+	classic := math.Abs(float64(len(l.entries) - len(r.entries)))
+
+	rt.BalancedSplit = true
+	l, r, _ = rt.split(newNode())
+	balanced := math.Abs(float64(len(l.entries) - len(r.entries)))
+
+	if balanced > 0 || balanced >= classic {
+		t.Errorf("balanced split produced groups differing by %v, classic by %v", balanced, classic)
+	}
+
+	// balancing nested boxes would add much overlap, so the classic split
+	// is kept
+	nested := func() *node {
+		entries := []entry{}
+		for i := 1; i <= 8; i++ {
+			f := float64(i)
+			entries = append(entries, entry{bb: mustRect(Point{-f, -f}, []float64{2 * f, 2 * f})})
+		}
+		return &node{leaf: true, entries: entries}
+	}
+	rt.BalancedSplit = false
+	cl, cr, _ := rt.split(nested())
+	rt.BalancedSplit = true
+	bl, br, _ := rt.split(nested())
+	if len(bl.entries) != len(cl.entries) || len(br.entries) != len(cr.entries) {
+		t.Errorf("balanced split of nested boxes produced groups of %d and %d, expected the classic %d and %d",
+			len(bl.entries), len(br.entries), len(cl.entries), len(cr.entries))
+	}
+	if len(cl.entries) == len(cr.entries) {
+		t.Errorf("classic split of nested boxes is balanced, so the test checks nothing")
+	}
+
+	rt = NewTree(2, 2, 4)
+	rt.BalancedSplit = true
+	for _, thing := range randomThings(200, 1) {
+		rt.Insert(thing)
+	}
+	verify(t, rt)
+	if size := len(rt.SearchIntersect(mustRect(Point{-1, -1}, []float64{200, 200}))); size != 200 {
+		t.Errorf("SearchIntersect with balanced splits returned %d objects", size)
+	}
+}
+
+func TestPartitionAtLevel(t *testing.T) {
+	things := randomThings(300, 1)
+
+	for _, tc := range tests(2, 3, 6, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+
+			for level := 1; level <= rt.Depth(); level++ {
+				var nodes []*node
+				var collect func(n *node)
+				collect = func(n *node) {
+					if n.level == level {
+						nodes = append(nodes, n)
+						return
+					}
+					for _, e := range n.entries {
+						collect(e.child)
+					}
+				}
+				collect(rt.root)
+
+				parts := rt.PartitionAtLevel(level)
+				if len(parts) != len(nodes) {
+					t.Fatalf("PartitionAtLevel(%d) returned %d partitions, expected %d", level, len(parts), len(nodes))
+				}
+
+				seen := map[Spatial]int{}
+				for i, part := range parts {
+					if bb := nodes[i].computeBoundingBox(); !part.Bounds().Equal(bb) {
+						t.Errorf("partition %d at level %d has bounds %v, expected %v", i, level, part.Bounds(), bb)
+					}
+					for _, obj := range part.Objects {
+						seen[obj]++
+						if !part.Bounds().containsRect(obj.Bounds()) {
+							t.Errorf("partition %v does not contain object %v", part.Bounds(), obj)
+						}
+					}
+				}
+				for _, thing := range things {
+					if seen[thing] != 1 {
+						t.Errorf("object %v appears in %d partitions at level %d", thing, seen[thing], level)
+					}
+				}
+			}
+
+			if parts := rt.PartitionAtLevel(rt.Depth() + 1); parts != nil {
+				t.Errorf("PartitionAtLevel returned %d partitions for invalid level", len(parts))
+			}
+		})
+	}
+}
+
+func TestItem(t *testing.T) {
+	type payload struct{ name string }
+	items := []*Item{
+		NewItem(mustRect(Point{0, 0}, []float64{1, 1}), "string"),
+		NewItem(mustRect(Point{2, 2}, []float64{1, 1}), 42),
+		NewItem(mustRect(Point{4, 4}, []float64{1, 1}), &payload{"struct"}),
+		NewItem(mustRect(Point{6, 6}, []float64{1, 1}), []float64{1, 2}),
+	}
+
+	rt := NewTree(2, 2, 3)
+	for _, item := range items {
+		rt.Insert(item)
+	}
+
+	for _, item := range items {
+		q := rt.SearchIntersect(item.Rect)
+		if len(q) != 1 || q[0] != item {
+			t.Fatalf("SearchIntersect(%v) returned %v, expected %v", item.Rect, q, item)
+		}
+	}
+
+	if s, ok := rt.NearestNeighbor(Point{0, 0}).(*Item).Data.(string); !ok || s != "string" {
+		t.Errorf("failed to retrieve string payload")
+	}
+	if i, ok := rt.NearestNeighbor(Point{2.5, 2.5}).(*Item).Data.(int); !ok || i != 42 {
+		t.Errorf("failed to retrieve int payload")
+	}
+	if p, ok := rt.NearestNeighbor(Point{4.5, 4.5}).(*Item).Data.(*payload); !ok || p.name != "struct" {
+		t.Errorf("failed to retrieve struct payload")
+	}
+
+	if !rt.Delete(items[3]) || rt.Size() != 3 {
+		t.Errorf("failed to delete item")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	things := randomThings(100, 1)
+	for _, tc := range tests(2, 3, 6, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+			if err := rt.Validate(); err != nil {
+				t.Errorf("Validate failed on a valid tree: %v", err)
+			}
+
+			rt.size++
+			if err := rt.Validate(); err == nil {
+				t.Errorf("Validate failed to detect wrong size")
+			}
+			rt.size--
+
+			rt.root.entries[0].child.parent = nil
+			if err := rt.Validate(); err == nil {
+				t.Errorf("Validate failed to detect wrong parent pointer")
+			}
+		})
+	}
+}
+
+func TestSetDebug(t *testing.T) {
+	things := randomThings(100, 1)
+	rt := NewTree(2, 3, 6)
+	rt.SetDebug(true)
+	for _, thing := range things {
+		rt.Insert(thing)
+	}
+	for _, thing := range things[:50] {
+		rt.Delete(thing)
+	}
+
+	// corrupt the bounding box of a subtree
+	corrupt := func() {
+		e := &rt.root.entries[0]
+		e.bb = mustRect(Point{1000, 1000}, []float64{1, 1})
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("debug mode failed to panic on a corrupted tree")
+		}
+	}()
+	corrupt()
+	rt.Insert(mustRect(Point{1, 1}, []float64{1, 1}))
+}
+
+func TestCostMetric(t *testing.T) {
+	newTree := func(cost CostMetric) *Rtree {
+		rt := NewTree(2, 1, 3)
+		rt.Cost = cost
+		rt.root = &node{level: 2}
+		rt.height = 2
+		for _, bb := range []Rect{
+			mustRect(Point{0, 0}, []float64{10, 1}),
+			mustRect(Point{0, 3}, []float64{2, 2}),
+		} {
+			leaf := &node{rt.root, true, []entry{{bb, nil, bb}}, 1}
+			rt.root.entries = append(rt.root.entries, entry{bb, leaf, nil})
+		}
+		rt.size = 2
+		return rt
+	}
+
+	// the object enlarges the skinny leaf by more area but less margin
+	obj := mustRect(Point{1, 1.5}, []float64{0.5, 0.5})
+	e := entry{obj, nil, obj}
+
+	area, margin := newTree(CostArea), newTree(CostMargin)
+	if leaf, _ := area.chooseNode(area.root, e, 1); leaf != area.root.entries[1].child {
+		t.Errorf("CostArea failed to choose the leaf with least area enlargement")
+	}
+	if leaf, _ := margin.chooseNode(margin.root, e, 1); leaf != margin.root.entries[0].child {
+		t.Errorf("CostMargin failed to choose the leaf with least margin enlargement")
+	}
+
+	for _, cost := range []CostMetric{CostArea, CostMargin} {
+		rt := NewTree(2, 2, 4)
+		rt.Cost = cost
+		for _, thing := range randomThings(200, 5) {
+			rt.Insert(thing)
+		}
+		if err := rt.Validate(); err != nil {
+			t.Errorf("invalid tree with cost metric %d: %v", cost, err)
+		}
+	}
+}
+
+func TestFillHistogram(t *testing.T) {
+	// Bulk-loading 9 objects with at most 3 per node yields a root and three
+	// leaves, all full.
+	rects := make([]Rect, 9)
+	things := make([]Spatial, len(rects))
+	for i := range rects {
+		rects[i] = mustRect(Point{float64(i % 3 * 10), float64(i / 3 * 10)}, []float64{1, 1})
+		things[i] = &rects[i]
+	}
+	rt := NewTree(2, 3, 3, things...)
+	hist := rt.FillHistogram()
+	if len(hist) != 1 || hist[3] != 4 {
+		t.Errorf("FillHistogram() = %v, expected map[3:4]", hist)
+	}
+
+	// Deleting an object leaves one leaf with two entries.
+	rt.MinChildren = 2
+	rt.Delete(things[0])
+	hist = rt.FillHistogram()
+	if len(hist) != 2 || hist[3] != 3 || hist[2] != 1 {
+		t.Errorf("FillHistogram() = %v after Delete, expected map[2:1 3:3]", hist)
+	}
+
+	if hist := NewTree(2, 3, 3).FillHistogram(); len(hist) != 1 || hist[0] != 1 {
+		t.Errorf("FillHistogram on empty tree returned %v", hist)
+	}
+
+	for _, tc := range tests(2, 3, 6, randomThings(300, 2)...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+			nodes, entries := 0, 0
+			for k, v := range rt.FillHistogram() {
+				nodes += v
+				entries += k * v
+			}
+			total := 0
+			for _, n := range rt.CountByLevel() {
+				total += n
+			}
+			if nodes != total || entries != rt.Size()+total-1 {
+				t.Errorf("FillHistogram counts %d nodes with %d entries, expected %d and %d", nodes, entries, total, rt.Size()+total-1)
+			}
+		})
+	}
+}
+
+func TestCountByLevel(t *testing.T) {
+	rt := NewTree(2, 3, 3)
+	things := []Rect{
+		mustRect(Point{0, 0}, []float64{2, 1}),
+		mustRect(Point{3, 1}, []float64{1, 2}),
+		mustRect(Point{1, 2}, []float64{2, 2}),
+		mustRect(Point{8, 6}, []float64{1, 1}),
+		mustRect(Point{10, 3}, []float64{1, 2}),
+		mustRect(Point{11, 7}, []float64{1, 1}),
+		mustRect(Point{0, 6}, []float64{1, 2}),
+		mustRect(Point{1, 6}, []float64{1, 2}),
+		mustRect(Point{0, 8}, []float64{1, 2}),
+		mustRect(Point{1, 8}, []float64{1, 2}),
+	}
+	for _, thing := range things {
+		rt.Insert(thing)
+	}
+
+	counts := rt.CountByLevel()
+	expected := []int{4, 2, 1}
+	if len(counts) != len(expected) {
+		t.Fatalf("CountByLevel returned %v, expected %v", counts, expected)
+	}
+	for i := range expected {
+		if counts[i] != expected[i] {
+			t.Errorf("CountByLevel returned %v, expected %v", counts, expected)
+		}
+	}
+
+	if counts := NewTree(2, 3, 3).CountByLevel(); len(counts) != 1 || counts[0] != 1 {
+		t.Errorf("CountByLevel on empty tree returned %v", counts)
+	}
+}
+
+func TestSearchIntersectWithBoundary(t *testing.T) {
+	rects := []Rect{
+		Point{1, 0.5}.ToRect(0), // on the boundary between the tiles
+		Point{0.5, 0.5}.ToRect(0.1),
+		Point{1.5, 0.5}.ToRect(0.1),
+		Point{2, 0.5}.ToRect(0), // on the upper boundary of the right tile
+	}
+	things := []Spatial{}
+	for i := range rects {
+		things = append(things, &rects[i])
+	}
+	left := mustRect(Point{0, 0}, []float64{1, 1})
+	right := mustRect(Point{1, 0}, []float64{1, 1})
+
+	for _, tc := range tests(2, 3, 3, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+
+			tests := []struct {
+				boundary    Boundary
+				left, right []Spatial
+			}{
+				{BoundaryOpen, []Spatial{things[1]}, []Spatial{things[2]}},
+				{BoundaryClosed, []Spatial{things[0], things[1]}, []Spatial{things[0], things[2], things[3]}},
+				{BoundaryHalfOpen, []Spatial{things[1]}, []Spatial{things[0], things[2]}},
+			}
+			for _, test := range tests {
+				l := rt.SearchIntersectWithBoundary(left, test.boundary)
+				r := rt.SearchIntersectWithBoundary(right, test.boundary)
+				if len(l) != len(test.left) || len(r) != len(test.right) {
+					t.Errorf("boundary %d: got %v and %v, expected %v and %v", test.boundary, l, r, test.left, test.right)
+					continue
+				}
+				ensureDisorderedSubset(t, l, test.left)
+				ensureDisorderedSubset(t, r, test.right)
+			}
+		})
+	}
+}
+
+func TestExtreme(t *testing.T) {
+	things := randomThings(300, 5)
+
+	for _, tc := range tests(2, 3, 6, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+
+			for axis := 0; axis < 2; axis++ {
+				maxObj, minObj := things[0], things[0]
+				for _, thing := range things {
+					if thing.Bounds().q[axis] > maxObj.Bounds().q[axis] {
+						maxObj = thing
+					}
+					if thing.Bounds().p[axis] < minObj.Bounds().p[axis] {
+						minObj = thing
+					}
+				}
+
+				if obj := rt.Extreme(axis, true); obj.Bounds().q[axis] != maxObj.Bounds().q[axis] {
+					t.Errorf("Extreme(%d, true) returned %v, expected %v", axis, obj, maxObj)
+				}
+				if obj := rt.Extreme(axis, false); obj.Bounds().p[axis] != minObj.Bounds().p[axis] {
+					t.Errorf("Extreme(%d, false) returned %v, expected %v", axis, obj, minObj)
+				}
+			}
+		})
+	}
+
+	if obj := NewTree(2, 3, 6).Extreme(0, true); obj != nil {
+		t.Errorf("Extreme on empty tree returned %v", obj)
+	}
+
+	rt := NewTree(2, 3, 6, things...)
+	for _, axis := range []int{-1, 2} {
+		func() {
+			defer func() {
+				if err := recover(); err != (DimError{2, axis}) {
+					t.Errorf("Extreme(%d, true) panicked with %v, expected a DimError", axis, err)
+				}
+			}()
+			rt.Extreme(axis, true)
+		}()
+	}
+}
+
+func TestOptimize(t *testing.T) {
+	things := randomThings(500, 2)
+	for _, tc := range tests(2, 3, 6, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+			rt.Optimize()
+			verify(t, rt)
+			if err := rt.Validate(); err != nil {
+				t.Errorf("Optimize produced invalid tree: %v", err)
+			}
+			if rt.Size() != len(things) {
+				t.Errorf("Optimize changed the tree size to %d", rt.Size())
+			}
+			for _, thing := range things {
+				if !rt.Delete(thing) {
+					t.Fatalf("Thing %v was not found in tree after Optimize", thing)
+				}
+			}
+			rt.Optimize()
+			if rt.Size() != 0 || len(rt.root.entries) != 0 {
+				t.Errorf("Optimize on empty tree returned non-empty tree")
+			}
+		})
+	}
+}
+
+func TestSetAutoOptimize(t *testing.T) {
+	things := randomThings(500, 2)
+
+	naive := NewTree(2, 3, 6)
+	rt := NewTree(2, 3, 6)
+	rt.SetAutoOptimize(len(things))
+	for _, thing := range things {
+		naive.Insert(thing)
+		rt.Insert(thing)
+	}
+
+	if rt.mutations != 0 {
+		t.Errorf("auto-optimization did not trigger, %d pending mutations", rt.mutations)
+	}
+	if rt.Size() != len(things) {
+		t.Errorf("auto-optimization changed the tree size to %d", rt.Size())
+	}
+	verify(t, rt)
+	if o, naiveO := overlapTotal(rt), overlapTotal(naive); o >= naiveO {
+		t.Errorf("auto-optimization did not reduce overlap: %v >= %v", o, naiveO)
+	}
+
+	rt.Delete(things[0])
+	if rt.mutations != 1 {
+		t.Errorf("Delete was not counted as a mutation")
+	}
+	rt.SetAutoOptimize(0)
+	rt.Delete(things[1])
+	if rt.mutations != 0 {
+		t.Errorf("mutations counted with auto-optimization disabled")
+	}
+}
+
+func TestGetAll(t *testing.T) {
+	things := randomThings(100, 1)
+	for _, tc := range tests(2, 3, 6, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+			all := rt.GetAll()
+			if len(all) != len(things) {
+				t.Fatalf("GetAll returned %d objects, expected %d", len(all), len(things))
+			}
+			ensureDisorderedSubset(t, all, things)
+		})
+	}
+	if all := NewTree(2, 3, 6).GetAll(); len(all) != 0 {
+		t.Errorf("GetAll on empty tree returned %v", all)
+	}
+}
+
+func TestSearchNotIntersecting(t *testing.T) {
+	things := randomThings(300, 3)
+	for _, tc := range tests(2, 3, 6, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+			for i := 0; i < 20; i++ {
+				bb := mustRect(Point{rand.Float64() * 60, rand.Float64() * 60}, []float64{40, 40})
+				in := rt.SearchIntersect(bb)
+				out := rt.SearchNotIntersecting(bb)
+				if len(in)+len(out) != len(things) {
+					t.Fatalf("SearchNotIntersecting returned %d objects, expected %d", len(out), len(things)-len(in))
+				}
+				for _, obj := range out {
+					if contains(obj, in) {
+						t.Fatalf("SearchNotIntersecting returned intersecting object %v", obj)
+					}
+				}
+			}
+		})
+	}
+
+	defer func() {
+		if err := recover(); err != (DimError{2, 3}) {
+			t.Errorf("SearchNotIntersecting with a three-dimensional box panicked with %v, expected a DimError", err)
+		}
+	}()
+	NewTree(2, 3, 6, things...).SearchNotIntersecting(mustRect(Point{0, 0, 0}, []float64{1, 1, 1}))
+}
+
+func TestSearchIntersectOrdered(t *testing.T) {
+	things := randomThings(300, 3)
+	reversed := make([]Spatial, len(things))
+	for i, thing := range things {
+		reversed[len(things)-1-i] = thing
+	}
+
+	less := func(a, b Spatial) bool {
+		ap, bp := a.Bounds().p, b.Bounds().p
+		if ap[0] != bp[0] {
+			return ap[0] < bp[0]
+		}
+		return ap[1] < bp[1]
+	}
+
+	rt1 := NewTree(2, 3, 6)
+	for _, thing := range things {
+		rt1.Insert(thing)
+	}
+	rt2 := NewTree(2, 3, 6, reversed...)
+
+	bb := mustRect(Point{20, 20}, []float64{50, 50})
+	q1 := rt1.SearchIntersectOrdered(bb, less)
+	q2 := rt2.SearchIntersectOrdered(bb, less)
+	if len(q1) == 0 || len(q1) != len(q2) {
+		t.Fatalf("SearchIntersectOrdered returned %d and %d objects", len(q1), len(q2))
+	}
+	for i := range q1 {
+		if q1[i] != q2[i] {
+			t.Fatalf("SearchIntersectOrdered results differ at index %d: %v != %v", i, q1[i], q2[i])
+		}
+		if i > 0 && less(q1[i], q1[i-1]) {
+			t.Fatalf("SearchIntersectOrdered results not sorted at index %d", i)
+		}
+	}
+}
+
+func TestSearchBox3D(t *testing.T) {
+	var things []Spatial
+	for i := 0; i < 10; i++ {
+		r, _ := NewRect3D(float64(i), float64(i), float64(i), 0.5, 0.5, 0.5)
+		things = append(things, &r)
+	}
+
+	rt := NewTree(3, 2, 4, things...)
+	q := rt.SearchBox3D(2.2, 2.2, 2.2, 4.2, 4.2, 4.2)
+	expected := []Spatial{things[2], things[3], things[4]}
+	if len(q) != len(expected) {
+		t.Fatalf("SearchBox3D returned %v, expected %v", q, expected)
+	}
+	ensureDisorderedSubset(t, q, expected)
+
+	defer func() {
+		if _, ok := recover().(DimError); !ok {
+			t.Errorf("SearchBox3D on 2D tree failed to panic with DimError")
+		}
+	}()
+	NewTree(2, 2, 4).SearchBox3D(0, 0, 0, 1, 1, 1)
+}
+
+func TestInsertRejectDuplicates(t *testing.T) {
+	things := []Spatial{
+		&Rect{Point{0, 0}, Point{1, 1}},
+		&Rect{Point{2, 2}, Point{3, 3}},
+		&Rect{Point{4, 4}, Point{5, 5}},
+	}
+	rt := NewTree(2, 2, 3)
+	rt.RejectDuplicates = true
+	for _, thing := range things {
+		if err := rt.TryInsert(thing); err != nil {
+			t.Fatalf("Insert(%v) returned error %v", thing, err)
+		}
+	}
+
+	for _, thing := range things {
+		if !rt.Contains(thing) {
+			t.Errorf("Contains(%v) = false, expected true", thing)
+		}
+		if err := rt.TryInsert(thing); err != ErrDuplicate {
+			t.Errorf("Insert of duplicate %v returned %v, expected ErrDuplicate", thing, err)
+		}
+	}
+	if rt.Size() != len(things) {
+		t.Errorf("Size() = %d after rejected inserts, expected %d", rt.Size(), len(things))
+	}
+
+	// an equal but distinct object is not a duplicate
+	if err := rt.TryInsert(&Rect{Point{0, 0}, Point{1, 1}}); err != nil {
+		t.Errorf("Insert of distinct object returned error %v", err)
+	}
+	if rt.Contains(&Rect{Point{0, 0}, Point{1, 1}}) {
+		t.Errorf("Contains of object not in tree returned true")
+	}
+}
+
+func TestNewTreeFromRects(t *testing.T) {
+	var rects []Rect
+	for i := 0; i < 20; i++ {
+		rects = append(rects, mustRect(Point{float64(i), 0}, []float64{0.5, 1}))
+	}
+	rt, handles := NewTreeFromRects(2, 2, 4, rects)
+	if rt.Size() != len(rects) || len(handles) != len(rects) {
+		t.Fatalf("NewTreeFromRects: size %d, %d handles, expected %d", rt.Size(), len(handles), len(rects))
+	}
+	verify(t, rt)
+
+	q := rt.SearchIntersect(mustRect(Point{4.2, 0.2}, []float64{2, 0.5}))
+	var got []int
+	for _, obj := range q {
+		got = append(got, obj.(*Item).Data.(int))
+	}
+	sort.Ints(got)
+	if len(got) != 3 || got[0] != 4 || got[1] != 5 || got[2] != 6 {
+		t.Errorf("SearchIntersect returned indices %v, expected [4 5 6]", got)
+	}
+
+	if !rt.Delete(handles[5]) {
+		t.Errorf("Delete(handles[5]) failed")
+	}
+	if rt.Size() != len(rects)-1 {
+		t.Errorf("Size() = %d after Delete, expected %d", rt.Size(), len(rects)-1)
+	}
+}
+
+func overlapTotal(rt *Rtree) float64 {
+	total, _ := rt.OverlapStats()
+	return total
+}
+
+func TestOverlapStats(t *testing.T) {
+	rt := NewTree(2, 2, 3)
+	if total, avg := rt.OverlapStats(); total != 0 || avg != 0 {
+		t.Errorf("OverlapStats on empty tree = %v, %v, expected 0, 0", total, avg)
+	}
+
+	// two leaves whose bounding boxes overlap in [1, 2] x [0, 1]
+	rt.root = &node{level: 2}
+	left := &node{parent: rt.root, leaf: true, level: 1}
+	right := &node{parent: rt.root, leaf: true, level: 1}
+	rt.root.entries = []entry{
+		{bb: mustRect(Point{0, 0}, []float64{2, 1}), child: left},
+		{bb: mustRect(Point{1, 0}, []float64{2, 1}), child: right},
+	}
+	if total, avg := rt.OverlapStats(); math.Abs(total-1) > EPS || math.Abs(avg-1) > EPS {
+		t.Errorf("OverlapStats = %v, %v, expected 1, 1", total, avg)
+	}
+
+	// clustered data: a few dense clusters of small rectangles
+	var things []Spatial
+	for c := 0; c < 5; c++ {
+		cx, cy := rand.Float64()*100, rand.Float64()*100
+		for i := 0; i < 200; i++ {
+			r := mustRect(Point{cx + rand.NormFloat64()*3, cy + rand.NormFloat64()*3}, []float64{0.5, 0.5})
+			things = append(things, &r)
+		}
+	}
+	naive := NewTree(2, 3, 6)
+	for _, thing := range things {
+		naive.Insert(thing)
+	}
+	bulk := NewTree(2, 3, 6, things...)
+	if o, naiveO := overlapTotal(bulk), overlapTotal(naive); o >= naiveO {
+		t.Errorf("bulk-loaded tree overlap %v >= naive insertion overlap %v", o, naiveO)
+	}
+}
+
+func TestDeleteEmptiesRoot(t *testing.T) {
+	// An underfull chain of nodes, as can be produced by bulk loading.
+	things := []Spatial{
+		&Rect{Point{0, 0}, Point{1, 1}},
+		&Rect{Point{2, 2}, Point{3, 3}},
+	}
+	rt := NewTree(2, 2, 3)
+	rt.root = &node{level: 3}
+	mid := &node{parent: rt.root, level: 2}
+	leaf := &node{parent: mid, leaf: true, level: 1}
+	for _, thing := range things {
+		leaf.entries = append(leaf.entries, entry{bb: thing.Bounds(), obj: thing})
+	}
+	mid.entries = []entry{{bb: leaf.computeBoundingBox(), child: leaf}}
+	rt.root.entries = []entry{{bb: mid.computeBoundingBox(), child: mid}}
+	rt.height = 3
+	rt.size = len(things)
+
+	if !rt.Delete(things[0]) {
+		t.Fatalf("Delete(%v) failed", things[0])
+	}
+	if err := rt.Validate(); err != nil {
+		t.Errorf("Delete produced invalid tree: %v", err)
+	}
+	if q := rt.SearchIntersect(things[1].Bounds()); len(q) != 1 || q[0] != things[1] {
+		t.Errorf("SearchIntersect after Delete returned %v, expected %v", q, things[1:])
+	}
+}
+
+func TestAnyIntersect(t *testing.T) {
+	rects := []Rect{
+		mustRect(Point{0, 0}, []float64{2, 1}),
+		mustRect(Point{3, 0}, []float64{1, 2}),
+		mustRect(Point{1, 3}, []float64{1, 1}),
+		mustRect(Point{8, 8}, []float64{1, 1}),
+		mustRect(Point{6, 6}, []float64{1, 1}),
+	}
+	things := []Spatial{}
+	for i := range rects {
+		things = append(things, &rects[i])
+	}
+
+	for _, tc := range tests(2, 2, 3, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+			queries := []Rect{
+				mustRect(Point{0.5, 0.5}, []float64{0.1, 0.1}),
+				mustRect(Point{4.5, 4.5}, []float64{1, 1}),
+				mustRect(Point{-5, -5}, []float64{20, 20}),
+				mustRect(Point{2, 0}, []float64{1, 1}), // touches only
+			}
+			for _, q := range queries {
+				exp := len(rt.SearchIntersect(q)) > 0
+				if got := rt.AnyIntersect(q); got != exp {
+					t.Errorf("AnyIntersect(%v) = %v, expected %v", q, got, exp)
+				}
+			}
+		})
+	}
+
+	if NewTree(2, 2, 3).AnyIntersect(mustRect(Point{0, 0}, []float64{1, 1})) {
+		t.Errorf("AnyIntersect on empty tree returned true")
+	}
+}
+
+func benchmarkAnyIntersect(b *testing.B, any func(rt *Rtree, bb Rect) bool) {
+	rt := NewTree(2, 25, 50, randomThings(100000, 0.5)...)
+	bb := mustRect(Point{10, 10}, []float64{80, 80})
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		any(rt, bb)
+	}
+}
+
+func BenchmarkAnyIntersect(b *testing.B) {
+	benchmarkAnyIntersect(b, func(rt *Rtree, bb Rect) bool { return rt.AnyIntersect(bb) })
+}
+
+func BenchmarkAnyIntersectSearch(b *testing.B) {
+	benchmarkAnyIntersect(b, func(rt *Rtree, bb Rect) bool { return len(rt.SearchIntersect(bb)) > 0 })
+}
+
+// sameStructure tests whether two trees of *Items group the items with equal
+// Data in the same way.
+func sameStructure(n1, n2 *node) bool {
+	if n1.leaf != n2.leaf || len(n1.entries) != len(n2.entries) {
+		return false
+	}
+	for i := range n1.entries {
+		e1, e2 := n1.entries[i], n2.entries[i]
+		if n1.leaf {
+			if e1.obj.(*Item).Data != e2.obj.(*Item).Data {
+				return false
+			}
+		} else if !sameStructure(e1.child, e2.child) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestNormalizeAxes(t *testing.T) {
+	// the same data in two coordinate systems whose x axes differ by an
+	// exact (power of two) factor
+	const scale = 1024
+	var rects, scaled []Rect
+	for i := 0; i < 500; i++ {
+		x, y, w, h := rand.Float64()*100, rand.Float64()*100, rand.Float64(), rand.Float64()
+		rects = append(rects, mustRect(Point{x, y}, []float64{w, h}))
+		scaled = append(scaled, mustRect(Point{x * scale, y}, []float64{w * scale, h}))
+	}
+
+	build := func(rects []Rect, normalize bool) *Rtree {
+		rt := NewTree(2, 3, 8)
+		rt.Cost = CostMargin
+		rt.NormalizeAxes = normalize
+		for i, r := range rects {
+			rt.Insert(NewItem(r, i))
+		}
+		verify(t, rt)
+		return rt
+	}
+
+	if !sameStructure(build(rects, true).root, build(scaled, true).root) {
+		t.Errorf("NormalizeAxes: scaling an axis changed the structure of the tree")
+	}
+	if sameStructure(build(rects, false).root, build(scaled, false).root) {
+		t.Errorf("scaling an axis did not change the structure of the tree without NormalizeAxes")
+	}
+}
+
+func TestNormalizeAxesAnisotropic(t *testing.T) {
+	// objects spread over a range a thousand times wider than high
+	const sx = 1000
+	var items []Spatial
+	for i := 0; i < 2000; i++ {
+		x, y, w, h := rand.Float64()*sx, rand.Float64(), rand.Float64()*0.02*sx, rand.Float64()*0.02
+		items = append(items, NewItem(mustRect(Point{x, y}, []float64{w + 0.01, h + 1e-5}), i))
+	}
+
+	build := func(cost CostMetric, normalize bool) *Rtree {
+		rt := NewTree(2, 3, 8)
+		rt.Cost = cost
+		rt.NormalizeAxes = normalize
+		for _, item := range items {
+			rt.Insert(item)
+		}
+		verify(t, rt)
+		return rt
+	}
+	// aspect returns the mean absolute logarithm of the aspect ratios of
+	// the leaves of rt relative to the range of the data, which is 0 for
+	// leaves as wide as high in normalized coordinates
+	aspect := func(rt *Rtree) float64 {
+		sum, leaves := 0.0, 0
+		rt.Walk(func(ref NodeRef, level int) bool {
+			if level == 1 {
+				bb := rt.NodeBounds(ref)
+				sum += math.Abs(math.Log((bb.q[0] - bb.p[0]) / sx / (bb.q[1] - bb.p[1])))
+				leaves++
+			}
+			return true
+		})
+		return sum / float64(leaves)
+	}
+
+	raw, normalized := build(CostMargin, false), build(CostMargin, true)
+	rawOverlap, _ := raw.OverlapStats()
+	normOverlap, _ := normalized.OverlapStats()
+	if normOverlap >= rawOverlap {
+		t.Errorf("NormalizeAxes: overlap %v, expected less than %v without normalization", normOverlap, rawOverlap)
+	}
+	if a, b := aspect(normalized), aspect(raw); a >= b {
+		t.Errorf("NormalizeAxes: mean leaf aspect %v, expected more balanced leaves than %v", a, b)
+	}
+
+	// all areas are scaled by the same factor, so normalizing under CostArea
+	// is rejected
+	defer func() {
+		if recover() == nil {
+			t.Errorf("inserting with NormalizeAxes under CostArea did not panic")
+		}
+	}()
+	build(CostArea, true)
+}
+
+func TestSmallestContaining(t *testing.T) {
+	rects := []Rect{
+		mustRect(Point{0, 0}, []float64{10, 10}),
+		mustRect(Point{1, 1}, []float64{6, 6}),
+		mustRect(Point{2, 2}, []float64{2, 2}),
+		mustRect(Point{5, 5}, []float64{1, 1}),
+		mustRect(Point{20, 20}, []float64{3, 3}),
+		mustRect(Point{21, 21}, []float64{1, 1}),
+	}
+	things := []Spatial{}
+	for i := range rects {
+		things = append(things, &rects[i])
+	}
+
+	for _, tc := range tests(2, 2, 3, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+			checks := []struct {
+				p   Point
+				exp Spatial
+			}{
+				{Point{3, 3}, things[2]},
+				{Point{5.5, 5.5}, things[3]},
+				{Point{6.5, 1.5}, things[1]},
+				{Point{9, 9}, things[0]},
+				{Point{21.5, 21.5}, things[5]},
+				{Point{15, 15}, nil},
+			}
+			for _, c := range checks {
+				if got := rt.SmallestContaining(c.p); got != c.exp {
+					t.Errorf("SmallestContaining(%v) = %v, expected %v", c.p, got, c.exp)
+				}
+			}
+		})
+	}
+}
+
+func TestInsertStream(t *testing.T) {
+	things := randomThings(100, 2)
+	ch := make(chan Spatial)
+	go func() {
+		for i, thing := range things {
+			ch <- thing
+			if i == 50 {
+				ch <- &Rect{Point{0, 0, 0}, Point{1, 1, 1}}
+			}
+		}
+		close(ch)
+	}()
+
+	rt := NewTree(2, 3, 6)
+	count, err := rt.InsertStream(ch)
+	if count != len(things) {
+		t.Errorf("InsertStream inserted %d objects, expected %d", count, len(things))
+	}
+	if rt.Size() != len(things) {
+		t.Errorf("Size() = %d after InsertStream, expected %d", rt.Size(), len(things))
+	}
+	if _, ok := err.(*DimError); !ok {
+		t.Errorf("InsertStream returned error %v, expected DimError", err)
+	}
+	verify(t, rt)
+}
+
+func TestSearchIntersectMulti(t *testing.T) {
+	things := randomThings(300, 3)
+	boxes := []Rect{
+		mustRect(Point{10, 10}, []float64{20, 20}),
+		mustRect(Point{20, 20}, []float64{20, 20}),
+		mustRect(Point{70, 5}, []float64{5, 80}),
+		mustRect(Point{200, 200}, []float64{1, 1}),
+	}
+
+	for _, tc := range tests(2, 3, 6, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+			results := rt.SearchIntersectMulti(boxes)
+			if len(results) != len(boxes) {
+				t.Fatalf("SearchIntersectMulti returned %d result sets, expected %d", len(results), len(boxes))
+			}
+			for i, bb := range boxes {
+				exp := rt.SearchIntersect(bb)
+				if len(results[i]) != len(exp) {
+					t.Errorf("SearchIntersectMulti for %v returned %d objects, expected %d", bb, len(results[i]), len(exp))
+					continue
+				}
+				ensureDisorderedSubset(t, results[i], exp)
+			}
+		})
+	}
+}
+
+func BenchmarkInsert(b *testing.B) {
+	things := randomThings(10000, 0.5)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rt := NewTree(2, 25, 50)
+		for _, thing := range things {
+			rt.Insert(thing)
+		}
+	}
+}
+
+func TestLeafAssignments(t *testing.T) {
+	things := randomThings(200, 2)
+	for _, tc := range tests(2, 3, 6, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+			leaves := rt.LeafAssignments()
+			if n := rt.CountByLevel()[0]; len(leaves) != n {
+				t.Errorf("LeafAssignments returned %d leaves, expected %d", len(leaves), n)
+			}
+
+			var flat []Spatial
+			for _, leaf := range leaves {
+				flat = append(flat, leaf...)
+			}
+			all := rt.GetAll()
+			if len(flat) != len(all) {
+				t.Fatalf("LeafAssignments returned %d objects, expected %d", len(flat), len(all))
+			}
+			for i := range flat {
+				if flat[i] != all[i] {
+					t.Errorf("LeafAssignments object %d = %v, GetAll returned %v", i, flat[i], all[i])
+				}
+			}
+		})
+	}
+}
+
+func TestClassifyIntersect(t *testing.T) {
+	rects := []Rect{
+		mustRect(Point{1, 1}, []float64{1, 1}),   // inside
+		mustRect(Point{2, 6}, []float64{2, 2}),   // inside
+		mustRect(Point{0, 0}, []float64{10, 10}), // inside, equal to the query
+		mustRect(Point{-1, 4}, []float64{2, 1}),  // partial
+		mustRect(Point{9, 9}, []float64{3, 3}),   // partial
+		mustRect(Point{-5, -5}, []float64{20, 20}),
+		mustRect(Point{10, 0}, []float64{1, 1}), // touching, not intersecting
+		mustRect(Point{20, 20}, []float64{1, 1}),
+	}
+	things := []Spatial{}
+	for i := range rects {
+		things = append(things, &rects[i])
+	}
+	bb := mustRect(Point{0, 0}, []float64{10, 10})
+
+	for _, tc := range tests(2, 2, 3, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+			inside, partial := rt.ClassifyIntersect(bb)
+			if len(inside) != 3 || len(partial) != 3 {
+				t.Fatalf("ClassifyIntersect returned %d inside and %d partial, expected 3 and 3", len(inside), len(partial))
+			}
+			ensureDisorderedSubset(t, inside, things[:3])
+			ensureDisorderedSubset(t, partial, things[3:6])
+		})
+	}
+
+	for _, tc := range tests(2, 3, 6, randomThings(300, 2)...) {
+		t.Run(tc.name+" random", func(t *testing.T) {
+			rt := tc.build()
+			inside, partial := rt.ClassifyIntersect(bb)
+			all := rt.SearchIntersect(bb)
+			if len(inside)+len(partial) != len(all) {
+				t.Fatalf("ClassifyIntersect returned %d objects, SearchIntersect returned %d", len(inside)+len(partial), len(all))
+			}
+			for _, obj := range inside {
+				if !bb.containsRect(obj.Bounds()) {
+					t.Errorf("%v classified as inside", obj)
+				}
+			}
+			for _, obj := range partial {
+				if bb.containsRect(obj.Bounds()) {
+					t.Errorf("%v classified as partial", obj)
+				}
+			}
+			ensureDisorderedSubset(t, append(inside, partial...), all)
+		})
+	}
+}
+
+func TestSearchIntersectWithOverlap(t *testing.T) {
+	things := randomThings(300, 5)
+	bb := mustRect(Point{20, 30}, []float64{25, 15})
+	for _, tc := range tests(2, 3, 6, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+			results := rt.SearchIntersectWithOverlap(bb)
+			expected := rt.SearchIntersect(bb)
+			if len(results) != len(expected) {
+				t.Fatalf("SearchIntersectWithOverlap returned %d results, expected %d", len(results), len(expected))
+			}
+			objs := make([]Spatial, len(results))
+			for i, r := range results {
+				objs[i] = r.Obj
+				if exp := overlap(bb, r.Obj.Bounds()); r.Overlap != exp || r.Overlap <= 0 {
+					t.Errorf("overlap of %v = %v, expected %v", r.Obj, r.Overlap, exp)
+				}
+			}
+			ensureDisorderedSubset(t, objs, expected)
+		})
+	}
+
+	r := mustRect(Point{0, 0}, []float64{2, 2})
+	rt := NewTree(2, 3, 6, &r)
+	results := rt.SearchIntersectWithOverlap(mustRect(Point{1, 1}, []float64{5, 5}))
+	if len(results) != 1 || math.Abs(results[0].Overlap-1) > EPS {
+		t.Errorf("SearchIntersectWithOverlap returned %v, expected an overlap of 1", results)
+	}
+}
+
+func TestSplitByBounds(t *testing.T) {
+	things := randomThings(500, 5)
+	boxes := []Rect{
+		mustRect(Point{0, 0}, []float64{50, 50}),
+		mustRect(Point{50, 0}, []float64{50, 50}),
+		mustRect(Point{0, 25}, []float64{100, 50}), // overlaps the first two
+	}
+	for _, tc := range tests(2, 3, 6, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+			trees := rt.SplitByBounds(boxes)
+			if len(trees) != len(boxes)+1 {
+				t.Fatalf("SplitByBounds returned %d trees, expected %d", len(trees), len(boxes)+1)
+			}
+
+			seen := make(map[Spatial]int)
+			for i, part := range trees {
+				verify(t, part)
+				for _, obj := range part.GetAll() {
+					seen[obj]++
+					c := obj.Bounds().center()
+					first := len(boxes)
+					for j := range boxes {
+						if boxes[j].containsPoint(c) {
+							first = j
+							break
+						}
+					}
+					if first != i {
+						t.Errorf("%v with center %v is in tree %d, expected %d", obj, c, i, first)
+					}
+				}
+			}
+
+			all := rt.GetAll()
+			if len(seen) != len(all) {
+				t.Errorf("SplitByBounds returned %d distinct objects, expected %d", len(seen), len(all))
+			}
+			for _, obj := range all {
+				if seen[obj] != 1 {
+					t.Errorf("%v appears in %d trees, expected 1", obj, seen[obj])
+				}
+			}
+			if rt.Size() != len(things) {
+				t.Errorf("SplitByBounds changed the size of tree to %d", rt.Size())
+			}
+		})
+	}
+}
+
+func TestIntersectingLeaves(t *testing.T) {
+	things := randomThings(300, 2)
+	for _, tc := range tests(2, 3, 6, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+			for i := 0; i < 50; i++ {
+				bb := mustRect(Point{rand.Float64() * 90, rand.Float64() * 90}, []float64{10, 10})
+				leaves := rt.IntersectingLeaves(bb)
+				if len(leaves) > rt.CountByLevel()[0] {
+					t.Errorf("IntersectingLeaves returned %d leaves, tree has %d", len(leaves), rt.CountByLevel()[0])
+				}
+				for _, leaf := range leaves {
+					if !intersect(bb, leaf) {
+						t.Errorf("leaf %v does not intersect %v", leaf, bb)
+					}
+				}
+				for _, obj := range rt.SearchIntersect(bb) {
+					covered := false
+					for _, leaf := range leaves {
+						if leaf.containsRect(obj.Bounds()) {
+							covered = true
+							break
+						}
+					}
+					if !covered {
+						t.Errorf("%v is not covered by the leaves intersecting %v", obj, bb)
+					}
+				}
+			}
+		})
+	}
+
+	rt := NewTree(2, 3, 6)
+	bb := mustRect(Point{0, 0}, []float64{10, 10})
+	if leaves := rt.IntersectingLeaves(bb); len(leaves) != 0 {
+		t.Errorf("IntersectingLeaves on empty tree returned %v", leaves)
+	}
+	r := mustRect(Point{1, 1}, []float64{1, 1})
+	rt.Insert(&r)
+	if leaves := rt.IntersectingLeaves(bb); len(leaves) != 1 || !leaves[0].Equal(r) {
+		t.Errorf("IntersectingLeaves on a single leaf returned %v, expected [%v]", leaves, r)
+	}
+}
+
+func TestSearchExact(t *testing.T) {
+	bb := mustRect(Point{10, 10}, []float64{5, 5})
+	rects := []Rect{
+		mustRect(Point{10, 10}, []float64{5, 5}),
+		mustRect(Point{10, 10}, []float64{5, 5}),
+		mustRect(Point{10.005, 10}, []float64{5, 5}),
+		mustRect(Point{10, 9.995}, []float64{5, 5.01}),
+		mustRect(Point{10.05, 10}, []float64{5, 5}),
+		mustRect(Point{10, 10}, []float64{5.1, 5}),
+		mustRect(Point{11, 11}, []float64{3, 3}),
+	}
+	things := []Spatial{}
+	for i := range rects {
+		things = append(things, &rects[i])
+	}
+	things = append(things, randomThings(200, 5)...)
+
+	for _, tc := range tests(2, 3, 6, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+			if q := rt.SearchExact(bb, 0); len(q) != 2 {
+				t.Errorf("SearchExact with eps 0 returned %d objects, expected 2", len(q))
+			} else {
+				ensureDisorderedSubset(t, q, things[:2])
+			}
+			if q := rt.SearchExact(bb, 0.01); len(q) != 4 {
+				t.Errorf("SearchExact with eps 0.01 returned %d objects, expected 4", len(q))
+			} else {
+				ensureDisorderedSubset(t, q, things[:4])
+			}
+			q := rt.SearchExact(bb, 0.2)
+			for _, obj := range things[:6] {
+				if !contains(obj, q) {
+					t.Errorf("SearchExact with eps 0.2 did not return %v", obj)
+				}
+			}
+			if contains(things[6], q) {
+				t.Errorf("SearchExact with eps 0.2 returned %v", things[6])
+			}
+		})
+	}
+}
+
+func TestFindDuplicates(t *testing.T) {
+	things := randomThings(100, 2)
+	for _, tc := range tests(2, 3, 6, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+			if dups := rt.FindDuplicates(); len(dups) != 0 {
+				t.Errorf("FindDuplicates() = %v, expected no duplicates", dups)
+			}
+
+			rt.Insert(things[7])
+			rt.Insert(things[42])
+			rt.Insert(things[7])
+			dups := rt.FindDuplicates()
+			if len(dups) != 2 {
+				t.Fatalf("FindDuplicates() returned %d objects, expected 2", len(dups))
+			}
+			ensureDisorderedSubset(t, dups, []Spatial{things[7], things[42]})
+		})
+	}
+}
+
+func TestNearestNeighborRing(t *testing.T) {
+	things := randomThings(500, 1)
+	for _, tc := range tests(2, 3, 6, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+			for i := 0; i < 200; i++ {
+				p := Point{rand.Float64()*300 - 100, rand.Float64()*300 - 100}
+				exp := rt.NearestNeighbor(p)
+				if got := rt.NearestNeighborRing(p); got != exp {
+					t.Errorf("NearestNeighborRing(%v) = %v, expected %v", p, got, exp)
+				}
+			}
+		})
+	}
+
+	if obj := NewTree(2, 3, 6).NearestNeighborRing(Point{0, 0}); obj != nil {
+		t.Errorf("NearestNeighborRing on empty tree returned %v", obj)
+	}
+
+	// distances below 1, whose squares are smaller than themselves
+	rt := NewTree(2, 2, 4)
+	var small []Spatial
+	for _, c := range []Point{{0.49, 0.49}, {0.55, 0}, {0.55, 1}, {0.54, 0.99}} {
+		r := mustRect(c, []float64{0.001, 0.001})
+		small = append(small, &r)
+		rt.Insert(&r)
+	}
+	if got := rt.NearestNeighborRing(Point{0, 0}); got != small[1] {
+		t.Errorf("NearestNeighborRing on sub-unit coordinates = %v, expected %v", got, small[1])
+	}
+
+	defer func() {
+		if _, ok := recover().(DimError); !ok {
+			t.Errorf("NearestNeighborRing with a 3D point failed to panic with DimError")
+		}
+	}()
+	rt.NearestNeighborRing(Point{0, 0, 0})
+}
+
+func TestDensestLeaf(t *testing.T) {
+	if bb, n := NewTree(2, 3, 6).DensestLeaf(); n != 0 || len(bb.p) != 0 {
+		t.Errorf("DensestLeaf on empty tree = %v, %d", bb, n)
+	}
+
+	// sparse background with a dense cluster in [50, 51] x [50, 51]
+	things := randomThings(200, 0.5)
+	for i := 0; i < 50; i++ {
+		r := mustRect(Point{50 + rand.Float64()*0.9, 50 + rand.Float64()*0.9}, []float64{0.1, 0.1})
+		things = append(things, &r)
+	}
+	cluster := mustRect(Point{50, 50}, []float64{1, 1})
+
+	for _, tc := range tests(2, 3, 6, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+			bb, n := rt.DensestLeaf()
+			for _, leaf := range rt.LeafAssignments() {
+				leafBB := leaf[0].Bounds()
+				for _, obj := range leaf[1:] {
+					leafBB = boundingBox(leafBB, obj.Bounds())
+				}
+				if len(leaf) > n || len(leaf) == n && leafBB.Size() < bb.Size() {
+					t.Errorf("DensestLeaf returned %v with %d objects, but leaf %v has %d", bb, n, leafBB, len(leaf))
+				}
+			}
+			// bulk loading fills all leaves, so the smallest one is in the cluster
+			if tc.name == "bulk-loaded" && !cluster.containsRect(bb) {
+				t.Errorf("DensestLeaf returned %v outside of the cluster %v", bb, cluster)
+			}
+		})
+	}
+}
+
+func TestDeleteFunc(t *testing.T) {
+	var things []Spatial
+	for i, thing := range randomThings(300, 2) {
+		things = append(things, NewItem(thing.Bounds(), i%3 == 0))
+	}
+	stale := func(obj Spatial) bool { return obj.(*Item).Data.(bool) }
+
+	for _, tc := range tests(2, 3, 6, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+			var deleted int
+			rt.OnDelete(func(Spatial) { deleted++ })
+
+			if n := rt.DeleteFunc(stale); n != 100 || deleted != 100 {
+				t.Errorf("DeleteFunc removed %d objects and notified %d, expected 100", n, deleted)
+			}
+			if rt.Size() != 200 {
+				t.Errorf("Size() = %d after DeleteFunc, expected 200", rt.Size())
+			}
+			if err := rt.Validate(); err != nil {
+				t.Errorf("DeleteFunc produced invalid tree: %v", err)
+			}
+			for _, obj := range things {
+				if rt.Contains(obj) == stale(obj) {
+					t.Errorf("Contains(%v) = %v after DeleteFunc", obj, !stale(obj))
+				}
+			}
+			if n := rt.DeleteFunc(stale); n != 0 {
+				t.Errorf("second DeleteFunc removed %d objects, expected 0", n)
+			}
+		})
+	}
+}
+
+// shifty is a misbehaving Spatial whose bounds change dimension.
+type shifty struct {
+	bounds Rect
+}
+
+func (s *shifty) Bounds() Rect {
+	return s.bounds
+}
+
+func TestInsertDimensionChange(t *testing.T) {
+	things := randomThings(10, 1)
+	rt := NewTree(2, 2, 3, things...)
+	obj := &shifty{Rect{Point{0, 0}, Point{1, 1}}}
+	if err := rt.TryInsert(obj); err != nil {
+		t.Fatalf("Insert(%v) returned error %v", obj, err)
+	}
+
+	obj.bounds = Rect{Point{0, 0, 0}, Point{1, 1, 1}}
+	for name, fn := range map[string]func(){
+		"Contains": func() { rt.Contains(obj) },
+		"Delete":   func() { rt.Delete(obj) },
+	} {
+		func() {
+			defer func() {
+				if err, ok := recover().(DimError); !ok || err != (DimError{2, 3}) {
+					t.Errorf("%s of object of wrong dimension did not panic with DimError{2, 3}", name)
+				}
+			}()
+			fn()
+		}()
+	}
+
+	// no object is removed if any of them cannot be reinserted
+	err := rt.BulkUpdate([]Spatial{things[0], obj})
+	if _, ok := err.(*DimError); !ok {
+		t.Errorf("BulkUpdate returned error %v, expected DimError", err)
+	}
+	if err := rt.TryInsert(obj); err == nil {
+		t.Errorf("TryInsert of object of wrong dimension succeeded")
+	} else if dimErr, ok := err.(*DimError); !ok || *dimErr != (DimError{2, 3}) {
+		t.Errorf("TryInsert returned error %v, expected DimError{2, 3}", err)
+	}
+	if rt.Size() != 11 || !rt.Contains(things[0]) {
+		t.Errorf("Size() = %d, expected 11 with all objects in the tree", rt.Size())
+	}
+	if err := rt.Validate(); err != nil {
+		t.Errorf("tree is invalid: %v", err)
+	}
+	obj.bounds = Rect{Point{0, 0}, Point{1, 1}}
+	if !rt.Contains(obj) {
+		t.Errorf("object of failed BulkUpdate is lost")
+	}
+
+	// the first object of an empty tree is checked as well
+	obj.bounds = Rect{Point{0, 0, 0}, Point{1, 1, 1}}
+	empty := NewTree(2, 2, 3)
+	if err := empty.TryInsert(obj); err == nil || empty.Size() != 0 {
+		t.Errorf("Insert of object of wrong dimension into empty tree returned %v", err)
+	}
+
+	// the internal steps check the dimension before changing the tree
+	if _, err := rt.chooseNode(rt.root, entry{bb: obj.bounds, obj: obj}, 1); err == nil {
+		t.Errorf("chooseNode of entry of wrong dimension returned no error")
+	}
+	n := &node{leaf: true, level: 1, entries: []entry{
+		{bb: mustRect(Point{0, 0}, []float64{1, 1})},
+		{bb: obj.bounds},
+		{bb: mustRect(Point{5, 5}, []float64{1, 1})},
+		{bb: mustRect(Point{6, 6}, []float64{1, 1})},
+	}}
+	if _, _, err := rt.split(n); err == nil {
+		t.Errorf("split of node with entry of wrong dimension returned no error")
+	} else if len(n.entries) != 4 {
+		t.Errorf("failed split changed the node to %d entries", len(n.entries))
+	}
+}
+
+func TestTopKIntersect(t *testing.T) {
+	things := randomThings(300, 2)
+	// score objects by their area
+	score := func(obj Spatial) float64 { return obj.Bounds().Size() }
+	bb := mustRect(Point{20, 20}, []float64{50, 50})
+
+	for _, tc := range tests(2, 3, 6, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+			all := rt.SearchIntersect(bb)
+			sort.Slice(all, func(i, j int) bool { return score(all[i]) > score(all[j]) })
+
+			for _, k := range []int{0, 1, 10, len(all), len(all) + 5} {
+				top := rt.TopKIntersect(bb, k, score)
+				exp := all
+				if k < len(exp) {
+					exp = exp[:k]
+				}
+				if len(top) != len(exp) {
+					t.Errorf("TopKIntersect(%d) returned %d objects, expected %d", k, len(top), len(exp))
+					continue
+				}
+				for i := range top {
+					if top[i] != exp[i] {
+						t.Errorf("TopKIntersect(%d)[%d] = %v, expected %v", k, i, top[i], exp[i])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestSearchIntersect2D(t *testing.T) {
+	rects := []Rect{
+		mustRect(Point{0, 0, -100}, []float64{1, 1, 1}),
+		mustRect(Point{0.5, 0.5, 50}, []float64{1, 1, 200}),
+		mustRect(Point{0, 0, 0}, []float64{3, 3, 0.1}),
+		mustRect(Point{5, 5, 0}, []float64{1, 1, 1}),
+		mustRect(Point{1, 1.5, 1e6}, []float64{0.1, 0.1, 0.1}),
+	}
+	things := []Spatial{}
+	for i := range rects {
+		things = append(things, &rects[i])
+	}
+
+	for _, tc := range tests(3, 2, 3, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+			q := rt.SearchIntersect2D(2, 2, 0.8, 0.8)
+			expected := []Spatial{things[0], things[1], things[2], things[4]}
+			if len(q) != len(expected) {
+				t.Fatalf("SearchIntersect2D returned %v, expected %v", q, expected)
+			}
+			ensureDisorderedSubset(t, q, expected)
+		})
+	}
+
+	defer func() {
+		if _, ok := recover().(DimError); !ok {
+			t.Errorf("SearchIntersect2D on 1D tree failed to panic with DimError")
+		}
+	}()
+	NewTree(1, 2, 3).SearchIntersect2D(0, 0, 1, 1)
+}
+
+func TestOptimizeSortedSearch(t *testing.T) {
+	things := randomThings(1000, 2)
+	rt := NewTree(2, 3, 6, things...)
+	ref := NewTree(2, 3, 6, things...)
+	rt.Optimize()
+	if !rt.sorted {
+		t.Fatalf("Optimize did not sort the tree")
+	}
+
+	for i := 0; i < 100; i++ {
+		bb := mustRect(Point{rand.Float64() * 100, rand.Float64() * 100}, []float64{rand.Float64() * 20, rand.Float64() * 20})
+		q, exp := rt.SearchIntersect(bb), ref.SearchIntersect(bb)
+		if len(q) != len(exp) {
+			t.Fatalf("SearchIntersect(%v) on sorted tree returned %d objects, expected %d", bb, len(q), len(exp))
+		}
+		ensureDisorderedSubset(t, q, exp)
+
+		// both the sorted and the unsorted search stop when a filter
+		// aborts, so that no objects are looked at after the limit
+		for _, tree := range []*Rtree{rt, ref} {
+			calls := 0
+			limit := LimitFilter(3)
+			counted := func(results []Spatial, obj Spatial) (refuse, abort bool) {
+				calls++
+				return limit(results, obj)
+			}
+			q := tree.SearchIntersect(bb, counted)
+			if len(q) != len(exp) && len(q) != 3 {
+				t.Errorf("SearchIntersect(%v) with limit on tree sorted %v returned %d objects", bb, tree.sorted, len(q))
+			}
+			if calls > 4 {
+				t.Errorf("SearchIntersect(%v) with limit 3 on tree sorted %v called the filter %d times", bb, tree.sorted, calls)
+			}
+		}
+	}
+
+	rt.Insert(&Rect{Point{50, 50}, Point{51, 51}})
+	if rt.sorted {
+		t.Errorf("Insert did not invalidate the sorted order")
+	}
+	rt.Optimize()
+	rt.Delete(things[0])
+	if rt.sorted {
+		t.Errorf("Delete did not invalidate the sorted order")
+	}
+}
+
+func TestOptimizeLazyDelete(t *testing.T) {
+	// lazy deletes swap emptied children out of their parents and shrink
+	// the boxes of the remaining ones, which breaks the sorted order
+	rng := rand.New(rand.NewSource(1))
+	var things []Spatial
+	for i := 0; i < 300; i++ {
+		r := mustRect(Point{rng.Float64() * 100, rng.Float64() * 100}, []float64{rng.Float64() * 2, rng.Float64() * 2})
+		things = append(things, &r)
+	}
+	rt := NewTree(2, 2, 4)
+	for _, thing := range things {
+		rt.Insert(thing)
+	}
+	rt.Optimize()
+	rt.SetBalanceMode(BalanceLazy)
+	live := make(map[Spatial]bool, len(things))
+	for _, thing := range things {
+		live[thing] = true
+	}
+	for _, i := range rng.Perm(len(things))[:150] {
+		rt.Delete(things[i])
+		delete(live, things[i])
+	}
+	if rt.sorted {
+		t.Errorf("lazy Delete did not invalidate the sorted order")
+	}
+
+	for i := 0; i < 200; i++ {
+		bb := mustRect(Point{rng.Float64() * 100, rng.Float64() * 100}, []float64{rng.Float64() * 10, rng.Float64() * 10})
+		var exp []Spatial
+		for obj := range live {
+			if intersect(bb, obj.Bounds()) {
+				exp = append(exp, obj)
+			}
+		}
+		if q := rt.SearchIntersect(bb); len(q) != len(exp) {
+			t.Fatalf("SearchIntersect(%v) returned %d objects, expected %d", bb, len(q), len(exp))
+		}
+	}
+}
+
+func BenchmarkSearchIntersectOptimized(b *testing.B) {
+	rt := NewTree(2, 25, 50, randomThings(100000, 0.5)...)
+	rt.Optimize()
+	benchmarkSearchIntersect(b, func(bb Rect) []Spatial { return rt.SearchIntersect(bb) })
+}
+
+func TestCoverageArea(t *testing.T) {
+	if a := NewTree(2, 3, 6).CoverageArea(); a != 0 {
+		t.Errorf("CoverageArea of empty tree = %v, expected 0", a)
+	}
+
+	// a 10x10 grid of unit squares tiling [0, 10] x [0, 10]
+	var things []Spatial
+	for x := 0; x < 10; x++ {
+		for y := 0; y < 10; y++ {
+			r := mustRect(Point{float64(x), float64(y)}, []float64{1, 1})
+			things = append(things, &r)
+		}
+	}
+	for _, tc := range tests(2, 3, 6, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			if a := tc.build().CoverageArea(); math.Abs(a-100) > EPS {
+				t.Errorf("CoverageArea = %v, expected 100", a)
+			}
+		})
+	}
+}
+
+func TestSetLeafSortAxis(t *testing.T) {
+	things := randomThings(300, 2)
+	leavesSorted := func(t *testing.T, rt *Rtree) {
+		for i, leaf := range rt.LeafAssignments() {
+			for j := 1; j < len(leaf); j++ {
+				if leaf[j-1].Bounds().p[1] > leaf[j].Bounds().p[1] {
+					t.Fatalf("leaf %d is not sorted on axis 1 at index %d", i, j)
+				}
+			}
+		}
+	}
+
+	for _, tc := range tests(2, 3, 6, things[:200]...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+			rt.SetLeafSortAxis(1)
+			leavesSorted(t, rt)
+
+			for _, thing := range things[200:] {
+				rt.Insert(thing)
+			}
+			for _, thing := range things[:50] {
+				rt.Delete(thing)
+			}
+			leavesSorted(t, rt)
+			verify(t, rt)
+
+			for i := 0; i < 50; i++ {
+				min := rand.Float64() * 100
+				max := min + rand.Float64()*10
+				var expected []Spatial
+				for _, thing := range things[50:] {
+					if bb := thing.Bounds(); bb.p[1] < max && min < bb.q[1] {
+						expected = append(expected, thing)
+					}
+				}
+				q := rt.SearchAxisRange(min, max)
+				if len(q) != len(expected) {
+					t.Fatalf("SearchAxisRange(%v, %v) returned %d objects, expected %d", min, max, len(q), len(expected))
+				}
+				ensureDisorderedSubset(t, q, expected)
+			}
+
+			rt.Optimize()
+			leavesSorted(t, rt)
+			bb := mustRect(Point{20, 20}, []float64{30, 30})
+			if q, exp := rt.SearchIntersect(bb), rt.SearchIntersectWithBoundary(bb, BoundaryOpen); len(q) != len(exp) {
+				t.Errorf("SearchIntersect after Optimize returned %d objects, expected %d", len(q), len(exp))
+			}
+
+			rt.SetLeafSortAxis(-1)
+			if q := rt.SearchAxisRange(20, 30); len(q) != len(rt.SearchIntersect(mustRect(Point{20, -1}, []float64{10, 200}))) {
+				t.Errorf("SearchAxisRange without leaf sorting returned %d objects", len(q))
+			}
+		})
+	}
+}
+
+func TestNearestFace(t *testing.T) {
+	rects := []Rect{
+		mustRect(Point{0, 0}, []float64{4, 2}),
+		mustRect(Point{20, 20}, []float64{1, 1}),
+		mustRect(Point{-20, 5}, []float64{1, 1}),
+	}
+	things := []Spatial{}
+	for i := range rects {
+		things = append(things, &rects[i])
+	}
+
+	cases := []struct {
+		p    Point
+		axis int
+		dist float64
+	}{
+		{Point{2, 3.5}, 1, 1.5},         // above the top face
+		{Point{5, 1}, 0, 1},             // right of the right face
+		{Point{6, -1}, 0, math.Sqrt(5)}, // off the corner, farther along x
+		{Point{3.5, 1}, 0, 0.5},         // inside, near the right face
+		{Point{1.5, 0.25}, 1, 0.25},     // inside, near the bottom face
+		{Point{2, -5}, 1, 5},            // below the bottom face
+		{Point{-0.5, -4}, 1, math.Sqrt(16.25)},
+	}
+	for _, tc := range tests(2, 3, 3, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+			for _, c := range cases {
+				obj, axis, dist := rt.NearestFace(c.p)
+				if obj != things[0] || axis != c.axis || math.Abs(dist-c.dist) > EPS {
+					t.Errorf("NearestFace(%v) = %v, %d, %v, expected %v, %d, %v", c.p, obj, axis, dist, things[0], c.axis, c.dist)
+				}
+			}
+		})
+	}
+
+	if obj, axis, _ := NewTree(2, 3, 3).NearestFace(Point{0, 0}); obj != nil || axis != -1 {
+		t.Errorf("NearestFace on empty tree returned %v, %d", obj, axis)
+	}
+}
+
+// moveThings returns copies of things moved by up to step along every axis.
+func moveThings(things []Spatial, step float64) []Spatial {
+	moved := make([]Spatial, len(things))
+	for i, thing := range things {
+		bb := thing.Bounds()
+		p := Point{bb.p[0] + (rand.Float64()*2-1)*step, bb.p[1] + (rand.Float64()*2-1)*step}
+		r := mustRect(p, []float64{bb.q[0] - bb.p[0], bb.q[1] - bb.p[1]})
+		moved[i] = &r
+	}
+	return moved
+}
+
+func TestInsertHint(t *testing.T) {
+	things := randomThings(300, 2)
+	for _, tc := range tests(2, 3, 6, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+			current := append([]Spatial{}, things...)
+			for frame := 0; frame < 3; frame++ {
+				moved := moveThings(current, 0.5)
+				for i := range current {
+					if err := rt.InsertHint(moved[i], current[i]); err != nil {
+						t.Fatalf("InsertHint returned %v", err)
+					}
+					if !rt.Delete(current[i]) {
+						t.Fatalf("Delete of %v failed", current[i])
+					}
+				}
+				current = moved
+				verify(t, rt)
+			}
+			if err := rt.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			ensureDisorderedSubset(t, rt.GetAll(), current)
+			if rt.Size() != len(current) {
+				t.Fatalf("Size() = %d, expected %d", rt.Size(), len(current))
+			}
+
+			thing := &Rect{Point{1, 1}, Point{2, 2}}
+			if err := rt.InsertHint(thing, &Rect{Point{1, 1}, Point{2, 2}}); err != nil || !rt.Contains(thing) {
+				t.Errorf("InsertHint with a hint not in the tree failed: %v", err)
+			}
+			other := &Rect{Point{3, 3}, Point{4, 4}}
+			if err := rt.InsertHint(other, nil); err != nil || !rt.Contains(other) {
+				t.Errorf("InsertHint without a hint failed: %v", err)
+			}
+			if err := rt.InsertHint(&Rect{Point{0, 0, 0}, Point{1, 1, 1}}, current[0]); err == nil {
+				t.Errorf("InsertHint of a three-dimensional object succeeded")
+			}
+		})
+	}
+}
+
+func TestInsertNearLeaf(t *testing.T) {
+	things := randomThings(300, 2)
+	for _, tc := range tests(2, 3, 6, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+			current := append([]Spatial{}, things...)
+			leaves := make([]NodeRef, len(current))
+			for frame := 0; frame < 5; frame++ {
+				moved := moveThings(current, 0.5)
+				for i := range current {
+					leaf, err := rt.InsertNearLeaf(moved[i], leaves[i])
+					if err != nil {
+						t.Fatalf("InsertNearLeaf returned %v", err)
+					}
+					if !leaf.n.holds(moved[i]) {
+						t.Fatalf("InsertNearLeaf returned a leaf not holding %v", moved[i])
+					}
+					leaves[i] = leaf
+					if !rt.Delete(current[i]) {
+						t.Fatalf("Delete of %v failed", current[i])
+					}
+				}
+				current = moved
+				verify(t, rt)
+			}
+
+			if err := rt.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			ensureDisorderedSubset(t, rt.GetAll(), current)
+			if rt.Size() != len(current) {
+				t.Fatalf("Size() = %d, expected %d", rt.Size(), len(current))
+			}
+			plain := NewTree(2, 3, 6)
+			for _, thing := range current {
+				plain.Insert(thing)
+			}
+			for i := 0; i < 50; i++ {
+				bb := mustRect(Point{rand.Float64() * 90, rand.Float64() * 90}, []float64{10, 10})
+				q, exp := rt.SearchIntersect(bb), plain.SearchIntersect(bb)
+				if len(q) != len(exp) {
+					t.Fatalf("SearchIntersect(%v) returned %d objects, expected %d", bb, len(q), len(exp))
+				}
+				ensureDisorderedSubset(t, q, exp)
+			}
+
+			// leaves of other trees, removed from them or not, are ignored
+			stale := NewTree(2, 3, 6, things...)
+			var removed NodeRef
+			stale.Walk(func(ref NodeRef, level int) bool {
+				if level == 1 && removed.n == nil {
+					removed = ref
+				}
+				return true
+			})
+			for _, thing := range removed.n.entries {
+				stale.Delete(thing.obj)
+			}
+			for _, hint := range []NodeRef{removed, {stale.root}, {&node{leaf: true}}} {
+				thing := &Rect{Point{1, 1}, Point{2, 2}}
+				if leaf, err := rt.InsertNearLeaf(thing, hint); err != nil || !rt.Contains(thing) || !leaf.n.holds(thing) {
+					t.Errorf("InsertNearLeaf with a hint not in the tree failed: %v", err)
+				}
+			}
+			if _, err := rt.InsertNearLeaf(&Rect{Point{0, 0, 0}, Point{1, 1, 1}}, leaves[0]); err == nil {
+				t.Errorf("InsertNearLeaf of a three-dimensional object succeeded")
+			}
+			if err := rt.Validate(); err != nil {
+				t.Fatal(err)
+			}
+
+			// the leaves of a version of a SharedRtree are shared with the
+			// previous version, which must not change
+			base := rt.Clone()
+			size := base.Size()
+			var hint NodeRef
+			base.Walk(func(ref NodeRef, level int) bool {
+				if level == 1 {
+					hint = ref
+				}
+				return true
+			})
+			shared := NewSharedRtree(base)
+			shared.UpdateCOW(func(next *Rtree) {
+				thing := &Rect{Point{1, 1}, Point{2, 2}}
+				if leaf, err := next.InsertNearLeaf(thing, hint); err != nil || !leaf.n.holds(thing) {
+					t.Errorf("InsertNearLeaf into a version of a SharedRtree failed: %v", err)
+				}
+			})
+			if base.Size() != size || shared.Load().Size() != size+1 {
+				t.Errorf("InsertNearLeaf into a new version changed the size of the previous one")
+			}
+			if err := base.Validate(); err != nil {
+				t.Errorf("previous version invalid after InsertNearLeaf: %v", err)
+			}
+		})
+	}
+}
+
+func benchmarkInsertCoherent(b *testing.B, insert func(rt *Rtree, obj, prev Spatial, hint NodeRef) NodeRef) {
+	things := randomThings(10000, 0.5)
+	rt := NewTree(2, 25, 50, things...)
+	leaves := make([]NodeRef, len(things))
+	for i, thing := range things {
+		leaves[i] = NodeRef{rt.root.findLeaf(thing, thing.Bounds(), defaultComparator)}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		j := i % len(things)
+		moved := moveThings(things[j:j+1], 0.1)[0]
+		leaves[j] = insert(rt, moved, things[j], leaves[j])
+		rt.Delete(things[j])
+		things[j] = moved
+	}
+}
+
+func BenchmarkInsertCoherent(b *testing.B) {
+	benchmarkInsertCoherent(b, func(rt *Rtree, obj, prev Spatial, hint NodeRef) NodeRef {
+		rt.Insert(obj)
+		return NodeRef{}
+	})
+}
+
+func BenchmarkInsertHintCoherent(b *testing.B) {
+	benchmarkInsertCoherent(b, func(rt *Rtree, obj, prev Spatial, hint NodeRef) NodeRef {
+		rt.InsertHint(obj, prev)
+		return NodeRef{}
+	})
+}
+
+func BenchmarkInsertNearLeafCoherent(b *testing.B) {
+	benchmarkInsertCoherent(b, func(rt *Rtree, obj, prev Spatial, hint NodeRef) NodeRef {
+		leaf, _ := rt.InsertNearLeaf(obj, hint)
+		return leaf
+	})
+}
+
+func TestNewTreeInferred(t *testing.T) {
+	first := &Rect{Point{0, 0, 0}, Point{1, 1, 1}}
+	rt := NewTreeInferred(3, 6, first)
+	if rt.Dim != 3 {
+		t.Errorf("NewTreeInferred inferred dimension %d, expected 3", rt.Dim)
+	}
+	if rt.Size() != 1 || !rt.Contains(first) {
+		t.Errorf("NewTreeInferred did not insert the first object")
+	}
+
+	if err := rt.TryInsert(&Rect{Point{2, 2, 2}, Point{3, 3, 3}}); err != nil {
+		t.Errorf("Insert of a three-dimensional object returned %v", err)
+	}
+	err := rt.TryInsert(&Rect{Point{0, 0}, Point{1, 1}})
+	if _, ok := err.(*DimError); !ok {
+		t.Errorf("Insert of a two-dimensional object returned %v, expected a DimError", err)
+	}
+	if rt.Size() != 2 {
+		t.Errorf("Size() = %d, expected 2", rt.Size())
+	}
+}
+
+func TestEmptyTreeQueries(t *testing.T) {
+	rt := NewTree(2, 3, 6)
+	bb := mustRect(Point{0, 0}, []float64{10, 10})
+	p := Point{1, 2}
+	score := func(obj Spatial) float64 { return 0 }
+	less := func(a, b Spatial) bool { return false }
+
+	counts := map[string]int{
+		"SearchIntersect":             len(rt.SearchIntersect(bb)),
+		"SearchIntersectWithBoundary": len(rt.SearchIntersectWithBoundary(bb, BoundaryClosed)),
+		"SearchIntersectOrdered":      len(rt.SearchIntersectOrdered(bb, less)),
+		"SearchIntersectWithLimit":    len(rt.SearchIntersectWithLimit(3, bb)),
+		"SearchIntersectWithOverlap":  len(rt.SearchIntersectWithOverlap(bb)),
+		"SearchIntersect2D":           len(rt.SearchIntersect2D(0, 0, 10, 10)),
+		"SearchNotIntersecting":       len(rt.SearchNotIntersecting(bb)),
+		"SearchAxisRange":             len(rt.SearchAxisRange(0, 10)),
+		"SearchIntersectMulti":        len(rt.SearchIntersectMulti([]Rect{bb})[0]),
+		"TopKIntersect":               len(rt.TopKIntersect(bb, 3, score)),
+		"ExplainIntersect":            rt.ExplainIntersect(bb).Results,
+		"RayIntersect":                len(rt.RayIntersect(p, Point{1, 0}, true)),
+		"GetAll":                      len(rt.GetAll()),
+		"GetAllBoundingBoxes":         len(rt.GetAllBoundingBoxes()),
+		"NearestNeighbors":            len(rt.NearestNeighbors(3, p)),
+		"NearestNeighborsTieBreak":    len(rt.NearestNeighborsTieBreak(3, p, less)),
+		"PartitionAtLevel":            len(rt.PartitionAtLevel(1)),
+		"FindDuplicates":              len(rt.FindDuplicates()),
+		"LeafAssignments":             len(rt.LeafAssignments()[0]),
+		"ReduceIntersect": rt.ReduceIntersect(bb, 0, func(acc interface{}, obj Spatial) interface{} {
+			return acc.(int) + 1
+		}).(int),
+	}
+	objs, dists := rt.NearestNeighborsWithDist(3, p)
+	counts["NearestNeighborsWithDist"] = len(objs) + len(dists)
+	inside, partial := rt.ClassifyIntersect(bb)
+	counts["ClassifyIntersect"] = len(inside) + len(partial)
+	for _, q := range rt.SearchQuadrants(bb) {
+		counts["SearchQuadrants"] += len(q)
+	}
+	_, n := rt.DensestLeaf()
+	counts["DensestLeaf"] = n
+	for name, count := range counts {
+		if count != 0 {
+			t.Errorf("%s on empty tree returned %d results", name, count)
+		}
+	}
+
+	nils := map[string]Spatial{
+		"NearestNeighbor":         rt.NearestNeighbor(p),
+		"NearestNeighborRing":     rt.NearestNeighborRing(p),
+		"NearestNeighborWeighted": rt.NearestNeighborWeighted(p, []float64{1, 2}),
+		"Extreme":                 rt.Extreme(0, true),
+		"SmallestContaining":      rt.SmallestContaining(p),
+	}
+	obj, _, _ := rt.NearestFace(p)
+	nils["NearestFace"] = obj
+	a, b, _ := rt.ClosestPair()
+	nils["ClosestPair"] = a
+	nils["ClosestPair second object"] = b
+	for name, obj := range nils {
+		if obj != nil {
+			t.Errorf("%s on empty tree returned %v", name, obj)
+		}
+	}
+
+	if rt.AnyIntersect(bb) {
+		t.Errorf("AnyIntersect on empty tree returned true")
+	}
+	if rt.Contains(&bb) {
+		t.Errorf("Contains on empty tree returned true")
+	}
+	if a := rt.CoverageArea(); a != 0 {
+		t.Errorf("CoverageArea on empty tree returned %v", a)
+	}
+	if total, avg := rt.OverlapStats(); total != 0 || avg != 0 {
+		t.Errorf("OverlapStats on empty tree returned %v, %v", total, avg)
+	}
+	if err := rt.Validate(); err != nil {
+		t.Errorf("Validate on empty tree returned %v", err)
+	}
+}
+
+func TestSearchAlongPath(t *testing.T) {
+	// An L-shaped path from (0, 0) to (10, 0) to (10, 10) with a corridor of
+	// width 1.  The objects in the corridor are listed in path order.
+	rects := []Rect{
+		mustRect(Point{-1, -0.5}, []float64{0.5, 1}), // before the start, at 0
+		mustRect(Point{2, 0.5}, []float64{1, 1}),     // at 2
+		mustRect(Point{6, -1.5}, []float64{1, 1}),    // below, at 6
+		mustRect(Point{9.5, -0.5}, []float64{1, 1}),  // on the corner, at 9.5
+		mustRect(Point{8.5, 4}, []float64{0.5, 1}),   // left of the second leg, at 14
+		mustRect(Point{10.5, 8}, []float64{2, 1}),    // right of the second leg, at 18
+		mustRect(Point{9, 11}, []float64{2, 2}),      // after the end, at 20
+		mustRect(Point{5, 2}, []float64{1, 1}),       // inside the L, too far
+		mustRect(Point{-3, 0}, []float64{1, 1}),      // before the start, too far
+		mustRect(Point{11.5, 2}, []float64{1, 1}),    // right of the second leg, too far
+		mustRect(Point{20, 20}, []float64{1, 1}),
+	}
+	things := []Spatial{}
+	for i := range rects {
+		things = append(things, &rects[i])
+	}
+	path := []Point{{0, 0}, {10, 0}, {10, 10}}
+
+	for _, tc := range tests(2, 2, 3, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+			objs := rt.SearchAlongPath(path, 1)
+			if len(objs) != 7 {
+				t.Fatalf("SearchAlongPath returned %d objects, expected 7: %v", len(objs), objs)
+			}
+			for i := range objs {
+				if objs[i] != things[i] {
+					t.Errorf("SearchAlongPath failed at index %d: %v != %v", i, objs[i], things[i])
+				}
+			}
+
+			if objs := rt.SearchAlongPath(path[1:2], 0.5); len(objs) != 1 || objs[0] != things[3] {
+				t.Errorf("SearchAlongPath for a single point returned %v, expected %v", objs, things[3])
+			}
+			if objs := rt.SearchAlongPath(nil, 1); len(objs) != 0 {
+				t.Errorf("SearchAlongPath for an empty path returned %v", objs)
+			}
+		})
+	}
+}
+
+func TestSetSlowQueryLog(t *testing.T) {
+	things := randomThings(300, 2)
+	for _, tc := range tests(2, 3, 6, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+			var calls, visited int
+			var elapsed time.Duration
+			rt.SetSlowQueryLog(5*time.Millisecond, func(nodesVisited int, d time.Duration) {
+				calls++
+				visited, elapsed = nodesVisited, d
+			})
+
+			bb := mustRect(Point{-10, -10}, []float64{200, 200})
+			rt.SearchIntersect(bb)
+			if calls != 0 {
+				t.Errorf("slow query log called %d times for a fast query", calls)
+			}
+
+			slow := func(results []Spatial, object Spatial) (refuse, abort bool) {
+				if len(results) == 0 {
+					time.Sleep(10 * time.Millisecond)
+				}
+				return false, false
+			}
+			if q := rt.SearchIntersect(bb, slow); len(q) != len(things) {
+				t.Fatalf("SearchIntersect returned %d objects, expected %d", len(q), len(things))
+			}
+			if calls != 1 {
+				t.Fatalf("slow query log called %d times for a slow query, expected 1", calls)
+			}
+			if elapsed < 5*time.Millisecond {
+				t.Errorf("slow query log reported %v, expected at least 5ms", elapsed)
+			}
+			total := 0
+			for _, n := range rt.CountByLevel() {
+				total += n
+			}
+			if visited != total {
+				t.Errorf("slow query log reported %d nodes visited, expected all %d", visited, total)
+			}
+
+			// a nearest neighbor search only visits the nodes close to p
+			calls = 0
+			if nn := rt.NearestNeighbors(1, Point{50, 50}, slow); len(nn) != 1 {
+				t.Fatalf("NearestNeighbors returned %d objects, expected 1", len(nn))
+			}
+			if calls != 1 || visited < rt.Depth() || visited >= total {
+				t.Errorf("slow query log called %d times with %d nodes visited for NearestNeighbors, expected once with %d to %d nodes", calls, visited, rt.Depth(), total-1)
+			}
+
+			// a query answered from the cache does not visit the tree
+			rt.EnableQueryCache(4, 1)
+			rt.SearchIntersect(bb, slow)
+			if visited != total {
+				t.Errorf("slow query log reported %d nodes visited on a cache miss, expected %d", visited, total)
+			}
+			rt.SearchIntersect(bb, slow)
+			if calls != 3 || visited != 0 {
+				t.Errorf("slow query log called %d times with %d nodes visited on a cache hit, expected 3 calls with none", calls, visited)
+			}
+			rt.EnableQueryCache(0, 0)
+
+			rt.SetSlowQueryLog(0, nil)
+			rt.SearchIntersect(bb, slow)
+			if calls != 3 {
+				t.Errorf("slow query log called after being disabled")
+			}
+		})
+	}
+}
+
+func TestBFS(t *testing.T) {
+	// A bulk-loaded tree with three leaves of three objects each is
+	// represented by one object, then the objects of the two further leaves,
+	// then the remaining objects of every leaf.
+	rects := make([]Rect, 9)
+	things := make([]Spatial, len(rects))
+	for i := range rects {
+		rects[i] = mustRect(Point{float64(i % 3 * 10), float64(i / 3 * 10)}, []float64{1, 1})
+		things[i] = &rects[i]
+	}
+	rt := NewTree(2, 3, 3, things...)
+	var levels []int
+	rt.BFS(func(level int, obj Spatial) {
+		levels = append(levels, level)
+	})
+	if exp := []int{0, 1, 1, 2, 2, 2, 2, 2, 2}; fmt.Sprint(levels) != fmt.Sprint(exp) {
+		t.Errorf("BFS reported levels %v, expected %v", levels, exp)
+	}
+
+	for _, tc := range tests(2, 3, 6, randomThings(300, 2)...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+			var order []Spatial
+			last := 0
+			rt.BFS(func(level int, obj Spatial) {
+				if level < last || level > rt.Depth() {
+					t.Errorf("BFS reported level %d after level %d", level, last)
+				}
+				last = level
+				order = append(order, obj)
+			})
+			if len(order) != rt.Size() {
+				t.Fatalf("BFS reported %d objects, expected %d", len(order), rt.Size())
+			}
+			ensureDisorderedSubset(t, order, rt.GetAll())
+			seen := make(map[Spatial]bool)
+			for _, obj := range order {
+				if seen[obj] {
+					t.Errorf("BFS reported %v twice", obj)
+				}
+				seen[obj] = true
+			}
+
+			var again []Spatial
+			rt.BFS(func(level int, obj Spatial) { again = append(again, obj) })
+			for i := range order {
+				if order[i] != again[i] {
+					t.Fatalf("BFS order differs at index %d between calls", i)
+				}
+			}
+		})
+	}
+
+	NewTree(2, 3, 6).BFS(func(level int, obj Spatial) {
+		t.Errorf("BFS on empty tree reported %v", obj)
+	})
+}
+
+func TestCoerceDimensions(t *testing.T) {
+	flat := &Rect{Point{1, 1}, Point{2, 3}}
+	rt := NewTree(3, 3, 6, randomThings3D(50)...)
+	if err := rt.TryInsert(flat); err == nil {
+		t.Fatalf("Insert of a 2D object into a 3D tree succeeded without coercion")
+	}
+
+	rt = NewTree(3, 3, 6)
+	rt.SetCoerceDimensions(true, 0)
+	for _, thing := range randomThings3D(50) {
+		rt.Insert(thing)
+	}
+	if err := rt.TryInsert(flat); err != nil {
+		t.Fatalf("Insert of a 2D object with coercion returned %v", err)
+	}
+	verify(t, rt)
+	if rt.Size() != 51 || !rt.Contains(flat) {
+		t.Fatalf("coerced object is not in the tree")
+	}
+
+	xy := mustRect(Point{0, 0, -1}, []float64{5, 5, 2})
+	if !contains(flat, rt.SearchIntersect(xy)) {
+		t.Errorf("SearchIntersect(%v) does not return the coerced object", xy)
+	}
+	above := mustRect(Point{0, 0, 1}, []float64{5, 5, 2})
+	if contains(flat, rt.SearchIntersect(above)) {
+		t.Errorf("SearchIntersect(%v) returned the coerced object outside its plane", above)
+	}
+	if obj := rt.NearestNeighbor(Point{1.5, 2, 0}); obj != flat {
+		t.Errorf("NearestNeighbor in the plane returned %v, expected %v", obj, flat)
+	}
+
+	// the coercion cannot change while coerced objects are stored
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("SetCoerceDimensions on a non-empty tree did not panic")
+			}
+		}()
+		rt.SetCoerceDimensions(true, 10)
+	}()
+	if !rt.Delete(flat) || rt.Contains(flat) {
+		t.Errorf("Delete of the coerced object failed")
+	}
+
+	raised := NewTree(3, 3, 6)
+	raised.SetCoerceDimensions(true, 10)
+	raised.Insert(flat)
+	if q := raised.SearchIntersect(mustRect(Point{0, 0, 9}, []float64{5, 5, 2})); !contains(flat, q) {
+		t.Errorf("object coerced to z = 10 not found at its plane")
+	}
+	if !raised.Delete(flat) {
+		t.Errorf("Delete of the object coerced to z = 10 failed")
+	}
+	if err := rt.TryInsert(&Rect{Point{0, 0, 0, 0}, Point{1, 1, 1, 1}}); err == nil {
+		t.Errorf("Insert of a 4D object into a 3D tree succeeded")
+	}
+}
+
+// randomThings3D returns n random three-dimensional objects.
+func randomThings3D(n int) []Spatial {
+	things := make([]Spatial, n)
+	for i := range things {
+		r := mustRect(Point{rand.Float64() * 100, rand.Float64() * 100, rand.Float64()*100 + 20}, []float64{1, 1, 1})
+		things[i] = &r
+	}
+	return things
+}
+
+func TestAutoTune(t *testing.T) {
+	things := randomThings(2000, 1)
+	var samples []Rect
+	for i := 0; i < 50; i++ {
+		samples = append(samples, mustRect(Point{rand.Float64() * 90, rand.Float64() * 90}, []float64{10, 10}))
+	}
+	for _, tc := range tests(2, 3, 6, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+			before := rt.queryCost(samples)
+			m := rt.AutoTune(samples)
+			if m < 4 || m > 256 {
+				t.Errorf("AutoTune returned %d, expected a value in [4, 256]", m)
+			}
+			if rt.MaxChildren != m || rt.MinChildren < 1 || rt.MinChildren > m/2 {
+				t.Errorf("AutoTune set MinChildren %d and MaxChildren %d, expected MaxChildren %d", rt.MinChildren, rt.MaxChildren, m)
+			}
+			if after := rt.queryCost(samples); after > before {
+				t.Errorf("queries cost %d after AutoTune, %d before", after, before)
+			}
+			verify(t, rt)
+			if rt.Size() != len(things) {
+				t.Errorf("Size() = %d after AutoTune, expected %d", rt.Size(), len(things))
+			}
+			for _, bb := range samples[:10] {
+				var expected []Spatial
+				for _, thing := range things {
+					if intersect(bb, thing.Bounds()) {
+						expected = append(expected, thing)
+					}
+				}
+				if q := rt.SearchIntersect(bb); len(q) != len(expected) {
+					t.Errorf("SearchIntersect(%v) returned %d objects after AutoTune, expected %d", bb, len(q), len(expected))
+				}
+			}
+		})
+	}
+}
+
+func TestNewTreeEmptyRoot(t *testing.T) {
+	rt := NewTree(2, 3, 6)
+	if rt.Size() != 0 || len(rt.root.entries) != 0 {
+		t.Errorf("new tree has size %d and %d root entries, expected 0", rt.Size(), len(rt.root.entries))
+	}
+	if all := rt.GetAll(); len(all) != 0 {
+		t.Errorf("GetAll on new tree returned %v", all)
+	}
+
+	thing := &Rect{Point{0, 0}, Point{1, 1}}
+	rt.Insert(thing)
+	if all := rt.GetAll(); rt.Size() != 1 || len(all) != 1 || all[0] != thing {
+		t.Errorf("after first Insert, Size() = %d and GetAll returned %v", rt.Size(), all)
+	}
+}
+
+func TestSearchQuadrants(t *testing.T) {
+	rects := []Rect{
+		mustRect(Point{1, 1}, []float64{1, 1}),     // lower-left
+		mustRect(Point{6, 1}, []float64{1, 1}),     // lower-right
+		mustRect(Point{1, 6}, []float64{1, 1}),     // upper-left
+		mustRect(Point{6, 6}, []float64{1, 1}),     // upper-right
+		mustRect(Point{4, 1}, []float64{2, 1}),     // lower-left and lower-right
+		mustRect(Point{4, 4}, []float64{2, 2}),     // all
+		mustRect(Point{20, 20}, []float64{1, 1}),   // none
+		mustRect(Point{-5, 7}, []float64{5.5, 10}), // upper-left
+	}
+	things := []Spatial{}
+	for i := range rects {
+		things = append(things, &rects[i])
+	}
+	expected := [4][]Spatial{
+		{things[0], things[4], things[5]},
+		{things[1], things[4], things[5]},
+		{things[2], things[5], things[7]},
+		{things[3], things[5]},
+	}
+
+	for _, tc := range tests(2, 2, 3, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			quadrants := tc.build().SearchQuadrants(mustRect(Point{0, 0}, []float64{10, 10}))
+			for i, q := range quadrants {
+				if len(q) != len(expected[i]) {
+					t.Errorf("quadrant %d contains %v, expected %v", i, q, expected[i])
+					continue
+				}
+				ensureDisorderedSubset(t, q, expected[i])
+			}
+		})
+	}
+
+	defer func() {
+		if err := recover(); err != (DimError{2, 3}) {
+			t.Errorf("SearchQuadrants with a three-dimensional box panicked with %v, expected a DimError", err)
+		}
+	}()
+	NewTree(2, 2, 3, things...).SearchQuadrants(mustRect(Point{0, 0, 0}, []float64{10, 10, 10}))
+}
+
+func TestSoftMaxChildren(t *testing.T) {
+	things := randomThings(500, 1)
+
+	hard := NewTree(2, 3, 6)
+	soft := NewTree(2, 3, 6)
+	soft.SoftMaxChildren = 24
+	for _, thing := range things {
+		hard.Insert(thing)
+		soft.Insert(thing)
+	}
+	if err := soft.Validate(); err != nil {
+		t.Errorf("tree with soft capacity is invalid: %v", err)
+	}
+	if h, s := hard.CountByLevel()[0], soft.CountByLevel()[0]; s >= h {
+		t.Errorf("soft capacity produced %d leaves, expected fewer than %d", s, h)
+	}
+
+	soft.Compact()
+	soft.SoftMaxChildren = 0
+	verify(t, soft)
+	if err := soft.Validate(); err != nil {
+		t.Errorf("Compact produced invalid tree: %v", err)
+	}
+	if soft.Size() != len(things) {
+		t.Errorf("Compact changed the tree size to %d", soft.Size())
+	}
+	for _, thing := range things {
+		if !soft.Contains(thing) {
+			t.Errorf("%v was not found in tree after Compact", thing)
+		}
+	}
+}
+
+func TestSetOutlierHandler(t *testing.T) {
+	rt := NewTree(2, 3, 6, randomThings(100, 1)...)
+	var outliers []Spatial
+	rt.SetOutlierHandler(func(obj Spatial, enlargement float64) bool {
+		if enlargement > 10 {
+			outliers = append(outliers, obj)
+			return false
+		}
+		return true
+	})
+
+	inside := &Rect{Point{50, 50}, Point{51, 51}}
+	slightlyOutside := &Rect{Point{100, 100}, Point{102, 102}}
+	outlier := &Rect{Point{0, 0}, Point{1e6, 1e6}}
+	if err := rt.TryInsert(inside); err != nil {
+		t.Errorf("Insert(%v) returned error %v", inside, err)
+	}
+	if err := rt.TryInsert(slightlyOutside); err != nil {
+		t.Errorf("Insert(%v) returned error %v", slightlyOutside, err)
+	}
+	if err := rt.TryInsert(outlier); err != ErrOutlier {
+		t.Errorf("Insert of outlier returned %v, expected ErrOutlier", err)
+	}
+	if len(outliers) != 1 || outliers[0] != outlier {
+		t.Errorf("outlier handler was called with %v, expected %v", outliers, outlier)
+	}
+	if rt.Size() != 102 || rt.Contains(outlier) {
+		t.Errorf("outlier was inserted into the tree")
+	}
+
+	rt.SetOutlierHandler(nil)
+	if err := rt.TryInsert(outlier); err != nil {
+		t.Errorf("Insert after removing outlier handler returned error %v", err)
+	}
+}
+
+func TestDumpRects(t *testing.T) {
+	things := randomThings(200, 2)
+	reversed := make([]Spatial, len(things))
+	for i, thing := range things {
+		reversed[len(things)-1-i] = thing
+	}
+
+	dump := func(rt *Rtree) string {
+		var buf strings.Builder
+		if err := rt.DumpRects(&buf); err != nil {
+			t.Fatalf("DumpRects returned error %v", err)
+		}
+		return buf.String()
+	}
+
+	rt1 := NewTree(2, 3, 6)
+	for _, thing := range things {
+		rt1.Insert(thing)
+	}
+	rt2 := NewTree(2, 4, 8, reversed...)
+	d1, d2 := dump(rt1), dump(rt2)
+	if d1 != d2 {
+		t.Errorf("DumpRects of trees with the same objects differ:\n%s\n%s", d1, d2)
+	}
+	if n := strings.Count(d1, "\n"); n != len(things) {
+		t.Errorf("DumpRects wrote %d lines, expected %d", n, len(things))
+	}
+	if d := dump(NewTree(2, 3, 6)); d != "" {
+		t.Errorf("DumpRects of empty tree wrote %q", d)
+	}
+}
+
+func TestDistinctFilter(t *testing.T) {
+	things := randomThings(50, 2)
+	spanning := &Rect{Point{10, 10}, Point{90, 90}}
+	rt := NewTree(2, 3, 6, things...)
+	for i := 0; i < 3; i++ {
+		rt.Insert(spanning)
+	}
+
+	bb := mustRect(Point{0, 0}, []float64{100, 100})
+	if q := rt.SearchIntersect(bb); len(q) != len(things)+3 {
+		t.Fatalf("SearchIntersect returned %d objects, expected %d", len(q), len(things)+3)
+	}
+	q := rt.SearchIntersect(bb, DistinctFilter())
+	if len(q) != len(things)+1 {
+		t.Errorf("SearchIntersect with DistinctFilter returned %d objects, expected %d", len(q), len(things)+1)
+	}
+	count := 0
+	for _, obj := range q {
+		if obj == spanning {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Errorf("SearchIntersect with DistinctFilter returned the spanning object %d times", count)
+	}
+}
+
+func TestInsertBatchAuto(t *testing.T) {
+	initial := randomThings(1000, 1)
+	for _, batchSize := range []int{1, 10, 1000, 10000} {
+		batch := randomThings(batchSize, 1)
+		rt := NewTree(2, 3, 6, initial...)
+		inserted := 0
+		rt.OnInsert(func(Spatial) { inserted++ })
+
+		if err := rt.InsertBatchAuto(batch); err != nil {
+			t.Fatalf("InsertBatchAuto returned error %v", err)
+		}
+		if inserted != batchSize {
+			t.Errorf("InsertBatchAuto notified %d inserts, expected %d", inserted, batchSize)
+		}
+		if rt.Size() != len(initial)+batchSize {
+			t.Errorf("Size() = %d after InsertBatchAuto, expected %d", rt.Size(), len(initial)+batchSize)
+		}
+		verify(t, rt)
+		if err := rt.Validate(); err != nil {
+			t.Errorf("InsertBatchAuto produced invalid tree: %v", err)
+		}
+		for _, thing := range append(initial, batch...) {
+			if !rt.Contains(thing) {
+				t.Fatalf("%v was not found in tree after InsertBatchAuto of %d objects", thing, batchSize)
+			}
+		}
+	}
+
+	rt := NewTree(2, 3, 6)
+	err := rt.InsertBatchAuto([]Spatial{&Rect{Point{0, 0}, Point{1, 1}}, &Rect{Point{0}, Point{1}}})
+	if _, ok := err.(*DimError); !ok || rt.Size() != 0 {
+		t.Errorf("InsertBatchAuto with wrong dimension returned %v and inserted %d objects", err, rt.Size())
+	}
+}
+
+func benchmarkInsertBatch(b *testing.B, batchSize int, insert func(rt *Rtree, objs []Spatial)) {
+	initial := randomThings(10000, 0.5)
+	batch := randomThings(batchSize, 0.5)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		rt := NewTree(2, 25, 50, initial...)
+		b.StartTimer()
+		insert(rt, batch)
+	}
+}
+
+func insertEach(rt *Rtree, objs []Spatial) {
+	for _, obj := range objs {
+		rt.Insert(obj)
+	}
+}
+
+func rebuild(rt *Rtree, objs []Spatial) {
+	entries := rt.root.appendObjects(nil)
+	for _, obj := range objs {
+		entries = append(entries, entry{bb: obj.Bounds(), obj: obj})
+	}
+	rt.bulkLoadEntries(entries)
+}
+
+func insertBatchAuto(rt *Rtree, objs []Spatial) {
+	rt.InsertBatchAuto(objs)
+}
+
+func BenchmarkInsertBatchSmallEach(b *testing.B)    { benchmarkInsertBatch(b, 100, insertEach) }
+func BenchmarkInsertBatchSmallRebuild(b *testing.B) { benchmarkInsertBatch(b, 100, rebuild) }
+func BenchmarkInsertBatchSmallAuto(b *testing.B)    { benchmarkInsertBatch(b, 100, insertBatchAuto) }
+func BenchmarkInsertBatchLargeEach(b *testing.B)    { benchmarkInsertBatch(b, 10000, insertEach) }
+func BenchmarkInsertBatchLargeRebuild(b *testing.B) { benchmarkInsertBatch(b, 10000, rebuild) }
+func BenchmarkInsertBatchLargeAuto(b *testing.B)    { benchmarkInsertBatch(b, 10000, insertBatchAuto) }
+
+func TestDeleteReinsertsInternalNodes(t *testing.T) {
+	things := randomThings(300, 1)
+	for _, tc := range tests(2, 3, 6, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+			if rt.Depth() < 3 {
+				t.Fatalf("tree of depth %d is too shallow", rt.Depth())
+			}
+
+			// emptying a subtree below the root makes its internal nodes
+			// underflow, so that their remaining children are reinserted at
+			// their original level
+			sub := rt.root.entries[0].child
+			var doomed []Spatial
+			for _, e := range sub.appendObjects(nil) {
+				doomed = append(doomed, e.obj)
+			}
+			deleted := map[Spatial]bool{}
+			for _, obj := range doomed {
+				if !rt.Delete(obj) {
+					t.Fatalf("Delete(%v) failed", obj)
+				}
+				deleted[obj] = true
+				if err := rt.Validate(); err != nil {
+					t.Fatalf("Delete produced invalid tree: %v", err)
+				}
+			}
+
+			verify(t, rt)
+			if rt.Size() != len(things)-len(doomed) {
+				t.Errorf("Size() = %d, expected %d", rt.Size(), len(things)-len(doomed))
+			}
+			for _, thing := range things {
+				if !deleted[thing] && !rt.Contains(thing) {
+					t.Errorf("%v was lost when condensing the tree", thing)
+				}
+			}
+		})
+	}
+}
+
+func TestExplainIntersect(t *testing.T) {
+	// two overlapping leaves below the root
+	rt := NewTree(2, 2, 3)
+	objs := []Spatial{
+		&Rect{Point{0, 0}, Point{1, 1}},
+		&Rect{Point{3, 3}, Point{4, 4}},
+		&Rect{Point{2, 2}, Point{3, 3}},
+		&Rect{Point{5, 5}, Point{6, 6}},
+	}
+	rt.root = &node{level: 2}
+	left := &node{parent: rt.root, leaf: true, level: 1, entries: []entry{
+		{bb: objs[0].Bounds(), obj: objs[0]},
+		{bb: objs[1].Bounds(), obj: objs[1]},
+	}}
+	right := &node{parent: rt.root, leaf: true, level: 1, entries: []entry{
+		{bb: objs[2].Bounds(), obj: objs[2]},
+		{bb: objs[3].Bounds(), obj: objs[3]},
+	}}
+	rt.root.entries = []entry{
+		{bb: left.computeBoundingBox(), child: left},
+		{bb: right.computeBoundingBox(), child: right},
+	}
+	rt.height, rt.size = 2, len(objs)
+
+	cases := []struct {
+		bb      Rect
+		leaves  int
+		results int
+	}{
+		{mustRect(Point{0.5, 0.5}, []float64{0.1, 0.1}), 1, 1},
+		{mustRect(Point{3.2, 3.2}, []float64{0.1, 0.1}), 2, 1}, // in the overlap
+		{mustRect(Point{1.5, 1.5}, []float64{0.2, 0.2}), 1, 0}, // in left only
+		{mustRect(Point{10, 10}, []float64{1, 1}), 0, 0},
+	}
+	for _, test := range cases {
+		plan := rt.ExplainIntersect(test.bb)
+		if plan.NodesPerLevel[1] != 1 || plan.NodesPerLevel[0] != test.leaves {
+			t.Errorf("ExplainIntersect(%v) visited %v nodes per level, expected [%d 1]", test.bb, plan.NodesPerLevel, test.leaves)
+		}
+		if len(plan.Nodes) != 1+test.leaves || !plan.Nodes[0].Equal(mustRect(Point{0, 0}, []float64{6, 6})) {
+			t.Errorf("ExplainIntersect(%v) visited nodes %v", test.bb, plan.Nodes)
+		}
+		if plan.Results != test.results || len(rt.SearchIntersect(test.bb)) != test.results {
+			t.Errorf("ExplainIntersect(%v) found %d results, expected %d", test.bb, plan.Results, test.results)
+		}
+	}
+}
+
+func TestReduceIntersect(t *testing.T) {
+	var things []Spatial
+	for i, thing := range randomThings(300, 2) {
+		things = append(things, NewItem(thing.Bounds(), float64(i)))
+	}
+	bb := mustRect(Point{20, 30}, []float64{40, 25})
+
+	for _, tc := range tests(2, 3, 6, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+			results := rt.SearchIntersect(bb)
+			sum := 0.0
+			for _, obj := range results {
+				sum += obj.(*Item).Data.(float64)
+			}
+
+			count := rt.ReduceIntersect(bb, 0, func(acc interface{}, obj Spatial) interface{} {
+				return acc.(int) + 1
+			})
+			if count != len(results) {
+				t.Errorf("ReduceIntersect counted %v objects, expected %d", count, len(results))
+			}
+			total := rt.ReduceIntersect(bb, 0.0, func(acc interface{}, obj Spatial) interface{} {
+				return acc.(float64) + obj.(*Item).Data.(float64)
+			})
+			if total != sum {
+				t.Errorf("ReduceIntersect summed %v, expected %v", total, sum)
+			}
+		})
+	}
+}
+
+func TestBalanceLazy(t *testing.T) {
+	things := randomThings(500, 2)
+	for _, tc := range tests(2, 3, 6, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+			rt.SetBalanceMode(BalanceLazy)
+			deleted := 0
+			rt.OnDelete(func(Spatial) { deleted++ })
+			for _, thing := range things[:400] {
+				if !rt.Delete(thing) {
+					t.Fatalf("Delete(%v) failed", thing)
+				}
+			}
+			if deleted != 400 {
+				t.Errorf("OnDelete hook was called %d times, expected 400", deleted)
+			}
+			if rt.Size() != 100 {
+				t.Errorf("Size() = %d, expected 100", rt.Size())
+			}
+			if len(rt.dirty) == 0 {
+				t.Fatalf("deletes in BalanceLazy mode left no nodes to condense")
+			}
+
+			// queries see a consistent tree without condensing it
+			dirty := len(rt.dirty)
+			checkLazyQueries(t, rt, NewTree(2, 3, 6, things[400:]...))
+			if len(rt.dirty) != dirty {
+				t.Errorf("queries changed the number of nodes to condense from %d to %d", dirty, len(rt.dirty))
+			}
+
+			// a clone condenses its own copies of the nodes still in the
+			// tree
+			attached := 0
+			rt.Walk(func(ref NodeRef, level int) bool {
+				if rt.dirty[ref.n] {
+					attached++
+				}
+				return true
+			})
+			clone := rt.Clone()
+			if len(clone.dirty) != attached {
+				t.Errorf("Clone has %d nodes to condense, expected %d", len(clone.dirty), attached)
+			}
+			clone.Compact()
+			if err := clone.Validate(); err != nil || len(clone.dirty) != 0 || len(rt.dirty) != dirty {
+				t.Errorf("Compact of the clone left %d and %d nodes to condense: %v", len(clone.dirty), len(rt.dirty), err)
+			}
+
+			// the next insert condenses the tree
+			extra := &Rect{Point{50, 50}, Point{51, 51}}
+			rt.Insert(extra)
+			if len(rt.dirty) != 0 {
+				t.Errorf("Insert did not condense the tree")
+			}
+			verify(t, rt)
+			if err := rt.Validate(); err != nil {
+				t.Error(err)
+			}
+			for _, thing := range append([]Spatial{extra}, things[400:]...) {
+				if !rt.Contains(thing) {
+					t.Errorf("%v was not found in tree after condensing", thing)
+				}
+			}
+		})
+	}
+
+	// deleting everything lazily leaves an empty tree
+	rt := NewTree(2, 3, 6, things...)
+	rt.SetBalanceMode(BalanceLazy)
+	for _, thing := range things {
+		rt.Delete(thing)
+	}
+	if rt.Depth() != 1 || len(rt.root.entries) != 0 {
+		t.Errorf("tree has depth %d and %d root entries after deleting everything", rt.Depth(), len(rt.root.entries))
+	}
+	rt.BFS(func(int, Spatial) { t.Errorf("BFS reported an object of an empty tree") })
+}
+
+// checkLazyQueries compares the read-only queries of rt, a tree in
+// BalanceLazy mode that has not been condensed, with those of exp, a tree
+// holding the same objects.
+func checkLazyQueries(t *testing.T, rt, exp *Rtree) {
+	if err := rt.Validate(); err != nil {
+		t.Errorf("Validate: %v", err)
+	}
+	rt.Walk(func(ref NodeRef, level int) bool {
+		if ref.n != rt.root && len(ref.n.entries) == 0 {
+			t.Errorf("Walk reached an empty node at level %d", level)
+		}
+		if bb := rt.NodeBounds(ref); ref.n != rt.root && !bb.Equal(ref.n.computeBoundingBox()) {
+			t.Errorf("NodeBounds = %v, expected %v", bb, ref.n.computeBoundingBox())
+		}
+		return true
+	})
+
+	bb := mustRect(Point{20, 20}, []float64{50, 50})
+	if q, e := rt.SearchIntersect(bb), exp.SearchIntersect(bb); len(q) != len(e) {
+		t.Errorf("SearchIntersect returned %d objects, expected %d", len(q), len(e))
+	}
+	if q, e := rt.Freeze().SearchIntersect(bb), exp.SearchIntersect(bb); len(q) != len(e) {
+		t.Errorf("Freeze().SearchIntersect returned %d objects, expected %d", len(q), len(e))
+	}
+	inside, partial := rt.ClassifyIntersect(bb)
+	expInside, expPartial := exp.ClassifyIntersect(bb)
+	if len(inside) != len(expInside) || len(partial) != len(expPartial) {
+		t.Errorf("ClassifyIntersect returned %d and %d objects, expected %d and %d", len(inside), len(partial), len(expInside), len(expPartial))
+	}
+	if plan := rt.ExplainIntersect(bb); len(plan.NodesPerLevel) != rt.Depth() {
+		t.Errorf("ExplainIntersect counted %d levels, expected %d", len(plan.NodesPerLevel), rt.Depth())
+	}
+	if sel := rt.Selectivity(bb); !(sel >= 0 && sel <= 1) {
+		t.Errorf("Selectivity = %v", sel)
+	}
+
+	p := Point{50, 50}
+	if obj, e := rt.NearestNeighbor(p), exp.NearestNeighbor(p); obj != e {
+		t.Errorf("NearestNeighbor = %v, expected %v", obj, e)
+	}
+	objs, e := rt.NearestNeighbors(5, p), exp.NearestNeighbors(5, p)
+	if len(objs) != len(e) {
+		t.Fatalf("NearestNeighbors returned %d objects, expected %d", len(objs), len(e))
+	}
+	ensureOrderedSubset(t, objs, e)
+	objs, dists := rt.NearestNeighborsWithDist(5, p)
+	_, expDists := exp.NearestNeighborsWithDist(5, p)
+	ensureOrderedSubset(t, objs, e)
+	for i := range dists {
+		if math.Abs(dists[i]-expDists[i]) > EPS {
+			t.Errorf("NearestNeighborsWithDist distance %d = %v, expected %v", i, dists[i], expDists[i])
+		}
+	}
+	less := func(a, b Spatial) bool { return a.Bounds().p[0] < b.Bounds().p[0] }
+	if objs := rt.NearestNeighborsTieBreak(5, p, less); len(objs) != 5 {
+		t.Errorf("NearestNeighborsTieBreak returned %d objects", len(objs))
+	}
+	points := []Point{{10, 10}, {90, 90}}
+	if objs, e := rt.NearestNeighborsForCluster(points, 3), exp.NearestNeighborsForCluster(points, 3); len(objs) != len(e) {
+		t.Errorf("NearestNeighborsForCluster returned %d objects, expected %d", len(objs), len(e))
+	}
+
+	if _, n := rt.DensestLeaf(); n == 0 {
+		t.Errorf("DensestLeaf found no objects")
+	}
+	reported := 0
+	rt.BFS(func(int, Spatial) { reported++ })
+	if reported != rt.Size() {
+		t.Errorf("BFS reported %d objects, expected %d", reported, rt.Size())
+	}
+	counted := 0
+	rt.LODNodes(100, func(_ Rect, count int) { counted += count })
+	if counted != rt.Size() {
+		t.Errorf("LODNodes counted %d objects, expected %d", counted, rt.Size())
+	}
+	var d1, d2 strings.Builder
+	rt.DumpRects(&d1)
+	exp.DumpRects(&d2)
+	if d1.String() != d2.String() {
+		t.Errorf("DumpRects differs from a tree with the same objects")
+	}
+}
+
+func benchmarkDeletePhase(b *testing.B, mode BalanceMode) {
+	things := randomThings(10000, 0.5)
+	bb := mustRect(Point{25, 25}, []float64{50, 50})
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		rt := NewTree(2, 25, 50, things...)
+		rt.SetBalanceMode(mode)
+		b.StartTimer()
+		for _, thing := range things[:9000] {
+			rt.Delete(thing)
+		}
+		rt.SearchIntersect(bb)
+	}
+}
+
+func BenchmarkDeletePhaseEager(b *testing.B) { benchmarkDeletePhase(b, BalanceEager) }
+func BenchmarkDeletePhaseLazy(b *testing.B)  { benchmarkDeletePhase(b, BalanceLazy) }
+
+func TestPopNearest(t *testing.T) {
+	things := randomThings(300, 2)
+	p := Point{40, 60}
+	expected := append([]Spatial{}, things...)
+	sort.SliceStable(expected, func(i, j int) bool {
+		return p.minDist(expected[i].Bounds()) < p.minDist(expected[j].Bounds())
+	})
+
+	for _, tc := range tests(2, 3, 6, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+			deleted := 0
+			rt.OnDelete(func(Spatial) { deleted++ })
+			for i := range expected {
+				obj := rt.PopNearest(p)
+				if obj == nil {
+					t.Fatalf("PopNearest returned nil with %d objects left", rt.Size())
+				}
+				if d, exp := p.minDist(obj.Bounds()), p.minDist(expected[i].Bounds()); d != exp {
+					t.Fatalf("object %d popped at squared distance %v, expected %v", i, d, exp)
+				}
+				if rt.Contains(obj) {
+					t.Fatalf("PopNearest did not remove %v", obj)
+				}
+				if rt.Size() != len(things)-i-1 {
+					t.Fatalf("Size() = %d after %d pops", rt.Size(), i+1)
+				}
+				if i%50 == 0 {
+					verify(t, rt)
+				}
+			}
+			if deleted != len(things) {
+				t.Errorf("OnDelete hook was called %d times, expected %d", deleted, len(things))
+			}
+			if obj := rt.PopNearest(p); obj != nil {
+				t.Errorf("PopNearest on an empty tree returned %v", obj)
+			}
+			if rt.Depth() != 1 {
+				t.Errorf("Depth() = %d after popping all objects", rt.Depth())
+			}
+		})
+	}
+}
+
+func TestSelectivity(t *testing.T) {
+	things := randomThings(5000, 1)
+	for _, tc := range tests(2, 10, 20, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+			for i := 0; i < 50; i++ {
+				size := 10 + rand.Float64()*50
+				bb := mustRect(Point{rand.Float64() * (100 - size), rand.Float64() * (100 - size)}, []float64{size, size})
+				actual := float64(len(rt.SearchIntersect(bb))) / float64(len(things))
+				if est := rt.Selectivity(bb); math.Abs(est-actual) > 0.03 {
+					t.Errorf("Selectivity(%v) = %v, but %v of the objects intersect it", bb, est, actual)
+				}
+			}
+			if s := rt.Selectivity(mustRect(Point{-10, -10}, []float64{200, 200})); math.Abs(s-1) > EPS {
+				t.Errorf("Selectivity of a rectangle containing everything = %v, expected 1", s)
+			}
+			if s := rt.Selectivity(mustRect(Point{200, 200}, []float64{1, 1})); s != 0 {
+				t.Errorf("Selectivity of a rectangle outside the tree = %v, expected 0", s)
+			}
+		})
+	}
+	if s := NewTree(2, 3, 6).Selectivity(mustRect(Point{0, 0}, []float64{1, 1})); s != 0 {
+		t.Errorf("Selectivity on an empty tree = %v, expected 0", s)
+	}
+}
+
+func TestLODNodes(t *testing.T) {
+	things := randomThings(500, 2)
+	for _, tc := range tests(2, 3, 6, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+			for _, maxArea := range []float64{5, 50, 500, 1e6} {
+				total, visited := 0, 0
+				rt.LODNodes(maxArea, func(bb Rect, count int) {
+					if bb.Size() > maxArea {
+						t.Errorf("LODNodes(%v) visited a node of area %v", maxArea, bb.Size())
+					}
+					total += count
+					visited++
+				})
+				if total != rt.Size() {
+					t.Errorf("LODNodes(%v) counted %d objects, expected %d", maxArea, total, rt.Size())
+				}
+				if maxArea == 1e6 && visited != 1 {
+					t.Errorf("LODNodes(%v) visited %d nodes, expected only the root", maxArea, visited)
+				}
+			}
+
+			// objects larger than maxArea are reported on their own
+			count := 0
+			rt.LODNodes(0, func(bb Rect, n int) {
+				if n != 1 {
+					t.Errorf("LODNodes(0) reported %d objects for %v", n, bb)
+				}
+				count++
+			})
+			if count != rt.Size() {
+				t.Errorf("LODNodes(0) reported %d objects, expected %d", count, rt.Size())
+			}
+		})
+	}
+	NewTree(2, 3, 6).LODNodes(1, func(Rect, int) {
+		t.Errorf("LODNodes called fn for an empty tree")
+	})
+}
+
+func TestNearestNeighborPreferring(t *testing.T) {
+	type stop struct {
+		Rect
+		priority int
+	}
+	low := &stop{mustRect(Point{9, 0}, []float64{1, 1}), 1}
+	high := &stop{mustRect(Point{-10, 0}, []float64{1, 1}), 2}
+	near := &stop{mustRect(Point{0, 9.3}, []float64{1, 1}), 0}
+	things := []Spatial{low, high}
+	for _, thing := range randomThings(200, 1) {
+		r := thing.(*Rect)
+		things = append(things, &stop{mustRect(Point{r.p[0] + 30, r.p[1] + 30}, []float64{1, 1}), 3})
+	}
+	better := func(a, b Spatial) bool {
+		return a.(*stop).priority > b.(*stop).priority
+	}
+
+	for _, tc := range tests(2, 3, 6, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+			p := Point{0, 0.5}
+			if obj := rt.NearestNeighborPreferring(p, better); obj != high {
+				t.Errorf("NearestNeighborPreferring returned %v, expected the equidistant stop of higher priority", obj)
+			}
+			if obj := rt.NearestNeighborPreferring(p, func(a, b Spatial) bool { return false }); obj != low && obj != high {
+				t.Errorf("NearestNeighborPreferring without preference returned %v", obj)
+			}
+
+			// a slightly closer stop wins unless it is within epsilon
+			rt.Insert(near)
+			if obj := rt.NearestNeighborPreferring(p, better); obj != near {
+				t.Errorf("NearestNeighborPreferring returned %v, expected the closest stop", obj)
+			}
+			rt.SetPreferEpsilon(0.5)
+			if obj := rt.NearestNeighborPreferring(p, better); obj != high {
+				t.Errorf("NearestNeighborPreferring with epsilon returned %v, expected the stop of higher priority", obj)
+			}
+		})
+	}
+	if obj := NewTree(2, 3, 6).NearestNeighborPreferring(Point{0, 0}, better); obj != nil {
+		t.Errorf("NearestNeighborPreferring on an empty tree returned %v", obj)
+	}
+}
+
+func TestEqualContents(t *testing.T) {
+	things := randomThings(300, 2)
+	incremental := NewTree(2, 3, 6)
+	for _, thing := range things {
+		incremental.Insert(thing)
+	}
+	bulk := NewTree(2, 3, 6, things...)
+	sameShape := incremental.Depth() == bulk.Depth()
+	hist := bulk.FillHistogram()
+	for entries, nodes := range incremental.FillHistogram() {
+		if hist[entries] != nodes {
+			sameShape = false
+		}
+	}
+	if sameShape {
+		t.Fatalf("incrementally built and bulk-loaded trees have the same shape")
+	}
+	if !incremental.EqualContents(bulk) || !bulk.EqualContents(incremental) {
+		t.Errorf("incrementally built and bulk-loaded trees do not have equal contents")
+	}
+
+	bulk.Delete(things[0])
+	if incremental.EqualContents(bulk) || bulk.EqualContents(incremental) {
+		t.Errorf("trees with different sizes have equal contents")
+	}
+	bulk.Insert(things[1])
+	if incremental.EqualContents(bulk) || bulk.EqualContents(incremental) {
+		t.Errorf("trees holding an object a different number of times have equal contents")
+	}
+
+	copied := mustRect(things[1].Bounds().p, []float64{1, 1})
+	other := NewTree(2, 3, 6, append([]Spatial{&copied}, things[1:]...)...)
+	if incremental.EqualContents(other) {
+		t.Errorf("trees holding different objects have equal contents")
+	}
+	if !NewTree(2, 3, 6).EqualContents(NewTree(2, 5, 10)) {
+		t.Errorf("empty trees do not have equal contents")
+	}
+}
+
+func TestNearestLeaves(t *testing.T) {
+	things := randomThings(500, 2)
+	for _, tc := range tests(2, 3, 6, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+			p := Point{30, 70}
+			leaves := rt.NearestLeaves(10, p)
+			if len(leaves) != 10 {
+				t.Fatalf("NearestLeaves returned %d leaves, expected 10", len(leaves))
+			}
+			all := rt.NearestLeaves(len(things), p)
+			total := 0
+			for i, leaf := range all {
+				if i > 0 && p.minDist(leaf.Bounds) < p.minDist(all[i-1].Bounds) {
+					t.Errorf("leaf %d at squared distance %v is closer than the previous one at %v", i, p.minDist(leaf.Bounds), p.minDist(all[i-1].Bounds))
+				}
+				if n := len(rt.SearchIntersect(leaf.Bounds)); leaf.Count == 0 || leaf.Count > n {
+					t.Errorf("leaf %v has %d objects, but %d objects intersect it", leaf.Bounds, leaf.Count, n)
+				}
+				total += leaf.Count
+			}
+			if total != rt.Size() {
+				t.Errorf("leaves hold %d objects, expected %d", total, rt.Size())
+			}
+			for i, leaf := range leaves {
+				if p.minDist(leaf.Bounds) != p.minDist(all[i].Bounds) {
+					t.Errorf("leaf %d of the 10 nearest is not among the 10 nearest of all leaves", i)
+				}
+			}
+		})
+	}
+	if leaves := NewTree(2, 3, 6).NearestLeaves(3, Point{0, 0}); len(leaves) != 0 {
+		t.Errorf("NearestLeaves on an empty tree returned %v", leaves)
+	}
+}
+
+func TestBestOverlap(t *testing.T) {
+	bb := mustRect(Point{10, 10}, []float64{10, 10})
+	rects := []Rect{
+		mustRect(Point{5, 5}, []float64{10, 10}),  // overlap 25
+		mustRect(Point{12, 12}, []float64{3, 3}),  // overlap 9
+		mustRect(Point{15, 8}, []float64{10, 10}), // overlap 40
+		mustRect(Point{0, 0}, []float64{40, 3}),   // no overlap
+		mustRect(Point{20, 10}, []float64{5, 5}),  // touching
+	}
+	things := []Spatial{}
+	for i := range rects {
+		things = append(things, &rects[i])
+	}
+	for _, thing := range randomThings(300, 2) {
+		r := thing.(*Rect)
+		far := mustRect(Point{r.p[0] + 50, r.p[1] + 50}, []float64{2, 2})
+		things = append(things, &far)
+	}
+
+	for _, tc := range tests(2, 3, 6, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+			obj, v := rt.BestOverlap(bb)
+			if obj != things[2] || math.Abs(v-40) > EPS {
+				t.Errorf("BestOverlap returned %v with overlap %v, expected %v with overlap 40", obj, v, things[2])
+			}
+			if max := maxOverlap(rt.SearchIntersectWithOverlap(bb)); math.Abs(v-max) > EPS {
+				t.Errorf("BestOverlap returned overlap %v, but the largest is %v", v, max)
+			}
+
+			query := mustRect(Point{60, 60}, []float64{20, 20})
+			_, v = rt.BestOverlap(query)
+			if max := maxOverlap(rt.SearchIntersectWithOverlap(query)); math.Abs(v-max) > EPS {
+				t.Errorf("BestOverlap(%v) returned overlap %v, but the largest is %v", query, v, max)
+			}
+
+			if obj, v := rt.BestOverlap(mustRect(Point{-10, -10}, []float64{5, 5})); obj != nil || v != 0 {
+				t.Errorf("BestOverlap of an empty region returned %v with overlap %v", obj, v)
+			}
+		})
+	}
+}
+
+func maxOverlap(results []OverlapResult) float64 {
+	max := 0.0
+	for _, r := range results {
+		max = math.Max(max, r.Overlap)
+	}
+	return max
+}
+
+func TestOptimizeRegion(t *testing.T) {
+	// a lattice of squares, so that the test is deterministic
+	var things []Spatial
+	for i := 0; i < 50; i++ {
+		for j := 0; j < 50; j++ {
+			r := mustRect(Point{float64(2 * i), float64(2 * j)}, []float64{1, 1})
+			things = append(things, &r)
+		}
+	}
+	rt := NewTree(2, 3, 6, things...)
+	region := mustRect(Point{0, 0}, []float64{30, 30})
+
+	// churn the region by deleting its objects and reinserting them in a
+	// scrambled order
+	churned := rt.SearchIntersect(region)
+	for _, obj := range churned {
+		rt.Delete(obj)
+	}
+	for i := range churned {
+		rt.Insert(churned[i*97%len(churned)])
+	}
+
+	before := leafOverlap(rt.root, region)
+	var untouched []*node
+	for _, e := range rt.root.entries {
+		if !intersect(region, e.bb) {
+			untouched = e.child.appendLeaves(untouched)
+		}
+	}
+
+	rt.OptimizeRegion(region)
+	verify(t, rt)
+	if err := rt.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if rt.Size() != len(things) {
+		t.Errorf("Size() = %d after OptimizeRegion, expected %d", rt.Size(), len(things))
+	}
+	if after := leafOverlap(rt.root, region); after >= before {
+		t.Errorf("OptimizeRegion did not reduce the overlap of the leaves in the region: %v before, %v after", before, after)
+	}
+
+	if len(untouched) == 0 {
+		t.Fatalf("no subtree of the root lies outside the region")
+	}
+	leaves := make(map[*node]bool)
+	for _, leaf := range rt.root.appendLeaves(nil) {
+		leaves[leaf] = true
+	}
+	for _, leaf := range untouched {
+		if !leaves[leaf] {
+			t.Fatalf("OptimizeRegion rebuilt a leaf outside the region")
+		}
+	}
+
+	q := rt.SearchIntersect(region)
+	if len(q) != len(churned) {
+		t.Errorf("SearchIntersect returned %d objects after OptimizeRegion, expected %d", len(q), len(churned))
+	}
+	ensureDisorderedSubset(t, q, churned)
+}
+
+// leafOverlap returns the total overlap of all pairs of leaves below n that
+// intersect bb.
+func leafOverlap(n *node, bb Rect) float64 {
+	var bbs []Rect
+	for _, leaf := range n.appendLeaves(nil) {
+		if leafBB := leaf.computeBoundingBox(); len(leaf.entries) > 0 && intersect(bb, leafBB) {
+			bbs = append(bbs, leafBB)
+		}
+	}
+	total := 0.0
+	for i, bb1 := range bbs {
+		for _, bb2 := range bbs[i+1:] {
+			total += overlap(bb1, bb2)
+		}
+	}
+	return total
+}
+
+// appendLeaves appends all leaves below n to leaves.
+func (n *node) appendLeaves(leaves []*node) []*node {
+	if n.leaf {
+		return append(leaves, n)
+	}
+	for _, e := range n.entries {
+		leaves = e.child.appendLeaves(leaves)
+	}
+	return leaves
+}
+
+// labeled is an object compared by content.
+type labeled struct {
+	bb    Rect
+	label string
+}
+
+func (l *labeled) Bounds() Rect {
+	return l.bb
+}
+
+func (l *labeled) Equal(other Spatial) bool {
+	o, ok := other.(*labeled)
+	return ok && o.label == l.label && o.bb.Equal(l.bb)
+}
+
+func TestDeleteEqualer(t *testing.T) {
+	var things []Spatial
+	for i, thing := range randomThings(200, 2) {
+		things = append(things, &labeled{thing.Bounds(), fmt.Sprint(i)})
+	}
+
+	for _, tc := range tests(2, 3, 6, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+			for _, thing := range things[:100] {
+				stored := thing.(*labeled)
+				copied := &labeled{stored.bb, stored.label}
+				if !rt.Contains(copied) {
+					t.Fatalf("Contains(%v) of an equal copy returned false", copied)
+				}
+				if !rt.Delete(copied) {
+					t.Fatalf("Delete(%v) of an equal copy failed", copied)
+				}
+				if rt.Contains(stored) {
+					t.Fatalf("%v is still in the tree after deleting an equal copy", stored)
+				}
+			}
+			if rt.Size() != 100 {
+				t.Errorf("Size() = %d, expected 100", rt.Size())
+			}
+			verify(t, rt)
+
+			// objects with equal bounds but different content are not deleted
+			other := &labeled{things[150].(*labeled).bb, "other"}
+			if rt.Delete(other) {
+				t.Errorf("Delete(%v) of an object with different content succeeded", other)
+			}
+			ensureDisorderedSubset(t, rt.SearchIntersect(mustRect(Point{-10, -10}, []float64{200, 200})), things[100:])
+		})
+	}
+}
+
+func TestSearchIntersectTraced(t *testing.T) {
+	things := randomThings(500, 2)
+	bb := mustRect(Point{20, 30}, []float64{30, 25})
+	for _, tc := range tests(2, 3, 6, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+			results := rt.SearchIntersectTraced(bb)
+			expected := rt.SearchIntersect(bb)
+			if len(results) != len(expected) {
+				t.Fatalf("SearchIntersectTraced returned %d objects, expected %d", len(results), len(expected))
+			}
+
+			rootBB := rt.root.computeBoundingBox()
+			for i, r := range results {
+				if r.Obj != expected[i] {
+					t.Fatalf("result %d is %v, expected %v", i, r.Obj, expected[i])
+				}
+				if len(r.Path) != rt.Depth() {
+					t.Fatalf("path of %v has length %d, expected %d", r.Obj, len(r.Path), rt.Depth())
+				}
+				if !r.Path[0].Equal(rootBB) {
+					t.Errorf("path of %v starts at %v, expected the root %v", r.Obj, r.Path[0], rootBB)
+				}
+				leaf := rt.root.findLeaf(r.Obj, r.Obj.Bounds(), defaultComparator)
+				if leafBB := leaf.computeBoundingBox(); !r.Path[len(r.Path)-1].Equal(leafBB) {
+					t.Errorf("path of %v ends at %v, expected its leaf %v", r.Obj, r.Path[len(r.Path)-1], leafBB)
+				}
+				for j := 1; j < len(r.Path); j++ {
+					if !r.Path[j-1].containsRect(r.Path[j]) {
+						t.Errorf("node %v on the path of %v is not contained in its parent %v", r.Path[j], r.Obj, r.Path[j-1])
+					}
+				}
+			}
+		})
+	}
+	if results := NewTree(2, 3, 6).SearchIntersectTraced(bb); len(results) != 0 {
+		t.Errorf("SearchIntersectTraced on an empty tree returned %v", results)
+	}
+}
+
+func TestNearestNeighborsCapped(t *testing.T) {
+	things := randomThings(1000, 1)
+	p := Point{50, 50}
+	for _, tc := range tests(2, 3, 6, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+			exact := rt.NearestNeighbors(10, p)
+
+			objs, capped := rt.NearestNeighborsCapped(10, 1000, p)
+			if capped {
+				t.Errorf("NearestNeighborsCapped with a large cap reported hitting it")
+			}
+			if len(objs) != len(exact) {
+				t.Fatalf("NearestNeighborsCapped returned %d objects, expected %d", len(objs), len(exact))
+			}
+			for i := range objs {
+				if d, exp := p.minDist(objs[i].Bounds()), p.minDist(exact[i].Bounds()); d != exp {
+					t.Errorf("neighbor %d at squared distance %v, expected %v", i, d, exp)
+				}
+			}
+
+			objs, capped = rt.NearestNeighborsCapped(10, 1, p)
+			if !capped {
+				t.Errorf("NearestNeighborsCapped with a cap of 1 did not report hitting it")
+			}
+			if len(objs) == 0 || len(objs) > 10 {
+				t.Fatalf("NearestNeighborsCapped with a cap of 1 returned %d objects", len(objs))
+			}
+			for i := range objs {
+				if p.minDist(objs[i].Bounds()) < p.minDist(exact[i].Bounds()) {
+					t.Errorf("approximate neighbor %d is closer than the exact one", i)
+				}
+				if i > 0 && p.minDist(objs[i].Bounds()) < p.minDist(objs[i-1].Bounds()) {
+					t.Errorf("approximate neighbors are not ordered by distance")
+				}
+			}
+		})
+	}
+}
+
+func TestDistinctBounds(t *testing.T) {
+	var things []Spatial
+	add := func(n int, r Rect) {
+		for i := 0; i < n; i++ {
+			things = append(things, NewItem(r, i))
+		}
+	}
+	add(5, mustRect(Point{1, 1}, []float64{2, 2}))
+	add(3, mustRect(Point{10, 20}, []float64{1, 0.5}))
+	add(1, mustRect(Point{50, 50}, []float64{3, 3}))
+	add(2, mustRect(Point{50.001, 50}, []float64{3, 3}))
+	add(4, mustRect(Point{70, 10}, []float64{5, 5}))
+
+	for _, tc := range tests(2, 3, 6, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+			groups := rt.DistinctBounds(0)
+			expected := map[string]int{
+				"[1 1] [3 3]":             5,
+				"[10 20] [11 20.5]":       3,
+				"[50 50] [53 53]":         1,
+				"[50.001 50] [53.001 53]": 2,
+				"[70 10] [75 15]":         4,
+			}
+			if len(groups) != len(expected) {
+				t.Errorf("DistinctBounds(0) returned %d groups, expected %d: %v", len(groups), len(expected), groups)
+			}
+			for key, n := range expected {
+				if groups[key] != n {
+					t.Errorf("DistinctBounds(0) counted %d objects with bounds %s, expected %d", groups[key], key, n)
+				}
+			}
+
+			groups = rt.DistinctBounds(0.01)
+			if len(groups) != 4 {
+				t.Errorf("DistinctBounds(0.01) returned %d groups, expected 4: %v", len(groups), groups)
+			}
+			if n := groups["[50 50] [53 53]"] + groups["[50.001 50] [53.001 53]"]; n != 3 {
+				t.Errorf("DistinctBounds(0.01) counted %d objects near [50, 53]x[50, 53], expected 3", n)
+			}
+
+			// a lazily balanced tree is counted without being condensed
+			rt.SetBalanceMode(BalanceLazy)
+			for _, thing := range things[:4] {
+				rt.Delete(thing)
+			}
+			dirty := len(rt.dirty)
+			if groups := rt.DistinctBounds(0); groups["[1 1] [3 3]"] != 1 || groups["[70 10] [75 15]"] != 4 {
+				t.Errorf("DistinctBounds(0) on a lazily balanced tree returned %v", groups)
+			}
+			if len(rt.dirty) != dirty {
+				t.Errorf("DistinctBounds condensed the tree")
+			}
+		})
+	}
+}
+
+func TestReverseNearestNeighbors(t *testing.T) {
+	things := randomThings(60, 1)
+	center := func(obj Spatial) Point { return obj.Bounds().center() }
+	for _, tc := range tests(2, 3, 6, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+			for i := 0; i < 20; i++ {
+				p := Point{rand.Float64() * 100, rand.Float64() * 100}
+				var expected []Spatial
+				for _, thing := range things {
+					c, r := center(thing), center(thing).dist(p)
+					closer := false
+					for _, other := range things {
+						if other != thing && c.dist(center(other)) < r {
+							closer = true
+							break
+						}
+					}
+					if !closer {
+						expected = append(expected, thing)
+					}
+				}
+
+				objs := rt.ReverseNearestNeighbors(p)
+				if len(objs) != len(expected) {
+					t.Fatalf("ReverseNearestNeighbors(%v) returned %d objects, expected %d", p, len(objs), len(expected))
+				}
+				ensureDisorderedSubset(t, objs, expected)
+			}
+		})
+	}
+}
+
+// packInOrder returns a tree whose nodes are filled with max entries each in
+// the order of things, without regard to their positions.
+func packInOrder(things []Spatial, max int) *Rtree {
+	rt := NewTree(2, 1, max)
+	level := []entry{}
+	for _, thing := range things {
+		level = append(level, entry{bb: thing.Bounds(), obj: thing})
+	}
+	for height := 1; ; height++ {
+		var parents []entry
+		walkPartitions(max, level, func(part []entry) {
+			n := &node{leaf: height == 1, level: height, entries: append([]entry{}, part...)}
+			for _, e := range n.entries {
+				if e.child != nil {
+					e.child.parent = n
+				}
+			}
+			parents = append(parents, entry{bb: n.computeBoundingBox(), child: n})
+		})
+		if len(parents) == 1 {
+			rt.root, rt.height, rt.size = parents[0].child, height, len(things)
+			return rt
+		}
+		level = parents
+	}
+}
+
+func TestTotalMargin(t *testing.T) {
+	rt := NewTree(2, 2, 3)
+	if m := rt.TotalMargin(); m != 0 {
+		t.Errorf("TotalMargin on empty tree = %v, expected 0", m)
+	}
+
+	// two leaves with margins 6 and 10
+	rt.root = &node{level: 2}
+	left := &node{parent: rt.root, leaf: true, level: 1}
+	right := &node{parent: rt.root, leaf: true, level: 1}
+	rt.root.entries = []entry{
+		{bb: mustRect(Point{0, 0}, []float64{2, 1}), child: left},
+		{bb: mustRect(Point{1, 0}, []float64{2, 3}), child: right},
+	}
+	if m := rt.TotalMargin(); math.Abs(m-16) > EPS {
+		t.Errorf("TotalMargin = %v, expected 16", m)
+	}
+
+	// clustered data: a few dense clusters of small rectangles
+	var things []Spatial
+	for c := 0; c < 5; c++ {
+		cx, cy := rand.Float64()*100, rand.Float64()*100
+		for i := 0; i < 200; i++ {
+			r := mustRect(Point{cx + rand.NormFloat64()*3, cy + rand.NormFloat64()*3}, []float64{0.5, 0.5})
+			things = append(things, &r)
+		}
+	}
+	rand.Shuffle(len(things), func(i, j int) { things[i], things[j] = things[j], things[i] })
+	naive := packInOrder(things, 6)
+	verify(t, naive)
+	tuned := NewTree(2, 3, 6)
+	tuned.Cost = CostMargin
+	for _, thing := range things {
+		tuned.Insert(thing)
+	}
+	if m, naiveM := tuned.TotalMargin(), naive.TotalMargin(); m >= naiveM {
+		t.Errorf("margin-minimizing insertion total margin %v >= naive packing total margin %v", m, naiveM)
+	}
+}
+
+func TestSetSeed(t *testing.T) {
+	things := randomThings(500, 2)
+	build := func(seed int64) *Rtree {
+		rt := NewTree(2, 3, 6, things[:250]...)
+		rt.SetSeed(seed)
+		for _, thing := range things[250:] {
+			rt.Insert(thing)
+		}
+		for _, thing := range things[100:150] {
+			rt.Delete(thing)
+		}
+		return rt
+	}
+	dump := func(rt *Rtree) string {
+		var buf strings.Builder
+		if err := rt.DumpRects(&buf); err != nil {
+			t.Fatalf("DumpRects returned error %v", err)
+		}
+		return buf.String()
+	}
+
+	rt1, rt2 := build(42), build(42)
+	if d1, d2 := dump(rt1), dump(rt2); d1 != d2 {
+		t.Errorf("DumpRects of trees built with the same seed differ:\n%s\n%s", d1, d2)
+	}
+	if rt1.Depth() != rt2.Depth() {
+		t.Errorf("trees built with the same seed have depths %d and %d", rt1.Depth(), rt2.Depth())
+	}
+	bbs1, bbs2 := rt1.GetAllBoundingBoxes(), rt2.GetAllBoundingBoxes()
+	if len(bbs1) != len(bbs2) {
+		t.Fatalf("trees built with the same seed have %d and %d nodes", len(bbs1), len(bbs2))
+	}
+	for i := range bbs1 {
+		if !bbs1[i].Equal(bbs2[i]) {
+			t.Fatalf("node %d of trees built with the same seed has bounds %v and %v", i, bbs1[i], bbs2[i])
+		}
+	}
+
+	s1, s2 := rt1.Sample(20), rt2.Sample(20)
+	if len(s1) != 20 {
+		t.Fatalf("Sample(20) returned %d objects", len(s1))
+	}
+	ensureOrderedSubset(t, s1, s2)
+	ensureDisorderedSubset(t, s1, rt1.GetAll())
+	if all := rt1.Sample(1000); len(all) != rt1.Size() {
+		t.Errorf("Sample(1000) returned %d objects, expected all %d", len(all), rt1.Size())
+	}
+}
+
+func TestSetChooseSubtree(t *testing.T) {
+	build := func() *Rtree {
+		rt := NewTree(2, 2, 4)
+		rt.root = &node{level: 2}
+		rt.height = 2
+		for _, x := range []float64{0, 10} {
+			leaf := &node{parent: rt.root, leaf: true, level: 1}
+			for _, y := range []float64{0, 0.5} {
+				r := mustRect(Point{x, y}, []float64{0.5, 0.5})
+				leaf.entries = append(leaf.entries, entry{bb: r, obj: &r})
+				rt.size++
+			}
+			rt.root.entries = append(rt.root.entries, entry{bb: leaf.computeBoundingBox(), child: leaf})
+		}
+		return rt
+	}
+	obj := &Rect{Point{10.1, 0.1}, Point{10.2, 0.2}}
+	leafOf := func(rt *Rtree, obj Spatial) int {
+		leaf := rt.root.findLeaf(obj, obj.Bounds(), defaultComparator)
+		for i, e := range rt.root.entries {
+			if leaf != nil && e.child == leaf {
+				return i
+			}
+		}
+		return -1
+	}
+
+	rt := build()
+	if i := leafOf(rt, obj); i != -1 {
+		t.Fatalf("object found in leaf %d before Insert", i)
+	}
+	rt.Insert(obj)
+	if i := leafOf(rt, obj); i != 1 {
+		t.Errorf("default policy inserted into leaf %d, expected 1", i)
+	}
+
+	rt = build()
+	calls := 0
+	rt.SetChooseSubtree(func(candidates []Rect, o Spatial) int {
+		calls++
+		if len(candidates) != 2 || o != obj {
+			t.Errorf("policy called with %d candidates for %v", len(candidates), o)
+		}
+		if i := rt.LeastEnlargement(candidates, o); i != 1 {
+			t.Errorf("LeastEnlargement returned %d, expected 1", i)
+		}
+		return 0
+	})
+	rt.Insert(obj)
+	verify(t, rt)
+	if calls != 1 {
+		t.Errorf("policy called %d times, expected 1", calls)
+	}
+	if i := leafOf(rt, obj); i != 0 {
+		t.Errorf("first-candidate policy inserted into leaf %d, expected 0", i)
+	}
+
+	rt.SetChooseSubtree(nil)
+	other := &Rect{Point{10.3, 0.3}, Point{10.4, 0.4}}
+	rt.Insert(other)
+	if i := leafOf(rt, other); i != 1 {
+		t.Errorf("default policy inserted into leaf %d after restoring it, expected 1", i)
+	}
+
+	// policies returning an invalid index are caught before the tree changes
+	for _, index := range []int{-1, 2} {
+		rt = build()
+		rt.SetChooseSubtree(func(candidates []Rect, o Spatial) int { return index })
+		func() {
+			defer func() {
+				msg, _ := recover().(string)
+				if !strings.Contains(msg, "ChooseSubtree policy returned index") {
+					t.Errorf("policy returning %d: Insert panicked with %q", index, msg)
+				}
+			}()
+			rt.Insert(obj)
+		}()
+		if rt.Size() != 4 {
+			t.Errorf("policy returning %d: Size() = %d after failed Insert, expected 4", index, rt.Size())
+		}
+		verify(t, rt)
+	}
+}
+
+func TestCountIntersectMulti(t *testing.T) {
+	things := randomThings(500, 2)
+	var boxes []Rect
+	for i := 0; i < 50; i++ {
+		boxes = append(boxes, mustRect(Point{rand.Float64() * 80, rand.Float64() * 80}, []float64{rand.Float64()*20 + 1, rand.Float64()*20 + 1}))
+	}
+	boxes = append(boxes, mustRect(Point{200, 200}, []float64{1, 1}))
+	for _, tc := range tests(2, 3, 6, things...) {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := tc.build()
+			counts := rt.CountIntersectMulti(boxes)
+			if len(counts) != len(boxes) {
+				t.Fatalf("CountIntersectMulti returned %d counts for %d boxes", len(counts), len(boxes))
+			}
+			for i, bb := range boxes {
+				if expected := len(rt.SearchIntersect(bb)); counts[i] != expected {
+					t.Errorf("count for %v = %d, expected %d", bb, counts[i], expected)
+				}
+			}
+			if counts := rt.CountIntersectMulti(nil); len(counts) != 0 {
+				t.Errorf("CountIntersectMulti(nil) returned %v", counts)
+			}
+		})
+	}
+}
+
+// overlappingBoxes returns n boxes of a sliding window overlapping each other
+// by most of their width.
+func overlappingBoxes(n int) []Rect {
+	boxes := make([]Rect, n)
+	for i := range boxes {
+		boxes[i] = mustRect(Point{float64(i) * 0.5, 20}, []float64{20, 20})
+	}
+	return boxes
+}
+
+func BenchmarkCountIntersectMulti(b *testing.B) {
+	rt := NewTree(2, 25, 50, randomThings(100000, 0.5)...)
+	boxes := overlappingBoxes(100)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rt.CountIntersectMulti(boxes)
+	}
+}
+
+func BenchmarkCountIntersectSeparate(b *testing.B) {
+	rt := NewTree(2, 25, 50, randomThings(100000, 0.5)...)
+	boxes := overlappingBoxes(100)
+	count := func(acc interface{}, obj Spatial) interface{} { return acc.(int) + 1 }
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, bb := range boxes {
+			rt.ReduceIntersect(bb, 0, count)
+		}
+	}
+}
+
+// ancestorAllocs returns the number of allocations made by fn, which updates
+// the stored bounds of the ancestors of n.  The bounds are restored before
+// every run, so that every run does the same work.
+func ancestorAllocs(rt *Rtree, n *node, fn func()) float64 {
+	var saved []Rect
+	for a := n; a != rt.root; a = a.parent {
+		saved = append(saved, a.getEntry().bb)
+	}
+	return testing.AllocsPerRun(1, func() {
+		i := 0
+		for a := n; a != rt.root; a = a.parent {
+			a.getEntry().bb = saved[i]
+			i++
+		}
+		fn()
+	})
+}
+
+func TestEnlargeAncestors(t *testing.T) {
+	// two equal deep trees, whose ancestors of a leaf receiving an entry are
+	// enlarged in one and recomputed from their entries in the other, as
+	// adjustTree does
+	things := randomThings(10000, 0.5)
+	enlarged, recomputed := NewTree(2, 3, 6, things...), NewTree(2, 3, 6, things...)
+	var enlarging, recomputing float64
+	adds := 0
+	for _, obj := range randomThings(500, 0.5) {
+		e := entry{bb: obj.Bounds(), obj: obj}
+		l1, _ := enlarged.chooseNode(enlarged.root, e, 1)
+		l2, _ := recomputed.chooseNode(recomputed.root, e, 1)
+		if len(l1.entries) >= enlarged.MaxChildren {
+			continue
+		}
+		adds++
+		l1.entries = append(l1.entries, e)
+		l2.entries = append(l2.entries, e)
+		enlarging += ancestorAllocs(enlarged, l1, func() { enlarged.enlargeAncestors(l1, e.bb) })
+		recomputing += ancestorAllocs(recomputed, l2, func() { recomputed.adjustTree(l2, nil) })
+		enlarged.size++
+		recomputed.size++
+	}
+	if adds < 100 {
+		t.Fatalf("only %d objects were added without splits", adds)
+	}
+	if err := enlarged.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	enlarged.Walk(func(ref NodeRef, level int) bool {
+		if bb, exp := enlarged.NodeBounds(ref), ref.n.computeBoundingBox(); !bb.Equal(exp) {
+			t.Fatalf("NodeBounds = %v after enlarging, expected %v", bb, exp)
+		}
+		return true
+	})
+	if 2*enlarging > recomputing {
+		t.Errorf("enlarging the ancestors made %v allocations for %d objects, recomputing them %v", enlarging, adds, recomputing)
+	}
+}
+
+// BenchmarkInsertIntoLargeTree reports the allocations per insert into a deep
+// tree, most of which are made by choosing the leaf and by splitting.
+func BenchmarkInsertIntoLargeTree(b *testing.B) {
+	things := randomThings(100000, 0.5)
+	rt := NewTree(2, 3, 6, things...)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bb := things[i%len(things)].Bounds()
+		rt.Insert(&bb)
+	}
+}
+
+func TestNodeBounds(t *testing.T) {
+	// the stored bounds must stay the tightest boxes of the entries through
+	// enlargements, splits of leaves and internal nodes and deletions
+	check := func(rt *Rtree) {
+		nodes := 0
+		rt.Walk(func(ref NodeRef, level int) bool {
+			nodes++
+			if level != ref.n.level {
+				t.Fatalf("Walk reported level %d for a node at level %d", level, ref.n.level)
+			}
+			if bb, exp := rt.NodeBounds(ref), ref.n.computeBoundingBox(); !bb.Equal(exp) {
+				t.Fatalf("NodeBounds = %v, expected %v", bb, exp)
+			}
+			return true
+		})
+		exp := 0
+		for _, n := range rt.CountByLevel() {
+			exp += n
+		}
+		if nodes != exp {
+			t.Fatalf("Walk visited %d nodes, expected %d", nodes, exp)
+		}
+	}
+
+	things := randomThings(300, 2)
+	rt := NewTree(2, 2, 4)
+	for _, thing := range things {
+		rt.Insert(thing)
+		check(rt)
+	}
+	if rt.Depth() < 3 {
+		t.Fatalf("Depth() = %d, expected internal nodes to have been split", rt.Depth())
+	}
+	for _, thing := range things[:200] {
+		rt.Delete(thing)
+		check(rt)
+	}
+
+	leaves := 0
+	rt.Walk(func(ref NodeRef, level int) bool {
+		if level == 1 {
+			leaves++
+		}
+		return level > 2
+	})
+	if leaves != 0 {
+		t.Errorf("Walk visited %d leaves below nodes for which fn returned false", leaves)
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2012 Daniel Connelly.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rtreego
+
+import "math"
+
+// Moving is implemented by objects that move linearly over time, for queries
+// of their positions with SearchIntersectAt.  Velocity returns the distance
+// moved per unit of time along every axis.  The bounds of the object are its
+// position at time 0, and its position at time t is its bounds translated by
+// t times its velocity.  Axes beyond the length of the velocity are treated
+// as stationary.  The velocity of a stored object must not change.
+type Moving interface {
+	Spatial
+	Velocity() []float64
+}
+
+// SetTimeHorizon makes tree store every Moving object with the bounding box
+// of the positions it passes through from time 0 to horizon, as in a TPR-tree,
+// so that the bounding boxes of nodes stay conservative for the whole time
+// window.  Queries with SearchIntersectAt at times within the
+// window then only visit the nodes that may contain a result, while queries
+// at other times search an area enlarged by the distance the fastest objects
+// move outside the window.  A horizon of 0, the default, stores objects at
+// their positions at time 0.
+//
+// The tree is rebuilt with the new bounds if it is not empty, and the grids
+// attached with AttachGrid count the objects anew.  Note that all
+// other queries and Delete use the stored bounds, i.e. the swept boxes of
+// Moving objects.
+func (tree *Rtree) SetTimeHorizon(horizon float64) {
+	tree.condenseDirty()
+	tree.timeHorizon = horizon
+	if tree.size > 0 {
+		tree.bulkLoad(tree.GetAll())
+		for _, g := range tree.grids {
+			g.recount()
+		}
+	}
+}
+
+// sweep returns bb enlarged to the positions obj passes through until the
+// time horizon of the tree if obj is Moving.
+func (tree *Rtree) sweep(obj Spatial, bb Rect) Rect {
+	m, ok := obj.(Moving)
+	if !ok || tree.timeHorizon == 0 {
+		return bb
+	}
+	return boundingBox(bb, positionAt(bb, m.Velocity(), tree.timeHorizon))
+}
+
+// trackVelocity records the speed of obj along every axis if it is Moving, to
+// bound how far the stored objects move outside the time horizon.
+func (tree *Rtree) trackVelocity(obj Spatial) {
+	m, ok := obj.(Moving)
+	if !ok {
+		return
+	}
+	if tree.maxSpeed == nil {
+		tree.maxSpeed = make([]float64, tree.Dim)
+	}
+	for i, v := range m.Velocity() {
+		if i < tree.Dim {
+			tree.maxSpeed[i] = math.Max(tree.maxSpeed[i], math.Abs(v))
+		}
+	}
+}
+
+// positionAt returns bb translated by t times v.
+func positionAt(bb Rect, v []float64, t float64) Rect {
+	r := Rect{append(Point{}, bb.p...), append(Point{}, bb.q...)}
+	for i := 0; i < len(v) && i < len(r.p); i++ {
+		r.p[i] += v[i] * t
+		r.q[i] += v[i] * t
+	}
+	return r
+}
+
+// SearchIntersectAt returns all objects whose positions at time t intersect
+// the specified rectangle.  The position of a Moving object is computed from
+// its bounds and velocity, other objects are stationary.
+//
+// The nodes are searched with bb enlarged by the distance the fastest stored
+// object moves from the nearest end of the time window set with
+// SetTimeHorizon to t, which contains every object that may intersect bb at
+// time t, and the objects found are then checked at their positions at t.
+func (tree *Rtree) SearchIntersectAt(bb Rect, t float64) []Spatial {
+	if len(bb.p) != tree.Dim {
+		panic(DimError{tree.Dim, len(bb.p)})
+	}
+
+	outside := 0.0
+	if t < 0 {
+		outside = -t
+	} else if t > tree.timeHorizon {
+		outside = t - tree.timeHorizon
+	}
+	search := bb
+	if outside > 0 && tree.maxSpeed != nil {
+		search = Rect{append(Point{}, bb.p...), append(Point{}, bb.q...)}
+		for i, v := range tree.maxSpeed {
+			search.p[i] -= v * outside
+			search.q[i] += v * outside
+		}
+	}
+
+	at := func(results []Spatial, obj Spatial) (refuse, abort bool) {
+		pos := tree.objectBounds(obj)
+		if m, ok := obj.(Moving); ok {
+			pos = positionAt(pos, m.Velocity(), t)
+		}
+		return !intersect(bb, pos), false
+	}
+	q := tree.startQuery()
+	results := tree.searchIntersect([]Spatial{}, tree.root, search, []Filter{at}, q)
+	tree.finishQuery(q)
+	return results
+}
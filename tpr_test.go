@@ -0,0 +1,87 @@
+package rtreego
+
+import (
+	"math/rand"
+	"testing"
+)
+
+type mover struct {
+	bb Rect
+	v  []float64
+}
+
+func (m *mover) Bounds() Rect {
+	return m.bb
+}
+
+func (m *mover) Velocity() []float64 {
+	return m.v
+}
+
+func TestSearchIntersectAt(t *testing.T) {
+	var things []Spatial
+	for i := 0; i < 300; i++ {
+		bb := mustRect(Point{rand.Float64() * 100, rand.Float64() * 100}, []float64{1, 1})
+		if i%5 == 0 {
+			things = append(things, &bb)
+			continue
+		}
+		v := []float64{rand.Float64()*4 - 2, rand.Float64()*4 - 2}
+		things = append(things, &mover{bb, v})
+	}
+	at := func(obj Spatial, t float64) Rect {
+		if m, ok := obj.(*mover); ok {
+			return positionAt(m.bb, m.v, t)
+		}
+		return obj.Bounds()
+	}
+
+	for _, horizon := range []float64{0, 10} {
+		rt := NewTree(2, 3, 6)
+		rt.SetTimeHorizon(horizon)
+		for _, thing := range things[:200] {
+			rt.Insert(thing)
+		}
+		if err := rt.InsertBatchAuto(things[200:]); err != nil {
+			t.Fatal(err)
+		}
+		verify(t, rt)
+
+		for _, tm := range []float64{-5, 0, 3, 10, 25} {
+			for i := 0; i < 20; i++ {
+				bb := mustRect(Point{rand.Float64()*100 - 10, rand.Float64()*100 - 10}, []float64{20, 20})
+				var expected []Spatial
+				for _, thing := range things {
+					if intersect(bb, at(thing, tm)) {
+						expected = append(expected, thing)
+					}
+				}
+				q := rt.SearchIntersectAt(bb, tm)
+				if len(q) != len(expected) {
+					t.Fatalf("horizon %v: SearchIntersectAt(%v, %v) returned %d objects, expected %d", horizon, bb, tm, len(q), len(expected))
+				}
+				ensureDisorderedSubset(t, q, expected)
+			}
+		}
+
+		// the swept bounds are used to find objects to delete
+		for _, thing := range things[:100] {
+			if !rt.Delete(thing) {
+				t.Fatalf("horizon %v: Delete(%v) failed", horizon, thing)
+			}
+		}
+		if rt.Size() != 200 {
+			t.Errorf("horizon %v: Size() = %d after deletes, expected 200", horizon, rt.Size())
+		}
+	}
+
+	// setting the horizon rebuilds a bulk-loaded tree
+	rt := NewTree(2, 3, 6, things...)
+	rt.SetTimeHorizon(10)
+	verify(t, rt)
+	for _, thing := range things {
+		if m, ok := thing.(*mover); ok && !rt.root.computeBoundingBox().containsRect(positionAt(m.bb, m.v, 10)) {
+			t.Fatalf("root does not contain %v at the end of the horizon", thing)
+		}
+	}
+}